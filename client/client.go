@@ -1,17 +1,20 @@
 package client
 
 import (
-	"bytes"
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"net"
 	"os"
 	"path"
-
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Plan9-Archive/libauth"
 	"github.com/emersion/go-sasl"
@@ -32,13 +35,27 @@ type Client struct {
 	rootFid       uint32
 	tags          []uint16
 	lastTag       uint16
+	tagFree       *sync.Cond // signalled when a tag is returned.
 	fids          []uint32
 	lastFid       uint32
+	liveFids      map[uint32]bool // taken and not yet returned.
+	shutdown      bool            // set by Close; the client no longer reconnects.
 	calls         map[uint16]chan proto.FCall
 	closed        bool
-	pathCacheLock sync.RWMutex
-	pathCache     map[string]uint32
+	pathCacheLock sync.Mutex
+	pathCache     map[string]*cachedFid // by cacheKey.
+	pathLRU       *list.List            // cached paths, most recently used first. Only kept WithWalkCache.
 	msize         uint32
+	version       string
+	flights       *flightGroup
+	user          string
+	aname         string
+	conf          Config
+	files         map[uint32]*File // open files, restored on reconnect.
+	lru           *list.List       // Files holding fids, most recently used first. Only kept WithMaxFids.
+	reconnectLock sync.Mutex
+	writeLock     sync.Mutex // serializes writes to c.
+	lostErr       error      // why the connection was lost.
 	sync.Mutex
 }
 
@@ -47,12 +64,121 @@ type File struct {
 	client *Client
 	offset uint64
 	iounit uint32
+	path   string
+	mode   proto.Mode
+	qid    proto.Qid
+	// noReconnect is set on files used while reconnecting, whose calls
+	// must not themselves trigger a reconnect.
+	noReconnect bool
+	// stale is set, under the client's lock, when reconnecting could not
+	// restore the file, and is returned by its calls.
+	stale error
+
+	// The fields below are only used WithMaxFids, and are guarded by the
+	// client's lock.
+	lruElem *list.Element
+	evicted bool // fid was clunked to make room for others.
+	busy    int  // calls using fid; f is not evicted while they run.
+	reopen  sync.Mutex
 }
 
 type Config struct {
-	authFunc func(user string, s io.ReadWriter) (string, error)
+	authFunc     func(user string, s io.ReadWriter) (string, error)
+	singleFlight bool
+	dial         func() (io.ReadWriteCloser, error)
+	strictTags   bool
+	timeout      time.Duration
+	version      string
+	tracer       func(req, resp proto.FCall, rtt time.Duration)
+	maxFids      int
+	walkCache    int
+}
+
+// ErrDisconnected is returned by calls that fail because the connection to
+// the server was lost. If the client was configured WithReconnect, it is
+// only returned once reconnecting has failed.
+var ErrDisconnected = errors.New("client: connection to server lost")
+
+// ErrStale is returned by calls on a File that could not be restored after
+// the client reconnected, for instance because it was removed meanwhile.
+// The File should be closed.
+var ErrStale = errors.New("client: file lost while reconnecting")
+
+// Error is an error the server reported in an Rerror.
+type Error struct {
+	Ename string
+	// Errno is the errno a 9P2000.u server sent along with Ename, or 0.
+	Errno uint32
+}
+
+func (e *Error) Error() string {
+	return e.Ename
+}
+
+// ErrUnsupported is matched by the errors of servers rejecting a request
+// they don't implement, such as a Tauth sent to a server that doesn't
+// authenticate. Callers can check for it with errors.Is and fall back.
+var ErrUnsupported = errors.New("client: request not supported by server")
+
+// errorKinds maps what servers say in an Rerror to the sentinel errors an
+// Error matches. 9P2000 errors are only text, so the messages are best
+// guesses covering Plan 9's servers, go9p's fs package and the strerror
+// text of Unix servers. The errnos are those 9P2000.u servers send.
+var errorKinds = []struct {
+	err    error
+	errnos []uint32
+	msgs   []string
+}{
+	{ErrUnsupported, []uint32{38, 95}, []string{"unknown message", "not supported", "not implemented",
+		"does not support", "no authentication required", "authentication not required"}},
+	{os.ErrNotExist, []uint32{2}, []string{"no such", "does not exist", "not found"}},
+	{os.ErrPermission, []uint32{1, 13}, []string{"permission denied", "not authenticated"}},
+	{os.ErrExist, []uint32{17}, []string{"already exists", "file exists"}},
+	{errUnknownFid, []uint32{9}, []string{"bad fid", "unknown fid", "fid unknown"}},
+}
+
+// errUnknownFid is matched by the errors of servers given a fid they don't
+// have, as a Topen pipelined behind its Twalk gets if the server handles it
+// first.
+var errUnknownFid = errors.New("client: unknown fid")
+
+// Is reports whether e is one of the rejections described by target:
+// ErrUnsupported, os.ErrNotExist, os.ErrPermission or os.ErrExist.
+func (e *Error) Is(target error) bool {
+	msg := strings.ToLower(e.Ename)
+	for _, k := range errorKinds {
+		if k.err != target {
+			continue
+		}
+		for _, errno := range k.errnos {
+			if e.Errno == errno {
+				return true
+			}
+		}
+		for _, m := range k.msgs {
+			if strings.Contains(msg, m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func rerrorErr(r *proto.RError) error {
+	return &Error{Ename: r.Ename, Errno: r.Errno}
 }
 
+// errNoSuchPath is returned for walks the server answers with fewer qids
+// than names, its way of saying a name does not exist.
+var errNoSuchPath = &Error{Ename: "No such path"}
+
+// maxReconnectAttempts and maxReconnectDelay bound the exponential backoff
+// used when reconnecting.
+const (
+	maxReconnectAttempts = 8
+	maxReconnectDelay    = 10 * time.Second
+)
+
 type Option func(*Config)
 
 func (c *Client) stop() {
@@ -62,40 +188,195 @@ func (c *Client) stop() {
 	c.c.Close()
 }
 
-func (c *Client) worker() {
-	defer c.c.Close()
+func (c *Client) worker(conn io.ReadWriteCloser, version string) {
+	defer conn.Close()
 	for {
-		call, err := proto.ParseCall(c.c)
+		call, err := proto.ParseCallVersion(conn, version)
 		if err != nil {
 			c.Lock()
-			if c.closed {
-				c.Unlock()
+			defer c.Unlock()
+			if c.closed || c.c != conn {
 				return
 			}
-			c.closed = true
-			c.Unlock()
-			log.Printf("Client Error: %s", err)
+			c.connLost(err)
 			return
 		}
 		tag := call.GetTag()
 		verboseLog("=in=> %v\n", call)
 		c.Lock()
 		rchan := c.calls[tag]
-		c.Unlock()
 		if rchan == nil {
+			// A reply to a tag we have no call for means the server
+			// is confused, or we are out of step with it.
+			if c.conf.strictTags && c.c == conn && !c.closed {
+				c.connLost(fmt.Errorf("reply for unknown tag %d: %v", tag, call))
+				c.Unlock()
+				return
+			}
+			c.Unlock()
+			log.Printf("Client: dropping reply for unknown tag %d: %v", tag, call)
 			continue
 		}
+		c.Unlock()
 		rchan <- call
 		c.returnTag(tag)
 	}
 }
 
+// Close clunks every fid the client holds, including those of Files that
+// have not been closed and the root fid, so that the server can release
+// them at once. Errors from the clunks are ignored. It then closes the
+// connection. Calls made on the client or its Files after Close fail with
+// ErrDisconnected, and the client does not reconnect.
+func (c *Client) Close() error {
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
+	c.Lock()
+	if c.shutdown {
+		c.Unlock()
+		return nil
+	}
+	c.shutdown = true
+	fids := make([]uint32, 0, len(c.liveFids)+1)
+	fids = append(fids, c.rootFid)
+	for fid := range c.liveFids {
+		fids = append(fids, fid)
+	}
+	c.Unlock()
+
+	// The clunks are all sent before waiting for any of the replies.
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, fid := range fids {
+		clunk := proto.TClunk{
+			Header: proto.Header{proto.Tclunk, c.takeTag()},
+			Fid:    fid,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.roundTrip(ctx, &clunk)
+		}()
+	}
+	wg.Wait()
+
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.lostErr = errors.New("client closed")
+	c.failCalls()
+	c.closed = true
+	return c.c.Close()
+}
+
+// connLost marks the connection as closed and fails all outstanding calls,
+// taking their tags back, since no more replies will arrive. c must be locked.
+func (c *Client) connLost(err error) {
+	c.closed = true
+	c.lostErr = err
+	c.c.Close()
+	c.failCalls()
+	log.Printf("Client Error: %s", err)
+}
+
+// failCalls fails all outstanding calls and takes their tags back. c must
+// be locked.
+func (c *Client) failCalls() {
+	for tag, rchan := range c.calls {
+		close(rchan)
+		if tag != 0 {
+			c.tags = append(c.tags, tag)
+		}
+	}
+	c.calls = make(map[uint16]chan proto.FCall)
+	c.tagFree.Broadcast()
+}
+
+// WithVersion sets the protocol version the client asks for in its
+// Tversion, "9P2000" by default. "9P2000.u" may be asked for too, but the
+// client only implements 9P2000: the server must downgrade to it, and
+// NewClient fails if the server agrees to 9P2000.u. Asking for any other
+// version makes NewClient fail.
+func WithVersion(version string) Option {
+	return func(c *Config) {
+		c.version = version
+	}
+}
+
+// WithTracer sets a function called after each request the client sends,
+// with the request, the server's reply and the time between sending the
+// request and receiving the reply. If no reply arrives, because the call
+// was cancelled or the connection was lost, resp is nil. The tracer is
+// called from the goroutine that made the call, so it may be called
+// concurrently, and it delays the caller until it returns.
+func WithTracer(tracer func(req, resp proto.FCall, rtt time.Duration)) Option {
+	return func(c *Config) {
+		c.tracer = tracer
+	}
+}
+
+// WithMaxFids limits the number of Files holding a fid on the server to
+// n. When another File is opened or walked to, the least recently used
+// one's fid is clunked. A File whose fid was clunked is walked to and
+// opened again the next time it is used, at the offset it was left at. So
+// that they aren't removed, Files opened with Orclose are never evicted,
+// nor are Files that are in use. The files behind evicted Files may have
+// changed or gone by the time they are used again.
+func WithMaxFids(n int) Option {
+	return func(c *Config) {
+		c.maxFids = n
+	}
+}
+
+// WithStrictTags makes the client drop the connection when the server sends
+// a reply with a tag that matches no outstanding call. By default such
+// replies are logged and ignored.
+func WithStrictTags() Option {
+	return func(c *Config) {
+		c.strictTags = true
+	}
+}
+
+// WithTimeout limits how long the client waits for the reply to each
+// request to d. A request that times out is flushed and fails with
+// context.DeadlineExceeded, and the connection stays usable. If the
+// connection is a net.Conn, d also bounds the version handshake done by
+// NewClient.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.timeout = d
+	}
+}
+
+// WithReconnect configures the client to reconnect when the connection to
+// the server is lost. dial is called to establish each new connection. On
+// reconnecting, the client attaches again and re-walks and re-opens all its
+// fids, so Files remain usable. Calls that failed because of the lost
+// connection are retried once the client has reconnected.
+func WithReconnect(dial func() (io.ReadWriteCloser, error)) Option {
+	return func(c *Config) {
+		c.dial = dial
+	}
+}
+
 func WithAuth(f func(user string, s io.ReadWriter) (string, error)) Option {
 	return func(c *Config) {
 		c.authFunc = f
 	}
 }
 
+// WithSingleFlight makes concurrent Stats (and the walks behind them) of
+// the same path share a single round-trip to the server. Every caller
+// receives the same result.
+func WithSingleFlight() Option {
+	return func(c *Config) {
+		c.singleFlight = true
+	}
+}
+
 func Plan9Auth(user string, s io.ReadWriter) (string, error) {
 	//log.Println("STARTING LIBAUTH PROXY")
 	//defer log.Println("FINISHED LIBAUTH PROXY")
@@ -162,306 +443,1027 @@ func NewClient(c io.ReadWriteCloser, user, aname string, opts ...Option) (*Clien
 		lastTag:   1,
 		fids:      nil,
 		lastFid:   0,
+		liveFids:  make(map[uint32]bool),
 		calls:     make(map[uint16]chan proto.FCall),
-		pathCache: make(map[string]uint32),
+		pathCache: make(map[string]*cachedFid),
+		pathLRU:   list.New(),
+		user:      user,
+		aname:     aname,
+		conf:      conf,
+		files:     make(map[uint32]*File),
+		lru:       list.New(),
+	}
+	client.tagFree = sync.NewCond(&client.Mutex)
+	if conf.singleFlight {
+		client.flights = newFlightGroup()
 	}
-	var afid uint32 = _NOFID
-	go client.worker()
 
-	version := proto.TRVersion{
-		Header:  proto.Header{proto.Tversion, 0},
-		Msize:   65536,
-		Version: "9P2000",
+	// Nothing else is reading yet, so a read deadline is safe here.
+	nc, isNetConn := c.(net.Conn)
+	if conf.timeout > 0 && isNetConn {
+		nc.SetReadDeadline(time.Now().Add(conf.timeout))
 	}
-	res, err := client.getResponse(&version)
+	version, msize, err := negotiate(c, conf.version)
 	if err != nil {
-		client.stop()
+		c.Close()
 		return nil, err
 	}
-	if rerror, ok := res.(*proto.RError); ok {
-		client.stop()
-		return nil, errors.New(rerror.Ename)
+	if conf.timeout > 0 && isNetConn {
+		nc.SetReadDeadline(time.Time{})
 	}
-	ver, ok := res.(*proto.TRVersion)
-	if !ok {
+	client.version = version
+	client.msize = msize
+	go client.worker(c, version)
+
+	if err := client.attach(); err != nil {
 		client.stop()
-		return nil, fmt.Errorf("Unexpected response while performing version: %v", res)
+		return nil, err
 	}
-	client.msize = ver.Msize
+	return client, nil
+}
 
-	if conf.authFunc != nil {
-		afid = client.takeFid()
+// attach authenticates, if configured to, and attaches the root fid.
+func (c *Client) attach() error {
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+	var afid uint32 = _NOFID
+	if c.conf.authFunc != nil {
+		afid = c.takeFid()
 		// perform Authentication.
 		auth := proto.TAuth{
 			Header: proto.Header{proto.Tauth, 0},
 			Afid:   afid,
-			Uname:  user,
-			Aname:  aname,
+			Uname:  c.user,
+			Aname:  c.aname,
 		}
-		res, err := client.getResponse(&auth)
+		res, err := c.roundTrip(ctx, &auth)
 		if err != nil {
-			client.stop()
-			return nil, err
+			return err
 		}
 		if rerror, ok := res.(*proto.RError); ok {
-			client.stop()
-			return nil, errors.New(rerror.Ename)
+			return rerrorErr(rerror)
 		}
 		_, ok := res.(*proto.RAuth)
 		if !ok {
-			client.stop()
-			return nil, fmt.Errorf("Unexpected response while performing auth: %v", res)
+			return fmt.Errorf("Unexpected response while performing auth: %v", res)
 		}
 		f := &File{
-			fid:    afid,
-			client: client,
-			offset: 0,
+			fid:         afid,
+			client:      c,
+			offset:      0,
+			iounit:      math.MaxUint32,
+			noReconnect: true,
 		}
 		defer f.Close() // Needs to be closed *after* attach, or it becomes invalid
-		conf.authFunc(user, f)
+		c.conf.authFunc(c.user, f)
 	}
 
 	attach := proto.TAttach{
 		Header: proto.Header{proto.Tattach, 0},
-		Fid:    client.rootFid,
+		Fid:    c.rootFid,
 		Afid:   afid,
-		Uname:  user,
-		Aname:  aname,
+		Uname:  c.user,
+		Aname:  c.aname,
 	}
 
-	res, err = client.getResponse(&attach)
+	res, err := c.roundTrip(ctx, &attach)
 	if err != nil {
-		client.stop()
-		return nil, err
+		return err
 	}
 	if rerror, ok := res.(*proto.RError); ok {
-		client.stop()
-		return nil, fmt.Errorf("Failed to attach to filesystem: %v", rerror.Ename)
+		return fmt.Errorf("Failed to attach to filesystem: %w", rerrorErr(rerror))
 	}
-	_, ok = res.(*proto.RAttach)
+	_, ok := res.(*proto.RAttach)
 	if !ok {
-		client.stop()
-		return nil, fmt.Errorf("Unexpected response while attaching: %v", res)
+		return fmt.Errorf("Unexpected response while attaching: %v", res)
 	}
+	return nil
+}
 
-	return client, nil
+// Reconnect replaces the client's connection with a new one from the
+// dialer configured WithReconnect, retrying with exponential backoff. The
+// root fid, cached fids and open Files are restored on the new connection.
+func (c *Client) Reconnect() error {
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
+	return c.reconnect()
 }
 
-func (c *Client) getResponse(call proto.FCall) (proto.FCall, error) {
-	response := make(chan proto.FCall)
+// reconnectIfBroken reconnects unless another caller already has.
+func (c *Client) reconnectIfBroken() error {
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
 	c.Lock()
-	c.calls[call.GetTag()] = response
-	verboseLog("<=out= %v\n", call)
-	_, err := c.c.Write(call.Compose())
+	closed := c.closed
 	c.Unlock()
-	if err != nil {
-		return nil, err
-	}
-	r, ok := <-response
-	if !ok {
-		return nil, errors.New("RPC Error.")
+	if !closed {
+		return nil
 	}
-	return r, nil
+	return c.reconnect()
 }
 
-func (c *Client) send(call proto.FCall) error {
+func (c *Client) reconnect() error {
+	if c.conf.dial == nil {
+		return errors.New("client: no dialer configured, see WithReconnect")
+	}
 	c.Lock()
-	defer c.Unlock()
-	verboseLog("<=out= %v\n", call)
-	_, err := c.c.Write(call.Compose())
-	return err
+	shutdown := c.shutdown
+	c.Unlock()
+	if shutdown {
+		return fmt.Errorf("%w: client closed", ErrDisconnected)
+	}
+	delay := 100 * time.Millisecond
+	var err error
+	for attempt := 0; attempt < maxReconnectAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+		if err = c.redial(); err == nil {
+			return nil
+		}
+		log.Printf("Client: reconnect failed: %s", err)
+	}
+	return fmt.Errorf("%w: %v", ErrDisconnected, err)
 }
 
-func (c *Client) takeTag() uint16 {
+// redial makes a single attempt at connecting and restoring the client's fids.
+func (c *Client) redial() error {
+	conn, err := c.conf.dial()
+	if err != nil {
+		return err
+	}
+	version, msize, err := negotiate(conn, c.conf.version)
+	if err != nil {
+		conn.Close()
+		return err
+	}
 	c.Lock()
-	defer c.Unlock()
-	if len(c.tags) == 0 {
-		c.lastTag++
-		return c.lastTag
+	old := c.c
+	c.c = conn
+	c.closed = false
+	c.version = version
+	c.msize = msize
+	c.Unlock()
+	old.Close()
+	go c.worker(conn, version)
+
+	if err := c.attach(); err != nil {
+		return err
 	}
-	t := c.tags[len(c.tags)-1]
-	c.tags = c.tags[:len(c.tags)-1]
-	return t
-}
 
-func (c *Client) returnTag(tag uint16) {
-	if tag == 0 {
-		return
+	c.pathCacheLock.Lock()
+	for path, e := range c.pathCache {
+		if err := c.walkTo(e.fid, path); err != nil {
+			// Gone while we were away.
+			c.uncache(path)
+			if e.users == 0 {
+				c.returnFid(e.fid)
+			}
+		}
 	}
+	c.pathCacheLock.Unlock()
+
 	c.Lock()
-	defer c.Unlock()
-	c.tags = append(c.tags, tag)
-	delete(c.calls, tag)
+	files := make([]*File, 0, len(c.files))
+	for _, f := range c.files {
+		files = append(files, f)
+	}
+	c.Unlock()
+	for _, f := range files {
+		err := c.restoreFile(f)
+		if errors.Is(err, ErrDisconnected) {
+			return err
+		}
+		if err != nil {
+			// Only this File is lost; the others may yet be restored.
+			c.Lock()
+			f.stale = fmt.Errorf("%w: %s: %v", ErrStale, f.path, err)
+			delete(c.files, f.fid)
+			if f.lruElem != nil {
+				c.lru.Remove(f.lruElem)
+				f.lruElem = nil
+			}
+			c.Unlock()
+		}
+	}
+	return nil
 }
 
-func (c *Client) takeFid() uint32 {
-	c.Lock()
-	defer c.Unlock()
-	if len(c.fids) == 0 {
-		c.lastFid++
-		return c.lastFid
+// restoreFile walks f's fid to its path on a new connection and, if f was
+// open, opens it again.
+func (c *Client) restoreFile(f *File) error {
+	if err := c.walkTo(f.fid, f.path); err != nil {
+		return err
 	}
-	fid := c.fids[len(c.fids)-1]
-	c.fids = c.fids[:len(c.fids)-1]
-	return fid
+	if f.mode == proto.None {
+		// Walked to, but never opened.
+		return nil
+	}
+	open := proto.TOpen{
+		Header: proto.Header{proto.Topen, c.takeTag()},
+		Fid:    f.fid,
+		Mode:   f.mode &^ proto.Otrunc,
+	}
+	res, err := c.roundTrip(context.Background(), &open)
+	if err != nil {
+		return err
+	}
+	if rerror, ok := res.(*proto.RError); ok {
+		// The fid was walked, so it must be clunked before reuse.
+		clunk := proto.TClunk{Header: proto.Header{proto.Tclunk, c.takeTag()}, Fid: f.fid}
+		c.roundTrip(context.Background(), &clunk)
+		return fmt.Errorf("reopening %s: %w", f.path, rerrorErr(rerror))
+	}
+	return nil
 }
 
-func (c *Client) returnFid(fid uint32) {
+// retryable reports whether call may be sent again once the client has
+// reconnected after losing the connection before its reply. Repeating it
+// must do no more than sending it once would, and its fid must be one that
+// reconnecting restored, rather than one the caller had just walked.
+func (c *Client) retryable(call proto.FCall) bool {
+	var fid uint32
+	switch t := call.(type) {
+	case *proto.TWalk:
+		fid = t.Fid
+	case *proto.TOpen:
+		if t.Mode&(proto.Otrunc|proto.Orclose) != 0 {
+			return false
+		}
+		fid = t.Fid
+	case *proto.TRead:
+		fid = t.Fid
+	case *proto.TStat:
+		fid = t.Fid
+	default:
+		return false
+	}
+	if fid == c.rootFid {
+		return true
+	}
 	c.Lock()
-	defer c.Unlock()
-	c.fids = append(c.fids, fid)
+	f, ok := c.files[fid]
+	c.Unlock()
+	if ok && f.stale == nil {
+		return true
+	}
+	c.pathCacheLock.Lock()
+	defer c.pathCacheLock.Unlock()
+	for _, e := range c.pathCache {
+		if e.fid == fid {
+			return true
+		}
+	}
+	return false
 }
 
-func removeBlank(ss []string) []string {
-	k := 0
-	for _, s := range ss {
-		if s != "" {
-			ss[k] = s
-			k++
+// walkTo walks fid to path from the root, without retrying on a lost connection.
+func (c *Client) walkTo(fid uint32, path string) error {
+	from := c.rootFid
+	for _, names := range walkSteps(removeBlank(strings.Split(path, "/"))) {
+		walk := proto.TWalk{
+			Header: proto.Header{proto.Twalk, c.takeTag()},
+			Fid:    from,
+			Newfid: fid,
+			Nwname: uint16(len(names)),
+			Wname:  names,
+		}
+		err := c.walkStep(&walk)
+		if err != nil && from == fid {
+			// fid was created by an earlier step, so the caller can
+			// only reuse it once it is clunked.
+			clunk := proto.TClunk{Header: proto.Header{proto.Tclunk, c.takeTag()}, Fid: fid}
+			c.roundTrip(context.Background(), &clunk)
+		}
+		if err != nil {
+			return err
 		}
+		from = fid
 	}
-	ss = ss[:k]
-	return ss
+	return nil
 }
 
-// walkFid walks a new fid to the selected path from the root and returns it.
-// fids should be returned to the client with returnFid once they're finished being used.
-func (c *Client) walkFid(path string) (uint32, error) {
-	//log.Printf("Walk(%s)", path)
-	//defer log.Printf("Walk() Return ")
-	parts := removeBlank(strings.Split(path, "/"))
-	newfid := c.takeFid()
-	walk := proto.TWalk{
-		Header: proto.Header{proto.Twalk, c.takeTag()},
-		Fid:    c.rootFid,
-		Newfid: newfid,
-		Nwname: uint16(len(parts)),
-		Wname:  parts,
-	}
-	res, err := c.getResponse(&walk)
+// walkStep sends walk, which is part of walkTo, and checks that all of its
+// names were walked.
+func (c *Client) walkStep(walk *proto.TWalk) error {
+	res, err := c.roundTrip(context.Background(), walk)
 	if err != nil {
-		c.clunkFid(newfid)
-		return ^uint32(0), err
+		return err
 	}
 	if rerror, ok := res.(*proto.RError); ok {
-		c.clunkFid(newfid)
-		return 0, errors.New(rerror.Ename)
+		return rerrorErr(rerror)
 	}
-	_, ok := res.(*proto.RWalk)
+	rwalk, ok := res.(*proto.RWalk)
 	if !ok {
-		c.clunkFid(newfid)
-		return 0, errors.New("Unexpected response to TWalk.")
+		return errors.New("Unexpected response to TWalk.")
 	}
-	//log.Printf("Walk() Return (%d, nil)", newfid)
-	return newfid, nil
+	if rwalk.Nwqid < walk.Nwname {
+		return errNoSuchPath
+	}
+	return nil
 }
 
-func (c *Client) lookupFid(path string) (uint32, bool) {
-	c.pathCacheLock.RLock()
-	defer c.pathCacheLock.RUnlock()
-	fid, ok := c.pathCache[path]
-	return fid, ok
+// walkSteps splits names into the name lists of the Twalks needed to walk
+// them, as a Twalk carries at most proto.MAXWELEM names. There is always
+// at least one step, as walking no names clones a fid.
+func walkSteps(names []string) [][]string {
+	steps := [][]string{}
+	for len(names) > proto.MAXWELEM {
+		steps = append(steps, names[:proto.MAXWELEM])
+		names = names[proto.MAXWELEM:]
+	}
+	return append(steps, names)
 }
 
-func (c *Client) cacheFid(path string) (uint32, error) {
-	if fid, ok := c.lookupFid(path); ok {
-		return fid, nil
-	}
-	fid, err := c.walkFid(path)
-	if err != nil {
-		return 0, err
-	}
-	c.pathCacheLock.Lock()
-	defer c.pathCacheLock.Unlock()
-	c.pathCache[path] = fid
-	return fid, nil
+// Msize returns the maximum message size negotiated with the server.
+func (c *Client) Msize() uint32 {
+	return c.msize
 }
 
-func (c *Client) dropCachedFid(path string) {
-	c.pathCacheLock.Lock()
-	defer c.pathCacheLock.Unlock()
-	delete(c.pathCache, path)
+// Version returns the protocol version negotiated with the server.
+func (c *Client) Version() string {
+	return c.version
 }
 
-func (c *Client) clunkFid(fid uint32) {
-	//log.Printf("Clunk(%d)", fid)
-	//defer log.Println("Clunk() Return")
-	if fid == 0 {
-		panic("Clunked 0")
+// clientMsize is the msize the client asks for.
+const clientMsize = 65536
+
+// minMsize is the smallest msize the client can work with. It leaves room
+// for the headers of Rread and Twrite.
+const minMsize = 256
+
+// clientVersion is the only protocol version the client implements. Its
+// messages have none of the fields 9P2000.u and 9P2000.L add.
+const clientVersion = "9P2000"
+
+// negotiate performs the version exchange on c, asking for version, and
+// returns the version and msize to use. Per version(5), the server may
+// answer with a smaller msize, which the client adopts, and may answer a
+// Tversion for 9P2000.u with 9P2000, which the client speaks. Asking for a
+// version other than those, a reply of any version but 9P2000, or an
+// unusably small msize is an error.
+func negotiate(c io.ReadWriter, version string) (string, uint32, error) {
+	if version == "" {
+		version = clientVersion
+	}
+	if version != clientVersion && version != "9P2000.u" {
+		return "", 0, fmt.Errorf("client: version %s is not supported, only %s", version, clientVersion)
+	}
+	ver, err := Handshake(c, version, clientMsize)
+	if err != nil {
+		return "", 0, err
 	}
-	clunk := proto.TClunk{
-		Header: proto.Header{proto.Tclunk, c.takeTag()},
-		Fid:    fid,
+	if ver.Version == "unknown" {
+		return "", 0, fmt.Errorf("client: server does not speak %s", version)
+	}
+	if ver.Version == "9P2000.u" {
+		return "", 0, fmt.Errorf("client: server agreed to %s, but only %s is implemented", ver.Version, clientVersion)
 	}
-	//log.Println("Getting Clunk Response.")
-	go func() {
-		c.getResponse(&clunk) // TODO: do something with response and err?
-		//c.send(&clunk)
-		//log.Printf("TClunk Response: %#v, error %#v\n", response, err)
-		c.returnFid(fid)
-	}()
+	if ver.Version != clientVersion {
+		return "", 0, fmt.Errorf("client: asked for %s, server replied %s", version, ver.Version)
+	}
+	msize := ver.Msize
+	if msize > clientMsize {
+		msize = clientMsize
+	}
+	if msize < minMsize {
+		return "", 0, fmt.Errorf("client: server msize %d is too small", ver.Msize)
+	}
+	return ver.Version, msize, nil
 }
 
-func readAll(max uint32, r io.Reader) ([]byte, error) {
-	var buff bytes.Buffer
-	buff.Grow(int(max))
-	_, err := buff.ReadFrom(r)
-	return buff.Bytes(), err
+// Handshake performs the version exchange on c, sending a Tversion with
+// the given version string and msize, and returns the server's Rversion.
+// It reads the reply directly from c, so it must be called before anything
+// else is reading from the connection. NewClient uses Handshake; it is
+// exported for tests and tools that need to control the exchange precisely.
+func Handshake(c io.ReadWriter, version string, msize uint32) (*proto.TRVersion, error) {
+	return HandshakeTag(c, proto.NOTAG, version, msize)
 }
 
-func (c *Client) Readdir(path string) ([]proto.Stat, error) {
-	file, err := c.Open(path, proto.Oread)
+// HandshakeTag is like Handshake, but sends the Tversion with the given tag
+// rather than proto.NOTAG. This is only useful for testing how servers deal
+// with malformed version requests.
+func HandshakeTag(c io.ReadWriter, tag uint16, version string, msize uint32) (*proto.TRVersion, error) {
+	tversion := proto.TRVersion{
+		Header:  proto.Header{proto.Tversion, tag},
+		Msize:   msize,
+		Version: version,
+	}
+	verboseLog("<=out= %v\n", &tversion)
+	_, err := c.Write(tversion.Compose())
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	bs, err := readAll(c.msize, file)
-	stats, err := proto.ParseStats(bs)
+	res, err := proto.ParseCall(c)
 	if err != nil {
-		//log.Printf("ERROR: %v\n", err)
 		return nil, err
 	}
-	//log.Printf("STATS: %v\n", stats)
-	return stats, nil
-}
+	verboseLog("=in=> %v\n", res)
+	if rerror, ok := res.(*proto.RError); ok {
+		return nil, rerrorErr(rerror)
+	}
+	ver, ok := res.(*proto.TRVersion)
+	if !ok || ver.Type != proto.Rversion {
+		return nil, fmt.Errorf("Unexpected response while performing version: %v", res)
+	}
+	return ver, nil
+}
+
+func (c *Client) getResponse(call proto.FCall) (proto.FCall, error) {
+	return c.getResponseContext(context.Background(), call)
+}
+
+// getResponseContext sends call and waits for its response. If ctx is
+// cancelled first, the call is flushed and ctx.Err() is returned. If the
+// connection is lost and the client was configured WithReconnect, the
+// client reconnects, and the call is retried if it is retryable. Otherwise
+// it fails with ErrDisconnected, as the server may or may not have done it.
+func (c *Client) getResponseContext(ctx context.Context, call proto.FCall) (proto.FCall, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	res, err := c.roundTrip(ctx, call)
+	if !errors.Is(err, ErrDisconnected) || c.conf.dial == nil {
+		return res, err
+	}
+	if err := c.reconnectIfBroken(); err != nil {
+		return nil, err
+	}
+	if !c.retryable(call) {
+		return nil, fmt.Errorf("%w: reconnected, but the request may not have been done", ErrDisconnected)
+	}
+	call.SetTag(c.takeTag())
+	return c.roundTrip(ctx, call)
+}
+
+// roundTrip is like getResponseContext, but never reconnects.
+func (c *Client) roundTrip(ctx context.Context, call proto.FCall) (proto.FCall, error) {
+	// Buffered, so the worker never blocks on a caller that gave up.
+	response := make(chan proto.FCall, 1)
+	tag := call.GetTag()
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		c.returnTag(tag)
+		return nil, ErrDisconnected
+	}
+	c.calls[tag] = response
+	conn := c.c
+	c.Unlock()
+	verboseLog("<=out= %v\n", call)
+	start := time.Now()
+	if err := c.write(conn, call.Compose()); err != nil {
+		c.trace(call, nil, start)
+		return nil, ErrDisconnected
+	}
+	res, err := c.await(ctx, tag, response)
+	c.trace(call, res, start)
+	return res, err
+}
+
+// trace passes an exchange to the tracer configured WithTracer, if any.
+func (c *Client) trace(req, resp proto.FCall, start time.Time) {
+	if c.conf.tracer != nil {
+		c.conf.tracer(req, resp, time.Since(start))
+	}
+}
+
+// write writes the marshaled messages b to conn. Writes are serialized by
+// writeLock rather than the client's mutex, so that the worker can go on
+// delivering replies while a write is blocked on the server. If the write
+// fails, the connection is lost and the calls waiting on it fail.
+func (c *Client) write(conn io.Writer, b []byte) error {
+	c.writeLock.Lock()
+	_, err := conn.Write(b)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.Lock()
+		if c.c == conn && !c.closed {
+			c.connLost(err)
+		}
+		c.Unlock()
+	}
+	return err
+}
+
+// await waits for the reply to the call with the given tag to arrive on
+// response. If ctx is done first, the call is flushed and ctx.Err() is
+// returned.
+func (c *Client) await(ctx context.Context, tag uint16, response chan proto.FCall) (proto.FCall, error) {
+	r, _, err := c.awaitFlush(ctx, tag, response)
+	return r, err
+}
+
+// awaitFlush is like await, but also returns a channel that is closed once
+// the server is finished with the call: at once if it replied, or once the
+// Tflush is answered if the call was flushed, after which the server has
+// either done the call or dropped it.
+func (c *Client) awaitFlush(ctx context.Context, tag uint16, response chan proto.FCall) (proto.FCall, <-chan struct{}, error) {
+	done := make(chan struct{})
+	select {
+	case r, ok := <-response:
+		close(done)
+		if !ok {
+			c.Lock()
+			defer c.Unlock()
+			return nil, done, fmt.Errorf("%w: %v", ErrDisconnected, c.lostErr)
+		}
+		return r, done, nil
+	case <-ctx.Done():
+		go func() {
+			c.flush(tag, response)
+			close(done)
+		}()
+		return nil, done, ctx.Err()
+	}
+}
+
+// withTimeout returns ctx limited by the timeout configured WithTimeout,
+// if any.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.conf.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.conf.timeout)
+}
+
+// flush sends a Tflush for oldtag and waits for the Rflush. oldtag may not
+// be reused until then, so it is only returned once the flush completes.
+func (c *Client) flush(oldtag uint16, response chan proto.FCall) {
+	flush := proto.TFlush{
+		Header: proto.Header{proto.Tflush, c.takeTag()},
+		Oldtag: oldtag,
+	}
+	// A flush must go out on the connection the call was sent on.
+	_, err := c.roundTrip(context.Background(), &flush)
+	if err != nil {
+		return
+	}
+	select {
+	case <-response:
+		// The reply beat the flush, and the worker already returned the tag.
+	default:
+		c.returnTag(oldtag)
+	}
+}
+
+func (c *Client) send(call proto.FCall) error {
+	c.Lock()
+	conn := c.c
+	c.Unlock()
+	verboseLog("<=out= %v\n", call)
+	return c.write(conn, call.Compose())
+}
+
+// maxTag is the highest tag the client uses. NOTAG is reserved for Tversion.
+const maxTag = proto.NOTAG - 1
+
+// takeTag returns a tag that is not in use. Freed tags are reused, so a
+// tag is never handed out twice while its call is outstanding. If every
+// tag is in use, takeTag waits for one to be returned.
+func (c *Client) takeTag() uint16 {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.tags) == 0 && c.lastTag == maxTag {
+		c.tagFree.Wait()
+	}
+	if len(c.tags) == 0 {
+		c.lastTag++
+		return c.lastTag
+	}
+	t := c.tags[len(c.tags)-1]
+	c.tags = c.tags[:len(c.tags)-1]
+	return t
+}
+
+func (c *Client) returnTag(tag uint16) {
+	if tag == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.tags = append(c.tags, tag)
+	delete(c.calls, tag)
+	c.tagFree.Signal()
+}
+
+func (c *Client) takeFid() uint32 {
+	c.Lock()
+	defer c.Unlock()
+	var fid uint32
+	if len(c.fids) == 0 {
+		c.lastFid++
+		fid = c.lastFid
+	} else {
+		fid = c.fids[len(c.fids)-1]
+		c.fids = c.fids[:len(c.fids)-1]
+	}
+	c.liveFids[fid] = true
+	return fid
+}
+
+func (c *Client) returnFid(fid uint32) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.liveFids, fid)
+	c.fids = append(c.fids, fid)
+}
+
+func removeBlank(ss []string) []string {
+	k := 0
+	for _, s := range ss {
+		if s != "" {
+			ss[k] = s
+			k++
+		}
+	}
+	ss = ss[:k]
+	return ss
+}
+
+// walkFid walks a new fid to the selected path and returns it. The walk
+// starts from the root, or WithWalkCache from the nearest cached fid.
+// fids should be returned to the client with returnFid once they're finished being used.
+func (c *Client) walkFid(path string) (uint32, error) {
+	//log.Printf("Walk(%s)", path)
+	//defer log.Printf("Walk() Return ")
+	from, names, done := c.walkStart(path)
+	newfid, _, err := c.walkNames(from, names)
+	done()
+	if err != nil {
+		return ^uint32(0), err
+	}
+	//log.Printf("Walk() Return (%d, nil)", newfid)
+	return newfid, nil
+}
+
+// walkNames walks a new fid from fid through names and returns it, along
+// with the qid of the last name walked. If names is empty, the returned
+// qid is zero.
+func (c *Client) walkNames(fid uint32, names []string) (uint32, proto.Qid, error) {
+	newfid := c.takeFid()
+	var qid proto.Qid
+	for _, step := range walkSteps(names) {
+		walk := proto.TWalk{
+			Header: proto.Header{proto.Twalk, c.takeTag()},
+			Fid:    fid,
+			Newfid: newfid,
+			Nwname: uint16(len(step)),
+			Wname:  step,
+		}
+		// Once the first step has created newfid, the rest walk it in
+		// place, and a failure leaves it to be clunked.
+		created := fid == newfid
+		res, err := c.getResponse(&walk)
+		if err != nil {
+			c.clunkFid(newfid)
+			return 0, proto.Qid{}, err
+		}
+		if rerror, ok := res.(*proto.RError); ok {
+			// A failed walk does not create newfid.
+			c.releaseWalked(newfid, created)
+			return 0, proto.Qid{}, rerrorErr(rerror)
+		}
+		rwalk, ok := res.(*proto.RWalk)
+		if !ok {
+			c.clunkFid(newfid)
+			return 0, proto.Qid{}, errors.New("Unexpected response to TWalk.")
+		}
+		if int(rwalk.Nwqid) < len(step) {
+			// A partial walk does not create newfid.
+			c.releaseWalked(newfid, created)
+			return 0, proto.Qid{}, errNoSuchPath
+		}
+		if len(rwalk.Wqid) > 0 {
+			qid = rwalk.Wqid[len(rwalk.Wqid)-1]
+		}
+		fid = newfid
+	}
+	return newfid, qid, nil
+}
+
+// releaseWalked gives up newfid after a failed walk. If an earlier walk
+// created it, it must be clunked before it can be used again.
+func (c *Client) releaseWalked(newfid uint32, created bool) {
+	if created {
+		c.clunkFid(newfid)
+	} else {
+		c.returnFid(newfid)
+	}
+}
+
+// Walk returns an unopened File for path. The File holds a fid on the
+// server, so further walks relative to it with WalkFrom need not start
+// from the root again. It may be opened with Open, and must be closed once
+// it is no longer needed.
+func (c *Client) Walk(path string) (*File, error) {
+	parts := removeBlank(strings.Split(path, "/"))
+	from, names, done := c.walkStart(path)
+	fid, qid, err := c.walkNames(from, names)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	f := c.newFile(fid, 0, "/"+strings.Join(parts, "/"), proto.None, qid)
+	if len(names) == 0 {
+		// Walking no names returns no qid.
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.qid = st.Qid
+	}
+	return f, nil
+}
+
+// WalkFrom returns an unopened File for the path reached by walking names
+// from f, which must not be open. The new File has its own fid, so f and
+// the new File can be closed independently. With no names, WalkFrom
+// returns a clone of f.
+func (f *File) WalkFrom(names ...string) (*File, error) {
+	if f.mode != proto.None {
+		return nil, errors.New("Cannot walk from an open file.")
+	}
+	for _, name := range names {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("Bad name %q.", name)
+		}
+	}
+	from, err := f.acquire()
+	if err != nil {
+		return nil, err
+	}
+	fid, qid, err := f.client.walkNames(from, names)
+	f.release()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		qid = f.qid
+	}
+	p := path.Join(append([]string{f.path}, names...)...)
+	return f.client.newFile(fid, 0, p, proto.None, qid), nil
+}
+
+// Open opens a File returned by Walk or WalkFrom. Once open, it can be read
+// and written, but no longer walked from. Directories may not be written,
+// truncated or removed on close, so Open refuses those modes for a File
+// whose Qid says it is a directory, without asking the server.
+func (f *File) Open(mode proto.Mode) error {
+	if f.mode != proto.None {
+		return errors.New("File already open.")
+	}
+	if f.IsDir() && (mode&0x0F == proto.Owrite || mode&0x0F == proto.Ordwr || mode&(proto.Otrunc|proto.Orclose) != 0) {
+		// Servers refuse these too, but the error is clearer here.
+		return fmt.Errorf("%s: Is a directory.", f.path)
+	}
+	fid, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer f.release()
+	open := proto.TOpen{
+		Header: proto.Header{proto.Topen, f.client.takeTag()},
+		Fid:    fid,
+		Mode:   mode,
+	}
+	res, err := f.call(context.Background(), &open)
+	if err != nil {
+		return err
+	}
+	if rerror, ok := res.(*proto.RError); ok {
+		return rerrorErr(rerror)
+	}
+	ro, ok := res.(*proto.ROpen)
+	if !ok {
+		return errors.New("Unexpected response to TOpen.")
+	}
+	f.iounit = ro.Iounit
+	if f.iounit == 0 {
+		f.iounit = math.MaxUint32
+	}
+	f.qid = ro.Qid
+	f.mode = mode
+	return nil
+}
+
+func (c *Client) clunkFid(fid uint32) {
+	//log.Printf("Clunk(%d)", fid)
+	//defer log.Println("Clunk() Return")
+	if fid == 0 {
+		panic("Clunked 0")
+	}
+	go c.clunk(fid)
+}
+
+// clunk clunks fid and waits for the reply. The fid is free for reuse
+// afterwards whatever the reply, as clunk(5) requires, so any error is
+// only informational.
+func (c *Client) clunk(fid uint32) error {
+	defer c.returnFid(fid)
+	clunk := proto.TClunk{
+		Header: proto.Header{proto.Tclunk, c.takeTag()},
+		Fid:    fid,
+	}
+	res, err := c.getResponse(&clunk)
+	if err != nil {
+		return err
+	}
+	if rerror, ok := res.(*proto.RError); ok {
+		return rerrorErr(rerror)
+	}
+	if _, ok := res.(*proto.RClunk); !ok {
+		return errors.New("Unexpected response to TClunk.")
+	}
+	return nil
+}
+
+// ReadAll opens the file at path, reads it until a short read or EOF, and
+// closes it. Files that grow while being read are read until the reads
+// catch up with the end.
+func (c *Client) ReadAll(path string) ([]byte, error) {
+	f, err := c.Open(path, proto.Oread)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chunk := int(c.msize - 11)
+	if int(f.iounit) < chunk {
+		chunk = int(f.iounit)
+	}
+	var data []byte
+	for {
+		buf := make([]byte, chunk)
+		n, err := f.ReadAt(buf, int64(len(data)))
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// WriteAll opens the file at path, truncating it, writes data to it and
+// closes it.
+func (c *Client) WriteAll(path string, data []byte) error {
+	f, err := c.Open(path, proto.Owrite|proto.Otrunc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteAt(data, 0)
+	return err
+}
+
+// Readdir returns the entries of the directory at path, sorted by name.
+// The directory is read to the end before any entries are parsed, so large
+// directories spanning many reads are returned whole. "." and ".." are left
+// out, and if the server lists a name more than once, only the first entry
+// is kept.
+func (c *Client) Readdir(path string) ([]proto.Stat, error) {
+	stats, err := c.ReadDirStats(path)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(stats))
+	k := 0
+	for _, st := range stats {
+		if seen[st.Name] {
+			continue
+		}
+		seen[st.Name] = true
+		stats[k] = st
+		k++
+	}
+	stats = stats[:k]
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats, nil
+}
+
+// ReadDirStats opens the directory at path, reads every entry in it and
+// closes it. Entries are returned in the order the server sent them, less
+// any "." and ".." entries.
+func (c *Client) ReadDirStats(path string) ([]proto.Stat, error) {
+	file, err := c.Open(path, proto.Oread)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var stats []proto.Stat
+	var pending []byte
+	buf := make([]byte, c.msize)
+	for {
+		n, err := file.Read(buf)
+		if err == io.EOF || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, buf[:n]...)
+		// A server should only return whole entries, but an entry that
+		// spans reads is kept until the rest of it arrives.
+		for len(pending) >= 2 {
+			size := 2 + (int(pending[0]) | int(pending[1])<<8)
+			if len(pending) < size {
+				break
+			}
+			st, err := proto.ParseStats(pending[:size])
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range st {
+				if s.Name != "." && s.Name != ".." {
+					stats = append(stats, s)
+				}
+			}
+			pending = pending[size:]
+		}
+	}
+	if len(pending) > 0 {
+		return nil, errors.New("Directory ends in a partial entry.")
+	}
+	return stats, nil
+}
+
+// ReadDirNames returns the names of the entries in the directory at path,
+// in the order the server sent them.
+func (c *Client) ReadDirNames(path string) ([]string, error) {
+	stats, err := c.ReadDirStats(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(stats))
+	for i := range stats {
+		names[i] = stats[i].Name
+	}
+	return names, nil
+}
 
 func (c *Client) Stat(path string) (*proto.Stat, error) {
 	//log.Println("Stat()")
 	//defer log.Println("Stat() Return")
-	newFid, err := c.cacheFid(path)
+	if c.flights == nil {
+		return c.stat(path)
+	}
+	v, err, _ := c.flights.do("stat\x00"+path, func() (interface{}, error) {
+		return c.stat(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Give each caller its own copy.
+	st := *v.(*proto.Stat)
+	return &st, nil
+}
+
+func (c *Client) stat(path string) (*proto.Stat, error) {
+	e, err := c.cacheFid(path)
 	if err != nil {
 		return nil, err
 	}
+	defer c.releaseCached(e)
 
 	stat := proto.TStat{
 		Header: proto.Header{proto.Tstat, c.takeTag()},
-		Fid:    newFid,
+		Fid:    e.fid,
 	}
 	res, err := c.getResponse(&stat)
 	if err != nil {
 		return nil, err
 	}
 	if rerror, ok := res.(*proto.RError); ok {
-		return nil, errors.New(rerror.Ename)
+		return nil, rerrorErr(rerror)
 	}
 	rstat, ok := res.(*proto.RStat)
 	if !ok {
 		return nil, errors.New("Unexpected response to RStat.")
 	}
+	c.noteQid(path, e, rstat.Stat.Qid)
 	return &rstat.Stat, nil
 }
 
 func (c *Client) WStat(path string, stat *proto.Stat) error {
 	//log.Println("WStat()")
 	//defer log.Println("WStat() Return")
-	newFid, err := c.cacheFid(path)
+	e, err := c.cacheFid(path)
 	if err != nil {
 		return err
 	}
+	defer c.releaseCached(e)
 
 	wstat := proto.TWstat{
 		Header: proto.Header{proto.Twstat, c.takeTag()},
-		Fid:    newFid,
+		Fid:    e.fid,
 		Stat:   *stat,
 	}
 	res, err := c.getResponse(&wstat)
@@ -469,15 +1471,41 @@ func (c *Client) WStat(path string, stat *proto.Stat) error {
 		return err
 	}
 	if rerror, ok := res.(*proto.RError); ok {
-		return errors.New(rerror.Ename)
+		return rerrorErr(rerror)
 	}
 	_, ok := res.(*proto.RWstat)
 	if !ok {
 		return fmt.Errorf("Unexpected response to RWstat: %#v", res)
 	}
+	if stat.Name != "" {
+		// Renamed.
+		c.dropCached(path)
+	}
 	return nil
 }
 
+// Truncate sets the length of the file at path to size, extending it if
+// size is beyond its end.
+func (c *Client) Truncate(path string, size uint64) error {
+	stat := nullStat()
+	stat.Length = size
+	return c.WStat(path, &stat)
+}
+
+// nullStat returns a Stat that changes nothing when sent in a Twstat, like
+// Plan 9's nulldir. Callers set only the fields they want changed.
+func nullStat() proto.Stat {
+	return proto.Stat{
+		Type:   math.MaxUint16,
+		Dev:    math.MaxUint32,
+		Qid:    proto.Qid{Qtype: math.MaxUint8, Vers: math.MaxUint32, Uid: math.MaxUint64},
+		Mode:   math.MaxUint32,
+		Atime:  math.MaxUint32,
+		Mtime:  math.MaxUint32,
+		Length: math.MaxUint64,
+	}
+}
+
 func (c *Client) Create(name string, perm os.FileMode) (*File, error) {
 	//log.Printf("Create(%s)\n", name)
 	//defer log.Println("Create() Return")
@@ -500,65 +1528,382 @@ func (c *Client) Create(name string, perm os.FileMode) (*File, error) {
 	}
 	if rerror, ok := res.(*proto.RError); ok {
 		c.clunkFid(newFid)
-		return nil, errors.New(rerror.Ename)
+		return nil, rerrorErr(rerror)
 	}
-	_, ok := res.(*proto.RCreate)
+	rc, ok := res.(*proto.RCreate)
 	if !ok {
 		c.clunkFid(newFid)
 		return nil, errors.New("Unexpected response to TCreate.")
 	}
-	return &File{
-		fid:    newFid,
-		client: c,
-		offset: 0,
-	}, nil
+	iounit := rc.Iounit
+	if iounit == 0 {
+		iounit = math.MaxUint32
+	}
+	return c.newFile(newFid, iounit, name, proto.Ordwr, rc.Qid), nil
 }
 
 func (c *Client) Open(path string, mode proto.Mode) (*File, error) {
 	//log.Println("Open()")
 	//defer log.Println("Open() Return")
-	newFid, err := c.walkFid(path)
+	newFid, ro, err := c.openPipelined(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	iounit := ro.Iounit
+	if iounit == 0 {
+		iounit = math.MaxUint32
+	}
+	return c.newFile(newFid, iounit, path, mode, ro.Qid), nil
+}
+
+// Clone returns a new File open on the same file as f, with the same mode
+// but its own fid and offset, starting at 0. Reads on the clone do not
+// affect f. The new fid is made by a Twalk with no names. 9P does not allow
+// walking an open fid, so the walk starts from the client's unopened fid for
+// f's path.
+func (c *Client) Clone(f *File) (*File, error) {
+	e, err := c.cacheFid(f.path)
+	if err != nil {
+		return nil, err
+	}
+	newfid := c.takeFid()
+	walk := proto.TWalk{
+		Header: proto.Header{proto.Twalk, c.takeTag()},
+		Fid:    e.fid,
+		Newfid: newfid,
+	}
+	res, err := c.getResponse(&walk)
+	c.releaseCached(e)
 	if err != nil {
+		c.returnFid(newfid)
 		return nil, err
 	}
+	if rerror, ok := res.(*proto.RError); ok {
+		c.returnFid(newfid)
+		return nil, rerrorErr(rerror)
+	}
+	if _, ok := res.(*proto.RWalk); !ok {
+		c.clunkFid(newfid)
+		return nil, errors.New("Unexpected response to TWalk.")
+	}
 
+	// Don't truncate the file a second time.
+	mode := f.mode &^ proto.Otrunc
 	open := proto.TOpen{
 		Header: proto.Header{proto.Topen, c.takeTag()},
-		Fid:    newFid,
+		Fid:    newfid,
 		Mode:   mode,
 	}
-	res, err := c.getResponse(&open)
+	res, err = c.getResponse(&open)
 	if err != nil {
-		c.clunkFid(newFid)
+		c.clunkFid(newfid)
 		return nil, err
 	}
 	if rerror, ok := res.(*proto.RError); ok {
-		c.clunkFid(newFid)
-		return nil, errors.New(rerror.Ename)
+		c.clunkFid(newfid)
+		return nil, rerrorErr(rerror)
 	}
 	ro, ok := res.(*proto.ROpen)
 	if !ok {
-		c.clunkFid(newFid)
+		c.clunkFid(newfid)
 		return nil, errors.New("Unexpected response to TOpen.")
 	}
-	//c.clunkFid(newFid)
 	iounit := ro.Iounit
 	if iounit == 0 {
 		iounit = math.MaxUint32
 	}
-	return &File{
-		fid:    newFid,
+	return c.newFile(newfid, iounit, f.path, mode, ro.Qid), nil
+}
+
+// newFile returns a File for the open fid, and registers it to be reopened
+// if the client reconnects.
+func (c *Client) newFile(fid, iounit uint32, path string, mode proto.Mode, qid proto.Qid) *File {
+	f := &File{
+		fid:    fid,
 		client: c,
 		offset: 0,
 		iounit: iounit,
-	}, nil
+		path:   path,
+		mode:   mode,
+		qid:    qid,
+	}
+	c.Lock()
+	c.files[fid] = f
+	victims := c.track(f)
+	c.Unlock()
+	c.clunkFids(victims)
+	return f
+}
+
+// track adds f to the LRU list and evicts Files over the limit set by
+// WithMaxFids, returning their fids to be clunked. c must be locked.
+func (c *Client) track(f *File) []uint32 {
+	if c.conf.maxFids <= 0 {
+		return nil
+	}
+	f.lruElem = c.lru.PushFront(f)
+	var victims []uint32
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.conf.maxFids; {
+		v := e.Value.(*File)
+		e = e.Prev()
+		if v.busy > 0 || v.mode&proto.Orclose != 0 {
+			continue
+		}
+		c.lru.Remove(v.lruElem)
+		v.lruElem = nil
+		v.evicted = true
+		delete(c.files, v.fid)
+		victims = append(victims, v.fid)
+	}
+	return victims
+}
+
+func (c *Client) clunkFids(fids []uint32) {
+	for _, fid := range fids {
+		c.clunkFid(fid)
+	}
+}
+
+// acquire returns the fid to use for a call on f, reopening f if its fid
+// was evicted. f is not evicted until the call is over and release is
+// called. It fails if reconnecting left f stale.
+func (f *File) acquire() (uint32, error) {
+	c := f.client
+	c.Lock()
+	stale := f.stale
+	c.Unlock()
+	if stale != nil {
+		return 0, stale
+	}
+	if c.conf.maxFids <= 0 || f.noReconnect {
+		return f.fid, nil
+	}
+	f.reopen.Lock()
+	defer f.reopen.Unlock()
+	c.Lock()
+	if !f.evicted {
+		f.busy++
+		if f.lruElem != nil {
+			c.lru.MoveToFront(f.lruElem)
+		}
+		c.Unlock()
+		return f.fid, nil
+	}
+	c.Unlock()
+
+	fid, _, err := c.walkNames(c.rootFid, removeBlank(strings.Split(f.path, "/")))
+	if err != nil {
+		return 0, err
+	}
+	if f.mode != proto.None {
+		open := proto.TOpen{
+			Header: proto.Header{proto.Topen, c.takeTag()},
+			Fid:    fid,
+			Mode:   f.mode &^ proto.Otrunc,
+		}
+		res, err := c.getResponse(&open)
+		if err != nil {
+			c.clunkFid(fid)
+			return 0, err
+		}
+		if rerror, ok := res.(*proto.RError); ok {
+			c.clunkFid(fid)
+			return 0, fmt.Errorf("reopening %s: %s", f.path, rerror.Ename)
+		}
+	}
+	c.Lock()
+	f.fid = fid
+	f.evicted = false
+	f.busy++
+	c.files[fid] = f
+	victims := c.track(f)
+	c.Unlock()
+	c.clunkFids(victims)
+	return fid, nil
+}
+
+// release ends a call started with acquire.
+func (f *File) release() {
+	c := f.client
+	if c.conf.maxFids <= 0 || f.noReconnect {
+		return
+	}
+	c.Lock()
+	f.busy--
+	c.Unlock()
+}
+
+// openPipelined walks a new fid to path and opens it. The Topen is sent
+// right behind the Twalk, without waiting for the Rwalk, so opening costs a
+// single round trip. A server may handle the Topen before the Twalk has
+// created the fid, in which case the open is retried once the walk is done,
+// as it is if the Topen alone timed out. Any other failure of the Topen is
+// returned. newfid is clunked whenever the walk may have created it.
+// Paths of more than proto.MAXWELEM names take more round trips, as only the
+// last Twalk of the path can be pipelined.
+func (c *Client) openPipelined(path string, mode proto.Mode) (uint32, *proto.ROpen, error) {
+	from, parts, done := c.walkStart(path)
+	defer done()
+	if len(parts) > proto.MAXWELEM {
+		// Only the last Twalk can be sent along with the Topen.
+		n := len(parts) - proto.MAXWELEM
+		dir, _, err := c.walkNames(from, parts[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+		defer c.clunkFid(dir)
+		from, parts = dir, parts[n:]
+	}
+	newfid := c.takeFid()
+	walk := proto.TWalk{
+		Header: proto.Header{proto.Twalk, c.takeTag()},
+		Fid:    from,
+		Newfid: newfid,
+		Nwname: uint16(len(parts)),
+		Wname:  parts,
+	}
+	open := proto.TOpen{
+		Header: proto.Header{proto.Topen, c.takeTag()},
+		Fid:    newfid,
+		Mode:   mode,
+	}
+	walkResponse := make(chan proto.FCall, 1)
+	openResponse := make(chan proto.FCall, 1)
+	c.Lock()
+	c.calls[walk.Tag] = walkResponse
+	c.calls[open.Tag] = openResponse
+	conn := c.c
+	c.Unlock()
+	verboseLog("<=out= %v\n", &walk)
+	verboseLog("<=out= %v\n", &open)
+	start := time.Now()
+	err := c.write(conn, append(walk.Compose(), open.Compose()...))
+	if err != nil {
+		c.trace(&walk, nil, start)
+		c.trace(&open, nil, start)
+		c.returnFid(newfid)
+		return 0, nil, err
+	}
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+	wres, walkDone, werr := c.awaitFlush(ctx, walk.Tag, walkResponse)
+	c.trace(&walk, wres, start)
+	ores, openDone, oerr := c.awaitFlush(ctx, open.Tag, openResponse)
+	c.trace(&open, ores, start)
+	if errors.Is(werr, ErrDisconnected) || errors.Is(oerr, ErrDisconnected) {
+		// The fids went with the connection.
+		c.returnFid(newfid)
+		if werr != nil {
+			return 0, nil, werr
+		}
+		return 0, nil, oerr
+	}
+	if werr != nil {
+		// The walk may yet have created newfid. Once both calls are
+		// flushed the server is done with them, so the Tclunk can't
+		// overtake the Twalk.
+		go func() {
+			<-walkDone
+			<-openDone
+			c.clunk(newfid)
+		}()
+		return 0, nil, werr
+	}
+
+	if rerror, ok := wres.(*proto.RError); ok {
+		c.returnFid(newfid)
+		return 0, nil, rerrorErr(rerror)
+	}
+	rwalk, ok := wres.(*proto.RWalk)
+	if !ok {
+		c.clunkFid(newfid)
+		return 0, nil, errors.New("Unexpected response to TWalk.")
+	}
+	if int(rwalk.Nwqid) < len(parts) {
+		// A partial walk does not create newfid.
+		c.returnFid(newfid)
+		return 0, nil, errNoSuchPath
+	}
+
+	retry := oerr != nil
+	if rerror, ok := ores.(*proto.RError); ok && errors.Is(rerrorErr(rerror), errUnknownFid) {
+		// The open raced the walk.
+		retry = true
+	}
+	if retry {
+		// Now that the walk is done, and any flushed open with it, try
+		// again.
+		<-openDone
+		open.Tag = c.takeTag()
+		ores, err = c.getResponse(&open)
+		if err != nil {
+			c.clunkFid(newfid)
+			return 0, nil, err
+		}
+	}
+	if rerror, ok := ores.(*proto.RError); ok {
+		c.clunkFid(newfid)
+		return 0, nil, rerrorErr(rerror)
+	}
+	ro, ok := ores.(*proto.ROpen)
+	if !ok {
+		c.clunkFid(newfid)
+		return 0, nil, errors.New("Unexpected response to TOpen.")
+	}
+	return newfid, ro, nil
+}
+
+// Qid returns the Qid the server reported when f was walked to, opened or
+// created.
+func (f *File) Qid() proto.Qid {
+	return f.qid
+}
+
+// IsDir reports whether f is a directory, going by its Qid.
+func (f *File) IsDir() bool {
+	return f.qid.Qtype&proto.QTDIR != 0
+}
+
+func (f *File) call(ctx context.Context, call proto.FCall) (proto.FCall, error) {
+	if f.noReconnect {
+		return f.client.roundTrip(ctx, call)
+	}
+	return f.client.getResponseContext(ctx, call)
 }
 
+// Close clunks the file's fid. The fid is freed whatever the server
+// replies; an error it sends, such as one from a file that failed to save,
+// is returned for information only. If the file was opened with Orclose,
+// the server removes it as the fid is clunked.
 func (f *File) Close() error {
 	//log.Println("Close()")
 	//defer log.Println("Close() Return")
-	f.client.clunkFid(f.fid)
-	return nil
+	c := f.client
+	c.Lock()
+	evicted := f.evicted
+	if !evicted {
+		delete(c.files, f.fid)
+	}
+	if f.lruElem != nil {
+		c.lru.Remove(f.lruElem)
+		f.lruElem = nil
+	}
+	// Closing the client clunked every fid.
+	shutdown := c.shutdown
+	stale := f.stale
+	c.Unlock()
+	if evicted || shutdown {
+		return nil
+	}
+	if stale != nil {
+		// Reconnecting left the fid unused on the server.
+		c.returnFid(f.fid)
+		return nil
+	}
+	if f.mode != proto.None && f.mode&proto.Orclose != 0 {
+		defer c.dropCached(f.path)
+	}
+	return c.clunk(f.fid)
 }
 
 func (f *File) Read(p []byte) (n int, err error) {
@@ -570,20 +1915,25 @@ func (f *File) Read(p []byte) (n int, err error) {
 	if len(p) > int(f.iounit) {
 		p = p[:f.iounit]
 	}
+	fid, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer f.release()
 	read := proto.TRead{
 		Header: proto.Header{proto.Tread, f.client.takeTag()},
-		Fid:    f.fid,
+		Fid:    fid,
 		Offset: f.offset,
 		Count:  uint32(len(p)),
 	}
-	res, err := f.client.getResponse(&read)
+	res, err := f.call(context.Background(), &read)
 	if err != nil {
 		//c.clunkFid(newFid)
 		return 0, err
 	}
 	if rerror, ok := res.(*proto.RError); ok {
 		//c.clunkFid(newFid)
-		return 0, errors.New(rerror.Ename)
+		return 0, rerrorErr(rerror)
 	}
 	rresp, ok := res.(*proto.RRead)
 	if !ok {
@@ -603,57 +1953,281 @@ func (f *File) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// ReadAt reads len(b) bytes at off, as io.ReaderAt does: if it reads
+// fewer, it returns an error saying why, io.EOF at the end of the file.
 func (f *File) ReadAt(b []byte, off int64) (n int, err error) {
+	return f.ReadAtContext(context.Background(), b, off)
+}
+
+// ReadAtContext is like ReadAt, but if ctx is cancelled before the server
+// replies, the read is flushed and ctx.Err() is returned. The File remains
+// valid after a cancelled read.
+//
+// Reads larger than the negotiated msize or the file's iounit are split
+// into several Treads, and short replies are followed by more Treads until
+// b is full or the server replies with no data, which gives io.EOF.
+func (f *File) ReadAtContext(ctx context.Context, b []byte, off int64) (n int, err error) {
+	for n < len(b) {
+		read, err := f.ReadSomeAt(ctx, b[n:], off+int64(n))
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadSomeAt reads at off with a single Tread, and returns what the server
+// replied with, however short, as io.Reader's Read does. b is cut to the
+// negotiated msize and the file's iounit. io.EOF is returned if the server
+// sent no data. It suits streams, whose reads return what is available
+// rather than wait to fill b.
+func (f *File) ReadSomeAt(ctx context.Context, b []byte, off int64) (int, error) {
 	if len(b) > int(f.client.msize-11) {
 		b = b[:f.client.msize-11]
 	}
 	if len(b) > int(f.iounit) {
 		b = b[:f.iounit]
 	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.tread(ctx, b, uint64(off))
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *File) tread(ctx context.Context, b []byte, off uint64) (int, error) {
+	data, err := f.treadData(ctx, uint32(len(b)), off)
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, data), nil
+}
+
+// treadData reads up to count bytes at off and returns the data the
+// server sent.
+func (f *File) treadData(ctx context.Context, count uint32, off uint64) ([]byte, error) {
+	fid, err := f.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer f.release()
 	read := proto.TRead{
 		Header: proto.Header{proto.Tread, f.client.takeTag()},
-		Fid:    f.fid,
-		Offset: uint64(off),
-		Count:  uint32(len(b)),
+		Fid:    fid,
+		Offset: off,
+		Count:  count,
 	}
-	res, err := f.client.getResponse(&read)
+	res, err := f.call(ctx, &read)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if rerror, ok := res.(*proto.RError); ok {
-		return 0, errors.New(rerror.Ename)
+		return nil, rerrorErr(rerror)
 	}
 	rresp, ok := res.(*proto.RRead)
 	if !ok {
-		return 0, errors.New("Unexpected response to TRead.")
+		return nil, errors.New("Unexpected response to TRead.")
 	}
-
-	n = copy(b, rresp.Data)
-	if uint32(n) != rresp.Count {
+	if len(rresp.Data) > int(count) {
 		panic("Sent too much data.")
 	}
-	f.offset += uint64(n)
-	if len(rresp.Data) == 0 {
-		return 0, io.EOF
+	return rresp.Data, nil
+}
+
+var _ io.ReadWriteSeeker = (*File)(nil)
+var _ io.WriterTo = (*File)(nil)
+var _ io.ReaderFrom = (*File)(nil)
+
+// WriteTo writes the rest of f, from its current offset, to w. Each
+// message's data is handed to w as it arrives, without going through an
+// intermediate buffer. WriteTo returns once a read comes back empty.
+func (f *File) WriteTo(w io.Writer) (n int64, err error) {
+	count := f.client.msize - 11
+	if f.iounit < count {
+		count = f.iounit
 	}
-	return n, nil
+	for {
+		data, err := f.treadData(context.Background(), count, f.offset)
+		if err != nil {
+			return n, err
+		}
+		if len(data) == 0 {
+			return n, nil
+		}
+		m, err := w.Write(data)
+		f.offset += uint64(m)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		if m < len(data) {
+			return n, io.ErrShortWrite
+		}
+	}
+}
+
+// ReadFrom writes the contents of r to f at its current offset until r
+// returns io.EOF, reading r in chunks that each fit in one Twrite.
+func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
+	size := f.client.msize - 23
+	if f.iounit < size {
+		size = f.iounit
+	}
+	buf := make([]byte, size)
+	for {
+		m, rerr := r.Read(buf)
+		if m > 0 {
+			wrote, err := f.twrite(context.Background(), buf[:m], f.offset)
+			f.offset += uint64(wrote)
+			n += int64(wrote)
+			if err != nil {
+				return n, err
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// Seek sets the offset used by the next Read or Write to offset,
+// interpreted according to whence: io.SeekStart, io.SeekCurrent or
+// io.SeekEnd. Seeking relative to the end stats the file to learn its
+// length. Seek returns the new offset.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = int64(f.offset)
+	case io.SeekEnd:
+		st, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		base = int64(st.Length)
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+	if base+offset < 0 {
+		return 0, errors.New("Seek: negative position")
+	}
+	f.offset = uint64(base + offset)
+	return int64(f.offset), nil
+}
+
+// Stat returns the stat of the file, sent on its own fid rather than by
+// walking to its path.
+func (f *File) Stat() (*proto.Stat, error) {
+	fid, err := f.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer f.release()
+	stat := proto.TStat{
+		Header: proto.Header{proto.Tstat, f.client.takeTag()},
+		Fid:    fid,
+	}
+	res, err := f.call(context.Background(), &stat)
+	if err != nil {
+		return nil, err
+	}
+	if rerror, ok := res.(*proto.RError); ok {
+		return nil, rerrorErr(rerror)
+	}
+	rstat, ok := res.(*proto.RStat)
+	if !ok {
+		return nil, errors.New("Unexpected response to TStat.")
+	}
+	return &rstat.Stat, nil
+}
+
+// WStat sends stat in a Twstat on the file's fid. Fields to be left as they
+// are must hold the "don't touch" values of wstat(5).
+func (f *File) WStat(stat *proto.Stat) error {
+	fid, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer f.release()
+	wstat := proto.TWstat{
+		Header: proto.Header{proto.Twstat, f.client.takeTag()},
+		Fid:    fid,
+		Stat:   *stat,
+	}
+	res, err := f.call(context.Background(), &wstat)
+	if err != nil {
+		return err
+	}
+	if rerror, ok := res.(*proto.RError); ok {
+		return rerrorErr(rerror)
+	}
+	if _, ok := res.(*proto.RWstat); !ok {
+		return fmt.Errorf("Unexpected response to TWstat: %#v", res)
+	}
+	if stat.Name != "" {
+		// Renamed.
+		f.client.dropCached(f.path)
+	}
+	if stat.Name != "" && !strings.Contains(stat.Name, "/") {
+		// The file is reopened by its new path if its fid is evicted.
+		f.reopen.Lock()
+		f.path = path.Join(path.Dir(f.path), stat.Name)
+		f.reopen.Unlock()
+	}
+	return nil
+}
+
+// Truncate sets the length of the file to size, extending it if size is
+// beyond its end. The file's offset is not changed.
+func (f *File) Truncate(size uint64) error {
+	stat := nullStat()
+	stat.Length = size
+	return f.WStat(&stat)
 }
 
+// Write writes p at the file's offset and advances the offset past what
+// was written. As io.Writer requires, it writes all of p or returns an
+// error; see WriteAt.
 func (f *File) Write(p []byte) (n int, err error) {
 	//log.Println("Write()")
 	//defer log.Println("Write() Return")
-	n, err = f.twrite(p, f.offset)
+	n, err = f.twrite(context.Background(), p, f.offset)
 	f.offset += uint64(n)
 	return n, err
 }
 
+// WriteAt writes b at offset off. It writes all of b or returns an error,
+// as io.WriterAt requires: b is sent in Twrites no larger than the msize
+// and iounit allow, and when the server accepts fewer bytes than were
+// sent, the rest is sent again. A server accepting nothing ends the write
+// with io.ErrShortWrite. n is the number of bytes the server accepted.
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 	//log.Println("WriteAt()")
 	//defer log.Println("WriteAt() Return")
-	return f.twrite(b, uint64(off))
+	return f.twrite(context.Background(), b, uint64(off))
 }
 
-func (f *File) twrite(p []byte, off uint64) (n int, err error) {
+// WriteAtContext is like WriteAt, but if ctx is cancelled before the server
+// replies, the outstanding write is flushed and ctx.Err() is returned along
+// with the number of bytes already written.
+func (f *File) WriteAtContext(ctx context.Context, b []byte, off int64) (n int, err error) {
+	return f.twrite(ctx, b, uint64(off))
+}
+
+func (f *File) twrite(ctx context.Context, p []byte, off uint64) (n int, err error) {
+	fid, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer f.release()
 	wrote := 0
 	for len(p) > 0 {
 		b := p
@@ -665,23 +2239,29 @@ func (f *File) twrite(p []byte, off uint64) (n int, err error) {
 		}
 		write := proto.TWrite{
 			Header: proto.Header{proto.Twrite, f.client.takeTag()},
-			Fid:    f.fid,
-			Offset: uint64(off),
+			Fid:    fid,
+			Offset: off,
 			Count:  uint32(len(b)),
 			Data:   b,
 		}
-		res, err := f.client.getResponse(&write)
+		res, err := f.call(ctx, &write)
 		if err != nil {
 			return wrote, err
 		}
 		if rerror, ok := res.(*proto.RError); ok {
-			return wrote, errors.New(rerror.Ename)
+			return wrote, rerrorErr(rerror)
 		}
 		r, ok := res.(*proto.RWrite)
 		if !ok {
 			return wrote, errors.New("Unexpected response to TWrite.")
 		}
+		// A short write is legal; the loop sends the rest. A server
+		// taking nothing would have it loop forever.
+		if r.Count == 0 || int(r.Count) > len(b) {
+			return wrote, io.ErrShortWrite
+		}
 		wrote += int(r.Count)
+		off += uint64(r.Count)
 		p = p[r.Count:]
 	}
 	return wrote, nil
@@ -690,7 +2270,7 @@ func (f *File) twrite(p []byte, off uint64) (n int, err error) {
 func (c *Client) Remove(path string) error {
 	//log.Printf("Remove(%s)\n", path)
 	//defer log.Println("Remove() Return")
-	defer c.dropCachedFid(path)
+	defer c.dropCached(path)
 	newFid, err := c.walkFid(path)
 	if err != nil {
 		return err
@@ -707,8 +2287,7 @@ func (c *Client) Remove(path string) error {
 		return err
 	}
 	if rerror, ok := res.(*proto.RError); ok {
-		c.clunkFid(newFid)
-		return errors.New(rerror.Ename)
+		return rerrorErr(rerror)
 	}
 	_, ok := res.(*proto.RRemove)
 	if !ok {
@@ -716,3 +2295,37 @@ func (c *Client) Remove(path string) error {
 	}
 	return nil
 }
+
+// RemoveAll removes name and, if it is a directory, everything it
+// contains, removing children before their parents. Files that are removed
+// by someone else while RemoveAll runs are skipped, and if name does not
+// exist RemoveAll returns nil. Otherwise it stops at the first failure,
+// returning an error naming the path that could not be removed.
+func (c *Client) RemoveAll(name string) error {
+	st, err := c.Stat(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return c.removeAll(name, st.Mode)
+}
+
+func (c *Client) removeAll(name string, mode uint32) error {
+	if mode&proto.DMDIR != 0 {
+		stats, err := c.Readdir(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for _, st := range stats {
+			if err := c.removeAll(path.Join(name, st.Name), st.Mode); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
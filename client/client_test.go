@@ -1,9 +1,18 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -82,3 +91,1909 @@ func TestWalk(t *testing.T) {
 	err = f.Close()
 	assert.NoError(t, err)
 }
+
+func TestWalkFrom(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	a := fs.NewStaticDir(testFS.NewStat("a", "glenda", "glenda", 0777|proto.DMDIR))
+	root.AddChild(a)
+	a.AddChild(fs.NewStaticFile(testFS.NewStat("one", "glenda", "glenda", 0666), []byte("1")))
+	a.AddChild(fs.NewStaticFile(testFS.NewStat("two", "glenda", "glenda", 0666), []byte("2")))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	dir, err := c.Walk("/a")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(a.Stat().Qid, dir.Qid())
+	for _, name := range []string{"one", "two"} {
+		f, err := dir.WalkFrom(name)
+		if !assert.NoError(err) {
+			continue
+		}
+		if assert.NoError(f.Open(proto.Oread)) {
+			bs, err := ioutil.ReadAll(f)
+			assert.NoError(err)
+			assert.Len(bs, 1)
+		}
+		_, err = f.WalkFrom("x")
+		assert.Error(err, "walking from an open file")
+		assert.NoError(f.Close())
+	}
+	_, err = dir.WalkFrom("missing")
+	assert.Error(err)
+
+	// Closing the directory leaves files walked from it usable.
+	f, err := dir.WalkFrom("..", "a", "one")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(dir.Close())
+	if assert.NoError(f.Open(proto.Oread)) {
+		bs, err := ioutil.ReadAll(f)
+		assert.NoError(err)
+		assert.Equal("1", string(bs))
+	}
+	assert.NoError(f.Close())
+
+	root2, err := c.Walk("/")
+	if assert.NoError(err) {
+		assert.Equal(root.Stat().Qid, root2.Qid())
+		root2.Close()
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	testFS, _ := fs.NewFS("glenda", "glenda", 0777)
+
+	for _, tt := range []struct {
+		name      string
+		version   string
+		msize     uint32
+		wantVer   string
+		wantMsize uint32
+	}{
+		{"Plain", "9P2000", 8192, "9P2000", 8192},
+		{"DowngradeL", "9P2000.L", 8192, "9P2000", 8192},
+		{"DowngradeU", "9P2000.u", 8192, "9P2000", 8192},
+		{"Unknown", "9P1999", 8192, "unknown", 8192},
+		{"LargeMsize", "9P2000", 1 << 20, "9P2000", proto.MaxMsgLen},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			p1r, p1w := io.Pipe()
+			p2r, p2w := io.Pipe()
+			go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+			conn := &TwoPipe{p2r, p1w}
+			defer conn.Close()
+
+			ver, err := Handshake(conn, tt.version, tt.msize)
+			assert.NoError(err)
+			if assert.NotNil(ver) {
+				assert.Equal(uint8(proto.Rversion), ver.Type)
+				assert.Equal(proto.NOTAG, ver.Tag)
+				assert.Equal(tt.wantVer, ver.Version)
+				assert.Equal(tt.wantMsize, ver.Msize)
+			}
+		})
+	}
+}
+
+func TestReadAtContextCancel(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	release := make(chan struct{})
+	var once sync.Once
+	root.AddChild(&fs.WrappedFile{
+		File: fs.NewStaticFile(testFS.NewStat("block", "glenda", "glenda", 0444), []byte(helloText)),
+		ReadF: func(fid uint64, offset uint64, count uint64) ([]byte, error) {
+			blocked := false
+			once.Do(func() { blocked = true })
+			if blocked {
+				<-release
+			}
+			if offset >= uint64(len(helloText)) {
+				return nil, nil
+			}
+			return []byte(helloText[offset:]), nil
+		},
+	})
+	defer close(release)
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	f, err := c.Open("/block", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	bs := make([]byte, 100)
+	start := time.Now()
+	_, err = f.ReadAtContext(ctx, bs, 0)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 5*time.Second)
+
+	// The fid is still usable after the flushed read.
+	n, err := f.ReadAt(bs, 0)
+	assert.Equal(io.EOF, err)
+	assert.Equal(helloText, string(bs[:n]))
+}
+
+func TestReadAtShortReplies(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(&fs.WrappedFile{
+		File: fs.NewStaticFile(testFS.NewStat("short", "glenda", "glenda", 0444), []byte(helloText)),
+		ReadF: func(fid uint64, offset uint64, count uint64) ([]byte, error) {
+			if offset >= uint64(len(helloText)) {
+				return nil, nil
+			}
+			if count > 3 {
+				count = 3
+			}
+			end := offset + count
+			if end > uint64(len(helloText)) {
+				end = uint64(len(helloText))
+			}
+			return []byte(helloText[offset:end]), nil
+		},
+	})
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	f, err := c.Open("/short", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+
+	bs := make([]byte, 8)
+	n, err := f.ReadAt(bs, 0)
+	assert.NoError(err)
+	assert.Equal(helloText[:8], string(bs[:n]))
+
+	bs = make([]byte, 100)
+	n, err = f.ReadAt(bs, 2)
+	assert.Equal(io.EOF, err)
+	assert.Equal(helloText[2:], string(bs[:n]))
+
+	n, err = f.ReadSomeAt(context.Background(), bs, 0)
+	assert.NoError(err)
+	assert.Equal(helloText[:3], string(bs[:n]))
+}
+
+func TestLargeReadWrite(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("big", "glenda", "glenda", 0666), []byte{}))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	f, err := c.Open("/big", proto.Ordwr)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+
+	data := make([]byte, 4*c.Msize()+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	n, err := f.WriteAt(data, 0)
+	assert.NoError(err)
+	assert.Equal(len(data), n)
+
+	bs := make([]byte, len(data)+10)
+	n, err = f.ReadAt(bs, 0)
+	assert.Equal(io.EOF, err)
+	assert.Equal(len(data), n)
+	assert.Equal(data, bs[:n])
+
+	n, err = f.ReadAt(bs, int64(len(data)))
+	assert.Equal(io.EOF, err)
+	assert.Equal(0, n)
+}
+
+func TestCopy(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	big := fs.NewStaticFile(testFS.NewStat("big", "glenda", "glenda", 0666), []byte{})
+	root.AddChild(big)
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	data := make([]byte, 3*c.Msize()+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	f, err := c.Open("/big", proto.Owrite)
+	if !assert.NoError(err) {
+		return
+	}
+	// Hide bytes.Reader's WriterTo, so that io.Copy uses f.ReadFrom.
+	n, err := io.Copy(f, struct{ io.Reader }{bytes.NewReader(data)})
+	assert.NoError(err)
+	assert.Equal(int64(len(data)), n)
+	n, err = f.ReadFrom(strings.NewReader("tail"))
+	assert.NoError(err)
+	assert.Equal(int64(4), n)
+	f.Close()
+	assert.Equal(append(data, "tail"...), big.Data)
+
+	f, err = c.Open("/big", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	_, err = f.Seek(10, io.SeekStart)
+	assert.NoError(err)
+	var buf bytes.Buffer
+	n, err = io.Copy(&buf, f)
+	assert.NoError(err)
+	assert.Equal(int64(len(big.Data)-10), n)
+	assert.Equal(big.Data[10:], buf.Bytes())
+	n, err = f.WriteTo(&buf)
+	assert.NoError(err)
+	assert.Equal(int64(0), n, "WriteTo at EOF")
+}
+
+// countingWriter counts the Tstat messages written through it.
+type countingWriter struct {
+	*io.PipeWriter
+	tstats int32
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if len(p) > 4 && p[4] == proto.Tstat {
+		atomic.AddInt32(&w.tstats, 1)
+	}
+	return w.PipeWriter.Write(p)
+}
+
+type countingPipe struct {
+	*io.PipeReader
+	*countingWriter
+}
+
+func (t *countingPipe) Close() error {
+	t.PipeReader.Close()
+	t.PipeWriter.Close()
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0444), []byte(helloText)))
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+
+	type exchange struct {
+		req, resp proto.FCall
+		rtt       time.Duration
+	}
+	var mu sync.Mutex
+	var traced []exchange
+	tracer := func(req, resp proto.FCall, rtt time.Duration) {
+		mu.Lock()
+		traced = append(traced, exchange{req, resp, rtt})
+		mu.Unlock()
+	}
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "", WithTracer(tracer))
+	if !assert.NoError(err) {
+		return
+	}
+
+	mu.Lock()
+	traced = nil
+	mu.Unlock()
+	_, err = c.Stat("/hello")
+	assert.NoError(err)
+	_, err = c.Stat("/missing")
+	assert.Error(err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []string
+	for _, e := range traced {
+		if !assert.NotNil(e.resp) {
+			continue
+		}
+		assert.Equal(e.req.GetTag(), e.resp.GetTag())
+		assert.True(e.rtt > 0)
+		types = append(types, fmt.Sprintf("%T/%T", e.req, e.resp))
+	}
+	assert.Equal([]string{
+		"*proto.TWalk/*proto.RWalk",
+		"*proto.TStat/*proto.RStat",
+		"*proto.TWalk/*proto.RError",
+	}, types)
+}
+
+func TestMaxFids(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	for _, name := range []string{"a", "b", "c"} {
+		root.AddChild(fs.NewStaticFile(testFS.NewStat(name, "glenda", "glenda", 0444), []byte(name+"0123456789")))
+	}
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "", WithMaxFids(2))
+	if !assert.NoError(err) {
+		return
+	}
+
+	a, err := c.Open("/a", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	bs := make([]byte, 3)
+	_, err = io.ReadFull(a, bs)
+	assert.NoError(err)
+	assert.Equal("a01", string(bs))
+
+	b, err := c.Open("/b", proto.Oread)
+	assert.NoError(err)
+	cf, err := c.Open("/c", proto.Oread)
+	assert.NoError(err)
+	c.Lock()
+	assert.True(a.evicted)
+	assert.False(b.evicted)
+	assert.Equal(2, c.lru.Len())
+	c.Unlock()
+
+	// a is reopened where it left off, which evicts b.
+	_, err = io.ReadFull(a, bs)
+	assert.NoError(err)
+	assert.Equal("234", string(bs))
+	c.Lock()
+	assert.False(a.evicted)
+	assert.True(b.evicted)
+	c.Unlock()
+
+	assert.NoError(b.Close())
+	assert.NoError(cf.Close())
+	assert.NoError(a.Close())
+	c.Lock()
+	assert.Equal(0, c.lru.Len())
+	assert.Empty(c.files)
+	c.Unlock()
+}
+
+func TestTagExhaustion(t *testing.T) {
+	assert := assert.New(t)
+	_, c := setup(t)
+
+	// Pretend every tag but one has been handed out.
+	c.Lock()
+	c.tags = nil
+	c.lastTag = maxTag - 1
+	c.Unlock()
+	last := c.takeTag()
+	assert.Equal(maxTag, last)
+
+	got := make(chan uint16)
+	go func() { got <- c.takeTag() }()
+	select {
+	case tag := <-got:
+		t.Fatalf("took tag %d while all were in use", tag)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.returnTag(last)
+	select {
+	case tag := <-got:
+		assert.Equal(last, tag)
+	case <-time.After(5 * time.Second):
+		t.Fatal("takeTag did not wake when a tag was returned")
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	const files = 50
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("f%d", i)
+		root.AddChild(fs.NewStaticFile(testFS.NewStat(name, "glenda", "glenda", 0444), []byte(name)))
+	}
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	open := make([]*File, files)
+	for i := range open {
+		open[i], err = c.Open(fmt.Sprintf("/f%d", i), proto.Oread)
+		if !assert.NoError(err) {
+			return
+		}
+	}
+	var wg sync.WaitGroup
+	var mismatches int32
+	for i := 0; i < 5000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bs := make([]byte, 16)
+			n, err := open[i%files].ReadAt(bs, 0)
+			if err != io.EOF || string(bs[:n]) != fmt.Sprintf("f%d", i%files) {
+				atomic.AddInt32(&mismatches, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(int32(0), mismatches)
+}
+
+// clunkRecorder records the fids of the Tclunks written through it.
+type clunkRecorder struct {
+	*io.PipeWriter
+	fids map[uint32]bool
+	sync.Mutex
+}
+
+func (w *clunkRecorder) Write(p []byte) (int, error) {
+	if len(p) >= 11 && p[4] == proto.Tclunk {
+		w.Lock()
+		w.fids[binary.LittleEndian.Uint32(p[7:])] = true
+		w.Unlock()
+	}
+	return w.PipeWriter.Write(p)
+}
+
+type recordingPipe struct {
+	*io.PipeReader
+	*clunkRecorder
+}
+
+func (t *recordingPipe) Close() error {
+	t.PipeReader.Close()
+	t.PipeWriter.Close()
+	return nil
+}
+
+func (w *clunkRecorder) clunked(fid uint32) bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.fids[fid]
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	var closes int32
+	for _, name := range []string{"a", "b", "c"} {
+		root.AddChild(&fs.WrappedFile{
+			File: fs.NewStaticFile(testFS.NewStat(name, "glenda", "glenda", 0666), []byte(name)),
+			CloseF: func(fid uint64) error {
+				atomic.AddInt32(&closes, 1)
+				return nil
+			},
+		})
+	}
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	rec := &clunkRecorder{PipeWriter: p1w, fids: make(map[uint32]bool)}
+	c, err := NewClient(&recordingPipe{p2r, rec}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	var files []*File
+	for _, name := range []string{"/a", "/b", "/c"} {
+		f, err := c.Open(name, proto.Oread)
+		if !assert.NoError(err) {
+			return
+		}
+		files = append(files, f)
+	}
+	dir, err := c.Walk("/")
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.NoError(c.Close())
+	for _, f := range files {
+		assert.True(rec.clunked(f.fid), "fid %d of %s was not clunked", f.fid, f.path)
+	}
+	assert.True(rec.clunked(dir.fid))
+	assert.True(rec.clunked(c.rootFid))
+	assert.Equal(int32(3), atomic.LoadInt32(&closes))
+
+	_, err = c.Stat("/a")
+	assert.True(errors.Is(err, ErrDisconnected), "%v", err)
+	assert.NoError(files[0].Close())
+	assert.NoError(c.Close())
+}
+
+// slowStatFile blocks Stat calls while gate is non-nil.
+type slowStatFile struct {
+	*fs.StaticFile
+	gate chan struct{}
+	sync.Mutex
+}
+
+func (f *slowStatFile) Stat() proto.Stat {
+	f.Lock()
+	gate := f.gate
+	f.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	return f.StaticFile.Stat()
+}
+
+func TestSingleFlightStat(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	slow := &slowStatFile{StaticFile: fs.NewStaticFile(testFS.NewStat("slow", "glenda", "glenda", 0444), []byte(helloText))}
+	root.AddChild(slow)
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	cw := &countingWriter{PipeWriter: p1w}
+	c, err := NewClient(&countingPipe{p2r, cw}, "glenda", "", WithSingleFlight())
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Warm the fid cache so only Tstats are outstanding below.
+	_, err = c.Stat("/slow")
+	assert.NoError(err)
+	atomic.StoreInt32(&cw.tstats, 0)
+
+	gate := make(chan struct{})
+	slow.Lock()
+	slow.gate = gate
+	slow.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := c.Stat("/slow")
+			if assert.NoError(err) {
+				assert.Equal("slow", st.Name)
+			}
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	slow.Lock()
+	slow.gate = nil
+	slow.Unlock()
+	close(gate)
+	wg.Wait()
+
+	assert.Equal(int32(1), atomic.LoadInt32(&cw.tstats))
+}
+
+func TestOpenPipelined(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	a := fs.NewStaticDir(testFS.NewStat("a", "glenda", "glenda", 0777|proto.DMDIR))
+	b := fs.NewStaticDir(testFS.NewStat("b", "glenda", "glenda", 0777|proto.DMDIR))
+	root.AddChild(a)
+	a.AddChild(b)
+	b.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0444), []byte(helloText)))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		f, err := c.Open("/a/b/hello", proto.Oread)
+		if !assert.NoError(err) {
+			return
+		}
+		bs := make([]byte, 100)
+		n, err := f.ReadAt(bs, 0)
+		assert.Equal(io.EOF, err)
+		assert.Equal(helloText, string(bs[:n]))
+		f.Close()
+	}
+
+	_, err = c.Open("/a/nothing/hello", proto.Oread)
+	assert.Error(err)
+	_, err = c.Open("/a/b/hello", proto.Owrite)
+	assert.Error(err)
+	_, err = c.Open("/a/b", proto.Oread)
+	assert.NoError(err)
+}
+
+func TestOpenPipelinedFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		// open answers the nth Topen, or returns nil to hang.
+		open      func(n int, to *proto.TOpen) proto.FCall
+		hangWalk  bool
+		wantErr   bool
+		wantOpens int
+		wantClunk bool
+	}{
+		{
+			name: "rerror",
+			open: func(n int, to *proto.TOpen) proto.FCall {
+				return &proto.RError{Header: proto.Header{Type: proto.Rerror, Tag: to.Tag}, Ename: "Permission denied."}
+			},
+			wantErr: true, wantOpens: 1, wantClunk: true,
+		},
+		{
+			name: "raced walk",
+			open: func(n int, to *proto.TOpen) proto.FCall {
+				if n == 1 {
+					return &proto.RError{Header: proto.Header{Type: proto.Rerror, Tag: to.Tag}, Ename: "Bad Fid."}
+				}
+				return &proto.ROpen{Header: proto.Header{Type: proto.Ropen, Tag: to.Tag}}
+			},
+			wantOpens: 2,
+		},
+		{
+			name: "open timeout",
+			open: func(n int, to *proto.TOpen) proto.FCall {
+				if n == 1 {
+					return nil
+				}
+				return &proto.ROpen{Header: proto.Header{Type: proto.Ropen, Tag: to.Tag}}
+			},
+			wantOpens: 2,
+		},
+		{
+			name:     "walk timeout",
+			open:     func(n int, to *proto.TOpen) proto.FCall { return nil },
+			hangWalk: true, wantErr: true, wantOpens: 1, wantClunk: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			var opens int
+			var walked uint32
+			clunked := make(chan uint32, 1)
+			handle := func(call proto.FCall, w io.Writer) {
+				switch tc := call.(type) {
+				case *proto.TWalk:
+					walked = tc.Newfid
+					if !tt.hangWalk {
+						w.Write(walkReply(tc))
+					}
+				case *proto.TOpen:
+					opens++
+					if r := tt.open(opens, tc); r != nil {
+						w.Write(r.Compose())
+					}
+				case *proto.TFlush:
+					w.Write((&proto.RFlush{Header: proto.Header{Type: proto.Rflush, Tag: tc.Tag}}).Compose())
+				case *proto.TClunk:
+					clunked <- tc.Fid
+					w.Write((&proto.RClunk{Header: proto.Header{Type: proto.Rclunk, Tag: tc.Tag}}).Compose())
+				}
+			}
+			c, err := NewClient(fakeServer(t, handle), "glenda", "", WithTimeout(50*time.Millisecond))
+			if !assert.NoError(err) {
+				return
+			}
+
+			_, err = c.Open("/file", proto.Oread)
+			if tt.wantErr {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+			select {
+			case fid := <-clunked:
+				assert.True(tt.wantClunk, "fid %d clunked", fid)
+				assert.Equal(walked, fid)
+			case <-time.After(200 * time.Millisecond):
+				assert.False(tt.wantClunk, "fid not clunked")
+			}
+			assert.Equal(tt.wantOpens, opens)
+		})
+	}
+}
+
+// slowWriter delays every write, simulating a high-latency link.
+type slowWriter struct {
+	*io.PipeWriter
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.PipeWriter.Write(p)
+}
+
+type slowPipe struct {
+	*io.PipeReader
+	*slowWriter
+}
+
+func (t *slowPipe) Close() error {
+	t.PipeReader.Close()
+	t.PipeWriter.Close()
+	return nil
+}
+
+func BenchmarkOpen(b *testing.B) {
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0444), []byte(helloText)))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&slowPipe{p2r, &slowWriter{p1w, time.Millisecond}}, "glenda", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := c.Open("/hello", proto.Oread)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+}
+
+func TestReadWriteAll(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("old contents")))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	bs, err := c.ReadAll("/file")
+	assert.NoError(err)
+	assert.Equal("old contents", string(bs))
+
+	data := make([]byte, 3*c.Msize())
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	assert.NoError(c.WriteAll("/file", data))
+	bs, err = c.ReadAll("/file")
+	assert.NoError(err)
+	assert.Equal(data, bs)
+
+	assert.NoError(c.WriteAll("/file", []byte("short")))
+	bs, err = c.ReadAll("/file")
+	assert.NoError(err)
+	assert.Equal("short", string(bs))
+
+	_, err = c.ReadAll("/nothing")
+	assert.Error(err)
+	assert.Error(c.WriteAll("/nothing", data))
+}
+
+func TestTruncate(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	sf := fs.NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("some contents"))
+	root.AddChild(sf)
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	// By path, without an open fid.
+	assert.NoError(c.Truncate("/file", 4))
+	bs, err := c.ReadAll("/file")
+	assert.NoError(err)
+	assert.Equal("some", string(bs))
+	st, err := c.Stat("/file")
+	assert.NoError(err)
+	assert.Equal(uint64(4), st.Length)
+	assert.Equal(uint32(0666), st.Mode&0777)
+	assert.Equal("file", st.Name)
+
+	// On an open fid, which keeps its offset.
+	f, err := c.Open("/file", proto.Ordwr)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	_, err = f.Write([]byte("so"))
+	assert.NoError(err)
+	assert.NoError(f.Truncate(6))
+	_, err = f.Write([]byte("me"))
+	assert.NoError(err)
+	assert.Equal([]byte("some\x00\x00"), sf.Data)
+	assert.NoError(f.Truncate(0))
+	assert.Empty(sf.Data)
+
+	assert.Error(c.Truncate("/nothing", 0))
+}
+
+// trickleFile is a StaticFile that accepts at most max bytes per write.
+type trickleFile struct {
+	*fs.StaticFile
+	max    int
+	writes int32
+}
+
+func (f *trickleFile) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
+	atomic.AddInt32(&f.writes, 1)
+	if len(data) > f.max {
+		data = data[:f.max]
+	}
+	return f.StaticFile.Write(fid, offset, data)
+}
+
+func TestShortWrites(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	tf := &trickleFile{StaticFile: fs.NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte{}), max: 3}
+	root.AddChild(tf)
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	f, err := c.Open("/file", proto.Owrite)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	n, err := f.Write([]byte("Hello, World!"))
+	assert.NoError(err)
+	assert.Equal(13, n)
+	assert.Equal(int32(5), atomic.LoadInt32(&tf.writes))
+	n, err = f.WriteAt([]byte("there"), 7)
+	assert.NoError(err)
+	assert.Equal(5, n)
+	n, err = f.Write([]byte("?"))
+	assert.NoError(err)
+	assert.Equal(1, n)
+	assert.Equal("Hello, there!?", string(tf.Data))
+
+	// A server that accepts nothing can't stall the writer.
+	tf.max = 0
+	n, err = f.Write([]byte("more"))
+	assert.Equal(io.ErrShortWrite, err)
+	assert.Equal(0, n)
+}
+
+func TestFileStat(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	sf := fs.NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("contents"))
+	root.AddChild(sf)
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	var walks int32
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "", WithTracer(func(req, resp proto.FCall, rtt time.Duration) {
+		if _, ok := req.(*proto.TWalk); ok {
+			atomic.AddInt32(&walks, 1)
+		}
+	}))
+	if !assert.NoError(err) {
+		return
+	}
+
+	f, err := c.Open("/file", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	before := atomic.LoadInt32(&walks)
+	st, err := f.Stat()
+	if assert.NoError(err) {
+		assert.Equal("file", st.Name)
+		assert.Equal(uint64(8), st.Length)
+		assert.Equal(f.Qid().Uid, st.Qid.Uid)
+	}
+
+	wst := nullStat()
+	wst.Mode = 0600
+	wst.Name = "renamed"
+	assert.NoError(f.WStat(&wst))
+	assert.Equal("renamed", sf.Stat().Name)
+	assert.Equal(uint32(0600), sf.Stat().Mode&0777)
+	assert.Equal("/renamed", f.path)
+	// Neither needed a walk.
+	assert.Equal(before, atomic.LoadInt32(&walks))
+
+	wst = nullStat()
+	wst.Name = "a/b"
+	assert.Error(f.WStat(&wst))
+	assert.Equal("/renamed", f.path)
+}
+
+// failSync is a StaticFile that fails to sync, making clunks fail.
+type failSync struct {
+	*fs.StaticFile
+}
+
+func (f failSync) Sync(fid uint64) error {
+	return errors.New("Disk on fire.")
+}
+
+func TestCloseError(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(failSync{fs.NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte{})})
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("other", "glenda", "glenda", 0666), []byte{}))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	f, err := c.Open("/file", proto.Owrite)
+	if !assert.NoError(err) {
+		return
+	}
+	fid := f.fid
+	err = f.Close()
+	if assert.Error(err) {
+		assert.Equal("Disk on fire.", err.Error())
+	}
+	c.Lock()
+	assert.False(c.liveFids[fid])
+	c.Unlock()
+
+	// The fid is free, on both sides, and is used again.
+	f, err = c.Open("/other", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(fid, f.fid)
+	assert.NoError(f.Close())
+}
+
+// redialer serves testFS on a new pipe for every dial, and can break the
+// current connection.
+type redialer struct {
+	srv    go9p.Srv
+	dials  int
+	server [2]io.Closer
+	sync.Mutex
+}
+
+func (d *redialer) dial() (io.ReadWriteCloser, error) {
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, d.srv)
+	d.Lock()
+	defer d.Unlock()
+	d.dials++
+	d.server = [2]io.Closer{p1r, p2w}
+	return &TwoPipe{p2r, p1w}, nil
+}
+
+func (d *redialer) breakConn() {
+	d.Lock()
+	defer d.Unlock()
+	d.server[0].Close()
+	d.server[1].Close()
+}
+
+func TestReconnect(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0666), []byte(helloText)))
+	d := &redialer{srv: testFS.Server()}
+
+	conn, _ := d.dial()
+	c, err := NewClient(conn, "glenda", "", WithReconnect(d.dial))
+	if !assert.NoError(err) {
+		return
+	}
+	f, err := c.Open("/hello", proto.Ordwr)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	_, err = c.Stat("/hello")
+	assert.NoError(err)
+
+	d.breakConn()
+
+	// The open file and cached fids keep working.
+	bs := make([]byte, 100)
+	n, err := f.ReadAt(bs, 0)
+	assert.Equal(io.EOF, err)
+	assert.Equal(helloText, string(bs[:n]))
+	st, err := c.Stat("/hello")
+	if assert.NoError(err) {
+		assert.Equal("hello", st.Name)
+	}
+	assert.Equal(2, d.dials)
+
+	assert.NoError(c.Reconnect())
+	assert.Equal(3, d.dials)
+	_, err = f.WriteAt([]byte("J"), 0)
+	assert.NoError(err)
+	bs, err = c.ReadAll("/hello")
+	assert.NoError(err)
+	assert.Equal("Jello, World!", string(bs))
+}
+
+func TestReconnectStale(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0666), []byte(helloText)))
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("gone", "glenda", "glenda", 0666), []byte(helloText)))
+	d := &redialer{srv: testFS.Server()}
+
+	conn, _ := d.dial()
+	c, err := NewClient(conn, "glenda", "", WithReconnect(d.dial))
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+	gone, err := c.Open("/gone", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	f, err := c.Open("/hello", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+
+	// A file removed while the client was away leaves only its File stale.
+	d.breakConn()
+	assert.NoError(root.DeleteChild("gone"))
+	bs := make([]byte, 5)
+	_, err = f.ReadAt(bs, 0)
+	assert.NoError(err)
+	assert.Equal("Hello", string(bs))
+	_, err = gone.ReadAt(bs, 0)
+	assert.True(errors.Is(err, ErrStale), err)
+	assert.NoError(gone.Close())
+	_, err = c.Stat("/hello")
+	assert.NoError(err)
+}
+
+// breakingSrv breaks its connection after handling a Tremove, before the
+// reply is sent.
+type breakingSrv struct {
+	go9p.Srv
+	d       *redialer
+	removes int32
+}
+
+func (s *breakingSrv) Remove(conn go9p.Conn, t *proto.TRemove) (proto.FCall, error) {
+	atomic.AddInt32(&s.removes, 1)
+	resp, err := s.Srv.Remove(conn, t)
+	s.d.breakConn()
+	return resp, err
+}
+
+func TestReconnectNoRetry(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777, fs.WithRemoveFile(fs.RMFile))
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0666), []byte(helloText)))
+	d := &redialer{}
+	srv := &breakingSrv{Srv: testFS.Server(), d: d}
+	d.srv = srv
+
+	conn, _ := d.dial()
+	c, err := NewClient(conn, "glenda", "", WithReconnect(d.dial))
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	// The remove was done, but its reply was lost, so it is not sent again.
+	err = c.Remove("/hello")
+	assert.True(errors.Is(err, ErrDisconnected), err)
+	assert.Equal(int32(1), atomic.LoadInt32(&srv.removes))
+	_, err = c.Stat("/hello")
+	assert.True(errors.Is(err, os.ErrNotExist), err)
+}
+
+func TestDisconnected(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0666), []byte(helloText)))
+	d := &redialer{srv: testFS.Server()}
+
+	conn, _ := d.dial()
+	c, err := NewClient(conn, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	d.breakConn()
+
+	_, err = c.Stat("/hello")
+	assert.True(errors.Is(err, ErrDisconnected))
+	assert.Error(c.Reconnect())
+}
+
+// fakeServer answers the version and attach exchange, then hands each
+// further request to handle.
+func fakeServer(t *testing.T, handle func(call proto.FCall, w io.Writer)) *TwoPipe {
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go func() {
+		defer p2w.Close()
+		for {
+			call, err := proto.ParseCall(p1r)
+			if err != nil {
+				return
+			}
+			switch tc := call.(type) {
+			case *proto.TRVersion:
+				reply := *tc
+				reply.Type = proto.Rversion
+				p2w.Write(reply.Compose())
+			case *proto.TAttach:
+				p2w.Write((&proto.RAttach{Header: proto.Header{Type: proto.Rattach, Tag: tc.Tag}}).Compose())
+			default:
+				handle(call, p2w)
+			}
+		}
+	}()
+	return &TwoPipe{p2r, p1w}
+}
+
+// walkReply answers tw as if every element exists.
+func walkReply(tw *proto.TWalk) []byte {
+	rw := &proto.RWalk{Header: proto.Header{Type: proto.Rwalk, Tag: tw.Tag}, Nwqid: tw.Nwname}
+	rw.Wqid = make([]proto.Qid, tw.Nwname)
+	return rw.Compose()
+}
+
+func TestLongWalk(t *testing.T) {
+	assert := assert.New(t)
+	var walks []*proto.TWalk
+	var mu sync.Mutex
+	handle := func(call proto.FCall, w io.Writer) {
+		switch tc := call.(type) {
+		case *proto.TWalk:
+			mu.Lock()
+			walks = append(walks, tc)
+			mu.Unlock()
+			w.Write(walkReply(tc))
+		case *proto.TOpen:
+			w.Write((&proto.ROpen{Header: proto.Header{Type: proto.Ropen, Tag: tc.Tag}}).Compose())
+		case *proto.TClunk:
+			w.Write((&proto.RClunk{Header: proto.Header{Type: proto.Rclunk, Tag: tc.Tag}}).Compose())
+		}
+	}
+	c, err := NewClient(fakeServer(t, handle), "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	var names []string
+	for i := 0; i < 40; i++ {
+		names = append(names, fmt.Sprintf("d%d", i))
+	}
+	long := "/" + strings.Join(names, "/")
+
+	check := func(op string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if assert.Len(walks, 3, op) {
+			var walked []string
+			for _, w := range walks {
+				assert.LessOrEqual(len(w.Wname), proto.MAXWELEM)
+				walked = append(walked, w.Wname...)
+			}
+			assert.Equal(names, walked, op)
+		}
+		walks = nil
+	}
+
+	f, err := c.Walk(long)
+	if assert.NoError(err) {
+		f.Close()
+	}
+	check("Walk")
+	f, err = c.Open(long, proto.Oread)
+	if assert.NoError(err) {
+		f.Close()
+	}
+	check("Open")
+}
+
+func TestRerrorErrno(t *testing.T) {
+	assert := assert.New(t)
+	handle := func(call proto.FCall, w io.Writer) {
+		rerror := &proto.RError{Header: proto.Header{Type: proto.Rerror, Tag: call.GetTag()}, Ename: "file does not exist", Errno: 2}
+		enc := proto.NewEncoder(w)
+		if call.(*proto.TWalk).Wname[0] == "u" {
+			// Trailing bytes the 9P2000 connection has no errno in.
+			enc.SetVersion("9P2000.u")
+		}
+		enc.Encode(rerror)
+	}
+	c, err := NewClient(fakeServer(t, handle), "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	var serr *Error
+	_, err = c.Stat("/u")
+	if assert.True(errors.As(err, &serr)) {
+		assert.Equal("file does not exist", err.Error())
+		assert.Equal(uint32(0), serr.Errno)
+	}
+	assert.True(errors.Is(err, os.ErrNotExist))
+	_, err = c.Stat("/plain")
+	if assert.True(errors.As(err, &serr)) {
+		assert.Equal(uint32(0), serr.Errno)
+	}
+}
+
+func TestUnknownTag(t *testing.T) {
+	reply := func(tag uint16) []byte {
+		st := proto.Stat{Name: "file"}
+		return (&proto.RStat{Header: proto.Header{Type: proto.Rstat, Tag: tag}, Stat: st}).Compose()
+	}
+	handle := func(call proto.FCall, w io.Writer) {
+		switch call.(type) {
+		case *proto.TWalk:
+			w.Write(walkReply(call.(*proto.TWalk)))
+		case *proto.TStat:
+			// A reply for a tag that was never sent, then the real reply.
+			w.Write(reply(call.GetTag() + 100))
+			w.Write(reply(call.GetTag()))
+		}
+	}
+
+	t.Run("Ignore", func(t *testing.T) {
+		assert := assert.New(t)
+		c, err := NewClient(fakeServer(t, handle), "glenda", "")
+		if !assert.NoError(err) {
+			return
+		}
+		st, err := c.Stat("/file")
+		if assert.NoError(err) {
+			assert.Equal("file", st.Name)
+		}
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		assert := assert.New(t)
+		c, err := NewClient(fakeServer(t, handle), "glenda", "", WithStrictTags())
+		if !assert.NoError(err) {
+			return
+		}
+		done := make(chan error)
+		go func() {
+			_, err := c.Stat("/file")
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			assert.True(errors.Is(err, ErrDisconnected))
+			assert.Contains(err.Error(), "unknown tag")
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stat hung after a reply with an unknown tag")
+		}
+	})
+}
+
+func TestClone(t *testing.T) {
+	assert := assert.New(t)
+	_, c := setup(t)
+
+	f, err := c.Open("/hello", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	bs := make([]byte, 5)
+	_, err = io.ReadFull(f, bs)
+	assert.NoError(err)
+	assert.Equal(helloText[:5], string(bs))
+
+	clone, err := c.Clone(f)
+	if !assert.NoError(err) {
+		return
+	}
+	defer clone.Close()
+	assert.NotEqual(f.fid, clone.fid)
+
+	all, err := ioutil.ReadAll(clone)
+	assert.NoError(err)
+	assert.Equal(helloText, string(all))
+
+	rest, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal(helloText[5:], string(rest))
+}
+
+func TestRemoveAll(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777, fs.WithRemoveFile(fs.RMFile))
+	a := fs.NewStaticDir(testFS.NewStat("a", "glenda", "glenda", 0777))
+	b := fs.NewStaticDir(testFS.NewStat("b", "glenda", "glenda", 0777))
+	root.AddChild(a)
+	a.AddChild(b)
+	a.AddChild(fs.NewStaticFile(testFS.NewStat("f1", "glenda", "glenda", 0666), []byte("one")))
+	b.AddChild(fs.NewStaticFile(testFS.NewStat("f2", "glenda", "glenda", 0666), []byte("two")))
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("keep", "glenda", "glenda", 0666), []byte("keep")))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.NoError(c.RemoveAll("/a"))
+	_, err = c.Stat("/a")
+	assert.Error(err)
+	assert.Len(root.Children(), 1)
+	assert.NoError(c.RemoveAll("/a"), "removing a missing path is not an error")
+}
+
+func TestTimeout(t *testing.T) {
+	assert := assert.New(t)
+	var stats int32
+	flushed := make(chan uint16, 1)
+	handle := func(call proto.FCall, w io.Writer) {
+		switch tc := call.(type) {
+		case *proto.TWalk:
+			w.Write(walkReply(tc))
+		case *proto.TStat:
+			// Hang on the first stat.
+			if atomic.AddInt32(&stats, 1) == 1 {
+				return
+			}
+			w.Write((&proto.RStat{Header: proto.Header{Type: proto.Rstat, Tag: tc.Tag}, Stat: proto.Stat{Name: "file"}}).Compose())
+		case *proto.TFlush:
+			flushed <- tc.Oldtag
+			w.Write((&proto.RFlush{Header: proto.Header{Type: proto.Rflush, Tag: tc.Tag}}).Compose())
+		}
+	}
+	c, err := NewClient(fakeServer(t, handle), "glenda", "", WithTimeout(50*time.Millisecond))
+	if !assert.NoError(err) {
+		return
+	}
+
+	start := time.Now()
+	_, err = c.Stat("/file")
+	assert.True(errors.Is(err, context.DeadlineExceeded), "got %v", err)
+	assert.True(time.Since(start) < 5*time.Second)
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out request was not flushed")
+	}
+
+	st, err := c.Stat("/file")
+	if assert.NoError(err) {
+		assert.Equal("file", st.Name)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	assert := assert.New(t)
+	_, c := setup(t)
+
+	f, err := c.Open("/hello", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+
+	off, err := f.Seek(-6, io.SeekEnd)
+	assert.NoError(err)
+	assert.Equal(int64(len(helloText)-6), off)
+	bs, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal("World!", string(bs))
+
+	off, err = f.Seek(0, io.SeekStart)
+	assert.NoError(err)
+	assert.Equal(int64(0), off)
+	bs = make([]byte, 5)
+	_, err = io.ReadFull(f, bs)
+	assert.NoError(err)
+	assert.Equal("Hello", string(bs))
+
+	off, err = f.Seek(2, io.SeekCurrent)
+	assert.NoError(err)
+	assert.Equal(int64(7), off)
+	bs, err = ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal("World!", string(bs))
+
+	_, err = f.Seek(-1, io.SeekStart)
+	assert.Error(err)
+}
+
+func TestReaddirLarge(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	const n = 10000
+	for i := 0; i < n; i++ {
+		root.AddChild(fs.NewStaticFile(testFS.NewStat(fmt.Sprintf("file%05d", i), "glenda", "glenda", 0444), nil))
+	}
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	stats, err := c.Readdir("/")
+	if !assert.NoError(err) {
+		return
+	}
+	if assert.Len(stats, n) {
+		for i, st := range stats {
+			if !assert.Equal(fmt.Sprintf("file%05d", i), st.Name) {
+				break
+			}
+		}
+	}
+}
+
+func TestReadDirSplitEntries(t *testing.T) {
+	assert := assert.New(t)
+	var dir []byte
+	for _, name := range []string{".", "b", "a", "c"} {
+		st := proto.Stat{Name: name, Uid: "glenda", Gid: "glenda", Muid: "glenda"}
+		dir = append(dir, st.Compose()...)
+	}
+	handle := func(call proto.FCall, w io.Writer) {
+		switch tc := call.(type) {
+		case *proto.TWalk:
+			w.Write(walkReply(tc))
+		case *proto.TOpen:
+			w.Write((&proto.ROpen{Header: proto.Header{Type: proto.Ropen, Tag: tc.Tag}, Iounit: 8192}).Compose())
+		case *proto.TRead:
+			// Hand the directory out 7 bytes at a time, so every entry
+			// spans several reads.
+			var data []byte
+			if tc.Offset < uint64(len(dir)) {
+				data = dir[tc.Offset:]
+				if len(data) > 7 {
+					data = data[:7]
+				}
+			}
+			w.Write((&proto.RRead{Header: proto.Header{Type: proto.Rread, Tag: tc.Tag}, Count: uint32(len(data)), Data: data}).Compose())
+		case *proto.TClunk:
+			w.Write((&proto.RClunk{Header: proto.Header{Type: proto.Rclunk, Tag: tc.Tag}}).Compose())
+		}
+	}
+	c, err := NewClient(fakeServer(t, handle), "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	names, err := c.ReadDirNames("/dir")
+	if assert.NoError(err) {
+		assert.Equal([]string{"b", "a", "c"}, names)
+	}
+	stats, err := c.ReadDirStats("/dir")
+	if assert.NoError(err) && assert.Len(stats, 3) {
+		assert.Equal("glenda", stats[2].Muid)
+	}
+
+	// A directory cut off in the middle of an entry is an error.
+	dir = dir[:len(dir)-3]
+	_, err = c.ReadDirStats("/dir")
+	assert.Error(err)
+}
+
+func TestFileQid(t *testing.T) {
+	assert := assert.New(t)
+	_, c := setup(t)
+
+	st, err := c.Stat("/hello")
+	if !assert.NoError(err) {
+		return
+	}
+	f, err := c.Open("/hello", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	assert.Equal(st.Qid, f.Qid())
+}
+
+// versionServer is a server that answers every Tversion with the given
+// version and msize, and accepts any attach.
+func versionServer(version string, msize uint32) *TwoPipe {
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go func() {
+		defer p2w.Close()
+		for {
+			call, err := proto.ParseCall(p1r)
+			if err != nil {
+				return
+			}
+			switch tc := call.(type) {
+			case *proto.TRVersion:
+				reply := proto.TRVersion{Header: proto.Header{Type: proto.Rversion, Tag: tc.Tag}, Msize: msize, Version: version}
+				p2w.Write(reply.Compose())
+			case *proto.TAttach:
+				p2w.Write((&proto.RAttach{Header: proto.Header{Type: proto.Rattach, Tag: tc.Tag}}).Compose())
+			}
+		}
+	}()
+	return &TwoPipe{p2r, p1w}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	for _, tt := range []struct {
+		ask, reply string
+		msize      uint32
+		version    string // empty if NewClient should fail.
+		wantMsize  uint32
+	}{
+		{"", "9P2000", 8192, "9P2000", 8192},
+		{"9P2000.u", "9P2000", 8192, "9P2000", 8192},
+		{"9P2000.u", "9P2000.u", 8192, "", 0},
+		{"", "9P2000.u", 8192, "", 0},
+		{"", "9P2000.L", 8192, "", 0},
+		{"", "9P2000", 1 << 20, "9P2000", 65536},
+		{"", "unknown", 8192, "", 0},
+		{"9P2000.u", "9P2000.L", 8192, "", 0},
+		{"", "9P1", 8192, "", 0},
+		{"9P2000.L", "9P2000", 8192, "", 0},
+		{"", "9P2000", 16, "", 0},
+	} {
+		name := fmt.Sprintf("%s/%s/%d", tt.ask, tt.reply, tt.msize)
+		c, err := NewClient(versionServer(tt.reply, tt.msize), "glenda", "", WithVersion(tt.ask))
+		if tt.version == "" {
+			assert.Error(t, err, name)
+			continue
+		}
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, tt.version, c.Version(), name)
+			assert.Equal(t, tt.wantMsize, c.Msize(), name)
+		}
+	}
+}
+
+func TestRemoveFailedFid(t *testing.T) {
+	assert := assert.New(t)
+	_, c := setup(t)
+
+	// The FS has no RemoveFile hook, so every remove fails.
+	for i := 0; i < 10; i++ {
+		assert.Error(c.Remove("/hello"))
+	}
+	_, err := c.Stat("/hello")
+	assert.NoError(err)
+
+	// Each failed remove's fid was clunked by the server and returned to
+	// the pool exactly once.
+	c.Lock()
+	defer c.Unlock()
+	seen := make(map[uint32]bool)
+	for _, fid := range c.fids {
+		assert.False(seen[fid], "fid %d returned twice", fid)
+		seen[fid] = true
+	}
+}
+
+func TestWalkCache(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777, fs.WithRemoveFile(fs.RMFile))
+	a := fs.NewStaticDir(testFS.NewStat("a", "glenda", "glenda", 0777))
+	root.AddChild(a)
+	b := fs.NewStaticDir(testFS.NewStat("b", "glenda", "glenda", 0777))
+	a.AddChild(b)
+	b.AddChild(fs.NewStaticFile(testFS.NewStat("c", "glenda", "glenda", 0666), []byte("contents")))
+	b.AddChild(fs.NewStaticFile(testFS.NewStat("d", "glenda", "glenda", 0666), []byte("contents")))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	var mu sync.Mutex
+	var walks []proto.TWalk
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "", WithWalkCache(2), WithTracer(func(req, resp proto.FCall, rtt time.Duration) {
+		if w, ok := req.(*proto.TWalk); ok {
+			mu.Lock()
+			walks = append(walks, *w)
+			mu.Unlock()
+		}
+	}))
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+	lastWalks := func() []proto.TWalk {
+		mu.Lock()
+		defer mu.Unlock()
+		ws := walks
+		walks = nil
+		return ws
+	}
+	cached := func(path string) (uint32, bool) {
+		c.pathCacheLock.Lock()
+		defer c.pathCacheLock.Unlock()
+		e, ok := c.pathCache[path]
+		if !ok {
+			return 0, false
+		}
+		return e.fid, true
+	}
+
+	// A stat walks once, and the path is cleaned.
+	_, err = c.Stat("/a/b/c")
+	assert.NoError(err)
+	_, err = c.Stat("a//b/c/")
+	assert.NoError(err)
+	if ws := lastWalks(); assert.Len(ws, 1) {
+		assert.Equal(c.rootFid, ws[0].Fid)
+	}
+	cfid, ok := cached("/a/b/c")
+	assert.True(ok)
+
+	// Opens clone the cached fid.
+	f, err := c.Open("/a/b/c", proto.Oread)
+	if assert.NoError(err) {
+		f.Close()
+	}
+	if ws := lastWalks(); assert.Len(ws, 1) {
+		assert.Equal(cfid, ws[0].Fid)
+		assert.Empty(ws[0].Wname)
+	}
+
+	// Walks below a cached directory start from it.
+	_, err = c.Stat("/a")
+	assert.NoError(err)
+	afid, _ := cached("/a")
+	lastWalks()
+	f, err = c.Walk("/a/b/d")
+	if assert.NoError(err) {
+		f.Close()
+	}
+	if ws := lastWalks(); assert.Len(ws, 1) {
+		assert.Equal(afid, ws[0].Fid)
+		assert.Equal([]string{"b", "d"}, ws[0].Wname)
+	}
+
+	// The least recently used path is evicted, and its fid clunked.
+	_, err = c.Stat("/a/b")
+	assert.NoError(err)
+	_, ok = cached("/a/b/c")
+	assert.False(ok)
+	_, ok = cached("/a")
+	assert.True(ok)
+	assert.Eventually(func() bool {
+		c.Lock()
+		defer c.Unlock()
+		return !c.liveFids[cfid]
+	}, time.Second, 10*time.Millisecond)
+
+	// A new version of a directory forgets its children.
+	_, err = c.Stat("/a/b/c")
+	assert.NoError(err)
+	_, err = c.Stat("/a/b")
+	assert.NoError(err)
+	st := b.Stat()
+	st.Qid.Vers++
+	b.WriteStat(&st)
+	_, err = c.Stat("/a/b")
+	assert.NoError(err)
+	_, ok = cached("/a/b")
+	assert.True(ok)
+	_, ok = cached("/a/b/c")
+	assert.False(ok)
+
+	// Renaming a directory forgets everything below it.
+	_, err = c.Stat("/a/b/c")
+	assert.NoError(err)
+	wst := nullStat()
+	wst.Name = "z"
+	assert.NoError(c.WStat("/a/b", &wst))
+	_, ok = cached("/a/b")
+	assert.False(ok)
+	_, ok = cached("/a/b/c")
+	assert.False(ok)
+	_, err = c.Stat("/a/b/c")
+	assert.Error(err)
+	_, err = c.Stat("/a/z/c")
+	assert.NoError(err)
+
+	// As does removing it.
+	assert.NoError(c.Remove("/a/z/c"))
+	_, ok = cached("/a/z/c")
+	assert.False(ok)
+	_, err = c.Stat("/a/z/c")
+	assert.Error(err)
+}
+
+func TestErrorIs(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(errors.Is(&Error{Ename: "Authentication Not Supported."}, ErrUnsupported))
+	assert.True(errors.Is(&Error{Ename: "unknown message type"}, ErrUnsupported))
+	assert.True(errors.Is(&Error{Ename: "file does not exist"}, os.ErrNotExist))
+	assert.True(errors.Is(&Error{Ename: "oops", Errno: 2}, os.ErrNotExist))
+	assert.True(errors.Is(&Error{Ename: "Permission denied."}, os.ErrPermission))
+	assert.True(errors.Is(&Error{Ename: "file already exists"}, os.ErrExist))
+	assert.False(errors.Is(&Error{Ename: "Permission denied."}, os.ErrNotExist))
+	assert.False(errors.Is(&Error{Ename: "Disk on fire."}, ErrUnsupported))
+
+	testFS, root := fs.NewFS("glenda", "glenda", 0777, fs.WithCreateFile(fs.CreateStaticFile))
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0400), []byte{}))
+	connect := func(opts ...Option) (*Client, error) {
+		p1r, p1w := io.Pipe()
+		p2r, p2w := io.Pipe()
+		go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+		return NewClient(&TwoPipe{p2r, p1w}, "glenda", "", opts...)
+	}
+
+	// The server doesn't authenticate, so the client can tell and
+	// attach without.
+	_, err := connect(WithAuth(func(user string, s io.ReadWriter) (string, error) { return user, nil }))
+	assert.True(errors.Is(err, ErrUnsupported))
+	c, err := connect()
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	_, err = c.Stat("/missing")
+	assert.True(errors.Is(err, os.ErrNotExist))
+	_, err = c.Open("/missing", proto.Oread)
+	assert.True(errors.Is(err, os.ErrNotExist))
+	_, err = c.Create("/file", 0600)
+	assert.True(errors.Is(err, os.ErrExist))
+	_, err = c.Open("/file", proto.Owrite)
+	assert.True(errors.Is(err, os.ErrPermission))
+}
+
+func TestFileIsDir(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticDir(testFS.NewStat("dir", "glenda", "glenda", 0777)))
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte{}))
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+	var opens int32
+	c, err := NewClient(&TwoPipe{p2r, p1w}, "glenda", "", WithTracer(func(req, resp proto.FCall, rtt time.Duration) {
+		if _, ok := req.(*proto.TOpen); ok {
+			atomic.AddInt32(&opens, 1)
+		}
+	}))
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	for _, p := range []string{"/", "/dir"} {
+		d, err := c.Walk(p)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.True(d.IsDir(), p)
+		assert.Error(d.Open(proto.Owrite))
+		assert.Error(d.Open(proto.Oread | proto.Otrunc))
+		assert.Error(d.Open(proto.Oread | proto.Orclose))
+		assert.Equal(int32(0), atomic.LoadInt32(&opens))
+		assert.NoError(d.Open(proto.Oread))
+		atomic.StoreInt32(&opens, 0)
+		d.Close()
+	}
+
+	f, err := c.Walk("/file")
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	assert.False(f.IsDir())
+	assert.NoError(f.Open(proto.Ordwr))
+}
+
+func TestOrclose(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := fs.NewFS("glenda", "glenda", 0777, fs.WithRemoveFile(fs.RMFile))
+	for _, name := range []string{"scratch", "dropped"} {
+		root.AddChild(fs.NewStaticFile(testFS.NewStat(name, "glenda", "glenda", 0666), []byte{}))
+	}
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("readonly", "glenda", "glenda", 0444), []byte{}))
+	connect := func() (*Client, error) {
+		p1r, p1w := io.Pipe()
+		p2r, p2w := io.Pipe()
+		go go9p.ServeReadWriter(p1r, p2w, testFS.Server())
+		return NewClient(&TwoPipe{p2r, p1w}, "glenda", "", WithWalkCache(8))
+	}
+	c, err := connect()
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	// Removing the file on close takes permission to remove it.
+	_, err = c.Open("/readonly", proto.Oread|proto.Orclose)
+	assert.True(errors.Is(err, os.ErrPermission))
+
+	_, err = c.Stat("/scratch")
+	assert.NoError(err)
+	f, err := c.Open("/scratch", proto.Ordwr|proto.Orclose)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = f.Write([]byte("scratch"))
+	assert.NoError(err)
+	_, err = c.Stat("/scratch")
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	_, err = c.Stat("/scratch")
+	assert.True(errors.Is(err, os.ErrNotExist))
+
+	// Files left open Orclose are removed when the connection ends.
+	c2, err := connect()
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = c2.Open("/dropped", proto.Oread|proto.Orclose)
+	assert.NoError(err)
+	c2.Close()
+	assert.Eventually(func() bool {
+		_, err := c.Stat("/dropped")
+		return errors.Is(err, os.ErrNotExist)
+	}, time.Second, 10*time.Millisecond)
+}
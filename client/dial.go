@@ -0,0 +1,88 @@
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseDialString converts a Plan 9 dial string of the form net!addr!port,
+// such as "tcp!example.com!564" or "unix!/tmp/ns.glenda/acme", to the
+// network and address expected by net.Dial. The network "net" means TCP.
+// For TCP, the port may be omitted or given as "9fs", both meaning 564.
+func ParseDialString(dial string) (network, addr string, err error) {
+	parts := strings.Split(dial, "!")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+		return "", "", fmt.Errorf("client: bad dial string %q", dial)
+	}
+	network, addr = parts[0], parts[1]
+	switch network {
+	case "net", "tcp", "tcp4", "tcp6":
+		if network == "net" {
+			network = "tcp"
+		}
+		port := "564"
+		if len(parts) == 3 && parts[2] != "9fs" {
+			port = parts[2]
+		}
+		addr = net.JoinHostPort(addr, port)
+	case "unix":
+		if len(parts) == 3 {
+			return "", "", fmt.Errorf("client: bad dial string %q: unix addresses have no port", dial)
+		}
+	default:
+		return "", "", fmt.Errorf("client: bad dial string %q: unknown network %s", dial, network)
+	}
+	return network, addr, nil
+}
+
+// dialAddr returns the network and address to dial for addr. If addr is a
+// Plan 9 dial string, its network replaces the given one.
+func dialAddr(network, addr string) (string, string, error) {
+	if strings.Contains(addr, "!") {
+		return ParseDialString(addr)
+	}
+	return network, addr, nil
+}
+
+// Dial connects to the 9P server at addr on the named network and returns a
+// Client attached as user to aname. See net.Dial for the network and address
+// forms accepted. addr may also be a Plan 9 dial string, in which case
+// network is ignored; see ParseDialString.
+func Dial(network, addr, user, aname string, opts ...Option) (*Client, error) {
+	network, addr, err := dialAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, user, aname, opts...)
+}
+
+// DialTLS connects to the 9P server at the TCP address addr over TLS and
+// returns a Client attached as user to aname. config may be nil, in which case
+// the default configuration is used and the server name is taken from addr.
+// The TLS handshake completes before any 9P traffic is sent, so certificate
+// problems are reported by DialTLS itself. addr may be a Plan 9 dial string.
+func DialTLS(addr string, config *tls.Config, user, aname string, opts ...Option) (*Client, error) {
+	network, addr, err := dialAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.Dial(network, addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("client: TLS handshake with %s: %w", addr, err)
+	}
+	return NewClient(conn, user, aname, opts...)
+}
+
+// DialAuth connects to the 9P server at the TCP address addr, authenticating
+// with the shared secret, and returns a Client attached as user to aname. It
+// is the client half of fs.ServeAuth. addr may be a Plan 9 dial string.
+func DialAuth(addr, secret, user, aname string, opts ...Option) (*Client, error) {
+	opts = append(opts, WithAuth(SecretAuth(secret)))
+	return Dial("tcp", addr, user, aname, opts...)
+}
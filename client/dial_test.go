@@ -0,0 +1,373 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSigned returns a certificate for 127.0.0.1 and a pool trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go9p test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestDialTLS(t *testing.T) {
+	assert := assert.New(t)
+	cert, pool := selfSigned(t)
+
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0444), []byte(helloText)))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go go9p.ServeReadWriter(conn, conn, testFS.Server())
+		}
+	}()
+
+	_, err = DialTLS(l.Addr().String(), nil, "glenda", "")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "TLS handshake")
+		var certErr x509.UnknownAuthorityError
+		assert.True(errors.As(err, &certErr), "want a certificate error, got %v", err)
+	}
+
+	c, err := DialTLS(l.Addr().String(), &tls.Config{RootCAs: pool}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	data, err := c.ReadAll("/hello")
+	assert.NoError(err)
+	assert.Equal(helloText, string(data))
+}
+
+func TestDialAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0400), []byte(helloText)))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	go fs.ServeAuth(addr, "sesame", testFS)
+
+	var c *Client
+	for i := 0; i < 50; i++ {
+		c, err = DialAuth(addr, "sesame", "glenda", "")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !assert.NoError(err) {
+		return
+	}
+	data, err := c.ReadAll("/hello")
+	assert.NoError(err)
+	assert.Equal(helloText, string(data))
+
+	_, err = DialAuth(addr, "open says me", "glenda", "")
+	assert.Error(err)
+}
+
+func TestParseDialString(t *testing.T) {
+	for _, tt := range []struct {
+		dial, network, addr string
+	}{
+		{"tcp!example.com!5640", "tcp", "example.com:5640"},
+		{"tcp!example.com", "tcp", "example.com:564"},
+		{"net!example.com!9fs", "tcp", "example.com:564"},
+		{"tcp!::1!564", "tcp", "[::1]:564"},
+		{"unix!/tmp/ns.glenda/acme", "unix", "/tmp/ns.glenda/acme"},
+	} {
+		network, addr, err := ParseDialString(tt.dial)
+		if assert.NoError(t, err, tt.dial) {
+			assert.Equal(t, tt.network, network, tt.dial)
+			assert.Equal(t, tt.addr, addr, tt.dial)
+		}
+	}
+	for _, dial := range []string{"example.com", "tcp!", "il!example.com!564", "unix!/tmp/sock!564", "tcp!a!b!c"} {
+		_, _, err := ParseDialString(dial)
+		assert.Error(t, err, dial)
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	assert := assert.New(t)
+
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0400), []byte(helloText)))
+
+	dir, err := ioutil.TempDir("", "dial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go9p.ServeReadWriter(conn, conn, testFS.Server())
+	}()
+
+	// The network given is ignored in favor of the dial string's.
+	c, err := Dial("tcp", "unix!"+sock, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	data, err := c.ReadAll("/hello")
+	assert.NoError(err)
+	assert.Equal(helloText, string(data))
+}
+
+// closeCounter is a StaticFile that counts its Closes.
+type closeCounter struct {
+	*fs.StaticFile
+	closes int32
+}
+
+func (f *closeCounter) Close(fid uint64) error {
+	atomic.AddInt32(&f.closes, 1)
+	return nil
+}
+
+func TestServerShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	hello := &closeCounter{StaticFile: fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0400), []byte(helloText))}
+	root.AddChild(hello)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &go9p.Server{Srv: testFS.Server()}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	c, err := Dial("tcp", l.Addr().String(), "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	f, err := c.Open("/hello", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(srv.Shutdown(ctx))
+	// By the time Shutdown returns, the open file has been closed.
+	assert.Equal(int32(1), atomic.LoadInt32(&hello.closes))
+	assert.Equal(go9p.ErrServerClosed, <-served)
+
+	_, err = f.Read(make([]byte, 10))
+	assert.Error(err)
+	_, err = Dial("tcp", l.Addr().String(), "glenda", "")
+	assert.Error(err)
+	assert.Equal(go9p.ErrServerClosed, srv.Serve(l))
+}
+
+func TestServerTLSAuth(t *testing.T) {
+	assert := assert.New(t)
+	cert, pool := selfSigned(t)
+
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0400), []byte(helloText)))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := go9p.NewServer(testFS.Server(),
+		go9p.WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		go9p.WithAuthenticator(fs.SecretAuth("sesame")))
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+	addr := l.Addr().String()
+	config := &tls.Config{RootCAs: pool}
+
+	// Plain 9P isn't understood, and TLS alone doesn't get past auth.
+	_, err = Dial("tcp", addr, "glenda", "", WithTimeout(time.Second))
+	assert.Error(err)
+	_, err = DialTLS(addr, config, "glenda", "")
+	assert.Error(err)
+	_, err = DialTLS(addr, config, "glenda", "", WithAuth(SecretAuth("open says me")))
+	assert.Error(err)
+
+	c, err := DialTLS(addr, config, "glenda", "", WithAuth(SecretAuth("sesame")))
+	if !assert.NoError(err) {
+		return
+	}
+	data, err := c.ReadAll("/hello")
+	assert.NoError(err)
+	assert.Equal(helloText, string(data))
+
+	// Srvs without auth support are refused.
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := go9p.NewServer(struct{ go9p.Srv }{testFS.Server()}, go9p.WithAuthenticator(fs.SecretAuth("sesame")))
+	assert.Error(plain.Serve(l))
+}
+
+func TestServerConnections(t *testing.T) {
+	assert := assert.New(t)
+
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0444), []byte(helloText)))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := go9p.NewServer(testFS.Server())
+	go srv.Serve(l)
+	defer srv.Shutdown(context.Background())
+	assert.Empty(srv.Connections())
+
+	c, err := Dial("tcp", l.Addr().String(), "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	f, err := c.Open("/hello", proto.Oread)
+	if !assert.NoError(err) {
+		return
+	}
+
+	conns := srv.Connections()
+	if !assert.Len(conns, 1) {
+		return
+	}
+	info := conns[0]
+	assert.Equal(c.c.(net.Conn).LocalAddr().String(), info.RemoteAddr)
+	assert.Equal("glenda", info.User)
+	assert.Contains(info.Fids, go9p.FidInfo{Fid: f.fid, Path: "/hello", Mode: proto.Oread, User: "glenda"})
+	var paths []string
+	for _, fi := range info.Fids {
+		paths = append(paths, fi.Path)
+	}
+	assert.Contains(paths, "/")
+
+	// Once the client hangs up, the connection goes away.
+	c.Close()
+	for i := 0; i < 50 && len(srv.Connections()) > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Empty(srv.Connections())
+}
+
+func TestPipe(t *testing.T) {
+	assert := assert.New(t)
+
+	testFS, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(testFS.NewStat("hello", "glenda", "glenda", 0444), []byte(helloText)))
+	for i := 0; i < 20; i++ {
+		root.AddChild(fs.NewStaticFile(testFS.NewStat(fmt.Sprintf("f%d", i), "glenda", "glenda", 0666), nil))
+	}
+
+	cconn, sconn := go9p.NewPipe()
+	srv := go9p.NewServer(testFS.Server())
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeConn(sconn) }()
+
+	c, err := NewClient(cconn, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(srv.Connections(), 1)
+
+	// Requests and replies cross in both directions at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				bs, err := c.ReadAll("/hello")
+				assert.NoError(err)
+				assert.Equal(helloText, string(bs))
+				data := []byte(fmt.Sprintf("%s %d", name, j))
+				assert.NoError(c.WriteAll(name, data))
+				bs, err = c.ReadAll(name)
+				assert.NoError(err)
+				assert.Equal(data, bs)
+			}
+		}(fmt.Sprintf("/f%d", i))
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(srv.Shutdown(ctx))
+	assert.NoError(<-served)
+	assert.Empty(srv.Connections())
+}
@@ -0,0 +1,37 @@
+package client_test
+
+import (
+	"fmt"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/fs"
+)
+
+// Example_pipe serves a file system and reads from it in the same
+// process, over the two ends of a go9p.NewPipe.
+func Example_pipe() {
+	helloFS, root := fs.NewFS("glenda", "glenda", 0555)
+	root.AddChild(fs.NewStaticFile(
+		helloFS.NewStat("hello", "glenda", "glenda", 0444),
+		[]byte("Hello, World!\n"),
+	))
+
+	cconn, sconn := go9p.NewPipe()
+	srv := go9p.NewServer(helloFS.Server())
+	go srv.ServeConn(sconn)
+
+	c, err := client.NewClient(cconn, "glenda", "")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer c.Close()
+	bs, err := c.ReadAll("/hello")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Print(string(bs))
+	// Output: Hello, World!
+}
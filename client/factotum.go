@@ -0,0 +1,133 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/Plan9-Archive/libauth"
+)
+
+// factotumMax is the largest message exchanged with factotum's rpc file.
+const factotumMax = 4096
+
+// ErrNoFactotum is returned by FactotumAuth when factotum's rpc file cannot
+// be opened, usually because no factotum is running.
+var ErrNoFactotum = errors.New("client: factotum not available")
+
+// FactotumAuth is an authentication function for use with WithAuth that lets
+// the local factotum agent authenticate user, as Plan 9 clients do. It opens
+// factotum's rpc file (/mnt/factotum/rpc on Plan 9, or the factotum service
+// in the plan9port namespace elsewhere) and runs a p9any conversation,
+// passing bytes between factotum and the server's auth fid. No keys are
+// handled by this process.
+//
+// If factotum cannot be reached, the returned error wraps ErrNoFactotum.
+func FactotumAuth(user string, s io.ReadWriter) (string, error) {
+	rpc, err := libauth.OpenRPC()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNoFactotum, err)
+	}
+	defer rpc.Close()
+	return factotumProxy(s, rpc, fmt.Sprintf("proto=p9any role=client user=%s", user))
+}
+
+// factotumCall sends verb and arg to factotum and returns the status and
+// argument of its reply.
+func factotumCall(rpc io.ReadWriter, verb string, arg []byte) (string, []byte, error) {
+	msg := []byte(verb)
+	if len(arg) > 0 {
+		msg = append(append(msg, ' '), arg...)
+	}
+	if len(msg) > factotumMax {
+		return "", nil, errors.New("factotum: rpc too big")
+	}
+	if _, err := rpc.Write(msg); err != nil {
+		return "", nil, fmt.Errorf("factotum: %v", err)
+	}
+	buf := make([]byte, factotumMax)
+	n, err := rpc.Read(buf)
+	if err != nil {
+		return "", nil, fmt.Errorf("factotum: %v", err)
+	}
+	buf = buf[:n]
+	if i := bytes.IndexByte(buf, ' '); i >= 0 {
+		return string(buf[:i]), buf[i+1:], nil
+	}
+	return string(buf), nil, nil
+}
+
+// factotumProxy runs the conversation described by params, relaying
+// messages between factotum's rpc file and the server's auth stream s. It
+// returns the client user factotum authenticated as.
+func factotumProxy(s io.ReadWriter, rpc io.ReadWriter, params string) (string, error) {
+	status, arg, err := factotumCall(rpc, "start", []byte(params))
+	if err != nil {
+		return "", err
+	}
+	if status != "ok" {
+		return "", fmt.Errorf("factotum: start: %s %s", status, arg)
+	}
+	for {
+		status, arg, err = factotumCall(rpc, "read", nil)
+		if err != nil {
+			return "", err
+		}
+		switch status {
+		case "done":
+			return factotumUser(rpc)
+		case "ok":
+			// factotum has a message for the server.
+			if _, err := s.Write(arg); err != nil {
+				return "", err
+			}
+		case "phase":
+			// factotum is waiting for a message from the server.
+			// It asks for more with toosmall until it has enough.
+			buf := make([]byte, factotumMax)
+			n := 0
+			for {
+				status, arg, err = factotumCall(rpc, "write", buf[:n])
+				if err != nil {
+					return "", err
+				}
+				if status != "toosmall" {
+					break
+				}
+				need, err := strconv.Atoi(string(arg))
+				if err != nil || need > factotumMax || need <= n {
+					return "", fmt.Errorf("factotum: bad toosmall %q", arg)
+				}
+				m, err := io.ReadAtLeast(s, buf[n:need], 1)
+				if err != nil {
+					return "", err
+				}
+				n += m
+			}
+			if status != "ok" {
+				return "", fmt.Errorf("factotum: write: %s %s", status, arg)
+			}
+		default:
+			return "", fmt.Errorf("factotum: %s %s", status, arg)
+		}
+	}
+}
+
+// factotumUser fetches the result of a finished conversation and returns
+// the client user it names.
+func factotumUser(rpc io.ReadWriter) (string, error) {
+	status, arg, err := factotumCall(rpc, "authinfo", nil)
+	if err != nil {
+		return "", err
+	}
+	if status != "ok" || len(arg) < 2 {
+		return "", fmt.Errorf("factotum: authinfo: %s %s", status, arg)
+	}
+	n := int(arg[0]) | int(arg[1])<<8
+	if len(arg) < 2+n {
+		return "", errors.New("factotum: bad authinfo")
+	}
+	return string(arg[2 : 2+n]), nil
+}
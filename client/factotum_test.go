@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFactotum answers rpc requests from a script. Each write must start
+// with the next expected request, and the following read returns its reply.
+type fakeFactotum struct {
+	t      *testing.T
+	script [][2]string
+	reply  string
+}
+
+func (f *fakeFactotum) Write(p []byte) (int, error) {
+	if len(f.script) == 0 {
+		f.t.Fatalf("unexpected rpc %q", p)
+	}
+	if !strings.HasPrefix(string(p), f.script[0][0]) {
+		f.t.Fatalf("rpc %q, want %q", p, f.script[0][0])
+	}
+	f.reply = f.script[0][1]
+	f.script = f.script[1:]
+	return len(p), nil
+}
+
+func (f *fakeFactotum) Read(p []byte) (int, error) {
+	return copy(p, f.reply), nil
+}
+
+// authStream is the server's end of an auth fid.
+type authStream struct {
+	bytes.Buffer
+	sent []string
+}
+
+func (s *authStream) Write(p []byte) (int, error) {
+	s.sent = append(s.sent, string(p))
+	return len(p), nil
+}
+
+func TestFactotumProxy(t *testing.T) {
+	assert := assert.New(t)
+	rpc := &fakeFactotum{t: t, script: [][2]string{
+		{"start proto=p9any role=client user=glenda", "ok"},
+		{"read", "ok hello"},
+		{"read", "phase"},
+		{"write", "toosmall 5"},
+		{"write world", "ok"},
+		{"read", "done"},
+		{"authinfo", "ok \x06\x00glenda\x00\x00\x00\x00\x00\x00"},
+	}}
+	s := &authStream{}
+	s.WriteString("world")
+	user, err := factotumProxy(s, rpc, "proto=p9any role=client user=glenda")
+	assert.NoError(err)
+	assert.Equal("glenda", user)
+	assert.Equal([]string{"hello"}, s.sent)
+	assert.Empty(rpc.script)
+
+	rpc = &fakeFactotum{t: t, script: [][2]string{
+		{"start", "ok"},
+		{"read", "needkey proto=p9sk1 dom=example.com"},
+	}}
+	_, err = factotumProxy(&authStream{}, rpc, "proto=p9any role=client")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "needkey")
+	}
+}
+
+func TestFactotumAuthMissing(t *testing.T) {
+	// Point plan9port at an empty namespace, where there is no factotum.
+	ns, err := ioutil.TempDir("", "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(ns)
+	old, set := os.LookupEnv("NAMESPACE")
+	os.Setenv("NAMESPACE", ns)
+	defer func() {
+		if set {
+			os.Setenv("NAMESPACE", old)
+		} else {
+			os.Unsetenv("NAMESPACE")
+		}
+	}()
+
+	_, err = FactotumAuth("glenda", &authStream{})
+	assert.True(t, errors.Is(err, ErrNoFactotum), "%v", err)
+}
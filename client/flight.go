@@ -0,0 +1,43 @@
+package client
+
+import "sync"
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// flightGroup coalesces concurrent calls with the same key, so that only
+// one of them does the work and all of them receive its result.
+type flightGroup struct {
+	calls map[string]*flightCall
+	sync.Mutex
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// do calls fn, unless a call for key is already in flight, in which case it
+// waits for that call and returns its result. shared reports whether the
+// result came from another caller's fn.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	g.Lock()
+	if fc, ok := g.calls[key]; ok {
+		g.Unlock()
+		<-fc.done
+		return fc.val, fc.err, true
+	}
+	fc := &flightCall{done: make(chan struct{})}
+	g.calls[key] = fc
+	g.Unlock()
+
+	fc.val, fc.err = fn()
+
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+	close(fc.done)
+	return fc.val, fc.err, false
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+)
+
+const secretNonceLen = 32
+
+// SecretAuth returns an authentication function for use with WithAuth that
+// proves knowledge of secret to a server using fs.SecretAuth. It answers the
+// server's challenge with an HMAC of the challenge and user, then waits for
+// the server to finish so that the attach which follows is accepted.
+func SecretAuth(secret string) func(string, io.ReadWriter) (string, error) {
+	return func(user string, s io.ReadWriter) (string, error) {
+		nonce := make([]byte, secretNonceLen)
+		if _, err := io.ReadFull(s, nonce); err != nil {
+			return "", err
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(nonce)
+		mac.Write([]byte(user))
+		if _, err := s.Write(append(mac.Sum(nil), user...)); err != nil {
+			return "", err
+		}
+		// The server ends the auth stream once it has checked the reply.
+		if _, err := io.Copy(ioutil.Discard, s); err != nil {
+			return "", err
+		}
+		return user, nil
+	}
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"container/list"
+	"strings"
+
+	"github.com/knusbaum/go9p/proto"
+)
+
+// A cachedFid is a fid the client keeps walked to a path, so that calls on
+// the path need not walk to it again. Stat, WStat and Clone use it
+// directly, and with WithWalkCache, walks to the path or below it start
+// from it.
+type cachedFid struct {
+	fid     uint32
+	qid     proto.Qid     // as last seen, or zero if not yet known.
+	users   int           // calls using fid.
+	dropped bool          // no longer in the cache; clunked once unused.
+	elem    *list.Element // in pathLRU, WithWalkCache.
+}
+
+// WithWalkCache bounds the fids the client keeps walked to paths to size,
+// clunking the least recently used when it is full, and makes walks use
+// them: Open, Walk, Create and Remove walk from the cached fid of the path,
+// or of its nearest cached parent, rather than from the root. Paths are
+// cached by Stat, WStat and Clone. Without WithWalkCache, the client caches
+// the paths those calls use without bound, but only for those calls.
+//
+// Cached fids are forgotten when their path, or a parent of it, is removed
+// or renamed through the client, and a directory's children are forgotten
+// when Stat finds its Qid.Vers has changed, as the files behind them may
+// have been replaced.
+func WithWalkCache(size int) Option {
+	return func(c *Config) {
+		c.walkCache = size
+	}
+}
+
+// cacheKey returns the key path is cached under.
+func cacheKey(path string) string {
+	return "/" + strings.Join(removeBlank(strings.Split(path, "/")), "/")
+}
+
+// acquireCached returns the cached fid for path, or nil, and marks it used
+// until releaseCached is called.
+func (c *Client) acquireCached(path string) *cachedFid {
+	c.pathCacheLock.Lock()
+	defer c.pathCacheLock.Unlock()
+	e, ok := c.pathCache[cacheKey(path)]
+	if !ok {
+		return nil
+	}
+	e.users++
+	if e.elem != nil {
+		c.pathLRU.MoveToFront(e.elem)
+	}
+	return e
+}
+
+// releaseCached ends a use of e started by acquireCached or cacheFid.
+func (c *Client) releaseCached(e *cachedFid) {
+	c.pathCacheLock.Lock()
+	e.users--
+	clunk := e.dropped && e.users == 0
+	c.pathCacheLock.Unlock()
+	if clunk {
+		c.clunkFid(e.fid)
+	}
+}
+
+// cacheFid returns the cached fid for path, walking to it if there is
+// none, and marks it used until releaseCached is called.
+func (c *Client) cacheFid(path string) (*cachedFid, error) {
+	for {
+		if e := c.acquireCached(path); e != nil {
+			return e, nil
+		}
+		if c.flights == nil {
+			return c.walkAndCache(path)
+		}
+		// Callers sharing the leader's walk take the fid from the cache
+		// once it is there.
+		var walked *cachedFid
+		_, err, _ := c.flights.do("walk\x00"+cacheKey(path), func() (interface{}, error) {
+			var err error
+			walked, err = c.walkAndCache(path)
+			return nil, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if walked != nil {
+			return walked, nil
+		}
+	}
+}
+
+// walkAndCache walks a new fid to path and adds it to the cache, returning
+// it marked used.
+func (c *Client) walkAndCache(path string) (*cachedFid, error) {
+	if e := c.acquireCached(path); e != nil {
+		return e, nil
+	}
+	fid, qid, err := c.walkNames(c.rootFid, removeBlank(strings.Split(path, "/")))
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(path)
+	c.pathCacheLock.Lock()
+	if e, ok := c.pathCache[key]; ok {
+		// Walked to concurrently.
+		e.users++
+		c.pathCacheLock.Unlock()
+		c.clunkFid(fid)
+		return e, nil
+	}
+	e := &cachedFid{fid: fid, qid: qid, users: 1}
+	c.pathCache[key] = e
+	var victims []uint32
+	if c.conf.walkCache > 0 {
+		e.elem = c.pathLRU.PushFront(key)
+		for c.pathLRU.Len() > c.conf.walkCache {
+			victim := c.pathLRU.Back().Value.(string)
+			if fid, ok := c.uncache(victim); ok {
+				victims = append(victims, fid)
+			}
+		}
+	}
+	c.pathCacheLock.Unlock()
+	c.clunkFids(victims)
+	return e, nil
+}
+
+// walkStart returns the fid a walk to path should start from, and the
+// names left to walk from it. WithWalkCache, that is the cached fid of
+// path or its nearest cached parent, which done releases once the walk has
+// been answered. Otherwise it is the root.
+func (c *Client) walkStart(path string) (from uint32, names []string, done func()) {
+	names = removeBlank(strings.Split(path, "/"))
+	if c.conf.walkCache > 0 {
+		for n := len(names); n >= 0; n-- {
+			if e := c.acquireCached("/" + strings.Join(names[:n], "/")); e != nil {
+				return e.fid, names[n:], func() { c.releaseCached(e) }
+			}
+		}
+	}
+	return c.rootFid, names, func() {}
+}
+
+// noteQid records qid, seen in a stat of path through e. If path is a
+// directory whose version has changed, its cached children are forgotten.
+func (c *Client) noteQid(path string, e *cachedFid, qid proto.Qid) {
+	key := cacheKey(path)
+	c.pathCacheLock.Lock()
+	var victims []uint32
+	if e.qid != (proto.Qid{}) && qid.Qtype&proto.QTDIR != 0 && qid.Vers != e.qid.Vers {
+		victims = c.uncacheUnder(key)
+	}
+	e.qid = qid
+	c.pathCacheLock.Unlock()
+	c.clunkFids(victims)
+}
+
+// dropCached forgets the cached fids of path and of everything below it,
+// after path was removed or renamed.
+func (c *Client) dropCached(path string) {
+	key := cacheKey(path)
+	c.pathCacheLock.Lock()
+	victims := c.uncacheUnder(key)
+	if fid, ok := c.uncache(key); ok {
+		victims = append(victims, fid)
+	}
+	c.pathCacheLock.Unlock()
+	c.clunkFids(victims)
+}
+
+// uncacheUnder removes the paths below key from the cache, returning the
+// fids to clunk. c.pathCacheLock must be held.
+func (c *Client) uncacheUnder(key string) []uint32 {
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	var victims []uint32
+	for p := range c.pathCache {
+		if strings.HasPrefix(p, prefix) {
+			if fid, ok := c.uncache(p); ok {
+				victims = append(victims, fid)
+			}
+		}
+	}
+	return victims
+}
+
+// uncache removes key from the cache. If its fid is not in use, it is
+// returned to be clunked; otherwise the last user clunks it.
+// c.pathCacheLock must be held.
+func (c *Client) uncache(key string) (uint32, bool) {
+	e, ok := c.pathCache[key]
+	if !ok {
+		return 0, false
+	}
+	delete(c.pathCache, key)
+	if e.elem != nil {
+		c.pathLRU.Remove(e.elem)
+		e.elem = nil
+	}
+	e.dropped = true
+	return e.fid, e.users == 0
+}
@@ -11,8 +11,6 @@ import (
 	"github.com/knusbaum/go9p/fs/real"
 )
 
-var exportFS fs.FS
-
 func main() {
 	directory := flag.String("dir", ".", "The directory that will be exported")
 	address := flag.String("address", "localhost:9000", "The address on which to listed for incoming 9p connections")
@@ -37,12 +35,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	exportFS.Root = &real.Dir{Path: dir}
-	fs.WithCreateFile(real.CreateFile)(&exportFS)
-	fs.WithCreateDir(real.CreateDir)(&exportFS)
-	fs.WithRemoveFile(real.Remove)(&exportFS)
+	var opts []fs.Option
 	if *noperm {
-		fs.IgnorePermissions()(&exportFS)
+		opts = append(opts, fs.IgnorePermissions())
+	}
+	exportFS, err := real.NewOSFS(dir, opts...)
+	if err != nil {
+		log.Fatal(err)
 	}
 	if *stdio {
 		if *verbose {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// Devices are DMDEVICE files whose contents are their 9P2000.u extension,
+// such as "c 1 3", the way a DMSYMLINK file's contents are its target.
+// FUSE passes device numbers in the kernel's encoding, which mkdev,
+// devMajor and devMinor convert to and from.
+
+func mkdev(major, minor uint32) uint32 {
+	return (major&0xfff)<<8 | minor&0xff | (minor&0xfff00)<<12
+}
+
+func devMajor(dev uint32) uint32 {
+	return (dev >> 8) & 0xfff
+}
+
+func devMinor(dev uint32) uint32 {
+	return dev&0xff | (dev>>12)&0xfff00
+}
+
+// fileType returns the S_IF* type of the file at p with stat st, and its
+// device number if it is a device. Block and character devices can only
+// be told apart by their contents, so those are read. Regular files have
+// a type of 0, which go-fuse takes to mean S_IFREG.
+func fileType(c *client.Client, p string, st *proto.Stat) (mode, rdev uint32) {
+	switch {
+	case st.Mode&proto.DMDIR != 0:
+		return fuse.S_IFDIR, 0
+	case st.Mode&proto.DMSYMLINK != 0:
+		return fuse.S_IFLNK, 0
+	case st.Mode&proto.DMNAMEDPIPE != 0:
+		return syscall.S_IFIFO, 0
+	case st.Mode&proto.DMSOCKET != 0:
+		return syscall.S_IFSOCK, 0
+	case st.Mode&proto.DMDEVICE != 0:
+		ext, err := c.ReadAll(p)
+		if err != nil {
+			return 0, 0
+		}
+		kind, major, minor, err := proto.ParseDeviceExtension(string(ext))
+		if err != nil {
+			return 0, 0
+		}
+		if kind == 'b' {
+			return syscall.S_IFBLK, mkdev(major, minor)
+		}
+		return syscall.S_IFCHR, mkdev(major, minor)
+	}
+	return 0, 0
+}
+
+var _ = (fs.NodeMknoder)((*Dir)(nil))
+
+// Mknod creates a device, named pipe, socket or empty regular file.
+func (r *Dir) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if ReadOnly {
+		return nil, syscall.EROFS
+	}
+	perm := mode & 0777
+	var ext string
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		perm |= proto.DMDEVICE
+		ext = proto.DeviceExtension('c', devMajor(dev), devMinor(dev))
+	case syscall.S_IFBLK:
+		perm |= proto.DMDEVICE
+		ext = proto.DeviceExtension('b', devMajor(dev), devMinor(dev))
+	case syscall.S_IFIFO:
+		perm |= proto.DMNAMEDPIPE
+	case syscall.S_IFSOCK:
+		perm |= proto.DMSOCKET
+	case syscall.S_IFREG, 0:
+	default:
+		return nil, syscall.EINVAL
+	}
+	fullPath := path.Join(r.path, name)
+	file, err := r.client.Create(fullPath, os.FileMode(perm))
+	if err != nil {
+		return nil, toErrno(err, syscall.EINVAL)
+	}
+	if ext != "" {
+		_, err = file.WriteAt([]byte(ext), 0)
+	}
+	file.Close()
+	if err != nil {
+		r.client.Remove(fullPath)
+		return nil, toErrno(err, syscall.EIO)
+	}
+	r.invalidate()
+	out.Mode = mode
+	out.Rdev = dev
+	node := &FileNode{client: r.client, path: fullPath, rdev: dev}
+	return r.NewInode(ctx, node, fs.StableAttr{Mode: mode & syscall.S_IFMT, Ino: qidIno(file.Qid())}), 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// dirCacheMax is the number of entries up to which a directory's listing
+// is kept in the Dir's dirCache. Larger directories are read from the
+// server again each time they are listed, and keep up to dirCacheMax of
+// the entries last listed or looked up in an entryCache instead.
+const dirCacheMax = 4096
+
+// dirReadSize is the size of the reads a dirStream asks for. The client
+// trims it to what the connection allows.
+const dirReadSize = 65536
+
+// dirStream lists a directory by reading it from the server a chunk at a
+// time, passing entries on as they arrive rather than once the whole
+// directory has been read.
+type dirStream struct {
+	dir     *Dir
+	file    *client.File
+	buf     []byte
+	pending []proto.Stat // decoded but not yet returned
+	listed  []proto.Stat // everything returned, kept for dirCache
+	uncache bool         // listed outgrew dirCacheMax, entries are cached instead
+	done    bool
+	errno   syscall.Errno
+}
+
+func newDirStream(r *Dir) (*dirStream, syscall.Errno) {
+	file, err := r.client.Open(r.path, proto.Oread)
+	if err != nil {
+		return nil, toErrno(err, syscall.EPIPE)
+	}
+	return &dirStream{dir: r, file: file, buf: make([]byte, dirReadSize)}, 0
+}
+
+// fill reads the next chunk of the directory.
+func (s *dirStream) fill() {
+	n, err := s.file.Read(s.buf)
+	if err == io.EOF || (err == nil && n == 0) {
+		s.finish()
+		return
+	}
+	if err != nil {
+		s.done = true
+		s.errno = toErrno(err, syscall.EIO)
+		return
+	}
+	stats, err := proto.ParseStats(s.buf[:n])
+	if err != nil {
+		s.done = true
+		s.errno = syscall.EIO
+		return
+	}
+	for _, st := range stats {
+		if st.Name == "." || st.Name == ".." {
+			continue
+		}
+		s.pending = append(s.pending, st)
+	}
+}
+
+// finish is called once the whole directory has been read, and caches it
+// if it was small enough. The entries of larger directories were cached as
+// they were returned.
+func (s *dirStream) finish() {
+	s.done = true
+	if s.uncache {
+		return
+	}
+	sort.Slice(s.listed, func(i, j int) bool { return s.listed[i].Name < s.listed[j].Name })
+	s.dir.setListing(s.listed)
+}
+
+func (s *dirStream) HasNext() bool {
+	for len(s.pending) == 0 && !s.done {
+		s.fill()
+	}
+	return len(s.pending) > 0 || s.errno != 0
+}
+
+func (s *dirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if len(s.pending) == 0 {
+		errno := s.errno
+		s.errno = 0
+		return fuse.DirEntry{}, errno
+	}
+	st := s.pending[0]
+	s.pending = s.pending[1:]
+	if !s.uncache {
+		if len(s.listed) < dirCacheMax {
+			s.listed = append(s.listed, st)
+		} else {
+			s.uncache = true
+			s.dir.cacheEntries(s.listed...)
+			s.listed = nil
+		}
+	}
+	if s.uncache {
+		s.dir.cacheEntries(st)
+	}
+	return statDirEntry(st), 0
+}
+
+func (s *dirStream) Close() {
+	s.file.Close()
+}
+
+// statDirEntry returns the directory entry describing st.
+func statDirEntry(st proto.Stat) fuse.DirEntry {
+	var mode uint32 = 0
+	if st.Mode&proto.DMDIR > 0 {
+		mode = fuse.S_IFDIR
+	} else if st.Mode&proto.DMSYMLINK != 0 {
+		mode = fuse.S_IFLNK
+	} else if st.Mode&proto.DMNAMEDPIPE != 0 {
+		mode = syscall.S_IFIFO
+	} else if st.Mode&proto.DMSOCKET != 0 {
+		mode = syscall.S_IFSOCK
+	}
+	return fuse.DirEntry{Name: st.Name, Mode: mode}
+}
+
+var _ = (fs.DirStream)((*dirStream)(nil))
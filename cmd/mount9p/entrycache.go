@@ -0,0 +1,59 @@
+package main
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/knusbaum/go9p/proto"
+)
+
+// An entryCache holds the stats of the entries of a directory too large
+// to cache whole, up to dirCacheMax of them, dropping the least recently
+// used when it is full. It is guarded by its Dir's mu.
+type entryCache struct {
+	entries map[string]*cachedEntry
+	lru     *list.List // of names, most recently used first.
+}
+
+type cachedEntry struct {
+	stat proto.Stat
+	ttl  time.Time
+	elem *list.Element // in lru.
+}
+
+func newEntryCache() *entryCache {
+	return &entryCache{entries: make(map[string]*cachedEntry), lru: list.New()}
+}
+
+// get returns the stat of the entry name, if it is cached and fresh.
+func (c *entryCache) get(name string) (proto.Stat, bool) {
+	e, ok := c.entries[name]
+	if !ok || time.Now().After(e.ttl) {
+		return proto.Stat{}, false
+	}
+	c.lru.MoveToFront(e.elem)
+	return e.stat, true
+}
+
+// put caches st for DefaultTTL.
+func (c *entryCache) put(st proto.Stat) {
+	if e, ok := c.entries[st.Name]; ok {
+		e.stat = st
+		e.ttl = time.Now().Add(DefaultTTL)
+		c.lru.MoveToFront(e.elem)
+		return
+	}
+	c.entries[st.Name] = &cachedEntry{stat: st, ttl: time.Now().Add(DefaultTTL), elem: c.lru.PushFront(st.Name)}
+	for c.lru.Len() > dirCacheMax {
+		victim := c.lru.Remove(c.lru.Back()).(string)
+		delete(c.entries, victim)
+	}
+}
+
+// remove drops the entry name, if it is cached.
+func (c *entryCache) remove(name string) {
+	if e, ok := c.entries[name]; ok {
+		c.lru.Remove(e.elem)
+		delete(c.entries, name)
+	}
+}
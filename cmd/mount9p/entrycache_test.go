@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntryCacheEvicts(t *testing.T) {
+	assert := assert.New(t)
+	c := newEntryCache()
+	for i := 0; i < dirCacheMax+10; i++ {
+		c.put(proto.Stat{Name: fmt.Sprintf("f%d", i)})
+		if i == dirCacheMax-1 {
+			// Used, so kept over older entries.
+			_, ok := c.get("f0")
+			assert.True(ok)
+		}
+	}
+	assert.Equal(dirCacheMax, c.lru.Len())
+	assert.Len(c.entries, dirCacheMax)
+	_, ok := c.get("f0")
+	assert.True(ok)
+	_, ok = c.get("f1")
+	assert.False(ok)
+	_, ok = c.get(fmt.Sprintf("f%d", dirCacheMax+9))
+	assert.True(ok)
+
+	c.remove("f0")
+	_, ok = c.get("f0")
+	assert.False(ok)
+}
+
+func TestLargeDirEntries(t *testing.T) {
+	assert := assert.New(t)
+	bigFS, root := fs.NewFS("glenda", "glenda", 0777)
+	for i := 0; i < dirCacheMax+10; i++ {
+		root.AddChild(fs.NewStaticFile(bigFS.NewStat(fmt.Sprintf("f%d", i), "glenda", "glenda", 0666), nil))
+	}
+
+	cc, sc := go9p.NewPipe()
+	srv := &go9p.Server{Srv: bigFS.Server()}
+	go srv.ServeConn(sc)
+	c, err := client.NewClient(cc, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	d := &Dir{client: c, path: "/"}
+	st, errno := d.entry("f7")
+	assert.Equal(syscall.Errno(0), errno)
+	assert.Equal("f7", st.Name)
+
+	// The listing is too large to keep, but the entry is cached.
+	stats, _ := d.listing()
+	assert.Nil(stats)
+	if assert.NotNil(d.entries) {
+		_, ok := d.entries.get("f7")
+		assert.True(ok)
+	}
+
+	// Other entries are statted alone, and missing ones aren't found.
+	st, errno = d.entry("f4000")
+	assert.Equal(syscall.Errno(0), errno)
+	assert.Equal("f4000", st.Name)
+	_, ok := d.entries.get("f4000")
+	assert.True(ok)
+	_, errno = d.entry("nothing")
+	assert.Equal(syscall.ENOENT, errno)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/knusbaum/go9p/client"
+)
+
+// errnoMessages maps fragments of the messages servers send in Rerror to
+// the errno they most likely mean. 9P2000 errors are only text, so the list
+// covers the wording of Plan 9's file servers, of go9p's fs package, and
+// of the strerror text Unix servers such as u9fs pass along. Earlier
+// entries win, so more specific fragments come first.
+var errnoMessages = []struct {
+	msg   string
+	errno syscall.Errno
+}{
+	{"permission denied", syscall.EACCES},
+	{"not authenticated", syscall.EACCES},
+	{"authentication failed", syscall.EACCES},
+	{"not a directory", syscall.ENOTDIR},
+	{"is a file", syscall.ENOTDIR},
+	{"is a directory", syscall.EISDIR},
+	{"write to directory", syscall.EISDIR},
+	{"directory not empty", syscall.ENOTEMPTY},
+	{"does not exist", syscall.ENOENT},
+	{"no such", syscall.ENOENT},
+	{"not found", syscall.ENOENT},
+	{"exists", syscall.EEXIST},
+	{"read-only", syscall.EROFS},
+	{"read only", syscall.EROFS},
+	{"in use", syscall.EBUSY},
+	{"name too long", syscall.ENAMETOOLONG},
+	{"no space", syscall.ENOSPC},
+	{"file system full", syscall.ENOSPC},
+	{"bad fid", syscall.EBADF},
+	{"not supported", syscall.ENOTSUP},
+	{"does not support", syscall.ENOTSUP},
+	{"cannot", syscall.EPERM},
+	{"interrupted", syscall.EINTR},
+	{"invalid", syscall.EINVAL},
+}
+
+// toErrno returns the errno describing err, an error returned by the
+// client. Errors that already are an errno are returned as they are, as
+// are the errnos 9P2000.u servers send. Lost connections become EIO, and
+// other server messages are looked up in errnoMessages. If nothing
+// matches, def is returned.
+func toErrno(err error, def syscall.Errno) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	var serr *client.Error
+	if errors.As(err, &serr) && serr.Errno != 0 {
+		return syscall.Errno(serr.Errno)
+	}
+	switch {
+	case errors.Is(err, client.ErrDisconnected):
+		return syscall.EIO
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	case errors.Is(err, context.DeadlineExceeded):
+		return syscall.ETIMEDOUT
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range errnoMessages {
+		if strings.Contains(msg, m.msg) {
+			return m.errno
+		}
+	}
+	return def
+}
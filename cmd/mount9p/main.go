@@ -4,14 +4,14 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"hash/crc64"
 	"io"
 	"log"
 	"math"
-	"net"
 	"os"
 	"os/user"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -25,10 +25,85 @@ import (
 	fans "9fans.net/go/plan9/client"
 )
 
-var crc64Table = crc64.MakeTable(0xC96C5795D7870F42)
+// qidIno returns the inode number for the file with Qid q. The Qid path is
+// the server's unique identifier for the file, so unlike a hash of the
+// file's name, the inode survives renames. The Qid type is XORed into the
+// top byte, and the result is offset by 2 so the small paths servers
+// usually start from don't land on 0, which go-fuse takes to mean "pick
+// one", or 1, the root.
+//
+// Qids don't fit in an inode number, so this can collide. Paths that
+// differ only in their top byte collide when their types differ by the
+// same bits: path 1<<56|5 of type 0 and path 5 of type 1, say. Paths
+// 1<<64-2 and 1<<64-1 wrap around to 0 and 1. Servers counting paths up
+// from 0, as most do, never get there.
+func qidIno(q proto.Qid) uint64 {
+	return (q.Uid ^ uint64(q.Qtype)<<56) + 2
+}
 
 var DefaultTTL = 5 * time.Second
-var ncTTL = uint64(5)
+
+// ReadOnly makes every operation that would modify the server fail with
+// EROFS before anything is sent to it.
+var ReadOnly bool
+
+// TrackVers makes mount9p watch the Qid.Vers of the files it stats. When
+// the version changes, the file was modified on the server, so the cached
+// listings are dropped and the kernel is told to forget the file's pages
+// and attributes.
+var TrackVers bool
+
+// PageCache lets the kernel keep the pages of files it has read across
+// opens, rather than reading them from the server again on every open.
+// It relies on TrackVers, which it turns on, to drop the pages of files
+// whose Qid.Vers shows they changed on the server. Writes still go
+// straight to the server, updating the cached pages as they do.
+var PageCache bool
+
+// EmptyStreams makes mount9p treat empty files as streams too, as it used
+// to. Servers that don't mark their streams, such as Plan 9's devices,
+// need it; go9p's fs marks them DMAPPEND.
+var EmptyStreams bool
+
+// isStream reports whether the file described by st is a stream, whose
+// length and offsets mean nothing, rather than a seekable file. Streams
+// are read and written directly, bypassing the kernel's page cache, which
+// would otherwise believe their length. Servers mark them append-only or
+// exclusive-use; with EmptyStreams, any empty file is taken as one.
+func isStream(st *proto.Stat) bool {
+	if st.Mode&(proto.DMAPPEND|proto.DMEXCL) != 0 {
+		return true
+	}
+	return EmptyStreams && st.Length == 0
+}
+
+// versTracker remembers the last Qid.Vers seen for a node.
+type versTracker struct {
+	mu    sync.Mutex
+	vers  uint32
+	known bool
+}
+
+// changed records v and reports whether it differs from the version seen
+// before. The first version seen is not a change.
+func (t *versTracker) changed(v uint32) bool {
+	if !TrackVers {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.known && t.vers != v
+	t.vers = v
+	t.known = true
+	return c
+}
+
+// forget makes the next version seen the new baseline, not a change.
+func (t *versTracker) forget() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.known = false
+}
 
 var dirCacheLock sync.RWMutex
 var dirCache map[string]*Dir = make(map[string]*Dir)
@@ -50,11 +125,99 @@ type Dir struct {
 	client *client.Client
 	path   string
 
+	// mu guards the caches below, which the poller updates while the
+	// FUSE handlers use them.
+	mu        sync.Mutex
 	statCache *proto.Stat
 	statTTL   time.Time
 
 	dirCache []proto.Stat
 	dirTTL   time.Time
+	// entries replaces dirCache for directories of more than
+	// dirCacheMax entries.
+	entries *entryCache
+
+	vers versTracker
+}
+
+// invalidate makes the next use of r's cached stat, listing or entries go
+// to the server.
+func (r *Dir) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dirTTL = time.Time{}
+	r.statTTL = time.Time{}
+	if r.entries != nil {
+		r.entries = newEntryCache()
+	}
+}
+
+// addEntry adds st to r's listing, so that lookups find the entry until r
+// is listed again, and marks the caches stale.
+func (r *Dir) addEntry(st proto.Stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statTTL = time.Time{}
+	if r.entries != nil {
+		// Looked up afresh when asked for.
+		r.entries.remove(st.Name)
+		return
+	}
+	r.dirTTL = time.Time{}
+	r.dirCache = append(r.dirCache, st)
+}
+
+// cacheEntries caches sts as entries of r, which is too large for its
+// listing to be kept whole.
+func (r *Dir) cacheEntries(sts ...proto.Stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = newEntryCache()
+		r.dirCache = nil
+	}
+	for _, st := range sts {
+		r.entries.put(st)
+	}
+}
+
+// listing returns r's cached listing, nil if it has none, and whether it
+// is fresh.
+func (r *Dir) listing() ([]proto.Stat, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dirCache, r.dirCache != nil && !time.Now().After(r.dirTTL)
+}
+
+// setListing caches stats as r's listing and returns the listing it
+// replaced. Listings of more than dirCacheMax entries aren't kept; r
+// caches the entries it is asked about instead.
+func (r *Dir) setListing(stats []proto.Stat) []proto.Stat {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.dirCache
+	if len(stats) > dirCacheMax {
+		r.dirCache = nil
+		if r.entries == nil {
+			r.entries = newEntryCache()
+		}
+		return old
+	}
+	r.dirCache = stats
+	r.dirTTL = time.Now().Add(DefaultTTL)
+	r.entries = nil
+	return old
+}
+
+// checkVers drops what is cached about r if q shows it changed.
+func (r *Dir) checkVers(q proto.Qid) {
+	if !r.vers.changed(q.Vers) {
+		return
+	}
+	r.invalidate()
+	// Notifying from inside an operation on the same inode can deadlock
+	// the kernel, so it is done in the background.
+	go r.NotifyContent(0, 0)
 }
 
 type StatDir struct {
@@ -77,18 +240,62 @@ var _ = (fs.NodeUnlinker)((*Dir)(nil))
 var _ = (fs.NodeRmdirer)((*Dir)(nil))
 var _ = (fs.NodeRenamer)((*Dir)(nil))
 var _ = (fs.NodeSetattrer)((*Dir)(nil))
+var _ = (fs.NodeStatfser)((*Dir)(nil))
+var _ = (fs.NodeSymlinker)((*Dir)(nil))
+
+// Symlink creates a DMSYMLINK file holding target.
+func (r *Dir) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if ReadOnly {
+		return nil, syscall.EROFS
+	}
+	fullPath := path.Join(r.path, name)
+	file, err := r.client.Create(fullPath, os.FileMode(proto.DMSYMLINK|0777))
+	if err != nil {
+		return nil, toErrno(err, syscall.EINVAL)
+	}
+	_, err = file.WriteAt([]byte(target), 0)
+	file.Close()
+	if err != nil {
+		r.client.Remove(fullPath)
+		return nil, toErrno(err, syscall.EIO)
+	}
+	r.invalidate()
+	out.Mode = 0777
+	out.Size = uint64(len(target))
+	return r.NewInode(ctx, &FileNode{client: r.client, path: fullPath}, fs.StableAttr{Mode: fuse.S_IFLNK, Ino: qidIno(file.Qid())}), 0
+}
+
+// 9P has no way to ask a server about its capacity, so Statfs reports a
+// large, mostly free filesystem. Reporting zeros makes tools like df think
+// the disk is full.
+const (
+	statfsBlockSize = 4096
+	statfsBlocks    = 1 << 40 / statfsBlockSize // 1TiB
+	statfsFiles     = 1 << 20
+)
+
+func (r *Dir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	out.Bsize = statfsBlockSize
+	out.Frsize = statfsBlockSize
+	out.Blocks = statfsBlocks
+	out.Bfree = statfsBlocks
+	out.Bavail = statfsBlocks
+	out.Files = statfsFiles
+	out.Ffree = statfsFiles
+	out.NameLen = 255
+	return 0
+}
 
 func (r *Dir) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if ReadOnly {
+		return syscall.EROFS
+	}
 	//log.Printf("(*Dir).Rename(%s (%s -> %s) (flags: %#x))", r.path, name, newName, flags)
 	newD, ok := newParent.(*Dir)
 	if !ok {
 		//log.Printf("Cannot rename to non-directory parent.")
 		return syscall.EINVAL
 	}
-	if r != newD {
-		//log.Printf("Cannot move from one place to another. (%s -> %s)", r.path, newD.path)
-		return syscall.EINVAL
-	}
 	stat := proto.Stat{
 		Type:   math.MaxUint16,
 		Dev:    math.MaxUint32,
@@ -102,50 +309,69 @@ func (r *Dir) Rename(ctx context.Context, name string, newParent fs.InodeEmbedde
 		Gid:    "",
 		Muid:   "",
 	}
+	if r != newD {
+		// 9P can't move files between directories, but servers made
+		// with fs.WithCrossDirRename take a name containing a "/" as
+		// the path to move to. It is made relative, as the server's
+		// root may not be ours. Elsewhere, EXDEV makes mv copy instead.
+		up := ""
+		if r.path != "/" {
+			up = strings.Repeat("../", strings.Count(r.path, "/"))
+		}
+		stat.Name = "./" + up + strings.TrimPrefix(path.Join(newD.path, newName), "/")
+	}
 	err := r.client.WStat(path.Join(r.path, name), &stat)
+	if err != nil && r != newD {
+		return syscall.EXDEV
+	}
 	if err != nil {
 		log.Printf("WSTAT RETURNED ERROR: %s\n", err)
-		return syscall.ENOENT
+		return toErrno(err, syscall.ENOENT)
 	}
-	r.dirTTL = time.Time{}
-	r.statTTL = time.Time{}
+	r.invalidate()
+	newD.invalidate()
 	return 0
 }
 
 func (r *Dir) Unlink(ctx context.Context, name string) syscall.Errno {
+	if ReadOnly {
+		return syscall.EROFS
+	}
 	err := r.client.Remove(path.Join(r.path, name))
 	if err != nil {
 		//log.Printf("Unlink failed: %s\n", err)
-		return syscall.EINVAL
+		return toErrno(err, syscall.EINVAL)
 	}
-	r.dirTTL = time.Time{}
-	r.statTTL = time.Time{}
+	r.invalidate()
 	return 0
 }
 
 func (r *Dir) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if ReadOnly {
+		return syscall.EROFS
+	}
 	err := r.client.Remove(path.Join(r.path, name))
 	if err != nil {
 		//log.Printf("Unlink failed: %s\n", err)
-		return syscall.EINVAL
+		return toErrno(err, syscall.EINVAL)
 	}
-	r.dirTTL = time.Time{}
-	r.statTTL = time.Time{}
+	r.invalidate()
 	return 0
 }
 
 func (r *Dir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if ReadOnly {
+		return nil, syscall.EROFS
+	}
 	fullPath := path.Join(r.path, name)
 	//log.Printf("Mkdir(%s)", fullPath)
 	file, err := r.client.Create(fullPath, os.FileMode(mode|proto.DMDIR))
 	if err != nil {
 		//log.Printf("Error creating [%s]: %s", r.path, err)
-		return nil, syscall.EINVAL
+		return nil, toErrno(err, syscall.EINVAL)
 	}
 	defer file.Close()
-	r.dirTTL = time.Time{}
-	r.statTTL = time.Time{}
-	r.dirCache = append(r.dirCache, proto.Stat{
+	r.addEntry(proto.Stat{
 		Type:   0,
 		Dev:    0,
 		Qid:    proto.Qid{Qtype: math.MaxUint8, Vers: math.MaxUint32, Uid: math.MaxUint64},
@@ -160,103 +386,114 @@ func (r *Dir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.Ent
 	})
 	dir := &Dir{client: r.client, path: fullPath}
 	dirPut(fullPath, dir)
-	return r.NewInode(ctx, dir, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: crc64.Checksum([]byte(fullPath), crc64Table)}), 0
+	return r.NewInode(ctx, dir, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: qidIno(file.Qid())}), 0
+}
+
+// nlink returns the link count of the directory: 2, for its entry in its
+// parent and its own ".", plus one for the ".." of each subdirectory. It is
+// computed from the cached listing. If the directory hasn't been listed, it
+// returns 1, which tools like find take to mean the count is unknown.
+func (r *Dir) nlink() uint32 {
+	stats, _ := r.listing()
+	if stats == nil {
+		return 1
+	}
+	n := uint32(2)
+	for _, stat := range stats {
+		if stat.Mode&proto.DMDIR != 0 {
+			n++
+		}
+	}
+	return n
 }
 
 func (r *Dir) oldGetattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	if r.statCache == nil || time.Now().After(r.statTTL) {
+	r.mu.Lock()
+	stat := r.statCache
+	if stat != nil && time.Now().After(r.statTTL) {
+		stat = nil
+	}
+	r.mu.Unlock()
+	if stat == nil {
 		//log.Printf("oldGetattr(%s)", r.path)
-		stat, err := r.client.Stat(r.path)
+		var err error
+		stat, err = r.client.Stat(r.path)
 		if err != nil {
 			log.Printf("STAT RETURNED ERROR: %s\n", err)
-			return syscall.ENOENT
+			return toErrno(err, syscall.ENOENT)
 		}
+		r.checkVers(stat.Qid)
+		r.mu.Lock()
 		r.statCache = stat
 		r.statTTL = time.Now().Add(DefaultTTL)
+		r.mu.Unlock()
 	}
-	out.AttrValid = ncTTL
-	out.Nlink = 1
-	out.Ino = r.statCache.Qid.Uid
-	out.Mode = r.statCache.Mode
-	out.Size = r.statCache.Length
-	out.Mtime = uint64(r.statCache.Mtime)
+	out.SetTimeout(DefaultTTL)
+	out.Nlink = r.nlink()
+	out.Ino = qidIno(stat.Qid)
+	out.Mode = stat.Mode
+	out.Size = stat.Length
+	out.Mtime = uint64(stat.Mtime)
+	out.Atime = uint64(stat.Atime)
+	out.Ctime = uint64(stat.Mtime)
 	return 0
 }
 
 func (r *Dir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	//log.Printf("(*Dir).Getattr(%s)", r.path)
 	if dir := dirGet(path.Dir(r.path)); dir != nil {
-		_, errno := dir.Readdir(ctx)
-		if errno > 0 {
-			return errno
+		stat, errno := dir.entry(path.Base(r.path))
+		if errno == 0 {
+			r.checkVers(stat.Qid)
+			out.SetTimeout(DefaultTTL)
+			out.Nlink = r.nlink()
+			out.Ino = qidIno(stat.Qid)
+			out.Mode = stat.Mode
+			out.Size = stat.Length
+			out.Mtime = uint64(stat.Mtime)
+			out.Atime = uint64(stat.Atime)
+			out.Ctime = uint64(stat.Mtime)
+			return 0
 		}
-		base := path.Base(r.path)
-		for _, stat := range dir.dirCache {
-			if stat.Name == base {
-				out.AttrValid = ncTTL
-				out.Nlink = 1
-				out.Ino = stat.Qid.Uid
-				out.Mode = stat.Mode
-				out.Size = stat.Length
-				out.Mtime = uint64(stat.Mtime)
-				return 0
-			}
+		if errno != syscall.ENOENT {
+			return errno
 		}
 	}
 	return r.oldGetattr(ctx, f, out)
 }
 
 func (r *Dir) Setattr(ctx context.Context, h fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
-	log.Printf("(*Dir).SetAttr(%s)", r.path)
-	stat := proto.Stat{
-		Type:   math.MaxUint16,
-		Dev:    math.MaxUint32,
-		Qid:    proto.Qid{Qtype: math.MaxUint8, Vers: math.MaxUint32, Uid: math.MaxUint64},
-		Mode:   math.MaxUint32,
-		Atime:  math.MaxUint32,
-		Mtime:  math.MaxUint32,
-		Length: math.MaxUint64,
-		Name:   "",
-		Uid:    "",
-		Gid:    "",
-		Muid:   "",
+	if ReadOnly {
+		return syscall.EROFS
 	}
-	send := false
-	if newMode, ok := in.GetMode(); ok {
-		stat.Mode = newMode
-		send = true
-	}
-	if newSize, ok := in.GetSize(); ok {
-		stat.Length = newSize
-		send = true
-	}
-	if send {
+	log.Printf("(*Dir).SetAttr(%s)", r.path)
+	if stat, send := setattrStat(in); send {
 		err := r.client.WStat(r.path, &stat)
 		if err != nil {
 			log.Printf("WSTAT RETURNED ERROR: %s\n", err)
-			return syscall.ENOENT
+			return toErrno(err, syscall.ENOENT)
 		}
 	}
-	out.Mode = stat.Mode
-	out.Size = stat.Length
-	out.Mtime = uint64(stat.Mtime)
+	r.mu.Lock()
+	r.statTTL = time.Time{}
+	r.mu.Unlock()
 	if dir := dirGet(path.Dir(r.path)); dir != nil {
-		dir.dirTTL = time.Time{}
-		dir.statTTL = time.Time{}
+		dir.invalidate()
 	}
-	return 0
+	return r.Getattr(ctx, h, out)
 }
 
 func (r *Dir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if ReadOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
 	//log.Printf("Create(%s)", path.Join(r.path, name))
 	file, err := r.client.Create(path.Join(r.path, name), os.FileMode(mode))
 	if err != nil {
 		//log.Printf("Error creating [%s]: %s", r.path, err)
-		return nil, nil, 0, syscall.EINVAL
+		return nil, nil, 0, toErrno(err, syscall.EINVAL)
 	}
-	r.dirTTL = time.Time{}
-	r.statTTL = time.Time{}
-	r.dirCache = append(r.dirCache, proto.Stat{
+	r.addEntry(proto.Stat{
 		Type:   0,
 		Dev:    0,
 		Qid:    proto.Qid{Qtype: math.MaxUint8, Vers: math.MaxUint32, Uid: math.MaxUint64},
@@ -271,60 +508,110 @@ func (r *Dir) Create(ctx context.Context, name string, flags uint32, mode uint32
 	})
 	fullPath := path.Join(r.path, name)
 	fileNode := &FileNode{client: r.client, path: fullPath}
-	return r.NewInode(ctx, fileNode, fs.StableAttr{Ino: crc64.Checksum([]byte(fullPath), crc64Table)}), &File{file, fileNode}, fuse.FOPEN_DIRECT_IO, 0
+	fh = &File{file: file, node: fileNode, append: flags&syscall.O_APPEND != 0}
+	if EmptyStreams {
+		fuseFlags = fuse.FOPEN_DIRECT_IO
+	}
+	return r.NewInode(ctx, fileNode, fs.StableAttr{Ino: qidIno(file.Qid())}), fh, fuseFlags, 0
 }
 
 func (r *Dir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	if r.dirCache == nil || time.Now().After(r.dirTTL) {
-		//log.Printf("LOOKUP READDIR(%s)\n", r.path)
-		stats, err := r.client.Readdir(r.path)
+	stat, errno := r.entry(name)
+	if errno > 0 {
+		return nil, errno
+	}
+	out.SetEntryTimeout(DefaultTTL)
+	out.SetAttrTimeout(DefaultTTL)
+	out.Nlink = 1
+	out.Ino = qidIno(stat.Qid)
+	out.Mode = stat.Mode
+	out.Size = stat.Length
+	out.Mtime = uint64(stat.Mtime)
+	out.Atime = uint64(stat.Atime)
+	out.Ctime = uint64(stat.Mtime)
+	fullPath := path.Join(r.path, name)
+	if child := r.GetChild(name); child != nil {
+		switch n := child.Operations().(type) {
+		case *FileNode:
+			n.checkVers(stat.Qid)
+		case *Dir:
+			n.checkVers(stat.Qid)
+		}
+	}
+	if stat.Mode&proto.DMDIR > 0 {
+		if dir := dirGet(fullPath); dir != nil {
+			out.Nlink = dir.nlink()
+			return r.NewInode(ctx, dir, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: qidIno(stat.Qid)}), 0
+		}
+		dir := &Dir{client: r.client, path: fullPath}
+		dirPut(fullPath, dir)
+		return r.NewInode(ctx, dir, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: qidIno(stat.Qid)}), 0
+	}
+	mode, rdev := fileType(r.client, fullPath, &stat)
+	out.Rdev = rdev
+	return r.NewInode(ctx, &FileNode{client: r.client, path: fullPath, rdev: rdev}, fs.StableAttr{Mode: mode, Ino: qidIno(stat.Qid)}), 0
+}
+
+// entry returns the stat of r's entry name, from r's listing, which is
+// read again unless it is fresh. Directories too large to keep listed
+// look the entry up in their cache of entries, or else stat it alone.
+func (r *Dir) entry(name string) (proto.Stat, syscall.Errno) {
+	r.mu.Lock()
+	if r.entries != nil {
+		stat, ok := r.entries.get(name)
+		r.mu.Unlock()
+		if ok {
+			return stat, 0
+		}
+		st, err := r.client.Stat(path.Join(r.path, name))
 		if err != nil {
-			return nil, syscall.EPIPE
+			return proto.Stat{}, toErrno(err, syscall.ENOENT)
 		}
-		r.dirCache = stats
-		r.dirTTL = time.Now().Add(DefaultTTL)
+		r.cacheEntries(*st)
+		return *st, 0
 	}
-	for _, stat := range r.dirCache {
+	r.mu.Unlock()
+	stats, errno := r.refresh()
+	if errno > 0 {
+		return proto.Stat{}, errno
+	}
+	for _, stat := range stats {
 		if stat.Name == name {
-			out.EntryValid = ncTTL
-			out.AttrValid = ncTTL
-			out.Nlink = 1
-			out.Ino = stat.Qid.Uid
-			out.Mode = stat.Mode
-			out.Size = stat.Length
-			out.Mtime = uint64(stat.Mtime)
-			fullPath := path.Join(r.path, name)
-			if stat.Mode&proto.DMDIR > 0 {
-				if dir := dirGet(fullPath); dir != nil {
-					return r.NewInode(ctx, dir, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: crc64.Checksum([]byte(fullPath), crc64Table)}), 0
-				}
-				dir := &Dir{client: r.client, path: fullPath}
-				dirPut(fullPath, dir)
-				return r.NewInode(ctx, dir, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: crc64.Checksum([]byte(fullPath), crc64Table)}), 0
+			if len(stats) > dirCacheMax {
+				r.cacheEntries(stat)
 			}
-			return r.NewInode(ctx, &FileNode{client: r.client, path: fullPath}, fs.StableAttr{Ino: crc64.Checksum([]byte(fullPath), crc64Table)}), 0
+			return stat, 0
 		}
 	}
-	return nil, syscall.ENOENT
+	return proto.Stat{}, syscall.ENOENT
 }
 
+// refresh reads the whole directory into dirCache unless it is fresh, and
+// returns the listing.
+func (r *Dir) refresh() ([]proto.Stat, syscall.Errno) {
+	if stats, fresh := r.listing(); fresh {
+		return stats, 0
+	}
+	stats, err := r.client.Readdir(r.path)
+	if err != nil {
+		return nil, toErrno(err, syscall.EPIPE)
+	}
+	r.setListing(stats)
+	return stats, 0
+}
+
+// Readdir lists the directory from dirCache while it is fresh. Otherwise
+// the directory is streamed from the server, which also refills dirCache
+// if the directory turns out to be small.
 func (r *Dir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	if r.dirCache == nil || time.Now().After(r.dirTTL) {
+	stats, fresh := r.listing()
+	if !fresh {
 		//log.Printf("ACTUAL READDIR(%s)\n", r.path)
-		stats, err := r.client.Readdir(r.path)
-		if err != nil {
-			return nil, syscall.EPIPE
-		}
-		r.dirCache = stats
-		r.dirTTL = time.Now().Add(DefaultTTL)
-	}
-	entries := make([]fuse.DirEntry, 0)
-	for _, stat := range r.dirCache {
-		var mode uint32 = 0
-		if stat.Mode&proto.DMDIR > 0 {
-			mode = fuse.S_IFDIR
-		}
-		entries = append(entries, fuse.DirEntry{Name: stat.Name, Mode: mode})
+		return newDirStream(r)
+	}
+	entries := make([]fuse.DirEntry, 0, len(stats))
+	for _, stat := range stats {
+		entries = append(entries, statDirEntry(stat))
 	}
 
 	return fs.NewListDirStream(entries), 0
@@ -334,17 +621,40 @@ type FileNode struct {
 	fs.Inode
 	client *client.Client
 	path   string
+	rdev   uint32 // device number, if the file is a device.
+
+	vers versTracker
+}
+
+// checkVers drops what is cached about f if q shows it changed, and
+// reports whether it did.
+func (f *FileNode) checkVers(q proto.Qid) bool {
+	if !f.vers.changed(q.Vers) {
+		return false
+	}
+	if dir := dirGet(path.Dir(f.path)); dir != nil {
+		dir.invalidate()
+	}
+	go f.NotifyContent(0, 0)
+	return true
 }
 
 type File struct {
 	file *client.File
 	node *FileNode
+	// append is set when the file was opened with O_APPEND. 9P has no
+	// append mode, so every write goes to the length of the file, as
+	// found by statting it just before writing.
+	append bool
+	// stream is set for streams, whose reads return at the first reply.
+	stream bool
 }
 
 var _ = (fs.NodeOpener)((*FileNode)(nil))
 var _ = (fs.NodeGetattrer)((*FileNode)(nil))
 var _ = (fs.NodeSetattrer)((*FileNode)(nil))
 var _ = (fs.NodeFsyncer)((*FileNode)(nil))
+var _ = (fs.NodeReadlinker)((*FileNode)(nil))
 var _ = (fs.FileReader)((*File)(nil))
 var _ = (fs.FileWriter)((*File)(nil))
 var _ = (fs.FileFlusher)((*File)(nil))
@@ -367,29 +677,52 @@ func convertFlag(mode uint32) proto.Mode {
 	return m
 }
 
+// Readlink returns the target of a symlink, which is stored as the contents
+// of a DMSYMLINK file.
+func (f *FileNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := f.client.ReadAll(f.path)
+	if err != nil {
+		return nil, toErrno(err, syscall.EIO)
+	}
+	return target, 0
+}
+
 func (f *FileNode) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
 	//log.Printf("FUSE: Fsync(%s)\n", f.path)
 	return 0
 }
 
 func (f *FileNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if ReadOnly && (flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0) {
+		return nil, 0, syscall.EROFS
+	}
 	//log.Printf("(*FileNode).Open(%s, %#x -> %#x)\n", f.path, flags, convertFlag(flags))
 	file, err := f.client.Open(f.path, convertFlag(flags))
 	if err != nil {
 		//log.Printf("FUSE: Open(%s) -> Error: %s", f.path, err)
-		return nil, 0, syscall.EINVAL
+		return nil, 0, toErrno(err, syscall.EINVAL)
 	}
-	// TODO: Optimize
-	stat, err := f.client.Stat(f.path)
+	// The open fid is statted directly, saving a walk.
+	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		log.Printf("STAT RETURNED ERROR: %s\n", err)
-		return nil, 0, syscall.ENOENT
+		return nil, 0, toErrno(err, syscall.ENOENT)
 	}
-	if stat.Length == 0 {
-		return &File{file, f}, fuse.FOPEN_DIRECT_IO, 0
+	changed := f.checkVers(stat.Qid)
+	stream := isStream(stat)
+	fh = &File{file: file, node: f, append: flags&syscall.O_APPEND != 0, stream: stream}
+	if stream {
+		return fh, fuse.FOPEN_DIRECT_IO, 0
+	}
+	// The pages are only kept if the file is known not to have
+	// changed since they were read. Without FOPEN_KEEP_CACHE, the
+	// kernel drops them itself.
+	if PageCache && !changed {
+		return fh, fuse.FOPEN_KEEP_CACHE, 0
 	}
 
-	return &File{file, f}, 0, 0
+	return fh, 0, 0
 	//log.Printf("FUSE: Open(%s) -> OK\n", f.path)
 	//return &File{file, f}, fuse.FOPEN_DIRECT_IO, 0
 	//Inode.NotifyContent
@@ -398,46 +731,77 @@ func (f *FileNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fu
 
 func (f *FileNode) oldGetattr(ctx context.Context, h fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	//log.Printf("FileNode.oldGetattr(%s)", f.path)
-	stat, err := f.client.Stat(f.path)
+	var stat *proto.Stat
+	var err error
+	if fh, ok := h.(*File); ok {
+		stat, err = fh.file.Stat()
+	} else {
+		stat, err = f.client.Stat(f.path)
+	}
 	if err != nil {
 		log.Printf("STAT RETURNED ERROR: %s\n", err)
-		return syscall.ENOENT
+		return toErrno(err, syscall.ENOENT)
 	}
-	out.AttrValid = ncTTL
+	f.checkVers(stat.Qid)
+	out.SetTimeout(DefaultTTL)
 	out.Nlink = 1
-	out.Ino = stat.Qid.Uid
+	out.Rdev = f.rdev
+	out.Ino = qidIno(stat.Qid)
 	out.Mode = stat.Mode
 	out.Size = stat.Length
 	out.Mtime = uint64(stat.Mtime)
+	out.Atime = uint64(stat.Atime)
+	out.Ctime = uint64(stat.Mtime)
 	return 0
 }
 
 func (f *FileNode) Getattr(ctx context.Context, h fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
 	//log.Printf("(*FileNode).Getattr(%s)", f.path)
 	if dir := dirGet(path.Dir(f.path)); dir != nil {
-		_, errno := dir.Readdir(ctx)
-		if errno > 0 {
-			return errno
+		stat, errno := dir.entry(path.Base(f.path))
+		if errno == 0 {
+			f.checkVers(stat.Qid)
+			out.SetTimeout(DefaultTTL)
+			out.Nlink = 1
+			out.Rdev = f.rdev
+			out.Ino = qidIno(stat.Qid)
+			out.Mode = stat.Mode
+			out.Size = stat.Length
+			out.Mtime = uint64(stat.Mtime)
+			out.Atime = uint64(stat.Atime)
+			out.Ctime = uint64(stat.Mtime)
+			return 0
 		}
-		base := path.Base(f.path)
-		for _, stat := range dir.dirCache {
-			if stat.Name == base {
-				out.AttrValid = ncTTL
-				out.Nlink = 1
-				out.Ino = stat.Qid.Uid
-				out.Mode = stat.Mode
-				out.Size = stat.Length
-				out.Mtime = uint64(stat.Mtime)
-				return 0
-			}
+		if errno != syscall.ENOENT {
+			return errno
 		}
 	}
 	return f.oldGetattr(ctx, h, out)
 }
 
 func (f *FileNode) Setattr(ctx context.Context, h fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if ReadOnly {
+		return syscall.EROFS
+	}
 	log.Printf("(*FileNode).SetAttr(%s)", f.path)
-	stat := proto.Stat{
+	if stat, send := setattrStat(in); send {
+		err := f.client.WStat(f.path, &stat)
+		if err != nil {
+			log.Printf("WSTAT RETURNED ERROR: %s\n", err)
+			return toErrno(err, syscall.ENOENT)
+		}
+	}
+	if dir := dirGet(path.Dir(f.path)); dir != nil {
+		dir.invalidate()
+	}
+	return f.Getattr(ctx, h, out)
+}
+
+// setattrStat returns a wstat making the changes requested by in. Fields in
+// doesn't set are left as "don't touch". send is false if there is nothing
+// to change.
+func setattrStat(in *fuse.SetAttrIn) (stat proto.Stat, send bool) {
+	stat = proto.Stat{
 		Type:   math.MaxUint16,
 		Dev:    math.MaxUint32,
 		Qid:    proto.Qid{Qtype: math.MaxUint8, Vers: math.MaxUint32, Uid: math.MaxUint64},
@@ -450,7 +814,6 @@ func (f *FileNode) Setattr(ctx context.Context, h fs.FileHandle, in *fuse.SetAtt
 		Gid:    "",
 		Muid:   "",
 	}
-	send := false
 	if newMode, ok := in.GetMode(); ok {
 		stat.Mode = newMode
 		send = true
@@ -459,22 +822,43 @@ func (f *FileNode) Setattr(ctx context.Context, h fs.FileHandle, in *fuse.SetAtt
 		stat.Length = newSize
 		send = true
 	}
-	if send {
-		//log.Printf("SENDING WSTAT")
-		err := f.client.WStat(f.path, &stat)
-		if err != nil {
-			log.Printf("WSTAT RETURNED ERROR: %s\n", err)
-			return syscall.ENOENT
-		}
+	if atime, ok := in.GetATime(); ok {
+		stat.Atime = uint32(atime.Unix())
+		send = true
 	}
-	out.Mode = stat.Mode
-	out.Size = stat.Length
-	out.Mtime = uint64(stat.Mtime)
-	if dir := dirGet(path.Dir(f.path)); dir != nil {
-		dir.dirTTL = time.Time{}
-		dir.statTTL = time.Time{}
+	if mtime, ok := in.GetMTime(); ok {
+		stat.Mtime = uint32(mtime.Unix())
+		send = true
 	}
-	return 0
+	if uid, ok := in.GetUID(); ok {
+		stat.Uid = userName(uid)
+		send = true
+	}
+	if gid, ok := in.GetGID(); ok {
+		stat.Gid = groupName(gid)
+		send = true
+	}
+	return stat, send
+}
+
+// userName returns the name of the local user with the given uid, since 9P
+// identifies users by name. If there is no such user, the number itself is
+// returned for the server to make sense of.
+func userName(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
+
+// groupName is like userName, for groups.
+func groupName(gid uint32) string {
+	id := strconv.FormatUint(uint64(gid), 10)
+	if g, err := user.LookupGroupId(id); err == nil {
+		return g.Name
+	}
+	return id
 }
 
 func (f *File) Flush(ctx context.Context) syscall.Errno {
@@ -487,57 +871,64 @@ func (f *File) Release(ctx context.Context) syscall.Errno {
 	err := f.file.Close()
 	if err != nil {
 		//log.Printf("Error flushing file: %s", err)
-		return syscall.EINVAL
+		return toErrno(err, syscall.EINVAL)
 	}
 	return 0
 }
 
 func (f *File) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	//log.Printf("(*File).Read(%s, off: %d, len: %d)", f.node.path, off, len(dest))
-	n, err := f.file.ReadAt(dest, off)
+	read := f.file.ReadAtContext
+	if f.stream {
+		// Return what the stream has now, rather than wait to fill dest.
+		read = f.file.ReadSomeAt
+	}
+	n, err := read(ctx, dest, off)
 	if err != nil {
 		if err == io.EOF {
 			return fuse.ReadResultData(dest[:n]), 0
 		}
+		if ctx.Err() != nil {
+			return nil, syscall.EINTR
+		}
 		//log.Printf("Error reading file: %s", err)
-		return nil, syscall.EINVAL
+		return nil, toErrno(err, syscall.EINVAL)
 	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
 func (f *File) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
-	log.Printf("(*File).SetAttr(%s)", f.node.path)
-	stat, err := f.node.client.Stat(f.node.path)
-	if err != nil {
-		log.Printf("STAT RETURNED ERROR: %s\n", err)
-		return syscall.ENOENT
-	}
-	stat.Mode = in.Mode
-	stat.Length = in.Size
-	err = f.node.client.WStat(f.node.path, stat)
-	if err != nil {
-		log.Printf("WSTAT RETURNED ERROR: %s\n", err)
-		return syscall.ENOENT
-	}
-	out.Mode = stat.Mode
-	out.Size = stat.Length
-	out.Mtime = uint64(stat.Mtime)
-	if dir := dirGet(path.Dir(f.node.path)); dir != nil {
-		dir.dirTTL = time.Time{}
-		dir.statTTL = time.Time{}
-	}
-	return 0
+	return f.node.Setattr(ctx, f, in, out)
 }
 
 func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
-	n, err := f.file.WriteAt(data, off)
+	if ReadOnly {
+		return 0, syscall.EROFS
+	}
+	if f.append {
+		// Another client may have appended since we last looked.
+		stat, err := f.file.Stat()
+		if err != nil {
+			return 0, toErrno(err, syscall.EIO)
+		}
+		off = int64(stat.Length)
+	}
+	n, err := f.file.WriteAtContext(ctx, data, off)
 	if err != nil {
 		//log.Printf("Error writing file: %s", err)
-		return uint32(n), syscall.EINVAL
+		if ctx.Err() != nil {
+			return uint32(n), syscall.EINTR
+		}
+		return uint32(n), toErrno(err, syscall.EINVAL)
+	}
+	if PageCache {
+		// The write changed the version, but the kernel's pages
+		// already hold what was written, so the next version seen
+		// isn't a reason to drop them.
+		f.node.vers.forget()
 	}
 	if dir := dirGet(path.Dir(f.node.path)); dir != nil {
-		dir.dirTTL = time.Time{}
-		dir.statTTL = time.Time{}
+		dir.invalidate()
 	}
 	return uint32(n), 0
 }
@@ -573,7 +964,8 @@ func main() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
 		fmt.Fprintf(flag.CommandLine.Output(), "  %s [options] address mountpoint\n", os.Args[0])
 		fmt.Fprintf(flag.CommandLine.Output(), "  %s [options] -srv local_service mountpoint\n", os.Args[0])
-		fmt.Fprintf(flag.CommandLine.Output(), "  %s [options] -s mountpoint\nOptions:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [options] -s mountpoint\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "The address may be host:port, a socket path, or a dial string like tcp!host!564 or unix!/path/to/socket.\nOptions:\n")
 		flag.PrintDefaults()
 	}
 	debug := flag.Bool("debug", false, "Prints FUSE debugging information.")
@@ -583,22 +975,41 @@ func main() {
 	auth := flag.Bool("a", false, "Enable plan9 auth")
 	stdio := flag.Bool("s", false, "Speak 9p over standard input/output")
 	srv := flag.Bool("srv", false, "Attach to a 9p service, not an address")
+	netName := flag.String("net", "tcp", "Network to dial the address on, tcp or unix. Ignored for dial strings.")
+	ttl := flag.Duration("ttl", DefaultTTL, "How long to cache directory listings and attributes. 0 disables caching.")
+	negTTL := flag.Duration("negttl", 0, "How long the kernel may cache failed lookups.")
+	flag.BoolVar(&ReadOnly, "ro", false, "Mount read-only. Nothing is ever written to the server.")
+	flag.BoolVar(&TrackVers, "vers", false, "Watch Qid.Vers and drop cached content and attributes of files changed on the server.")
+	flag.BoolVar(&EmptyStreams, "emptystreams", false, "Treat empty files as unseekable streams, not only those marked append-only or exclusive-use.")
+	flag.BoolVar(&PageCache, "cache", false, "Keep file contents in the kernel's page cache across opens, dropping them when Qid.Vers changes. Implies -vers.")
+	flag.DurationVar(&PollInterval, "poll", 0, "How often to list listed directories again, to show entries added or removed on the server at once. 0 disables polling.")
+	rootPath := flag.String("root", "/", "Directory on the server to present as the root of the mount")
 	flag.Parse()
-	var s io.ReadWriteCloser
+	DefaultTTL = *ttl
+	if PageCache {
+		TrackVers = true
+	}
+	clientOpts := []client.Option{client.WithSingleFlight()}
+	if *auth {
+		clientOpts = append(clientOpts, client.WithAuth(client.FactotumAuth))
+	}
+	go9p.Verbose = *verbose
+
+	var c *client.Client
 	var mountpoint string
 	if *stdio {
 		if len(flag.Args()) < 1 {
 			flag.Usage()
 			os.Exit(1)
 		}
-		s = &ReadWriteCloser{os.Stdin, os.Stdout}
+		c, err = client.NewClient(&ReadWriteCloser{os.Stdin, os.Stdout}, *username, *aname, clientOpts...)
 		mountpoint = flag.Arg(0)
 	} else {
 		if len(flag.Args()) < 2 {
 			flag.Usage()
 			os.Exit(1)
 		}
-		network := "tcp"
+		network := *netName
 		addr := flag.Arg(0)
 		if _, err := os.Stat(addr); err == nil {
 			// Probably a unix socket.
@@ -609,29 +1020,41 @@ func main() {
 			ns := fans.Namespace()
 			addr = path.Join(ns, addr)
 		}
-		s, err = net.Dial(network, addr)
-		if err != nil {
-			log.Fatal(err)
-		}
+		c, err = client.Dial(network, addr, *username, *aname, clientOpts...)
 		mountpoint = flag.Arg(1)
 	}
-	var clientOpts []client.Option
-	if *auth {
-		clientOpts = append(clientOpts, client.WithAuth(client.Plan9Auth))
-	}
-	go9p.Verbose = *verbose
-	c, err := client.NewClient(s, *username, *aname, clientOpts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	opts := &fs.Options{UID: uint32(os.Geteuid()), GID: uint32(os.Getgid()), MountOptions: fuse.MountOptions{DirectMount: true, AllowOther: true}}
 	opts.Debug = *debug
-	root := &StatDir{Dir{client: c, path: "/"}, 0777}
+	opts.EntryTimeout = &DefaultTTL
+	opts.AttrTimeout = &DefaultTTL
+	opts.NegativeTimeout = negTTL
+	if ReadOnly {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+	base := path.Clean("/" + *rootPath)
+	stat, err := c.Stat(base)
+	if err != nil {
+		log.Fatalf("Cannot walk to root %s: %v\n", base, err)
+	}
+	if stat.Mode&proto.DMDIR == 0 {
+		log.Fatalf("Cannot mount %s: not a directory\n", base)
+	}
+	root := &StatDir{Dir{client: c, path: base}, 0777}
 	//dirPut("/", root)
 	server, err := fs.Mount(mountpoint, root, opts)
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
 	}
+	if PollInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go pollDirs(&root.Dir, stop)
+	}
 	server.Wait()
+	// Let the server release everything we still hold.
+	c.Close()
 }
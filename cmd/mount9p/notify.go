@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"github.com/knusbaum/go9p/proto"
+)
+
+// PollInterval is how often the directories mount9p has listed are listed
+// again, so that entries added or removed on the server are shown at once
+// rather than once the kernel's cache of them times out. 0 disables
+// polling.
+var PollInterval time.Duration
+
+// pollDirs polls the listed directories under root every PollInterval
+// until stop is closed.
+func pollDirs(root *Dir, stop <-chan struct{}) {
+	t := time.NewTicker(PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		for _, d := range listedDirs(root) {
+			d.poll()
+		}
+	}
+}
+
+// listedDirs returns root and the directories seen below it whose
+// listings are cached.
+func listedDirs(root *Dir) []*Dir {
+	dirCacheLock.RLock()
+	defer dirCacheLock.RUnlock()
+	dirs := make([]*Dir, 0, len(dirCache)+1)
+	if stats, _ := root.listing(); stats != nil {
+		dirs = append(dirs, root)
+	}
+	for _, d := range dirCache {
+		if stats, _ := d.listing(); d != root && stats != nil {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// poll lists r again and tells the kernel about the entries that were
+// added, removed or replaced by another file since it was last listed.
+// Entries that remain have their Qid.Vers checked, as Lookup would.
+func (r *Dir) poll() {
+	stats, err := r.client.Readdir(r.path)
+	if err != nil {
+		// Removed, most likely, which polling its parent shows.
+		return
+	}
+	old := r.setListing(stats)
+
+	before := make(map[string]proto.Qid, len(old))
+	for _, st := range old {
+		before[st.Name] = st.Qid
+	}
+	changed := false
+	for _, st := range stats {
+		q, ok := before[st.Name]
+		delete(before, st.Name)
+		if !ok || q.Uid != st.Qid.Uid || q.Qtype != st.Qid.Qtype {
+			changed = true
+			r.NotifyEntry(st.Name)
+			continue
+		}
+		if child := r.GetChild(st.Name); child != nil {
+			switch n := child.Operations().(type) {
+			case *FileNode:
+				n.checkVers(st.Qid)
+			case *Dir:
+				n.checkVers(st.Qid)
+			}
+		}
+	}
+	for name := range before {
+		changed = true
+		if child := r.GetChild(name); child != nil {
+			r.NotifyDelete(name, child)
+			r.RmChild(name)
+		} else {
+			r.NotifyEntry(name)
+		}
+	}
+	if changed {
+		// Drop the kernel's cached listing.
+		r.NotifyContent(0, 0)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/proto"
+)
+
+// 9P2000 has no extended attributes. mount9p uses the following convention
+// instead: the attributes of a file /a/b are the files in the sibling
+// directory /a/.b.xattr, where each file is named for the attribute and
+// holds its value.
+func xattrDir(p string) string {
+	return path.Join(path.Dir(p), "."+path.Base(p)+".xattr")
+}
+
+// errNoAttr is returned for attributes that are not set.
+const errNoAttr = syscall.Errno(fuse.ENOATTR)
+
+// Flags to setxattr(2).
+const (
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+var _ = (fs.NodeListxattrer)((*Dir)(nil))
+var _ = (fs.NodeListxattrer)((*FileNode)(nil))
+var _ = (fs.NodeGetxattrer)((*Dir)(nil))
+var _ = (fs.NodeGetxattrer)((*FileNode)(nil))
+var _ = (fs.NodeSetxattrer)((*Dir)(nil))
+var _ = (fs.NodeSetxattrer)((*FileNode)(nil))
+var _ = (fs.NodeRemovexattrer)((*Dir)(nil))
+var _ = (fs.NodeRemovexattrer)((*FileNode)(nil))
+
+func (r *Dir) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(r.client, r.path, dest)
+}
+
+func (f *FileNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return listxattr(f.client, f.path, dest)
+}
+
+// listxattr writes the null-terminated names of the attributes of p into
+// dest. If dest is empty, only the required size is returned. If dest is
+// too small, ERANGE is returned along with the required size.
+func listxattr(c *client.Client, p string, dest []byte) (uint32, syscall.Errno) {
+	if p == "/" {
+		return 0, 0
+	}
+	stats, err := c.Readdir(xattrDir(p))
+	if err != nil {
+		// No attribute directory means no attributes.
+		return 0, 0
+	}
+	var names []byte
+	for _, stat := range stats {
+		if stat.Mode&proto.DMDIR != 0 {
+			continue
+		}
+		names = append(names, stat.Name...)
+		names = append(names, 0)
+	}
+	if len(dest) == 0 {
+		return uint32(len(names)), 0
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), 0
+}
+
+func (r *Dir) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(r.client, r.path, attr, dest)
+}
+
+func (f *FileNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	return getxattr(f.client, f.path, attr, dest)
+}
+
+func (r *Dir) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setxattr(r.client, r.path, attr, data, flags)
+}
+
+func (f *FileNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	return setxattr(f.client, f.path, attr, data, flags)
+}
+
+func (r *Dir) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return removexattr(r.client, r.path, attr)
+}
+
+func (f *FileNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	return removexattr(f.client, f.path, attr)
+}
+
+// xattrFile returns the file holding the attribute attr of p, or "" if attr
+// can't be stored under the convention.
+func xattrFile(p, attr string) string {
+	if attr == "" || attr == "." || attr == ".." || strings.Contains(attr, "/") {
+		return ""
+	}
+	return path.Join(xattrDir(p), attr)
+}
+
+// attrErrno is toErrno for errors about an attribute's file, which are
+// reported as the attribute not being set if the file does not exist.
+func attrErrno(err error) syscall.Errno {
+	errno := toErrno(err, errNoAttr)
+	if errno == syscall.ENOENT {
+		return errNoAttr
+	}
+	return errno
+}
+
+// getxattr reads the value of the attribute attr of p into dest. If dest is
+// empty, only the size of the value is returned. If dest is too small,
+// ERANGE is returned along with the required size.
+func getxattr(c *client.Client, p, attr string, dest []byte) (uint32, syscall.Errno) {
+	file := xattrFile(p, attr)
+	if p == "/" || file == "" {
+		return 0, errNoAttr
+	}
+	value, err := c.ReadAll(file)
+	if err != nil {
+		return 0, attrErrno(err)
+	}
+	if len(dest) == 0 {
+		return uint32(len(value)), 0
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
+
+// setxattr sets the attribute attr of p to data, creating the attribute
+// directory if it doesn't exist yet.
+func setxattr(c *client.Client, p, attr string, data []byte, flags uint32) syscall.Errno {
+	if ReadOnly {
+		return syscall.EROFS
+	}
+	file := xattrFile(p, attr)
+	if p == "/" || file == "" {
+		return syscall.ENOTSUP
+	}
+	_, err := c.Stat(file)
+	exists := err == nil
+	switch {
+	case exists && flags&xattrCreate != 0:
+		return syscall.EEXIST
+	case !exists && flags&xattrReplace != 0:
+		return errNoAttr
+	}
+	if !exists {
+		dir := xattrDir(p)
+		if _, err := c.Stat(dir); err != nil {
+			d, err := c.Create(dir, os.FileMode(proto.DMDIR|0755))
+			if err != nil {
+				return toErrno(err, syscall.EIO)
+			}
+			d.Close()
+			invalidateDir(path.Dir(p))
+		}
+		f, err := c.Create(file, 0644)
+		if err != nil {
+			return toErrno(err, syscall.EIO)
+		}
+		_, err = f.WriteAt(data, 0)
+		f.Close()
+		return toErrno(err, syscall.EIO)
+	}
+	return toErrno(c.WriteAll(file, data), syscall.EIO)
+}
+
+// removexattr removes the attribute attr of p, and the attribute directory
+// once it is empty.
+func removexattr(c *client.Client, p, attr string) syscall.Errno {
+	if ReadOnly {
+		return syscall.EROFS
+	}
+	file := xattrFile(p, attr)
+	if p == "/" || file == "" {
+		return errNoAttr
+	}
+	if _, err := c.Stat(file); err != nil {
+		return attrErrno(err)
+	}
+	if err := c.Remove(file); err != nil {
+		return toErrno(err, syscall.EIO)
+	}
+	if stats, err := c.Readdir(xattrDir(p)); err == nil && len(stats) == 0 {
+		c.Remove(xattrDir(p))
+		invalidateDir(path.Dir(p))
+	}
+	return 0
+}
+
+// invalidateDir drops the cached listing of the directory p, if any.
+func invalidateDir(p string) {
+	if dir := dirGet(p); dir != nil {
+		dir.invalidate()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/fs"
+	"github.com/knusbaum/go9p/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListxattr(t *testing.T) {
+	assert := assert.New(t)
+	xfs, root := fs.NewFS("glenda", "glenda", 0777)
+	root.AddChild(fs.NewStaticFile(xfs.NewStat("file", "glenda", "glenda", 0666), nil))
+	root.AddChild(fs.NewStaticFile(xfs.NewStat("bare", "glenda", "glenda", 0666), nil))
+	attrs := fs.NewStaticDir(xfs.NewStat(".file.xattr", "glenda", "glenda", 0777|proto.DMDIR))
+	root.AddChild(attrs)
+	attrs.AddChild(fs.NewStaticFile(xfs.NewStat("user.a", "glenda", "glenda", 0666), []byte("1")))
+	attrs.AddChild(fs.NewStaticFile(xfs.NewStat("user.bb", "glenda", "glenda", 0666), []byte("22")))
+	// Directories aren't attributes.
+	attrs.AddChild(fs.NewStaticDir(xfs.NewStat("sub", "glenda", "glenda", 0777|proto.DMDIR)))
+
+	cc, sc := go9p.NewPipe()
+	srv := &go9p.Server{Srv: xfs.Server()}
+	go srv.ServeConn(sc)
+	c, err := client.NewClient(cc, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer c.Close()
+
+	want := "user.a\x00user.bb\x00"
+	n, errno := listxattr(c, "/file", nil)
+	assert.Equal(syscall.Errno(0), errno)
+	assert.Equal(uint32(len(want)), n)
+
+	dest := make([]byte, 64)
+	n, errno = listxattr(c, "/file", dest)
+	assert.Equal(syscall.Errno(0), errno)
+	assert.Equal(want, string(dest[:n]))
+
+	n, errno = listxattr(c, "/file", make([]byte, 4))
+	assert.Equal(syscall.ERANGE, errno)
+	assert.Equal(uint32(len(want)), n)
+
+	n, errno = listxattr(c, "/bare", dest)
+	assert.Equal(syscall.Errno(0), errno)
+	assert.Equal(uint32(0), n)
+}
@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"errors"
+
+	"github.com/knusbaum/go9p/proto"
+)
+
+// DeviceFile is a device special file or named pipe, for mirroring trees
+// such as /dev. It holds no data of its own. go9p speaks plain 9P2000,
+// whose stats have no room for the 9P2000.u extension, so as with
+// DMSYMLINK files, the extension is served as the file's contents instead:
+// reading a device returns its proto.DeviceExtension, and reading a named
+// pipe returns nothing.
+type DeviceFile struct {
+	BaseFile
+	ext []byte
+}
+
+// NewDeviceFile creates a DeviceFile with the given stat. kind is 'b' for
+// a block device, 'c' for a character device or 'p' for a named pipe, and
+// sets the DMDEVICE or DMNAMEDPIPE bit of the stat's mode. major and minor
+// are the device numbers, and are ignored for named pipes.
+func NewDeviceFile(s *proto.Stat, kind byte, major, minor uint32) (*DeviceFile, error) {
+	f := &DeviceFile{BaseFile: BaseFile{fStat: *s}}
+	switch kind {
+	case 'b', 'c':
+		f.fStat.Mode |= proto.DMDEVICE
+		f.ext = []byte(proto.DeviceExtension(kind, major, minor))
+	case 'p':
+		f.fStat.Mode |= proto.DMNAMEDPIPE
+	default:
+		return nil, errors.New("Unknown device kind.")
+	}
+	f.fStat.Length = uint64(len(f.ext))
+	return f, nil
+}
+
+func (f *DeviceFile) Open(fid uint64, omode proto.Mode) error {
+	if omode&0x0F == proto.Owrite || omode&0x0F == proto.Ordwr || omode&proto.Otrunc != 0 {
+		return errors.New("Cannot write to a device.")
+	}
+	return nil
+}
+
+func (f *DeviceFile) Read(fid uint64, offset uint64, count uint64) ([]byte, error) {
+	if offset >= uint64(len(f.ext)) {
+		return []byte{}, nil
+	}
+	if count > uint64(len(f.ext))-offset {
+		count = uint64(len(f.ext)) - offset
+	}
+	return f.ext[offset : offset+count], nil
+}
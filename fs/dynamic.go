@@ -1,6 +1,11 @@
 package fs
 
 import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/knusbaum/go9p/proto"
 )
 
@@ -49,10 +54,52 @@ func (f *DynamicFile) Read(fid uint64, offset uint64, count uint64) ([]byte, err
 }
 
 func (f *DynamicFile) Close(fid uint64) error {
+	f.Lock()
+	defer f.Unlock()
 	delete(f.fidContent, fid)
 	return nil
 }
 
+// ReadOnlyFile is a DynamicFile that cannot be written, and whose Stat
+// reports the length of the content it would generate now. That makes it
+// suitable for generated content such as status pages, where clients rely
+// on the length to know how much to read. As with a DynamicFile, each fid
+// reads from the content generated when it was opened.
+type ReadOnlyFile struct {
+	DynamicFile
+}
+
+// NewReadOnlyFile creates a ReadOnlyFile with the given stat whose content
+// is generated by content. content is called on every Stat as well as on
+// every Open, so it should be cheap. For fixed content, pass a function
+// returning the same slice every time.
+func NewReadOnlyFile(s *proto.Stat, content func() []byte) *ReadOnlyFile {
+	return &ReadOnlyFile{
+		DynamicFile{
+			BaseFile:   BaseFile{fStat: *s},
+			fidContent: make(map[uint64][]byte),
+			genContent: content,
+		},
+	}
+}
+
+func (f *ReadOnlyFile) Stat() proto.Stat {
+	stat := f.DynamicFile.Stat()
+	stat.Length = uint64(len(f.genContent()))
+	return stat
+}
+
+func (f *ReadOnlyFile) Open(fid uint64, omode proto.Mode) error {
+	if omode&0x0F == proto.Owrite || omode&0x0F == proto.Ordwr || omode&proto.Otrunc != 0 {
+		return errors.New("File is read-only.")
+	}
+	return f.DynamicFile.Open(fid, omode)
+}
+
+func (f *ReadOnlyFile) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
+	return 0, errors.New("File is read-only.")
+}
+
 // WrappedFile takes an existing File and adds optional hooks for the
 // Open, Read, Write, and Close functions.
 // OpenF, ReadF, WriteF, and CloseF, if set, are called rather than
@@ -63,6 +110,9 @@ type WrappedFile struct {
 	ReadF  func(fid uint64, offset uint64, count uint64) ([]byte, error)
 	WriteF func(fid uint64, offset uint64, data []byte) (uint32, error)
 	CloseF func(fid uint64) error
+
+	// ReadContextF, if set, is used for reads in place of ReadF.
+	ReadContextF func(ctx context.Context, fid uint64, offset uint64, count uint64) ([]byte, error)
 }
 
 func (f *WrappedFile) Open(fid uint64, omode proto.Mode) error {
@@ -79,6 +129,21 @@ func (f *WrappedFile) Read(fid uint64, offset uint64, count uint64) ([]byte, err
 	return f.File.Read(fid, offset, count)
 }
 
+// ReadContext uses ReadContextF or ReadF if they are set, and otherwise
+// the wrapped File, passing it ctx if it is a ContextReader.
+func (f *WrappedFile) ReadContext(ctx context.Context, fid uint64, offset uint64, count uint64) ([]byte, error) {
+	if f.ReadContextF != nil {
+		return f.ReadContextF(ctx, fid, offset, count)
+	}
+	if f.ReadF != nil {
+		return f.ReadF(fid, offset, count)
+	}
+	if cr, ok := f.File.(ContextReader); ok {
+		return cr.ReadContext(ctx, fid, offset, count)
+	}
+	return f.File.Read(fid, offset, count)
+}
+
 func (f *WrappedFile) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
 	if f.WriteF != nil {
 		return f.WriteF(fid, offset, data)
@@ -92,3 +157,151 @@ func (f *WrappedFile) Close(fid uint64) error {
 	}
 	return f.File.Close(fid)
 }
+
+// MergedDir is a Dir that overlays a set of static children on top of
+// children generated on demand. Static children are managed with AddChild
+// and DeleteChild, as with a StaticDir. Dynamic children are produced by the
+// function passed to NewMergedDir every time the directory is walked or
+// read. A static child hides any dynamic child with the same name.
+type MergedDir struct {
+	*StaticDir
+	list func() []FSNode
+}
+
+// NewMergedDir creates a MergedDir which calls list to get its dynamic
+// children.
+func NewMergedDir(stat *proto.Stat, list func() []FSNode) *MergedDir {
+	return &MergedDir{
+		StaticDir: NewStaticDir(stat),
+		list:      list,
+	}
+}
+
+func (d *MergedDir) Children() map[string]FSNode {
+	children := d.StaticDir.Children()
+	for _, n := range d.list() {
+		name := n.Stat().Name
+		if _, ok := children[name]; ok {
+			continue
+		}
+		n.SetParent(d)
+		children[name] = n
+	}
+	return children
+}
+
+func (d *MergedDir) AddChild(n FSNode) error {
+	return d.StaticDir.addChild(n, d)
+}
+
+// DynamicDir is a Dir whose children are all generated on demand, by the
+// function passed to NewDynamicDir, for directories such as one listing
+// live processes. The generated children are kept for the DynamicDir's
+// TTL, so that a walk and the reads after it see the same set, and are
+// generated again once it has passed.
+//
+// Children keep their Qid path for as long as they keep being listed: a
+// child listed with the name and type of one listed the time before is
+// given its Qid path, whatever Qid the function made it with, so clients
+// see it as the same file. Each time the set of names changes, the DynamicDir's own
+// Qid.Vers is incremented.
+type DynamicDir struct {
+	dStat  proto.Stat
+	parent Dir
+	sync.RWMutex
+
+	list     func() []FSNode
+	ttl      time.Duration
+	listMu   sync.Mutex // held while the children are regenerated.
+	children map[string]FSNode
+	qids     map[string]proto.Qid
+	expires  time.Time
+}
+
+// NewDynamicDir creates a DynamicDir which calls list to generate its
+// children, at most once every ttl. A ttl of 0 generates them every time
+// the directory is walked or read.
+func NewDynamicDir(stat *proto.Stat, ttl time.Duration, list func() []FSNode) *DynamicDir {
+	d := &DynamicDir{
+		dStat: *stat,
+		list:  list,
+		ttl:   ttl,
+	}
+	d.dStat.Mode |= proto.DMDIR
+	d.dStat.Qid.Qtype = uint8(d.dStat.Mode >> 24)
+	return d
+}
+
+func (d *DynamicDir) Stat() proto.Stat {
+	d.RLock()
+	defer d.RUnlock()
+	return d.dStat
+}
+
+func (d *DynamicDir) WriteStat(s *proto.Stat) error {
+	d.Lock()
+	defer d.Unlock()
+	d.dStat = *s
+	return nil
+}
+
+func (d *DynamicDir) SetParent(p Dir) {
+	d.Lock()
+	defer d.Unlock()
+	d.parent = p
+}
+
+func (d *DynamicDir) Parent() Dir {
+	d.RLock()
+	defer d.RUnlock()
+	return d.parent
+}
+
+// Children returns the generated children, generating them again if the
+// TTL has passed.
+func (d *DynamicDir) Children() map[string]FSNode {
+	d.listMu.Lock()
+	defer d.listMu.Unlock()
+	if d.children == nil || !time.Now().Before(d.expires) {
+		d.refresh()
+	}
+	ret := make(map[string]FSNode, len(d.children))
+	for name, n := range d.children {
+		ret[name] = n
+	}
+	return ret
+}
+
+// refresh generates the children, giving those listed before their old
+// Qid paths. d.listMu must be held.
+func (d *DynamicDir) refresh() {
+	children := make(map[string]FSNode)
+	qids := make(map[string]proto.Qid)
+	for _, n := range d.list() {
+		st := n.Stat()
+		if !validName(st.Name) {
+			continue
+		}
+		if old, ok := d.qids[st.Name]; ok && old.Qtype == st.Qid.Qtype && old.Uid != st.Qid.Uid {
+			st.Qid.Uid = old.Uid
+			n.WriteStat(&st)
+		}
+		n.SetParent(d)
+		children[st.Name] = n
+		qids[st.Name] = n.Stat().Qid
+	}
+	changed := len(children) != len(d.children)
+	for name := range children {
+		if _, ok := d.children[name]; !ok {
+			changed = true
+		}
+	}
+	if changed && d.children != nil {
+		d.Lock()
+		d.dStat.Qid.Vers++
+		d.Unlock()
+	}
+	d.children = children
+	d.qids = qids
+	d.expires = time.Now().Add(d.ttl)
+}
@@ -0,0 +1,193 @@
+//go:build go1.16
+// +build go1.16
+
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc64"
+	"io"
+	iofs "io/fs"
+	"path"
+	"sync"
+
+	"github.com/knusbaum/go9p/proto"
+)
+
+var errReadOnly = errors.New("Read-only file system.")
+
+var embedCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// NewEmbedFS returns an FS serving the files of fsys read-only. fsys is
+// usually an embed.FS, but may be any io/fs.FS. If prefix is not empty, the
+// subdirectory prefix of fsys is served as the root instead. Every file is
+// owned by user and group "none", and write permissions are removed.
+// Creating, removing, writing and changing the attributes of files all fail.
+//
+// Qids are derived from each file's path, so they are the same every time
+// the FS is built from the same fsys.
+func NewEmbedFS(fsys iofs.FS, prefix string) (*FS, error) {
+	if prefix != "" && prefix != "." {
+		sub, err := iofs.Sub(fsys, prefix)
+		if err != nil {
+			return nil, err
+		}
+		fsys = sub
+	}
+	root := &embedDir{embedNode{fsys: fsys, name: "."}}
+	if _, err := iofs.Stat(fsys, "."); err != nil {
+		return nil, err
+	}
+	efs := &FS{Root: root}
+	efs.CreateFile = func(*FS, Dir, string, string, uint32, uint8) (File, error) {
+		return nil, errReadOnly
+	}
+	efs.CreateDir = func(*FS, Dir, string, string, uint32, uint8) (Dir, error) {
+		return nil, errReadOnly
+	}
+	efs.RemoveFile = func(*FS, FSNode) error {
+		return errReadOnly
+	}
+	return efs, nil
+}
+
+// embedNode holds what is common to files and directories of an embedded
+// file system. name is the node's path within fsys.
+type embedNode struct {
+	fsys   iofs.FS
+	name   string
+	parent Dir
+}
+
+func (n *embedNode) Stat() proto.Stat {
+	var mode uint32
+	var length uint64
+	var mtime uint32
+	info, err := iofs.Stat(n.fsys, n.name)
+	if err == nil {
+		mode = uint32(info.Mode().Perm()) &^ 0222
+		if info.IsDir() {
+			mode |= proto.DMDIR
+		} else {
+			length = uint64(info.Size())
+		}
+		if t := info.ModTime(); !t.IsZero() {
+			mtime = uint32(t.Unix())
+		}
+	}
+	name := path.Base(n.name)
+	if n.name == "." {
+		name = "/"
+	}
+	return proto.Stat{
+		Qid: proto.Qid{
+			Qtype: uint8(mode >> 24),
+			Uid:   crc64.Checksum([]byte(n.name), embedCRCTable),
+		},
+		Mode:   mode,
+		Atime:  mtime,
+		Mtime:  mtime,
+		Length: length,
+		Name:   name,
+		Uid:    "none",
+		Gid:    "none",
+		Muid:   "none",
+	}
+}
+
+func (n *embedNode) WriteStat(s *proto.Stat) error {
+	return errReadOnly
+}
+
+func (n *embedNode) SetParent(d Dir) {
+	n.parent = d
+}
+
+func (n *embedNode) Parent() Dir {
+	return n.parent
+}
+
+type embedDir struct {
+	embedNode
+}
+
+func (d *embedDir) Children() map[string]FSNode {
+	entries, err := iofs.ReadDir(d.fsys, d.name)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]FSNode, len(entries))
+	for _, e := range entries {
+		n := embedNode{fsys: d.fsys, name: path.Join(d.name, e.Name()), parent: d}
+		if e.IsDir() {
+			m[e.Name()] = &embedDir{n}
+		} else {
+			m[e.Name()] = &embedFile{embedNode: n}
+		}
+	}
+	return m
+}
+
+type embedFile struct {
+	embedNode
+	opens map[uint64]io.ReaderAt
+	sync.Mutex
+}
+
+func (f *embedFile) Open(fid uint64, omode proto.Mode) error {
+	if omode&0x0F == proto.Owrite || omode&0x0F == proto.Ordwr || omode&proto.Otrunc != 0 {
+		return errReadOnly
+	}
+	file, err := f.fsys.Open(f.name)
+	if err != nil {
+		return err
+	}
+	ra, ok := file.(io.ReaderAt)
+	if !ok {
+		// Not every fs.File can read at an offset.
+		bs, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		ra = bytes.NewReader(bs)
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.opens == nil {
+		f.opens = make(map[uint64]io.ReaderAt)
+	}
+	f.opens[fid] = ra
+	return nil
+}
+
+func (f *embedFile) Read(fid uint64, offset uint64, count uint64) ([]byte, error) {
+	f.Lock()
+	ra, ok := f.opens[fid]
+	f.Unlock()
+	if !ok {
+		return nil, errors.New("File not open.")
+	}
+	bs := make([]byte, count)
+	n, err := ra.ReadAt(bs, int64(offset))
+	if n > 0 || err == io.EOF {
+		return bs[:n], nil
+	}
+	return nil, err
+}
+
+func (f *embedFile) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
+	return 0, errReadOnly
+}
+
+func (f *embedFile) Close(fid uint64) error {
+	f.Lock()
+	ra := f.opens[fid]
+	delete(f.opens, fid)
+	f.Unlock()
+	if c, ok := ra.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
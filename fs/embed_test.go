@@ -0,0 +1,57 @@
+//go:build go1.16
+// +build go1.16
+
+package fs
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/knusbaum/go9p/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbedFS(t *testing.T) {
+	assert := assert.New(t)
+	assets := fstest.MapFS{
+		"assets/conf/app.conf": {Data: []byte("debug = false\n"), Mode: 0644},
+		"assets/README":        {Data: []byte("read me"), Mode: 0644},
+		"other":                {Data: []byte("not served")},
+	}
+	efs, err := NewEmbedFS(assets, "assets")
+	require.NoError(t, err)
+
+	children := efs.Root.(Dir).Children()
+	assert.Len(children, 2)
+	assert.Contains(children, "conf")
+	assert.Contains(children, "README")
+	conf := children["conf"].(Dir).Children()["app.conf"]
+	st := conf.Stat()
+	assert.Equal(uint32(0444), st.Mode)
+	assert.Equal(uint64(14), st.Length)
+
+	// Qids are the same however many times the FS is built.
+	efs2, err := NewEmbedFS(assets, "assets")
+	require.NoError(t, err)
+	assert.Equal(st.Qid, efs2.Root.(Dir).Children()["conf"].(Dir).Children()["app.conf"].Stat().Qid)
+
+	c := serveTest(t, efs)
+	defer c.Close()
+	c.attach(1, "glenda")
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 2, Wname: []string{"conf", "app.conf"}})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Owrite})
+	assert.IsType(&proto.RError{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 2, Offset: 8, Count: 100})
+	require.IsType(t, &proto.RRead{}, r)
+	assert.Equal("false\n", string(r.(*proto.RRead).Data))
+
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 3, Nwname: 0})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TCreate{Header: proto.Header{Type: proto.Tcreate, Tag: 1}, Fid: 3, Name: "new", Perm: 0666, Mode: uint8(proto.Owrite)})
+	assert.IsType(&proto.RError{}, r)
+}
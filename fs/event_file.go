@@ -0,0 +1,128 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/knusbaum/go9p/proto"
+)
+
+// eventQueue holds the events waiting to be read by one fid.
+type eventQueue struct {
+	events [][]byte
+	ready  chan struct{} // signalled when events are queued.
+	done   chan struct{} // closed when the fid is closed.
+}
+
+// EventFile is a file whose reads block until the server has something new
+// to say, in the manner of Plan 9 event files. Every fid open on the file
+// receives its own copy of each Notify made while it is open. A read
+// returns the oldest queued event, or as much of it as fits; the rest is
+// returned by the next read. When nothing is queued, reads block until
+// Notify is called or the fid is closed, in which case the read returns no
+// data. A blocked read that the client flushes gives up without taking an
+// event, which the next read returns. Clients may not write to an
+// EventFile.
+type EventFile struct {
+	*BaseFile
+	queues     map[uint64]*eventQueue
+	queuesLock sync.Mutex
+}
+
+// NewEventFile creates an EventFile with the given stat.
+func NewEventFile(stat *proto.Stat) *EventFile {
+	return &EventFile{
+		BaseFile: NewBaseFile(markStream(stat)),
+		queues:   make(map[uint64]*eventQueue),
+	}
+}
+
+// Notify queues a copy of data for every fid currently open on f, waking
+// any readers blocked waiting for it.
+func (f *EventFile) Notify(data []byte) {
+	f.queuesLock.Lock()
+	defer f.queuesLock.Unlock()
+	for _, q := range f.queues {
+		bs := make([]byte, len(data))
+		copy(bs, data)
+		q.events = append(q.events, bs)
+		select {
+		case q.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (f *EventFile) Stat() proto.Stat {
+	stat := f.BaseFile.Stat()
+	stat.Length = 0
+	return stat
+}
+
+func (f *EventFile) Open(fid uint64, omode proto.Mode) error {
+	if omode&0x0F == proto.Owrite || omode&0x0F == proto.Ordwr {
+		return errors.New("Cannot open event file for writing.")
+	}
+	f.queuesLock.Lock()
+	defer f.queuesLock.Unlock()
+	f.queues[fid] = &eventQueue{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	return nil
+}
+
+func (f *EventFile) Read(fid uint64, offset uint64, count uint64) ([]byte, error) {
+	return f.ReadContext(context.Background(), fid, offset, count)
+}
+
+// ReadContext is Read, giving up when ctx is cancelled.
+func (f *EventFile) ReadContext(ctx context.Context, fid uint64, offset uint64, count uint64) ([]byte, error) {
+	f.queuesLock.Lock()
+	q, ok := f.queues[fid]
+	f.queuesLock.Unlock()
+	if !ok {
+		return nil, errors.New("Failed to read event file. Not opened for read.")
+	}
+	for {
+		f.queuesLock.Lock()
+		if ctx.Err() != nil {
+			// Flushed, so the event would never reach the client.
+			f.queuesLock.Unlock()
+			return nil, ctx.Err()
+		}
+		if len(q.events) > 0 {
+			ev := q.events[0]
+			if uint64(len(ev)) > count {
+				q.events[0] = ev[count:]
+				ev = ev[:count]
+			} else {
+				q.events = q.events[1:]
+			}
+			f.queuesLock.Unlock()
+			return ev, nil
+		}
+		f.queuesLock.Unlock()
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return nil, nil
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (f *EventFile) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
+	return 0, errors.New("Cannot write to event file.")
+}
+
+func (f *EventFile) Close(fid uint64) error {
+	f.queuesLock.Lock()
+	defer f.queuesLock.Unlock()
+	if q, ok := f.queues[fid]; ok {
+		close(q.done)
+		delete(f.queues, fid)
+	}
+	return nil
+}
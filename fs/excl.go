@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"sync"
+	"time"
+)
+
+// exclTimeout is how long an exclusive-use (DMEXCL) file may sit unused
+// before its lock is broken and another fid may open it.
+var exclTimeout = 5 * time.Minute
+
+type exclLock struct {
+	fid  uint64 // connection-qualified fid holding the lock.
+	used time.Time
+}
+
+// exclLocks tracks which DMEXCL nodes are open, and by whom.
+type exclLocks struct {
+	locks map[FSNode]*exclLock
+	sync.Mutex
+}
+
+// acquire locks n for fid. It returns false if another fid holds a lock
+// on n that has been used within exclTimeout.
+func (l *exclLocks) acquire(n FSNode, fid uint64) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.locks == nil {
+		l.locks = make(map[FSNode]*exclLock)
+	}
+	now := time.Now()
+	if lock, ok := l.locks[n]; ok && lock.fid != fid && now.Sub(lock.used) < exclTimeout {
+		return false
+	}
+	l.locks[n] = &exclLock{fid: fid, used: now}
+	return true
+}
+
+// touch records a use of n by fid, keeping its lock alive.
+func (l *exclLocks) touch(n FSNode, fid uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if lock, ok := l.locks[n]; ok && lock.fid == fid {
+		lock.used = time.Now()
+	}
+}
+
+// release drops fid's lock on n, if it holds one.
+func (l *exclLocks) release(n FSNode, fid uint64) {
+	l.Lock()
+	defer l.Unlock()
+	if lock, ok := l.locks[n]; ok && lock.fid == fid {
+		delete(l.locks, n)
+	}
+}
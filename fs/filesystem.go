@@ -17,10 +17,12 @@
 package fs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -64,6 +66,37 @@ type File interface {
 	Close(fid uint64) error
 }
 
+// Syncer is a File that wants to know when a client is done writing, for
+// instance to persist the data durably. 9P2000 has no fsync, so Sync is
+// called when a fid opened for writing is released, by Tclunk, Tremove or
+// the loss of the connection, just before Close. An error from Sync is
+// returned to the client in place of Rclunk.
+type Syncer interface {
+	File
+	Sync(fid uint64) error
+}
+
+// ContextReader is a File whose reads may block until something happens,
+// such as an EventFile. ReadContext is called in place of Read, with a
+// context that is cancelled when the client flushes the read or the
+// connection ends, so that the read can give up. Its reply is not sent
+// once the context is cancelled.
+type ContextReader interface {
+	File
+	ReadContext(ctx context.Context, fid uint64, offset uint64, count uint64) ([]byte, error)
+}
+
+// Sizer is a File whose length is expensive to find, such as a generated
+// report. Its Stat need not fill in Length, so that listing its directory
+// doesn't size it; the length is only found, by calling Size, when the
+// file itself is statted. Clients that take lengths from directory
+// listings see the length Stat reports, usually 0. A wstat only changes
+// the Length Stat reports if it sets one.
+type Sizer interface {
+	File
+	Size() (uint64, error)
+}
+
 // Dir represents a directory within the Filesystem.
 type Dir interface {
 	FSNode
@@ -77,18 +110,42 @@ type ModDir interface {
 	DeleteChild(name string) error
 }
 
+// maxPathDepth bounds the number of parents FullPath will follow.
+const maxPathDepth = 1024
+
 // FullPath is a helper function that assembles the names
 // of all the parent nodes of f into a full path string.
+// If f has more than maxPathDepth ancestors, which usually means
+// a node is its own ancestor, the path of the nearest ones is
+// returned, prefixed with "(cycle)".
 func FullPath(f FSNode) string {
 	if f == nil {
 		return ""
 	}
-	parent := f.Parent()
-	if parent == nil {
-		return f.Stat().Name
+	var names []string
+	var n FSNode = f
+	for {
+		names = append(names, n.Stat().Name)
+		parent := n.Parent()
+		if parent == nil {
+			break
+		}
+		if len(names) > maxPathDepth {
+			names = append(names, "(cycle)")
+			break
+		}
+		n = parent
 	}
-	fp := FullPath(parent)
-	return strings.Replace(fp+"/"+f.Stat().Name, "//", "/", -1)
+
+	var b strings.Builder
+	b.WriteString(names[len(names)-1])
+	for i := len(names) - 2; i >= 0; i-- {
+		if !strings.HasSuffix(b.String(), "/") {
+			b.WriteByte('/')
+		}
+		b.WriteString(names[i])
+	}
+	return b.String()
 }
 
 // BaseNode provides a basic FSNode. It is intended to be embedded in other structures implementing
@@ -115,7 +172,7 @@ func (n *BaseNode) Parent() Dir {
 
 func NewBaseNode(fs *FS, parent Dir, name, uid, gid string, mode uint32) BaseNode {
 	return BaseNode{
-		FStat:   *fs.NewStat(name, uid, gid, mode),
+		FStat:   *fs.newStat(childPath(parent, name), name, uid, gid, mode),
 		FParent: parent,
 	}
 }
@@ -140,6 +197,8 @@ func NewBaseFile(s *proto.Stat) *BaseFile {
 }
 
 func (f *BaseFile) Stat() proto.Stat {
+	f.RLock()
+	defer f.RUnlock()
 	return f.fStat
 }
 
@@ -198,13 +257,32 @@ func (f *BaseFile) Close(fid uint64) error {
 // instances of Dir can have children. Instances of File can only be leaves of
 // the tree.
 type FS struct {
-	Root        Dir
-	CreateFile  func(fs *FS, parent Dir, user, name string, perm uint32, mode uint8) (File, error)
-	CreateDir   func(fs *FS, parent Dir, user, name string, perm uint32, mode uint8) (Dir, error)
-	WalkFail    func(fs *FS, parent Dir, name string) (FSNode, error)
-	RemoveFile  func(fs *FS, f FSNode) error
-	uid         uint64 // uid for generating Qids.
-	ignorePerms bool   // When true, the server will ignore user/group permissions
+	Root       Dir
+	CreateFile func(fs *FS, parent Dir, user, name string, perm uint32, mode uint8) (File, error)
+	CreateDir  func(fs *FS, parent Dir, user, name string, perm uint32, mode uint8) (Dir, error)
+	WalkFail   func(fs *FS, parent Dir, name string) (FSNode, error)
+	RemoveFile func(fs *FS, f FSNode) error
+	// GroupResolver decides group membership for permission checks. If
+	// nil, a user is only a member of the group with the same name.
+	GroupResolver GroupResolver
+	// UserDB lists the known users and groups. See WithValidateMuid.
+	UserDB       UserDB
+	uid          uint64 // uid for generating Qids.
+	qidGen       func(path string, mode uint32) proto.Qid
+	ignorePerms  bool // When true, the server will ignore user/group permissions
+	removeTmp    bool // When true, DMTMP files are removed when their creator disconnects
+	crossRename  bool // When true, a wstat name containing "/" moves the node
+	fixedTimes   bool // When true, reads and writes leave Atime, Mtime and Muid alone
+	validateMuid bool // When true, reject unknown users and groups from UserDB
+	excl         exclLocks
+	// maxDirEntries limits the entries listed by a directory read. 0 means no limit.
+	maxDirEntries int
+	// maxDepth and maxPathLen limit the paths clients can walk to and
+	// create. 0 means the default.
+	maxDepth   int
+	maxPathLen int
+	// roots are the trees added with AddRoot, by aname.
+	roots map[string]Dir
 	// doAuth bool
 	authFunc func(s io.ReadWriter) (string, error)
 	sync.RWMutex
@@ -214,18 +292,74 @@ type FS struct {
 // like setting the various hook functions.
 func NewFS(rootUser, rootGroup string, rootPerms uint32, opts ...Option) (*FS, *StaticDir) {
 	var fs FS
-	d := NewStaticDir(fs.NewStat("/", rootUser, rootGroup, rootPerms|proto.DMDIR))
-	fs.Root = d
 	for _, o := range opts {
 		o(&fs)
 	}
+	d := NewStaticDir(fs.newStat("/", "/", rootUser, rootGroup, rootPerms|proto.DMDIR))
+	fs.Root = d
 	return &fs, d
 }
 
+// AddRoot makes d the root of a tree served to clients attaching with
+// aname, so that one FS can serve several trees. Root is still served to
+// clients attaching with an empty aname. Once a root has been added,
+// attaches with an aname that is not known fail; until then, every aname
+// attaches to Root. Adding a root for an aname that has one replaces it.
+func (fs *FS) AddRoot(aname string, d Dir) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.roots == nil {
+		fs.roots = make(map[string]Dir)
+	}
+	fs.roots[aname] = d
+}
+
+// NewRoot creates an empty StaticDir owned by rootUser and rootGroup with
+// rootPerms, and adds it with AddRoot as the root for aname.
+func (fs *FS) NewRoot(aname, rootUser, rootGroup string, rootPerms uint32) *StaticDir {
+	d := NewStaticDir(fs.newStat("/", "/", rootUser, rootGroup, rootPerms|proto.DMDIR))
+	fs.AddRoot(aname, d)
+	return d
+}
+
+// root returns the root of the tree served to clients attaching with
+// aname.
+func (fs *FS) root(aname string) (Dir, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	if d, ok := fs.roots[aname]; ok {
+		return d, nil
+	}
+	if aname != "" && len(fs.roots) > 0 {
+		return nil, fmt.Errorf("No such file system: %s", aname)
+	}
+	return fs.Root, nil
+}
+
 // NewQid generates a new, unique proto.Qid for use in a new file.
 // Each file in the FS should have a unique proto.Qid. statMode
 // should come from the file's Stat().Mode
+//
+// NewQid always uses the default counter. If the FS was configured
+// WithQidGenerator, use NewQidAt instead, as the generator needs the
+// file's path.
 func (fs *FS) NewQid(statMode uint32) proto.Qid {
+	return fs.newQid("", statMode)
+}
+
+// NewQidAt is NewQid for the file at path, its full path within the tree,
+// such as "/a/b". If the FS was configured WithQidGenerator, the Qid comes
+// from the generator.
+func (fs *FS) NewQidAt(path string, statMode uint32) proto.Qid {
+	return fs.newQid(path, statMode)
+}
+
+// newQid returns a Qid for the file at path, or one from the counter if
+// path is empty.
+func (fs *FS) newQid(path string, statMode uint32) proto.Qid {
+	if fs.qidGen != nil && path != "" {
+		return fs.qidGen(path, statMode)
+	}
 	fs.Lock()
 	defer fs.Unlock()
 	uid := fs.uid
@@ -237,15 +371,67 @@ func (fs *FS) NewQid(statMode uint32) proto.Qid {
 	}
 }
 
+// Find returns the node at path, an absolute path within the tree such as
+// "/a/b". Each element must name a child of a Dir; ".." names the parent.
+// Unlike walks by clients, Find does not call WalkFail, so it only finds
+// nodes already in the tree. It is safe to call from hooks such as
+// CreateFile. Trees added with AddRoot are searched with FindFrom.
+func (fs *FS) Find(path string) (FSNode, error) {
+	fs.RLock()
+	root := fs.Root
+	fs.RUnlock()
+	return FindFrom(root, path)
+}
+
+// FindFrom is Find in the tree whose root is root.
+func FindFrom(root Dir, path string) (FSNode, error) {
+	var n FSNode = root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		dir, ok := n.(Dir)
+		if !ok {
+			return nil, fmt.Errorf("%s: Not a directory", FullPath(n))
+		}
+		if name == ".." {
+			if parent := dir.Parent(); parent != nil {
+				n = parent
+			}
+			continue
+		}
+		child, ok := dir.Children()[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: No such file or directory", path)
+		}
+		n = child
+	}
+	return n, nil
+}
+
 // NewStat creates and returns a new proto.Stat object for use with a
 // FSNode. name will be the name of the node, and it will be owned by
 // user uid and group gid. mode is standard unix permissions bits, along
-// with any special mode bits (e.g. proto.DMDIR for directories)
+// with any special mode bits (e.g. proto.DMDIR for directories). As with
+// NewQid, the stat's Qid comes from the default counter; use NewStatAt if
+// the FS was configured WithQidGenerator.
 func (fs *FS) NewStat(name, uid, gid string, mode uint32) *proto.Stat {
+	return fs.newStat("", name, uid, gid, mode)
+}
+
+// NewStatAt is NewStat for a node named name in the directory whose full
+// path is dir, such as "/a". Its Qid is made with NewQidAt.
+func (fs *FS) NewStatAt(dir, name, uid, gid string, mode uint32) *proto.Stat {
+	return fs.newStat(path.Join(dir, name), name, uid, gid, mode)
+}
+
+// newStat is NewStat for a node whose path is known, which is passed to
+// the Qid generator. If path is empty, the Qid comes from the counter.
+func (fs *FS) newStat(path, name, uid, gid string, mode uint32) *proto.Stat {
 	return &proto.Stat{
 		Type:   0,
 		Dev:    0,
-		Qid:    fs.NewQid(mode),
+		Qid:    fs.newQid(path, mode),
 		Mode:   mode,
 		Atime:  uint32(time.Now().Unix()),
 		Mtime:  uint32(time.Now().Unix()),
@@ -257,6 +443,26 @@ func (fs *FS) NewStat(name, uid, gid string, mode uint32) *proto.Stat {
 	}
 }
 
+// rootOf returns the root of the tree n is in.
+func rootOf(n Dir) Dir {
+	for i := 0; i <= maxPathDepth; i++ {
+		p := n.Parent()
+		if p == nil {
+			break
+		}
+		n = p
+	}
+	return n
+}
+
+// childPath returns the path of a node called name in parent.
+func childPath(parent Dir, name string) string {
+	if parent == nil {
+		return name
+	}
+	return path.Join(FullPath(parent), name)
+}
+
 // RMFile is a function intended to be used with the WithRemoveFile Option.
 // RMFile simply enables the deletion of files and directories on the
 // FS subject to usual permissions checks.
@@ -328,6 +534,130 @@ func WithAuth(authFunc func(s io.ReadWriter) (string, error)) Option {
 	}
 }
 
+// WithGroupResolver configures the function used to decide whether a user
+// is a member of a group when checking permissions. Members of a file's
+// group are granted the group permission bits.
+func WithGroupResolver(r GroupResolver) Option {
+	return func(fs *FS) {
+		fs.GroupResolver = r
+	}
+}
+
+// WithUserDB configures the database of known users and groups.
+func WithUserDB(db UserDB) Option {
+	return func(fs *FS) {
+		fs.UserDB = db
+	}
+}
+
+// WithValidateMuid configures whether the server rejects operations that
+// would record a user or group unknown to the FS's UserDB as the Uid, Gid
+// or Muid of a file. This affects Tcreate, which records the creating user,
+// Twrite to files whose Muid the server keeps (see WithFixedTimes), and
+// Twstat changing the Gid. It has no effect unless a UserDB is set.
+// It is off by default.
+func WithValidateMuid(validate bool) Option {
+	return func(fs *FS) {
+		fs.validateMuid = validate
+	}
+}
+
+// WithMaxDirEntries limits the number of entries a client can read from a
+// single open directory to max. Directories with more children are listed
+// as if they contained only the first max of them by name; the rest are
+// still reachable by walking to them by name. Each open directory fid keeps
+// only the listed entries, but opening the directory still asks it for all
+// of its Children, so this does not bound the memory used while opening a
+// large directory.
+func WithMaxDirEntries(max int) Option {
+	return func(fs *FS) {
+		fs.maxDirEntries = max
+	}
+}
+
+// The limits on paths used by FSes not configured with WithMaxDepth or
+// WithMaxPathLen.
+const (
+	DefaultMaxDepth   = 1024
+	DefaultMaxPathLen = 64 * 1024
+)
+
+// WithMaxDepth limits the paths clients can walk to or create files at to
+// max names below the root. Walks that would go deeper fail before the
+// FS's WalkFail function is called, so a WalkFail that makes up nodes for
+// any name can't be made to build an endless tree.
+func WithMaxDepth(max int) Option {
+	return func(fs *FS) {
+		fs.maxDepth = max
+	}
+}
+
+// WithMaxPathLen limits the full paths clients can walk to or create files
+// at to max bytes, much as WithMaxDepth limits their depth.
+func WithMaxPathLen(max int) Option {
+	return func(fs *FS) {
+		fs.maxPathLen = max
+	}
+}
+
+// pathLimits returns the FS's limits on the depth and length of paths.
+func (fs *FS) pathLimits() (depth, length int) {
+	depth, length = DefaultMaxDepth, DefaultMaxPathLen
+	if fs.maxDepth > 0 {
+		depth = fs.maxDepth
+	}
+	if fs.maxPathLen > 0 {
+		length = fs.maxPathLen
+	}
+	return depth, length
+}
+
+// pathSize returns how many names below its root n is, and the length of
+// its full path. It stops counting past the FS's depth limit.
+func (fs *FS) pathSize(n FSNode) (depth, length int) {
+	maxDepth, _ := fs.pathLimits()
+	for p := n; depth <= maxDepth; depth++ {
+		parent := p.Parent()
+		if parent == nil {
+			break
+		}
+		length += len(p.Stat().Name) + 1
+		p = parent
+	}
+	return depth, length
+}
+
+// checkPath returns an error if name, in a directory depth names below the
+// root whose path is length bytes long, would be past the FS's limits.
+func (fs *FS) checkPath(depth, length int, name string) error {
+	if name == ".." {
+		return nil
+	}
+	maxDepth, maxLen := fs.pathLimits()
+	if depth+1 > maxDepth {
+		return fmt.Errorf("Path too deep: at most %d names.", maxDepth)
+	}
+	if length+1+len(name) > maxLen {
+		return fmt.Errorf("Path too long: at most %d bytes.", maxLen)
+	}
+	return nil
+}
+
+// WithQidGenerator configures the function used to generate the Qids of new
+// files in place of the default counter, which starts from 0 each time the
+// server starts. A generator deriving Qids from some stable identity of the
+// file lets clients keep caching by Qid across server restarts. gen is
+// passed the mode of the file and its full path. It is called when a
+// file's Qid is made, by the FS or by NewQidAt and NewStatAt; the Qid stays
+// the same if the file is later moved. NewQid and NewStat have no path to
+// pass it, so they use the counter. The generator must return distinct Qid
+// paths for distinct files.
+func WithQidGenerator(gen func(path string, mode uint32) proto.Qid) Option {
+	return func(fs *FS) {
+		fs.qidGen = gen
+	}
+}
+
 // IgnorePermissions configures the server to not enforce user/group permissions bits. This is
 // useful, for instance, when permissions need to be enforced at a higher level, or by an
 // underlying file system that is being exported by the server.
@@ -337,6 +667,49 @@ func IgnorePermissions() Option {
 	}
 }
 
+// RemoveTmpOnClose configures the server to remove the files a client
+// creates with the proto.DMTMP bit set once the client's connection
+// closes, making them scratch files that do not outlive the session. Files
+// are removed with the FS's RemoveFile function, or RMFile if none is set.
+// A file whose DMTMP bit has been cleared by a wstat is kept.
+func RemoveTmpOnClose() Option {
+	return func(fs *FS) {
+		fs.removeTmp = true
+	}
+}
+
+// WithCrossDirRename lets clients move nodes between directories, which
+// 9P itself cannot do. It is not standard 9P: a wstat whose name contains
+// a "/" is taken as the path to move the node to, relative to the node's
+// directory unless it begins with "/". The node is deleted from its
+// directory and added to the new one, both of which must be ModDirs the
+// user may write. Only clients that know of this convention use it;
+// mount9p does, and falls back to EXDEV against servers without it.
+func WithCrossDirRename() Option {
+	return func(fs *FS) {
+		fs.crossRename = true
+	}
+}
+
+// WithFixedTimes stops the server from updating the Atime of StaticFiles
+// when clients read them, and their Mtime and Muid when clients write
+// them, for servers that want their timestamps to stay as they were set.
+// Qid.Vers still changes with every change to a file's contents.
+func WithFixedTimes() Option {
+	return func(fs *FS) {
+		fs.fixedTimes = true
+	}
+}
+
+// timedNode is a node whose times are kept up to date by the server,
+// unless the FS is configured WithFixedTimes.
+type timedNode interface {
+	// accessed records a read by a client.
+	accessed()
+	// modified records a write by the client's user uname.
+	modified(uname string)
+}
+
 func Plan9Auth(s io.ReadWriter) (string, error) {
 	log.Println("STARTING LIBAUTH PROXY")
 	defer log.Println("FINISHED LIBAUTH PROXY")
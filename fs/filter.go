@@ -0,0 +1,68 @@
+package fs
+
+import (
+	"fmt"
+)
+
+type filterDir struct {
+	Dir
+	hide func(name string) bool
+}
+
+type filterModDir struct {
+	filterDir
+	mod ModDir
+}
+
+// FilterDir returns a view of d that hides every child whose name matches
+// hide. Hidden children are omitted from directory reads and cannot be
+// walked to. The filter applies to subdirectories as well, so hiding ".git"
+// hides it anywhere below d. The underlying tree is not modified.
+//
+// If d is a ModDir, so is the returned Dir, but children with hidden names
+// cannot be added or deleted through it.
+func FilterDir(d Dir, hide func(name string) bool) Dir {
+	fd := filterDir{Dir: d, hide: hide}
+	if mod, ok := d.(ModDir); ok {
+		return &filterModDir{filterDir: fd, mod: mod}
+	}
+	return &fd
+}
+
+func (d *filterDir) Children() map[string]FSNode {
+	children := d.Dir.Children()
+	visible := make(map[string]FSNode, len(children))
+	for name, child := range children {
+		if d.hide(name) {
+			continue
+		}
+		if cd, ok := child.(Dir); ok {
+			child = FilterDir(cd, d.hide)
+		}
+		visible[name] = child
+	}
+	return visible
+}
+
+func (d *filterDir) Parent() Dir {
+	p := d.Dir.Parent()
+	if p == nil {
+		return nil
+	}
+	return FilterDir(p, d.hide)
+}
+
+func (d *filterModDir) AddChild(n FSNode) error {
+	name := n.Stat().Name
+	if d.hide(name) {
+		return fmt.Errorf("%s: Permission denied.", name)
+	}
+	return d.mod.AddChild(n)
+}
+
+func (d *filterModDir) DeleteChild(name string) error {
+	if d.hide(name) {
+		return fmt.Errorf("%s: No such file.", name)
+	}
+	return d.mod.DeleteChild(name)
+}
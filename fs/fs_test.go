@@ -1,7 +1,15 @@
 package fs
 
 import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/knusbaum/go9p/proto"
 
@@ -38,6 +46,105 @@ func TestStaticDir(t *testing.T) {
 	assert.Len(root.Children(), 0)
 }
 
+func TestAddChild(t *testing.T) {
+	assert := assert.New(t)
+	var fs FS
+	root := NewStaticDir(fs.NewStat("/", "user", "group", 0777))
+	d := NewStaticDir(fs.NewStat("dir", "user", "group", 0777))
+	assert.NoError(root.AddChild(d))
+	assert.Equal(Dir(root), d.Parent())
+
+	assert.Error(root.AddChild(NewStaticFile(fs.NewStat("dir", "user", "group", 0666), nil)))
+	assert.Equal(d, root.Children()["dir"])
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		assert.Error(root.AddChild(NewStaticFile(fs.NewStat(name, "user", "group", 0666), nil)), name)
+	}
+	assert.Error(root.AddChild(nil))
+	// Directories cannot contain themselves or their ancestors.
+	assert.Error(d.AddChild(d))
+	sub := NewStaticDir(fs.NewStat("sub", "user", "group", 0777))
+	assert.NoError(d.AddChild(sub))
+	assert.Error(sub.AddChild(d))
+
+	assert.Error(root.DeleteChild("missing"))
+	assert.NoError(root.DeleteChild("dir"))
+	assert.Nil(d.Parent())
+	assert.Error(root.DeleteChild("dir"))
+
+	// Only one of many concurrent adds of a name succeeds.
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- root.AddChild(NewStaticFile(fs.NewStat("racy", "user", "group", 0666), nil))
+		}()
+	}
+	var added int
+	for i := 0; i < 10; i++ {
+		if <-errs == nil {
+			added++
+		}
+	}
+	assert.Equal(1, added)
+	assert.Len(root.Children(), 1)
+}
+
+func TestFullPath(t *testing.T) {
+	assert := assert.New(t)
+	var fs FS
+	root := NewStaticDir(fs.NewStat("/", "user", "group", 0777))
+	a := NewStaticDir(fs.NewStat("a", "user", "group", 0777))
+	f := NewStaticFile(fs.NewStat("f", "user", "group", 0666), nil)
+	assert.NoError(root.AddChild(a))
+	assert.NoError(a.AddChild(f))
+	assert.Equal("/", FullPath(root))
+	assert.Equal("/a", FullPath(a))
+	assert.Equal("/a/f", FullPath(f))
+	assert.Equal("", FullPath(nil))
+
+	root.WriteStat(fs.NewStat("", "user", "group", 0777))
+	assert.Equal("/a/f", FullPath(f))
+
+	// A cycle must not loop forever.
+	x := NewStaticDir(fs.NewStat("x", "user", "group", 0777))
+	y := NewStaticDir(fs.NewStat("y", "user", "group", 0777))
+	x.SetParent(y)
+	y.SetParent(x)
+	p := FullPath(x)
+	assert.True(strings.HasPrefix(p, "(cycle)/"), p)
+	assert.True(strings.HasSuffix(p, "/y/x"), p)
+}
+
+func TestFind(t *testing.T) {
+	assert := assert.New(t)
+	fs, root := NewFS("user", "group", 0777)
+	a := NewStaticDir(fs.NewStat("a", "user", "group", 0777|proto.DMDIR))
+	f := NewStaticFile(fs.NewStat("f", "user", "group", 0666), nil)
+	assert.NoError(root.AddChild(a))
+	assert.NoError(a.AddChild(f))
+
+	for path, want := range map[string]FSNode{
+		"/":        root,
+		"":         root,
+		"/a":       a,
+		"/a/f":     f,
+		"a//f":     f,
+		"/a/./f":   f,
+		"/a/../a":  a,
+		"/../a/f/": f,
+	} {
+		n, err := fs.Find(path)
+		if assert.NoError(err, path) {
+			assert.True(n == want, path)
+		}
+	}
+	_, err := fs.Find("/a/g")
+	assert.Error(err)
+	_, err = fs.Find("/a/f/g")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "Not a directory")
+	}
+}
+
 func TestStaticFile(t *testing.T) {
 	assert := assert.New(t)
 	var fs FS
@@ -92,3 +199,690 @@ func TestStaticFile(t *testing.T) {
 	err = f.Close(0)
 	assert.NoError(err)
 }
+
+func TestStaticFileMaxSize(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	f := NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("data"))
+	f.MaxSize = 8
+	root.AddChild(f)
+	root.AddChild(NewStaticFile(testFS.NewStat("default", "glenda", "glenda", 0666), nil))
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	open := func(fid uint32, name string) {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: fid, Nwname: 1, Wname: []string{name}})
+		assert.IsType(&proto.RWalk{}, r)
+		r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: fid, Mode: proto.Ordwr})
+		assert.IsType(&proto.ROpen{}, r)
+	}
+	write := func(fid uint32, offset uint64, data string) proto.FCall {
+		return c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: fid, Offset: offset, Count: uint32(len(data)), Data: []byte(data)})
+	}
+	open(2, "file")
+	open(3, "default")
+
+	assert.IsType(&proto.RWrite{}, write(2, 4, "more"))
+	assert.IsType(&proto.RError{}, write(2, 5, "more"))
+	assert.IsType(&proto.RError{}, write(3, 1<<62, "x"))
+	assert.IsType(&proto.RError{}, write(3, ^uint64(0), "x"))
+	assert.IsType(&proto.RError{}, write(3, DefaultMaxStaticSize, "x"))
+	assert.Equal("datamore", string(f.Data))
+
+	st := dontTouch()
+	st.Length = 1 << 62
+	r := c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 3, Stat: st})
+	assert.IsType(&proto.RError{}, r)
+	st.Length = 2
+	r = c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 2, Stat: st})
+	assert.IsType(&proto.RWstat{}, r)
+	assert.Equal("da", string(f.Data))
+}
+
+func TestStaticFileConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	var fs FS
+	f := NewStaticFile(fs.NewStat("file", "user", "group", 0666), nil)
+
+	// Each writer fills its own block, in reverse order so that most
+	// writes land past the end of the file and grow it.
+	const writers, block = 16, 1024
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			chunk := bytes.Repeat([]byte{byte('a' + w)}, 64)
+			for off := block - len(chunk); off >= 0; off -= len(chunk) {
+				_, err := f.Write(uint64(w), uint64(w*block+off), chunk)
+				assert.NoError(err)
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				bs, err := f.Read(uint64(w), uint64(w*block), block)
+				assert.NoError(err)
+				for _, b := range bs {
+					if b != 0 && b != byte('a'+w) {
+						t.Errorf("read %q in block %d", b, w)
+						return
+					}
+				}
+				f.Stat()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(uint64(writers*block), f.Stat().Length)
+	for w := 0; w < writers; w++ {
+		bs, err := f.Read(0, uint64(w*block), block)
+		assert.NoError(err)
+		assert.Equal(bytes.Repeat([]byte{byte('a' + w)}, block), bs)
+	}
+
+	// A write past the end zero-fills the gap.
+	_, err := f.Write(0, uint64(writers*block+10), []byte("x"))
+	assert.NoError(err)
+	bs, err := f.Read(0, uint64(writers*block), 100)
+	assert.NoError(err)
+	assert.Equal(append(make([]byte, 10), 'x'), bs)
+
+	// Reads return copies, unaffected by later writes.
+	bs, err = f.Read(0, 0, 4)
+	assert.NoError(err)
+	f.Write(0, 0, []byte("zzzz"))
+	assert.Equal("aaaa", string(bs))
+}
+
+func TestRWFile(t *testing.T) {
+	assert := assert.New(t)
+	var fs FS
+
+	var out bytes.Buffer
+	f := NewRWFile(fs.NewStat("log", "user", "group", 0666), strings.NewReader("Hello, World!\n"), &out)
+	assert.Equal(uint64(0), f.Stat().Length)
+	// Marked as a stream for clients.
+	assert.Equal(proto.DMAPPEND|0666, f.Stat().Mode)
+	assert.Equal(uint8(proto.DMAPPEND>>24), f.Stat().Qid.Qtype)
+
+	assert.NoError(f.Open(0, proto.Ordwr))
+	r, err := f.Read(0, 100, 5)
+	assert.NoError(err)
+	assert.Equal([]byte("Hello"), r)
+	r, err = f.Read(0, 0, 100)
+	assert.NoError(err)
+	assert.Equal([]byte(", World!\n"), r)
+	r, err = f.Read(0, 0, 100)
+	assert.NoError(err)
+	assert.Len(r, 0)
+
+	n, err := f.Write(0, 50, []byte("abc"))
+	assert.NoError(err)
+	assert.Equal(uint32(3), n)
+	assert.Equal("abc", out.String())
+	assert.Equal(uint64(0), f.Stat().Length)
+	assert.NoError(f.Close(0))
+
+	ro := NewRWFile(fs.NewStat("ro", "user", "group", 0444), strings.NewReader(""), nil)
+	assert.Error(ro.Open(0, proto.Owrite))
+	assert.NoError(ro.Open(0, proto.Oread))
+}
+
+func TestSeekerFile(t *testing.T) {
+	assert := assert.New(t)
+	var fs FS
+
+	tmp, err := ioutil.TempFile("", "seeker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	tmp.WriteString("Hello, World!\n")
+
+	f := NewSeekerFile(fs.NewStat("file", "user", "group", 0666), tmp)
+	assert.Equal(uint64(14), f.Stat().Length)
+	assert.NoError(f.Open(1, proto.Ordwr))
+	assert.NoError(f.Open(2, proto.Oread))
+
+	// Reads from many fids at once each get what is at their offset.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bs, err := f.Read(1, 7, 5)
+			assert.NoError(err)
+			assert.Equal("World", string(bs))
+			bs, err = f.Read(2, 0, 5)
+			assert.NoError(err)
+			assert.Equal("Hello", string(bs))
+		}()
+	}
+	wg.Wait()
+
+	// Reads stop at the end.
+	bs, err := f.Read(1, 10, 100)
+	assert.NoError(err)
+	assert.Equal("ld!\n", string(bs))
+	bs, err = f.Read(1, 100, 10)
+	assert.NoError(err)
+	assert.Len(bs, 0)
+
+	vers := f.Stat().Qid.Vers
+	n, err := f.Write(1, 14, []byte("Bye\n"))
+	assert.NoError(err)
+	assert.Equal(uint32(4), n)
+	assert.Equal(uint64(18), f.Stat().Length)
+	assert.NotEqual(vers, f.Stat().Qid.Vers)
+
+	// An *os.File can be truncated.
+	st := f.Stat()
+	st.Length = 5
+	assert.NoError(f.WriteStat(&st))
+	bs, err = f.Read(1, 0, 100)
+	assert.NoError(err)
+	assert.Equal("Hello", string(bs))
+	assert.NoError(f.Open(3, proto.Owrite|proto.Otrunc))
+	assert.Equal(uint64(0), f.Stat().Length)
+
+	// Other seekers can't.
+	rs := NewSeekerFile(fs.NewStat("rs", "user", "group", 0666), &seekBuffer{data: []byte("data")})
+	assert.Error(rs.Open(1, proto.Owrite|proto.Otrunc))
+	st = rs.Stat()
+	assert.Equal(uint64(4), st.Length)
+	st.Length = 2
+	assert.Error(rs.WriteStat(&st))
+	assert.Equal(uint64(4), rs.Stat().Length)
+}
+
+// seekBuffer is an io.ReadWriteSeeker held in memory.
+type seekBuffer struct {
+	data []byte
+	off  int64
+}
+
+func (b *seekBuffer) Read(p []byte) (int, error) {
+	if b.off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.off:])
+	b.off += int64(n)
+	return n, nil
+}
+
+func (b *seekBuffer) Write(p []byte) (int, error) {
+	if end := b.off + int64(len(p)); end > int64(len(b.data)) {
+		b.data = append(b.data, make([]byte, end-int64(len(b.data)))...)
+	}
+	n := copy(b.data[b.off:], p)
+	b.off += int64(n)
+	return n, nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += int64(len(b.data))
+	}
+	b.off = offset
+	return offset, nil
+}
+
+func TestRWFileFactory(t *testing.T) {
+	assert := assert.New(t)
+	var fs FS
+
+	opened := 0
+	f := NewRWFileFactory(fs.NewStat("log", "user", "group", 0444), func() (io.Reader, io.Writer, error) {
+		opened++
+		return strings.NewReader("stream"), nil, nil
+	})
+
+	assert.NoError(f.Open(0, proto.Oread))
+	assert.NoError(f.Open(1, proto.Oread))
+	assert.Equal(2, opened)
+
+	// Each fid gets its own stream.
+	r, err := f.Read(0, 0, 100)
+	assert.NoError(err)
+	assert.Equal([]byte("stream"), r)
+	r, err = f.Read(1, 0, 100)
+	assert.NoError(err)
+	assert.Equal([]byte("stream"), r)
+
+	assert.NoError(f.Close(0))
+	_, err = f.Read(0, 0, 100)
+	assert.Error(err)
+}
+
+func TestMergedDir(t *testing.T) {
+	assert := assert.New(t)
+	testFS, _ := NewFS("glenda", "glenda", 0777)
+
+	sessions := []string{"1"}
+	dir := NewMergedDir(testFS.NewStat("sessions", "glenda", "glenda", 0777|proto.DMDIR), func() []FSNode {
+		var nodes []FSNode
+		for _, s := range sessions {
+			nodes = append(nodes, NewStaticFile(testFS.NewStat(s, "glenda", "glenda", 0444), []byte("session "+s)))
+		}
+		// A dynamic child cannot hide a static one.
+		nodes = append(nodes, NewStaticFile(testFS.NewStat("ctl", "glenda", "glenda", 0444), []byte("dynamic")))
+		return nodes
+	})
+	ctl := NewStaticFile(testFS.NewStat("ctl", "glenda", "glenda", 0666), []byte{})
+	assert.NoError(dir.AddChild(ctl))
+	testFS.Root = dir
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	for _, name := range []string{"ctl", "1"} {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{name}})
+		assert.IsType(&proto.RWalk{}, r, name)
+		c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 2})
+	}
+	assert.Equal(ctl, dir.Children()["ctl"])
+	assert.Equal(Dir(dir), dir.Children()["1"].Parent())
+
+	sessions = append(sessions, "2")
+	r := c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 1, Mode: proto.Oread})
+	if !assert.IsType(&proto.ROpen{}, r) {
+		return
+	}
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 1, Offset: 0, Count: 8000})
+	if !assert.IsType(&proto.RRead{}, r) {
+		return
+	}
+	stats, err := proto.ParseStats(r.(*proto.RRead).Data)
+	assert.NoError(err)
+	var names []string
+	for _, st := range stats {
+		names = append(names, st.Name)
+	}
+	assert.ElementsMatch([]string{"ctl", "1", "2"}, names)
+}
+
+func TestEventFile(t *testing.T) {
+	assert := assert.New(t)
+	var fs FS
+
+	f := NewEventFile(fs.NewStat("event", "user", "group", 0444))
+	assert.Error(f.Open(0, proto.Owrite))
+	assert.NoError(f.Open(1, proto.Oread))
+	assert.NoError(f.Open(2, proto.Oread))
+
+	read := func(fid uint64, count uint64) chan []byte {
+		c := make(chan []byte, 1)
+		go func() {
+			bs, err := f.Read(fid, 0, count)
+			assert.NoError(err)
+			c <- bs
+		}()
+		return c
+	}
+	wait := func(c chan []byte) []byte {
+		select {
+		case bs := <-c:
+			return bs
+		case <-time.After(5 * time.Second):
+			t.Fatal("read did not return")
+			return nil
+		}
+	}
+
+	r1, r2 := read(1, 100), read(2, 4)
+	select {
+	case <-r1:
+		t.Fatal("read returned before any event")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Each reader gets its own copy.
+	f.Notify([]byte("changed"))
+	assert.Equal([]byte("changed"), wait(r1))
+	assert.Equal([]byte("chan"), wait(r2))
+	assert.Equal([]byte("ged"), wait(read(2, 100)))
+
+	// Closing the fid wakes a blocked reader.
+	r1 = read(1, 100)
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(f.Close(1))
+	assert.Len(wait(r1), 0)
+	assert.NoError(f.Close(2))
+}
+
+func TestEventFileFlush(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	f := NewEventFile(testFS.NewStat("event", "glenda", "glenda", 0444))
+	root.AddChild(f)
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"event"}})
+	assert.IsType(&proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	assert.IsType(&proto.ROpen{}, r)
+
+	// More reads block than the server has workers, and they can all
+	// still be flushed.
+	for tag := uint16(10); tag < 260; tag++ {
+		c.send(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: tag}, Fid: 2, Count: 100})
+	}
+	for tag := uint16(10); tag < 260; tag++ {
+		r = c.rpc(&proto.TFlush{Header: proto.Header{Type: proto.Tflush, Tag: 1}, Oldtag: tag})
+		assert.IsType(&proto.RFlush{}, r)
+	}
+
+	// The flushed reads leave the event for the next one.
+	time.Sleep(10 * time.Millisecond)
+	f.Notify([]byte("changed"))
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 2}, Fid: 2, Count: 100})
+	if assert.IsType(&proto.RRead{}, r) {
+		assert.Equal(uint16(2), r.GetTag())
+		assert.Equal("changed", string(r.(*proto.RRead).Data))
+	}
+}
+
+func TestReadOnlyFile(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	status := "starting"
+	root.AddChild(NewReadOnlyFile(testFS.NewStat("status", "glenda", "glenda", 0666), func() []byte {
+		return []byte(status)
+	}))
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"status"}})
+	assert.IsType(&proto.RWalk{}, r)
+	r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2})
+	if assert.IsType(&proto.RStat{}, r) {
+		assert.Equal(uint64(len("starting")), r.(*proto.RStat).Stat.Length)
+	}
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Ordwr})
+	assert.IsType(&proto.RError{}, r)
+
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	assert.IsType(&proto.ROpen{}, r)
+	status = "running smoothly"
+	r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2})
+	if assert.IsType(&proto.RStat{}, r) {
+		assert.Equal(uint64(len(status)), r.(*proto.RStat).Stat.Length)
+	}
+	// Reads on the open fid still see the content as it was at open.
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 2, Offset: 4, Count: 100})
+	if assert.IsType(&proto.RRead{}, r) {
+		assert.Equal("ting", string(r.(*proto.RRead).Data))
+	}
+	r = c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: 2, Count: 1, Data: []byte("x")})
+	assert.IsType(&proto.RError{}, r)
+}
+
+func TestDeviceFile(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	null, err := NewDeviceFile(testFS.NewStat("null", "glenda", "glenda", 0666), 'c', 1, 3)
+	if !assert.NoError(err) {
+		return
+	}
+	root.AddChild(null)
+	_, err = NewDeviceFile(testFS.NewStat("bad", "glenda", "glenda", 0666), 'x', 1, 3)
+	assert.Error(err)
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"null"}})
+	assert.IsType(&proto.RWalk{}, r)
+	r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2})
+	if assert.IsType(&proto.RStat{}, r) {
+		st := r.(*proto.RStat).Stat
+		assert.Equal(proto.DMDEVICE|0666, st.Mode)
+		assert.Equal(uint64(len("c 1 3")), st.Length)
+	}
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Owrite})
+	assert.IsType(&proto.RError{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	assert.IsType(&proto.ROpen{}, r)
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 2, Offset: 0, Count: 100})
+	if assert.IsType(&proto.RRead{}, r) {
+		assert.Equal("c 1 3", string(r.(*proto.RRead).Data))
+	}
+}
+
+func TestStaticSymlink(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777, WithCreateFile(CreateStaticFile))
+	link := NewStaticSymlink(testFS.NewStat("link", "glenda", "glenda", 0777), "/some/target")
+	root.AddChild(link)
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"link"}})
+	if assert.IsType(&proto.RWalk{}, r) {
+		assert.Equal(uint8(proto.DMSYMLINK>>24), r.(*proto.RWalk).Wqid[0].Qtype)
+	}
+	r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2})
+	if assert.IsType(&proto.RStat{}, r) {
+		st := r.(*proto.RStat).Stat
+		assert.Equal(proto.DMSYMLINK|0777, st.Mode)
+		assert.Equal(uint64(len("/some/target")), st.Length)
+	}
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	assert.IsType(&proto.ROpen{}, r)
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 2, Offset: 0, Count: 100})
+	if assert.IsType(&proto.RRead{}, r) {
+		assert.Equal("/some/target", string(r.(*proto.RRead).Data))
+	}
+
+	// Links created by clients are written after creation.
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 3, Nwname: 0})
+	assert.IsType(&proto.RWalk{}, r)
+	r = c.rpc(&proto.TCreate{Header: proto.Header{Type: proto.Tcreate, Tag: 1}, Fid: 3, Name: "new", Perm: proto.DMSYMLINK | 0777, Mode: uint8(proto.Owrite)})
+	assert.IsType(&proto.RCreate{}, r)
+	r = c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: 3, Offset: 0, Count: 4, Data: []byte("link")})
+	assert.IsType(&proto.RWrite{}, r)
+	if assert.IsType(&StaticSymlink{}, root.Children()["new"]) {
+		assert.Equal("link", root.Children()["new"].(*StaticSymlink).Target())
+	}
+}
+
+func TestStaticFileTimes(t *testing.T) {
+	for _, fixed := range []bool{false, true} {
+		assert := assert.New(t)
+		var opts []Option
+		if fixed {
+			opts = append(opts, WithFixedTimes())
+		}
+		testFS, root := NewFS("glenda", "glenda", 0777, opts...)
+		st := testFS.NewStat("file", "glenda", "glenda", 0666)
+		st.Atime, st.Mtime = 1, 1
+		f := NewStaticFile(st, []byte("data"))
+		root.AddChild(f)
+		c := serveTest(t, testFS)
+		c.attach(1, "other")
+
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"file"}})
+		assert.IsType(&proto.RWalk{}, r)
+		r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Ordwr})
+		assert.IsType(&proto.ROpen{}, r)
+
+		r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 2, Offset: 0, Count: 100})
+		assert.IsType(&proto.RRead{}, r)
+		assert.Equal(uint32(1), f.Stat().Mtime)
+		assert.Equal(uint32(0), f.Stat().Qid.Vers)
+		if fixed {
+			assert.Equal(uint32(1), f.Stat().Atime)
+		} else {
+			assert.Greater(f.Stat().Atime, uint32(1))
+		}
+
+		r = c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: 2, Offset: 0, Count: 4, Data: []byte("more")})
+		assert.IsType(&proto.RWrite{}, r)
+		// The version changes either way.
+		assert.Equal(uint32(1), f.Stat().Qid.Vers)
+		if fixed {
+			assert.Equal(uint32(1), f.Stat().Mtime)
+			assert.Equal("glenda", f.Stat().Muid)
+		} else {
+			assert.Greater(f.Stat().Mtime, uint32(1))
+			assert.Equal("other", f.Stat().Muid)
+		}
+
+		// So does truncation, by open or by wstat.
+		r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 3, Nwname: 1, Wname: []string{"file"}})
+		assert.IsType(&proto.RWalk{}, r)
+		r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 3, Mode: proto.Owrite | proto.Otrunc})
+		assert.IsType(&proto.ROpen{}, r)
+		assert.Equal(uint32(2), f.Stat().Qid.Vers)
+		wst := dontTouch()
+		wst.Length = 10
+		r = c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 2, Stat: wst})
+		assert.IsType(&proto.RWstat{}, r)
+		assert.Equal(uint32(3), f.Stat().Qid.Vers)
+		c.Close()
+	}
+}
+
+func TestDynamicDir(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	names := []string{"1", "2"}
+	calls := 0
+	list := func() []FSNode {
+		calls++
+		var nodes []FSNode
+		for _, name := range names {
+			nodes = append(nodes, NewStaticFile(testFS.NewStat(name, "glenda", "glenda", 0444), []byte(name)))
+		}
+		return nodes
+	}
+	procs := NewDynamicDir(testFS.NewStat("procs", "glenda", "glenda", 0555), time.Hour, list)
+	root.AddChild(procs)
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	walk := func(name string) proto.Qid {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 2, Wname: []string{"procs", name}})
+		c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 2})
+		if !assert.IsType(&proto.RWalk{}, r, name) {
+			return proto.Qid{}
+		}
+		return r.(*proto.RWalk).Wqid[1]
+	}
+
+	// Within the TTL, the list is generated once.
+	q1 := walk("1")
+	assert.Equal(q1, walk("1"))
+	assert.Equal(1, calls)
+	assert.Equal(procs, procs.Children()["2"].Parent())
+
+	// Regenerated children keep their Qids.
+	procs.ttl, procs.expires = 0, time.Time{}
+	assert.Equal(q1, walk("1"))
+	assert.Equal(2, calls)
+	vers := procs.Stat().Qid.Vers
+	assert.Equal(q1.Uid, procs.Children()["1"].Stat().Qid.Uid)
+	assert.Equal(vers, procs.Stat().Qid.Vers)
+
+	// A child that goes away and comes back is a new file.
+	names = []string{"2", "3"}
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 2, Wname: []string{"procs", "1"}})
+	if assert.IsType(&proto.RWalk{}, r) {
+		assert.Len(r.(*proto.RWalk).Wqid, 1)
+	}
+	assert.Greater(procs.Stat().Qid.Vers, vers)
+	walk("3")
+	names = []string{"1"}
+	assert.NotEqual(q1.Uid, walk("1").Uid)
+
+	// Reads list the generated set.
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"procs"}})
+	assert.IsType(&proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	assert.IsType(&proto.ROpen{}, r)
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 2, Offset: 0, Count: 8000})
+	if assert.IsType(&proto.RRead{}, r) {
+		stats, err := proto.ParseStats(r.(*proto.RRead).Data)
+		assert.NoError(err)
+		if assert.Len(stats, 1) {
+			assert.Equal("1", stats[0].Name)
+		}
+	}
+}
+
+func TestQidGenerator(t *testing.T) {
+	assert := assert.New(t)
+	var paths []string
+	gen := func(path string, mode uint32) proto.Qid {
+		paths = append(paths, path)
+		h := fnv.New64a()
+		h.Write([]byte(path))
+		return proto.Qid{Qtype: uint8(mode >> 24), Uid: h.Sum64()}
+	}
+	newFS := func() (*FS, *StaticDir) {
+		return NewFS("glenda", "glenda", 0777, WithQidGenerator(gen), WithCreateDir(CreateStaticDir))
+	}
+
+	fs1, root1 := newFS()
+	fs2, root2 := newFS()
+	assert.Equal(root1.Stat().Qid, root2.Stat().Qid, "roots are stable across servers")
+	assert.Equal(uint8(proto.DMDIR>>24), root1.Stat().Qid.Qtype)
+
+	d1, err := CreateStaticDir(fs1, root1, "glenda", "d", 0777|proto.DMDIR, 0)
+	assert.NoError(err)
+	d2, err := CreateStaticDir(fs2, root2, "glenda", "d", 0777|proto.DMDIR, 0)
+	assert.NoError(err)
+	assert.Equal(d1.Stat().Qid, d2.Stat().Qid)
+	f, err := CreateStaticFile(fs1, d1, "glenda", "f", 0666, 0)
+	assert.NoError(err)
+	assert.NotEqual(d1.Stat().Qid.Uid, f.Stat().Qid.Uid)
+	assert.Equal([]string{"/", "/", "/d", "/d", "/d/f"}, paths)
+}
+
+func TestQidGeneratorNewStat(t *testing.T) {
+	assert := assert.New(t)
+	gen := func(path string, mode uint32) proto.Qid {
+		h := fnv.New64a()
+		h.Write([]byte(path))
+		return proto.Qid{Qtype: uint8(mode >> 24), Uid: h.Sum64()}
+	}
+	testFS, root := NewFS("glenda", "glenda", 0777, WithQidGenerator(gen))
+
+	a := NewStaticDir(testFS.NewStatAt("/", "a", "glenda", "glenda", 0777|proto.DMDIR))
+	actl := NewStaticFile(testFS.NewStatAt("/a", "ctl", "glenda", "glenda", 0666), nil)
+	assert.NoError(a.AddChild(actl))
+	assert.NoError(root.AddChild(a))
+	b := NewStaticDir(testFS.NewStatAt("/", "b", "glenda", "glenda", 0777|proto.DMDIR))
+	assert.NoError(root.AddChild(b))
+	bctl := NewStaticFile(testFS.NewStatAt("/b", "ctl", "glenda", "glenda", 0666), nil)
+	assert.NoError(b.AddChild(bctl))
+
+	assert.Equal(gen("/a", proto.DMDIR), a.Stat().Qid)
+	assert.Equal(gen("/a/ctl", 0), actl.Stat().Qid)
+	assert.Equal(gen("/b", proto.DMDIR), b.Stat().Qid)
+	assert.Equal(gen("/b/ctl", 0), bctl.Stat().Qid)
+	assert.NotEqual(actl.Stat().Qid.Uid, bctl.Stat().Qid.Uid)
+	assert.Equal(gen("/c", 0), testFS.NewQidAt("/c", 0))
+
+	// Qids stay put when files move.
+	assert.NoError(b.DeleteChild("ctl"))
+	assert.NoError(root.AddChild(bctl))
+	assert.Equal(gen("/b/ctl", 0), bctl.Stat().Qid)
+
+	// Without a path, the counter is used.
+	st := testFS.NewStat("d", "glenda", "glenda", 0666)
+	assert.Equal(testFS.NewQid(0).Uid, st.Qid.Uid+1)
+	d := NewStaticFile(st, nil)
+	assert.NoError(root.AddChild(d))
+	assert.Equal(st.Qid, d.Stat().Qid)
+}
@@ -10,17 +10,51 @@ const (
 	ugo_other = iota
 )
 
-func userInGroup(user string, group string) bool {
-	// For now groups and users are equivalent.
+// A GroupResolver reports whether user is a member of group.
+type GroupResolver func(user, group string) bool
+
+// defaultGroupResolver treats every user as the sole member of a group of
+// the same name.
+func defaultGroupResolver(user, group string) bool {
 	return user == group
 }
 
-func userRelation(user string, f FSNode) uint8 {
+func (fs *FS) userInGroup(user string, group string) bool {
+	if fs.GroupResolver == nil {
+		return defaultGroupResolver(user, group)
+	}
+	return fs.GroupResolver(user, group)
+}
+
+// A UserDB knows the user and group names that are valid on a server.
+type UserDB interface {
+	HasUser(name string) bool
+	HasGroup(name string) bool
+}
+
+// knownUser reports whether name may be recorded as a Uid or Muid. All
+// names are accepted unless validation is enabled and a UserDB is set.
+func (fs *FS) knownUser(name string) bool {
+	if !fs.validateMuid || fs.UserDB == nil {
+		return true
+	}
+	return fs.UserDB.HasUser(name)
+}
+
+// knownGroup is like knownUser, for Gids.
+func (fs *FS) knownGroup(name string) bool {
+	if !fs.validateMuid || fs.UserDB == nil {
+		return true
+	}
+	return fs.UserDB.HasGroup(name)
+}
+
+func (fs *FS) userRelation(user string, f FSNode) uint8 {
 	st := f.Stat()
 	if user == st.Uid {
 		return ugo_user
 	}
-	if userInGroup(user, st.Gid) {
+	if fs.userInGroup(user, st.Gid) {
 		return ugo_group
 	}
 	return ugo_other
@@ -50,8 +84,51 @@ func omodePermits(perm uint8, omode proto.Mode) bool {
 	return false
 }
 
-func openPermission(f FSNode, user string, omode proto.Mode) bool {
-	switch userRelation(user, f) {
+// ACLEntry grants the permission bits Perm (read 04, write 02, execute 01)
+// to User, or to members of Group. Exactly one of User or Group should be
+// set. An entry is absolute: if it matches, its bits are used instead of
+// the node's mode, so an entry with Perm 0 denies all access.
+type ACLEntry struct {
+	User  string
+	Group string
+	Perm  uint8
+}
+
+// ACLNode is an FSNode with an access control list. ACL entries are
+// consulted before the usual user/group/other mode bits. Entries naming
+// the user take precedence over entries naming a group. If no entry
+// matches, the mode bits are used as normal.
+type ACLNode interface {
+	FSNode
+	ACL() []ACLEntry
+}
+
+// aclPermission checks omode against the ACL of f, if it has one. ok is
+// false if no ACL entry applies to user.
+func (fs *FS) aclPermission(f FSNode, user string, omode proto.Mode) (permitted bool, ok bool) {
+	an, isACL := f.(ACLNode)
+	if !isACL {
+		return false, false
+	}
+	acl := an.ACL()
+	for _, e := range acl {
+		if e.User != "" && e.User == user {
+			return omodePermits(e.Perm, omode), true
+		}
+	}
+	for _, e := range acl {
+		if e.Group != "" && fs.userInGroup(user, e.Group) {
+			return omodePermits(e.Perm, omode), true
+		}
+	}
+	return false, false
+}
+
+func (fs *FS) openPermission(f FSNode, user string, omode proto.Mode) bool {
+	if permitted, ok := fs.aclPermission(f, user, omode); ok {
+		return permitted
+	}
+	switch fs.userRelation(user, f) {
 	case ugo_user:
 		return omodePermits(uint8(f.Stat().Mode>>6)&0x07, omode)
 		break
@@ -66,3 +143,28 @@ func openPermission(f FSNode, user string, omode proto.Mode) bool {
 	}
 	return false
 }
+
+// mayRemove reports whether user may remove f, with Tremove or by opening
+// it Orclose. That takes write permission on f and on its directory.
+func (fs *FS) mayRemove(f FSNode, user string) bool {
+	if parent := f.Parent(); parent != nil && !fs.openPermission(parent, user, proto.Owrite) {
+		return false
+	}
+	return fs.openPermission(f, user, proto.Owrite) && fs.removePermission(f, user)
+}
+
+// removePermission reports whether user may take f out of its directory.
+// If the directory has the sticky bit, DMSETVTX, only the owner of f or of
+// the directory may, whatever the other permissions allow. Renames need no
+// check of their own, as only a file's owner may rename it.
+func (fs *FS) removePermission(f FSNode, user string) bool {
+	parent := f.Parent()
+	if parent == nil {
+		return true
+	}
+	dst := parent.Stat()
+	if dst.Mode&proto.DMSETVTX == 0 {
+		return true
+	}
+	return f.Stat().Uid == user || dst.Uid == user
+}
@@ -0,0 +1,242 @@
+package fs
+
+import (
+	"math"
+	"testing"
+
+	"github.com/knusbaum/go9p/proto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type aclFile struct {
+	*StaticFile
+	acl []ACLEntry
+}
+
+func (f *aclFile) ACL() []ACLEntry {
+	return f.acl
+}
+
+func TestACL(t *testing.T) {
+	assert := assert.New(t)
+	staff := map[string]bool{"carol": true, "staff": true}
+	fs := FS{GroupResolver: func(user, group string) bool {
+		return group == "staff" && staff[user]
+	}}
+
+	f := &aclFile{
+		StaticFile: NewStaticFile(fs.NewStat("file", "glenda", "glenda", 0666), []byte{}),
+		acl: []ACLEntry{
+			{User: "bob", Perm: 0},
+			{Group: "staff", Perm: 04},
+			{User: "staff", Perm: 06},
+		},
+	}
+
+	// bob would be allowed by the other bits, but the ACL denies him.
+	assert.False(fs.openPermission(f, "bob", proto.Oread))
+	assert.False(fs.openPermission(f, "bob", proto.Owrite))
+
+	// The group entry applies to members of staff, allowing reads but
+	// denying the writes the mode bits would allow.
+	assert.True(fs.openPermission(f, "carol", proto.Oread))
+	assert.False(fs.openPermission(f, "carol", proto.Owrite))
+	assert.False(fs.openPermission(f, "carol", proto.Ordwr))
+
+	// An entry naming the user takes precedence over the group entry.
+	assert.True(fs.openPermission(f, "staff", proto.Ordwr))
+
+	// Users without an entry fall back to the mode bits.
+	assert.True(fs.openPermission(f, "alice", proto.Ordwr))
+	assert.True(fs.openPermission(f, "glenda", proto.Ordwr))
+
+	// Plain nodes are unaffected.
+	plain := NewStaticFile(fs.NewStat("plain", "glenda", "glenda", 0640), []byte{})
+	assert.True(fs.openPermission(plain, "glenda", proto.Ordwr))
+	assert.False(fs.openPermission(plain, "bob", proto.Oread))
+}
+
+func TestGroupResolver(t *testing.T) {
+	assert := assert.New(t)
+	staff := map[string]bool{"bob": true}
+	testFS, root := NewFS("glenda", "glenda", 0777, WithGroupResolver(func(user, group string) bool {
+		return group == "staff" && staff[user]
+	}))
+	root.AddChild(NewStaticFile(testFS.NewStat("file", "glenda", "staff", 0640), []byte("data")))
+
+	open := func(uname string, mode proto.Mode) proto.FCall {
+		c := serveTest(t, testFS)
+		defer c.Close()
+		c.attach(1, uname)
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"file"}})
+		assert.IsType(&proto.RWalk{}, r)
+		return c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: mode})
+	}
+
+	// bob is a member of staff, so gets the group bits.
+	assert.IsType(&proto.ROpen{}, open("bob", proto.Oread))
+	assert.IsType(&proto.RError{}, open("bob", proto.Owrite))
+
+	// eve is not, so gets the other bits.
+	assert.IsType(&proto.RError{}, open("eve", proto.Oread))
+
+	// With the default resolver, only the user named like the group is a member.
+	var fs FS
+	f := NewStaticFile(fs.NewStat("file", "glenda", "staff", 0640), []byte{})
+	assert.True(fs.openPermission(f, "staff", proto.Oread))
+	assert.False(fs.openPermission(f, "bob", proto.Oread))
+}
+
+type testUserDB map[string]bool
+
+func (db testUserDB) HasUser(name string) bool  { return db[name] }
+func (db testUserDB) HasGroup(name string) bool { return db[name] }
+
+// dontTouch returns a stat with every field set to its "don't touch" value.
+func dontTouch() proto.Stat {
+	return proto.Stat{
+		Type:   math.MaxUint16,
+		Dev:    math.MaxUint32,
+		Qid:    proto.Qid{Qtype: math.MaxUint8, Vers: math.MaxUint32, Uid: math.MaxUint64},
+		Mode:   math.MaxUint32,
+		Atime:  math.MaxUint32,
+		Mtime:  math.MaxUint32,
+		Length: math.MaxUint64,
+	}
+}
+
+func TestValidateMuid(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777,
+		WithUserDB(testUserDB{"glenda": true, "staff": true}),
+		WithValidateMuid(true),
+		WithGroupResolver(func(user, group string) bool { return true }),
+		WithCreateFile(CreateStaticFile),
+	)
+	root.AddChild(NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("data")))
+
+	create := func(uname, name string) proto.FCall {
+		c := serveTest(t, testFS)
+		defer c.Close()
+		c.attach(1, uname)
+		return c.rpc(&proto.TCreate{Header: proto.Header{Type: proto.Tcreate, Tag: 1}, Fid: 1, Name: name, Perm: 0666, Mode: uint8(proto.Owrite)})
+	}
+	assert.IsType(&proto.RCreate{}, create("glenda", "a"))
+	assert.IsType(&proto.RError{}, create("mallory", "b"))
+	assert.Contains(root.Children(), "a")
+	assert.NotContains(root.Children(), "b")
+
+	chgrp := func(gid string) proto.FCall {
+		c := serveTest(t, testFS)
+		defer c.Close()
+		c.attach(1, "glenda")
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"file"}})
+		assert.IsType(&proto.RWalk{}, r)
+		st := dontTouch()
+		st.Gid = gid
+		return c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 2, Stat: st})
+	}
+	assert.IsType(&proto.RWstat{}, chgrp("staff"))
+	assert.IsType(&proto.RError{}, chgrp("nogroup"))
+	assert.Equal("staff", root.Children()["file"].Stat().Gid)
+
+	write := func(uname string) proto.FCall {
+		c := serveTest(t, testFS)
+		defer c.Close()
+		c.attach(1, uname)
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"file"}})
+		assert.IsType(&proto.RWalk{}, r)
+		r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Owrite})
+		assert.IsType(&proto.ROpen{}, r)
+		return c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: 2, Count: uint32(len(uname)), Data: []byte(uname)})
+	}
+	assert.IsType(&proto.RWrite{}, write("glenda"))
+	assert.IsType(&proto.RError{}, write("mallory"))
+	file := root.Children()["file"].(*StaticFile)
+	assert.Equal("glenda", file.Stat().Muid)
+	assert.Equal("glenda", string(file.Data))
+
+	// With validation off, unknown names are accepted.
+	testFS.validateMuid = false
+	assert.IsType(&proto.RCreate{}, create("mallory", "b"))
+	assert.IsType(&proto.RWstat{}, chgrp("nogroup"))
+	assert.IsType(&proto.RWrite{}, write("mallory"))
+}
+
+func TestSticky(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777, WithRemoveFile(RMFile), WithGroupResolver(func(user, group string) bool {
+		return group == "staff" && (user == "alice" || user == "bob")
+	}))
+	upload := NewStaticDir(testFS.NewStat("upload", "glenda", "staff", proto.DMSETVTX|0775))
+	root.AddChild(upload)
+	for _, uid := range []string{"alice", "bob", "carol"} {
+		upload.AddChild(NewStaticFile(testFS.NewStat(uid, uid, "staff", 0666), []byte{}))
+	}
+
+	remove := func(uname, name string) proto.FCall {
+		c := serveTest(t, testFS)
+		defer c.Close()
+		c.attach(1, uname)
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 2, Wname: []string{"upload", name}})
+		assert.IsType(&proto.RWalk{}, r)
+		return c.rpc(&proto.TRemove{Header: proto.Header{Type: proto.Tremove, Tag: 1}, Fid: 2})
+	}
+
+	// Users may remove their own files, but not others', though they
+	// may write them.
+	assert.IsType(&proto.RError{}, remove("bob", "alice"))
+	assert.IsType(&proto.RRemove{}, remove("alice", "alice"))
+	// The directory's owner may remove anything.
+	assert.IsType(&proto.RRemove{}, remove("glenda", "carol"))
+	assert.Contains(upload.Children(), "bob")
+
+	// The owner may clear the bit, and then group members may remove
+	// each other's files again.
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"upload"}})
+	assert.IsType(&proto.RWalk{}, r)
+	st := dontTouch()
+	st.Mode = proto.DMDIR | 0775
+	r = c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 2, Stat: st})
+	assert.IsType(&proto.RWstat{}, r)
+	assert.Zero(upload.Stat().Mode & proto.DMSETVTX)
+	assert.IsType(&proto.RRemove{}, remove("alice", "bob"))
+}
+
+func TestRemoveDirPermission(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777, WithRemoveFile(RMFile))
+	ro := NewStaticDir(testFS.NewStat("ro", "glenda", "glenda", 0755))
+	root.AddChild(ro)
+	ro.AddChild(NewStaticFile(testFS.NewStat("file", "alice", "alice", 0666), []byte{}))
+
+	walk := func(c *testConn) {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 2, Wname: []string{"ro", "file"}})
+		assert.IsType(&proto.RWalk{}, r)
+	}
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "alice")
+
+	// alice may write her file, but not remove it from a directory she
+	// may not write, either with Tremove or by opening it Orclose.
+	walk(c)
+	r := c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Owrite | proto.Orclose})
+	assert.IsType(&proto.RError{}, r)
+	r = c.rpc(&proto.TRemove{Header: proto.Header{Type: proto.Tremove, Tag: 1}, Fid: 2})
+	assert.IsType(&proto.RError{}, r)
+	assert.Contains(ro.Children(), "file")
+
+	// Once she may write it, she may.
+	st := ro.Stat()
+	st.Mode = proto.DMDIR | 0777
+	ro.WriteStat(&st)
+	walk(c)
+	r = c.rpc(&proto.TRemove{Header: proto.Header{Type: proto.Tremove, Tag: 1}, Fid: 2})
+	assert.IsType(&proto.RRemove{}, r)
+	assert.NotContains(ro.Children(), "file")
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/knusbaum/go9p/fs"
 	"github.com/knusbaum/go9p/proto"
@@ -13,15 +15,17 @@ import (
 
 type Dir struct {
 	Path string
+	// root confines the tree to a directory. See NewOSFS.
+	root string
 }
 
 var _ fs.Dir = &Dir{}
 
 func (f *Dir) Parent() fs.Dir {
-	if f.Path == "/" {
+	if f.Path == "/" || f.Path == f.root {
 		return nil
 	}
-	return &Dir{path.Dir(f.Path)}
+	return &Dir{Path: path.Dir(f.Path), root: f.root}
 }
 
 func (f *Dir) SetParent(d fs.Dir) {
@@ -102,23 +106,84 @@ func (d *Dir) Children() map[string]fs.FSNode {
 	}
 	m := make(map[string]fs.FSNode)
 	for i := range infos {
-		if infos[i].IsDir() {
-			m[infos[i].Name()] = &Dir{Path: path.Join(d.Path, infos[i].Name())}
+		info := infos[i]
+		p := path.Join(d.Path, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 && d.root != "" {
+			if !d.contains(p) {
+				continue
+			}
+			info, err = os.Stat(p)
+			if err != nil {
+				continue
+			}
+		}
+		if info.IsDir() {
+			m[infos[i].Name()] = &Dir{Path: p, root: d.root}
 		} else {
 			//m[infos[i].Name()] = &RealFile{BaseFile: *fs.NewBaseFile(exportFS.NewStat(infos[i].Name(), user, group, uint32(infos[i].Mode()))), Path: path.Join(d.Path, infos[i].Name()), opens: make(map[uint64]*os.File)}
-			m[infos[i].Name()] = NewFile(path.Join(d.Path, infos[i].Name()))
+			m[infos[i].Name()] = &File{Path: p, opens: make(map[uint64]*os.File), root: d.root}
 		}
 	}
 	return m
 }
 
+// contains reports whether p, with any symlinks resolved, lies within the
+// directory d is confined to. Dangling links and link loops are not.
+func (d *Dir) contains(p string) bool {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		log.Printf("Skipping %s: %s", p, err)
+		return false
+	}
+	if resolved != d.root && !strings.HasPrefix(resolved, d.root+"/") {
+		log.Printf("Skipping %s: links outside of %s", p, d.root)
+		return false
+	}
+	return true
+}
+
 // CreateDir is a function meant to be passed to WithCreateDir.
 // It creates a real directory under the parent
 func CreateDir(filesystem *fs.FS, parent fs.Dir, user, name string, perm uint32, mode uint8) (fs.Dir, error) {
-	fullPath := path.Join(fs.FullPath(parent), name)
-	err := os.Mkdir(fullPath, os.FileMode(perm))
+	fullPath, err := childPath(parent, name)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Mkdir(fullPath, os.FileMode(perm))
 	if err != nil {
 		return nil, err
 	}
-	return &Dir{fullPath}, nil
+	return &Dir{Path: fullPath, root: rootOf(parent)}, nil
+}
+
+// osPath returns the path of n on the local filesystem.
+func osPath(n fs.FSNode) string {
+	switch n := n.(type) {
+	case *Dir:
+		return n.Path
+	case *File:
+		return n.Path
+	}
+	return fs.FullPath(n)
+}
+
+// rootOf returns the directory n is confined to, if any.
+func rootOf(n fs.FSNode) string {
+	switch n := n.(type) {
+	case *Dir:
+		return n.root
+	case *File:
+		return n.root
+	}
+	return ""
+}
+
+// childPath returns the path on the local filesystem of the child name of
+// parent. Names that would refer to anything but a direct child are
+// rejected.
+func childPath(parent fs.Dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("Invalid name: %q", name)
+	}
+	return path.Join(osPath(parent), name), nil
 }
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"sync"
 
 	"github.com/knusbaum/go9p/fs"
 	"github.com/knusbaum/go9p/proto"
@@ -15,17 +16,19 @@ import (
 type File struct {
 	Path  string
 	opens map[uint64]*os.File
+	root  string
+	sync.Mutex
 }
 
 func NewFile(path string) *File {
-	return &File{path, make(map[uint64]*os.File)}
+	return &File{Path: path, opens: make(map[uint64]*os.File)}
 }
 
 func (f *File) Parent() fs.Dir {
 	if f.Path == "/" {
 		return nil
 	}
-	return &Dir{path.Dir(f.Path)}
+	return &Dir{Path: path.Dir(f.Path), root: f.root}
 }
 
 func (f *File) SetParent(d fs.Dir) {
@@ -113,12 +116,16 @@ func (f *File) Open(fid uint64, omode proto.Mode) error {
 	if err != nil {
 		return err
 	}
+	f.Lock()
 	f.opens[fid] = file
+	f.Unlock()
 	return nil
 }
 
 func (f *File) Read(fid uint64, offset uint64, count uint64) ([]byte, error) {
+	f.Lock()
 	file := f.opens[fid]
+	f.Unlock()
 	bs := make([]byte, count)
 	n, err := file.ReadAt(bs, int64(offset))
 	if n > 0 {
@@ -131,14 +138,18 @@ func (f *File) Read(fid uint64, offset uint64, count uint64) ([]byte, error) {
 }
 
 func (f *File) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
+	f.Lock()
 	file := f.opens[fid]
+	f.Unlock()
 	n, err := file.WriteAt(data, int64(offset))
 	return uint32(n), err
 }
 
 func (f *File) Close(fid uint64) error {
+	f.Lock()
 	file := f.opens[fid]
 	delete(f.opens, fid)
+	f.Unlock()
 	return file.Close()
 }
 
@@ -146,15 +157,18 @@ func (f *File) Close(fid uint64) error {
 // It will add an empty StaticFile to the FS whenever a client attempts to
 // create a file.
 func CreateFile(filesystem *fs.FS, parent fs.Dir, user, name string, perm uint32, mode uint8) (fs.File, error) {
-	fullPath := path.Join(fs.FullPath(parent), name)
+	fullPath, err := childPath(parent, name)
+	if err != nil {
+		return nil, err
+	}
 	f, err := os.OpenFile(fullPath, os.O_CREATE, os.FileMode(perm))
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return NewFile(fullPath), nil
+	return &File{Path: fullPath, opens: make(map[uint64]*os.File), root: rootOf(parent)}, nil
 }
 
 func Remove(filesystem *fs.FS, f fs.FSNode) error {
-	return os.Remove(fs.FullPath(f))
+	return os.Remove(osPath(f))
 }
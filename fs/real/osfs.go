@@ -0,0 +1,36 @@
+package real
+
+import (
+	"path/filepath"
+
+	"github.com/knusbaum/go9p/fs"
+)
+
+// NewOSFS returns an FS exporting the directory root of the local
+// filesystem. Nothing is read up front: each walk and directory read lists
+// and stats the underlying directory, and reads and writes go straight to
+// the open os.File. Clients can create and remove files and directories,
+// subject to the FS's usual permission checks. opts are applied to the FS
+// after it is set up.
+//
+// The tree is confined to root. Walking ".." from the root stays at the
+// root, and symlinks that resolve outside of root, dangle or loop are left
+// out of directory listings and cannot be walked to.
+func NewOSFS(root string, opts ...fs.Option) (*fs.FS, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	osFS := &fs.FS{Root: &Dir{Path: root, root: root}}
+	fs.WithCreateFile(CreateFile)(osFS)
+	fs.WithCreateDir(CreateDir)(osFS)
+	fs.WithRemoveFile(Remove)(osFS)
+	for _, o := range opts {
+		o(osFS)
+	}
+	return osFS, nil
+}
@@ -0,0 +1,99 @@
+package real
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/client"
+	"github.com/knusbaum/go9p/fs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type twoPipe struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (t *twoPipe) Close() error {
+	t.PipeReader.Close()
+	t.PipeWriter.Close()
+	return nil
+}
+
+func TestOSFS(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp, err := ioutil.TempDir("", "osfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	must(ioutil.WriteFile(filepath.Join(root, "sub", "a"), []byte("inside"), 0644))
+	must(ioutil.WriteFile(filepath.Join(tmp, "secret"), []byte("outside"), 0644))
+	must(os.Symlink(filepath.Join(root, "sub", "a"), filepath.Join(root, "in")))
+	must(os.Symlink(filepath.Join(tmp, "secret"), filepath.Join(root, "out")))
+	must(os.Symlink("loop", filepath.Join(root, "loop")))
+
+	osFS, err := NewOSFS(root, fs.IgnorePermissions())
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Nil(osFS.Root.Parent(), "the root must not have a parent")
+
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, osFS.Server())
+	c, err := client.NewClient(&twoPipe{p2r, p1w}, "glenda", "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	stats, err := c.Readdir("/")
+	assert.NoError(err)
+	var names []string
+	for _, st := range stats {
+		names = append(names, st.Name)
+	}
+	sort.Strings(names)
+	assert.Equal([]string{"in", "sub"}, names)
+
+	bs, err := c.ReadAll("/in")
+	assert.NoError(err)
+	assert.Equal("inside", string(bs))
+	_, err = c.ReadAll("/out")
+	assert.Error(err)
+	_, err = c.ReadAll("/loop")
+	assert.Error(err)
+
+	f, err := c.Create("/sub/new", 0644)
+	if assert.NoError(err) {
+		_, err = f.Write([]byte("created"))
+		assert.NoError(err)
+		f.Close()
+	}
+	bs, err = ioutil.ReadFile(filepath.Join(root, "sub", "new"))
+	assert.NoError(err)
+	assert.Equal("created", string(bs))
+
+	_, err = CreateFile(osFS, osFS.Root, "glenda", "../escape", 0644, 0)
+	assert.Error(err)
+	_, err = os.Stat(filepath.Join(tmp, "escape"))
+	assert.True(os.IsNotExist(err))
+
+	assert.NoError(c.Remove("/sub/new"))
+	_, err = os.Stat(filepath.Join(root, "sub", "new"))
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"errors"
+	"io"
+
+	"github.com/knusbaum/go9p/proto"
+)
+
+// truncater is implemented by seekers that can change their length, such
+// as *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// SeekerFile is a File backed by an io.ReadWriteSeeker, such as an
+// *os.File. Every fid reads and writes the same seeker, at the offsets
+// clients ask for: each Read and Write seeks there first, and the file's
+// lock is held across the seek and the I/O so that fids don't move each
+// other's offsets. The length is found by seeking to the end. If the
+// seeker has a Truncate(int64) error method, the file can be truncated and
+// its length set with wstat.
+type SeekerFile struct {
+	BaseFile
+	rws io.ReadWriteSeeker
+}
+
+// NewSeekerFile returns a SeekerFile serving rws.
+func NewSeekerFile(stat *proto.Stat, rws io.ReadWriteSeeker) *SeekerFile {
+	return &SeekerFile{BaseFile: BaseFile{fStat: *stat}, rws: rws}
+}
+
+// Stat returns the file's stat, with the seeker's current length.
+func (f *SeekerFile) Stat() proto.Stat {
+	f.Lock()
+	defer f.Unlock()
+	if end, err := f.rws.Seek(0, io.SeekEnd); err == nil {
+		f.fStat.Length = uint64(end)
+	}
+	return f.fStat
+}
+
+// WriteStat sets the file's stat. A change of length truncates or extends
+// the seeker, and fails if it can't be.
+func (f *SeekerFile) WriteStat(s *proto.Stat) error {
+	f.Lock()
+	defer f.Unlock()
+	end, err := f.rws.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	vers := f.fStat.Qid.Vers
+	if s.Length != uint64(end) {
+		if err := f.truncate(int64(s.Length)); err != nil {
+			return err
+		}
+	}
+	f.fStat = *s
+	if s.Length != uint64(end) {
+		f.fStat.Qid.Vers = vers + 1
+	}
+	return nil
+}
+
+// truncate sets the seeker's length. f must be locked.
+func (f *SeekerFile) truncate(size int64) error {
+	t, ok := f.rws.(truncater)
+	if !ok {
+		return errors.New("Cannot change the length of the file.")
+	}
+	return t.Truncate(size)
+}
+
+// Open checks that the seeker can still seek, and truncates it for Otrunc.
+func (f *SeekerFile) Open(fid uint64, omode proto.Mode) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, err := f.rws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if omode&proto.Otrunc != 0 {
+		if err := f.truncate(0); err != nil {
+			return err
+		}
+		f.fStat.Qid.Vers++
+	}
+	return nil
+}
+
+func (f *SeekerFile) Read(fid uint64, offset uint64, count uint64) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, err := f.rws.Seek(int64(offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, count)
+	n, err := io.ReadFull(f.rws, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return data[:n], err
+}
+
+func (f *SeekerFile) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
+	f.Lock()
+	defer f.Unlock()
+	whence := io.SeekStart
+	if f.fStat.Mode&proto.DMAPPEND != 0 {
+		offset, whence = 0, io.SeekEnd
+	}
+	if _, err := f.rws.Seek(int64(offset), whence); err != nil {
+		return 0, err
+	}
+	n, err := f.rws.Write(data)
+	if n > 0 {
+		f.fStat.Qid.Vers++
+	}
+	return uint32(n), err
+}
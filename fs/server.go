@@ -2,10 +2,15 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/knusbaum/go9p"
 	"github.com/knusbaum/go9p/proto"
@@ -40,6 +45,14 @@ type conn struct {
 	fids   sync.Map
 	tags   sync.Map
 	msize  uint32
+	srv    *server
+	// tmps are the DMTMP files created on the connection, which are
+	// removed when it closes if the FS is configured RemoveTmpOnClose.
+	tmps   []FSNode
+	tmpsMu sync.Mutex
+	// uname is the user the connection first attached as.
+	uname   string
+	unameMu sync.Mutex
 }
 
 type ctxCancel struct {
@@ -66,6 +79,18 @@ func (c *conn) TagContext(tag uint16) context.Context {
 	return ctxc.ctx
 }
 
+// requestContext returns the context of the request with the given tag,
+// for a handler of that request. The context is created when the request
+// is read, so if there is none, the request has already been flushed.
+func (c *conn) requestContext(tag uint16) context.Context {
+	if v, ok := c.tags.Load(tag); ok {
+		return v.(*ctxCancel).ctx
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
 func (c *conn) DropContext(tag uint16) {
 	v, ok := c.tags.Load(tag)
 	if !ok {
@@ -76,9 +101,14 @@ func (c *conn) DropContext(tag uint16) {
 	ctxc.cancel()
 }
 
+// lastConnID is shared by all servers, since fids qualified by connection
+// ID are passed to Files that may be served by more than one server.
+var lastConnID uint32
+
 type server struct {
-	fs         *FS
-	currConnId uint32
+	fs *FS
+	// auth, if set by a go9p.Server, replaces the FS's authFunc.
+	auth go9p.Authenticator
 }
 
 // Server returns a go9p.Srv instance which will
@@ -87,31 +117,129 @@ func (fs *FS) Server() go9p.Srv {
 	return &server{fs: fs}
 }
 
+var _ go9p.AuthSrv = (*server)(nil)
+var _ go9p.Inspector = (*conn)(nil)
+
+// SetAuthenticator makes the server require clients to authenticate with
+// a, in place of any function the FS was configured WithAuth. It must be
+// called before the server is used.
+func (s *server) SetAuthenticator(a go9p.Authenticator) {
+	s.auth = a
+}
+
+// authFunc returns the function clients authenticate with, or nil if they
+// need not.
+func (s *server) authFunc() go9p.Authenticator {
+	if s.auth != nil {
+		return s.auth
+	}
+	return s.fs.authFunc
+}
+
 func (s *server) NewConn() go9p.Conn {
-	s.currConnId += 1
-	return &conn{connID: s.currConnId}
+	return &conn{connID: atomic.AddUint32(&lastConnID, 1), srv: s}
+}
+
+// attached records that the connection attached as uname.
+func (c *conn) attached(uname string) {
+	c.unameMu.Lock()
+	defer c.unameMu.Unlock()
+	if c.uname == "" {
+		c.uname = uname
+	}
+}
+
+// Inspect describes the connection and its fids, ordered by fid.
+func (c *conn) Inspect() go9p.ConnInfo {
+	c.unameMu.Lock()
+	info := go9p.ConnInfo{User: c.uname}
+	c.unameMu.Unlock()
+	c.fids.Range(func(k, v interface{}) bool {
+		fi := v.(*fidInfo)
+		info.Fids = append(info.Fids, go9p.FidInfo{
+			Fid:  k.(uint32),
+			Path: FullPath(fi.n),
+			Mode: fi.openMode,
+			User: fi.uname,
+		})
+		return true
+	})
+	sort.Slice(info.Fids, func(i, j int) bool { return info.Fids[i].Fid < info.Fids[j].Fid })
+	return info
+}
+
+// Close clunks the fids the client left behind when the connection ended,
+// removing the files opened Orclose, and removes the DMTMP files it created if the FS is configured
+// RemoveTmpOnClose.
+func (c *conn) Close() {
+	c.fids.Range(func(k, v interface{}) bool {
+		c.fids.Delete(k)
+		if err := c.srv.clunk(c, k.(uint32), v.(*fidInfo)); err != nil {
+			log.Printf("Failed to clunk fid %d: %v", k.(uint32), err)
+		}
+		return true
+	})
+	if !c.srv.fs.removeTmp {
+		return
+	}
+	c.tmpsMu.Lock()
+	tmps := c.tmps
+	c.tmps = nil
+	c.tmpsMu.Unlock()
+	for _, n := range tmps {
+		if n.Parent() == nil || n.Stat().Mode&proto.DMTMP == 0 {
+			// Already removed, or no longer temporary.
+			continue
+		}
+		remove := c.srv.fs.RemoveFile
+		if remove == nil {
+			remove = RMFile
+		}
+		if err := remove(c.srv.fs, n); err != nil {
+			log.Printf("Failed to remove temporary file %s: %v", FullPath(n), err)
+		}
+	}
 }
 
 func (_ *server) Version(gc go9p.Conn, t *proto.TRVersion) (proto.FCall, error) {
-	var reply proto.TRVersion
-	if t.Type == proto.Tversion && t.Version == "9P2000" {
-		if t.Msize > proto.MaxMsgLen {
-			t.Msize = proto.MaxMsgLen
-		}
-		gc.(*conn).msize = t.Msize
-		reply = *t
-		reply.Type = proto.Rversion
-		return &reply, nil
-	} else {
+	if t.Type != proto.Tversion {
 		return nil, fmt.Errorf("Cannot reply to type %d\n", t.Type)
 	}
+	reply := *t
+	reply.Type = proto.Rversion
+	// Any version beginning with "9P2000" (e.g. 9P2000.u, 9P2000.L) is
+	// negotiated down to plain 9P2000. Anything else is unknown.
+	if !strings.HasPrefix(t.Version, "9P2000") {
+		reply.Version = "unknown"
+		return &reply, nil
+	}
+	reply.Version = "9P2000"
+	if reply.Msize > proto.MaxMsgLen {
+		reply.Msize = proto.MaxMsgLen
+	}
+	gc.(*conn).msize = reply.Msize
+	return &reply, nil
+}
+
+// authInfo holds the state of an authentication conversation on an afid.
+// done is closed once the conversation has finished, after which uname and
+// err are valid.
+type authInfo struct {
+	stream *BlockingStream
+	done   chan struct{}
+	uname  string
+	err    error
 }
 
 func (s *server) Auth(gc go9p.Conn, t *proto.TAuth) (proto.FCall, error) {
-	if s.fs.authFunc == nil {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Authentication Not Supported."}, nil
+	if s.authFunc() == nil {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Authentication Not Supported."}, nil
 	}
 	c := gc.(*conn)
+	if _, ok := c.fids.Load(t.Afid); ok {
+		// The afid may only be reused once it has been clunked.
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Fid in use."}, nil
+	}
 
 	stream := NewBlockingStream(10)
 	authFile := NewStreamFile(
@@ -121,23 +249,25 @@ func (s *server) Auth(gc go9p.Conn, t *proto.TAuth) (proto.FCall, error) {
 
 	err := authFile.Open(c.toConnFid(t.Afid), proto.Ordwr)
 	if err != nil {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+	}
+	ai := &authInfo{
+		stream: stream,
+		done:   make(chan struct{}),
 	}
 	info := &fidInfo{
 		n:        authFile,
 		openMode: proto.Ordwr,
+		extra:    ai,
 	}
-	log.Printf("Storing info in C: %p, t.Afid: %d\n", c, t.Afid)
 	c.fids.Store(t.Afid, info)
 
 	go func() {
-		defer stream.Close()
-		uname, err := s.fs.authFunc(stream)
-		if err != nil {
-			info.extra = err
-		} else {
-			info.extra = uname
-		}
+		ai.uname, ai.err = s.authFunc()(stream)
+		// Publish the result before closing the stream. Clients
+		// attach as soon as they see the stream end.
+		close(ai.done)
+		stream.Close()
 	}()
 
 	return &proto.RAuth{proto.Header{proto.Rauth, t.Tag}, authFile.Stat().Qid}, nil
@@ -146,120 +276,201 @@ func (s *server) Auth(gc go9p.Conn, t *proto.TAuth) (proto.FCall, error) {
 func (s *server) Attach(gc go9p.Conn, t *proto.TAttach) (proto.FCall, error) {
 	c := gc.(*conn)
 
-	if s.fs.authFunc == nil {
+	if t.Fid == proto.NOFID {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
+	}
+	root, err := s.fs.root(t.Aname)
+	if err != nil {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+	}
+	if s.authFunc() == nil {
+		if t.Afid != proto.NOFID {
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Authentication not required: afid must be NOFID."}, nil
+		}
+		if _, loaded := c.fids.LoadOrStore(t.Fid, newFidInfo(t.Uname, root)); loaded {
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Fid in use."}, nil
+		}
 		log.Printf("%s attached", t.Uname)
-		c.fids.Store(t.Fid, newFidInfo(t.Uname, s.fs.Root))
-		return &proto.RAttach{proto.Header{proto.Rattach, t.Tag}, s.fs.Root.Stat().Qid}, nil
+		c.attached(t.Uname)
+		return &proto.RAttach{proto.Header{proto.Rattach, t.Tag}, root.Stat().Qid}, nil
 	}
 
-	log.Printf("Loading info from C: %p, t.Afid: %d\n", c, t.Afid)
+	if t.Afid == proto.NOFID {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Not Authenticated: authentication required."}, nil
+	}
 	i, ok := c.fids.Load(t.Afid)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Not Authenticated."}, nil
-	}
-	info := i.(*fidInfo)
-	if err, ok := info.extra.(error); ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Not Authenticated: unknown or clunked afid."}, nil
 	}
-
-	authName, ok := info.extra.(string)
+	ai, ok := i.(*fidInfo).extra.(*authInfo)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Not Authenticated."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Not Authenticated: afid is not an auth fid."}, nil
+	}
+	select {
+	case <-ai.done:
+	default:
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Not Authenticated: authentication incomplete."}, nil
+	}
+	if ai.err != nil {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: ai.err.Error()}, nil
 	}
+
 	// TODO: For some reason, these don't seem to need to match.
 	// User is authenticated as ai.Cuid, *not* necessarily as t.Uname.
 	//	if t.Uname != ai.Cuid {
-	//		return &proto.RError{proto.Header{t.Type, t.Tag}, "Bad attach uname"}, nil
+	//		return &proto.RError{Header: proto.Header{t.Type, t.Tag}, Ename: "Bad attach uname"}, nil
 	//	}
-	c.fids.Store(t.Fid, newFidInfo(authName, s.fs.Root))
-	return &proto.RAttach{proto.Header{proto.Rattach, t.Tag}, s.fs.Root.Stat().Qid}, nil
+	// Each fid carries the user it was attached as, so several users may
+	// share one connection.
+	if _, loaded := c.fids.LoadOrStore(t.Fid, newFidInfo(ai.uname, root)); loaded {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Fid in use."}, nil
+	}
+	c.attached(ai.uname)
+	return &proto.RAttach{proto.Header{proto.Rattach, t.Tag}, root.Stat().Qid}, nil
 }
 
 func (s *server) Walk(gc go9p.Conn, t *proto.TWalk) (proto.FCall, error) {
 	c := gc.(*conn)
 	i, ok := c.fids.Load(t.Fid)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Bad Fid."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
+	}
+	if len(t.Wname) > proto.MAXWELEM {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: fmt.Sprintf("Too many names in walk: at most %d.", proto.MAXWELEM)}, nil
 	}
 	info := i.(*fidInfo)
 	file := info.n
-	if t.Nwname > 0 && t.Wname[0] == ".." {
-		parent := file.Parent()
-		if parent != nil {
-			c.fids.Store(t.Newfid, info.deriveInfo(parent))
-			qids := make([]proto.Qid, 1)
-			qids[0] = parent.Stat().Qid
-			return &proto.RWalk{proto.Header{proto.Rwalk, t.Tag}, 1, qids}, nil
-		} else {
-			return &proto.RWalk{proto.Header{proto.Rwalk, t.Tag}, 0, nil}, nil
+	if t.Newfid != t.Fid {
+		if _, ok := c.fids.Load(t.Newfid); ok {
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Fid in use."}, nil
 		}
 	}
 
-	qids := make([]proto.Qid, 0)
-	for i := 0; i < int(t.Nwname); i++ {
-		if dir, ok := file.(Dir); ok {
-			file, ok = dir.Children()[t.Wname[i]]
-			if !ok {
-				if s.fs.WalkFail == nil {
-					return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "No such path"}, nil
-				}
-				f, err := s.fs.WalkFail(s.fs, dir, t.Wname[i])
-				if err != nil {
-					return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
-				}
-				if f == nil {
-					return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "No such path"}, nil
-				}
-				modDir, ok := dir.(ModDir)
-				if !ok {
-					return &proto.RError{proto.Header{proto.Rerror, t.Tag}, fmt.Sprintf("%s does not support modification.", FullPath(dir))}, nil
-				}
-				err = modDir.AddChild(f)
-				if err != nil {
-					return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
-				}
-				file = f
+	depth, length := s.fs.pathSize(file)
+	qids := make([]proto.Qid, 0, len(t.Wname))
+	for i, name := range t.Wname {
+		var next FSNode
+		err := s.fs.checkPath(depth, length, name)
+		if err == nil {
+			next, err = s.walkOne(file, name)
+		}
+		if err != nil {
+			if i == 0 {
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
 			}
-			qids = append(qids, file.Stat().Qid)
+			// A walk that fails partway reports the qids of the
+			// elements it could walk, and newfid is left unused.
+			return &proto.RWalk{proto.Header{proto.Rwalk, t.Tag}, uint16(len(qids)), qids}, nil
+		}
+		file = next
+		if name == ".." {
+			depth, length = s.fs.pathSize(file)
 		} else {
-			return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "No such path"}, nil
+			depth, length = depth+1, length+len(name)+1
 		}
+		qids = append(qids, file.Stat().Qid)
+	}
+	if t.Newfid == t.Fid {
+		c.fids.Store(t.Newfid, info.deriveInfo(file))
+	} else if _, loaded := c.fids.LoadOrStore(t.Newfid, info.deriveInfo(file)); loaded {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Fid in use."}, nil
 	}
-	c.fids.Store(t.Newfid, info.deriveInfo(file))
 	return &proto.RWalk{proto.Header{proto.Rwalk, t.Tag}, uint16(len(qids)), qids}, nil
 }
 
+// walkOne returns the node reached by walking name from file. Walking ".."
+// from the root stays at the root.
+func (s *server) walkOne(file FSNode, name string) (FSNode, error) {
+	dir, ok := file.(Dir)
+	if !ok {
+		return nil, errors.New("No such path")
+	}
+	if name == ".." {
+		if parent := dir.Parent(); parent != nil {
+			return parent, nil
+		}
+		return dir, nil
+	}
+	if f, ok := dir.Children()[name]; ok {
+		return f, nil
+	}
+	if s.fs.WalkFail == nil {
+		return nil, errors.New("No such path")
+	}
+	f, err := s.fs.WalkFail(s.fs, dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, errors.New("No such path")
+	}
+	modDir, ok := dir.(ModDir)
+	if !ok {
+		return nil, fmt.Errorf("%s does not support modification.", FullPath(dir))
+	}
+	if err := modDir.AddChild(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 func (s *server) Open(gc go9p.Conn, t *proto.TOpen) (proto.FCall, error) {
 	c := gc.(*conn)
 	//info, ok := c.fids[t.Fid]
 	i, ok := c.fids.Load(t.Fid)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Bad Fid."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
 	}
 	info := i.(*fidInfo)
 	if info.openMode != proto.None {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Fid already open."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Fid already open."}, nil
+	}
+	if !s.fs.ignorePerms && !s.fs.openPermission(info.n, info.uname, t.Mode&0x0F) {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
+	}
+	if t.Mode&proto.Orclose != 0 {
+		if s.fs.RemoveFile == nil {
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Cannot delete files."}, nil
+		}
+		if !s.fs.ignorePerms && !s.fs.mayRemove(info.n, info.uname) {
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
+		}
+	}
+	if t.Mode&proto.Otrunc != 0 && info.n.Stat().Mode&proto.DMAPPEND != 0 {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Cannot truncate append-only file."}, nil
 	}
-	if !s.fs.ignorePerms && !openPermission(info.n, info.uname, t.Mode&0x0F) {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Permission denied."}, nil
+	if info.n.Stat().Mode&proto.DMEXCL != 0 && !s.fs.excl.acquire(info.n, c.toConnFid(t.Fid)) {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "file in use"}, nil
 	}
 
 	switch n := info.n.(type) {
 	case Dir:
 		if (t.Mode&0x0F) == proto.Owrite ||
 			(t.Mode&0x0F) == proto.Ordwr {
-			return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Cannot write to directory."}, nil
+			s.fs.excl.release(info.n, c.toConnFid(t.Fid))
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Cannot write to directory."}, nil
 		}
 		children := n.Children()
-		cl := make([]FSNode, 0)
-		for _, c := range children {
-			cl = append(cl, c)
+		names := make([]string, 0, len(children))
+		for name := range children {
+			names = append(names, name)
+		}
+		if s.fs.maxDirEntries > 0 && len(names) > s.fs.maxDirEntries {
+			// Sorted, so every listing keeps the same entries.
+			sort.Strings(names)
+			log.Printf("Listing of %s truncated to %d of %d entries.", FullPath(n), s.fs.maxDirEntries, len(names))
+			names = names[:s.fs.maxDirEntries]
 		}
-		info.extra = cl
+		cl := make([]FSNode, 0, len(names))
+		for _, name := range names {
+			cl = append(cl, children[name])
+		}
+		info.extra = &dirListing{children: cl}
 	case File:
 		err := n.Open(c.toConnFid(t.Fid), t.Mode)
 		if err != nil {
-			return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+			s.fs.excl.release(info.n, c.toConnFid(t.Fid))
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
 		}
 	}
 	info.openMode = t.Mode
@@ -272,14 +483,25 @@ func (s *server) Create(gc go9p.Conn, t *proto.TCreate) (proto.FCall, error) {
 	c := gc.(*conn)
 	i, ok := c.fids.Load(t.Fid)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Bad Fid."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
 	}
 	info := i.(*fidInfo)
-	if !s.fs.ignorePerms && !openPermission(info.n, info.uname, proto.Owrite) {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Permission denied."}, nil
+	if !s.fs.ignorePerms && !s.fs.openPermission(info.n, info.uname, proto.Owrite) {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
+	}
+	if !s.fs.knownUser(info.uname) {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Unknown user."}, nil
+	}
+
+	if proto.Mode(t.Mode)&proto.Orclose != 0 && s.fs.RemoveFile == nil {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Cannot delete files."}, nil
 	}
 
 	if dir, ok := info.n.(Dir); ok {
+		depth, length := s.fs.pathSize(dir)
+		if err := s.fs.checkPath(depth, length, t.Name); err != nil {
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+		}
 		var new FSNode
 		var err error
 		if t.Perm&proto.DMDIR != 0 {
@@ -296,7 +518,15 @@ func (s *server) Create(gc go9p.Conn, t *proto.TCreate) (proto.FCall, error) {
 			}
 		}
 		if err != nil {
-			return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+		}
+		if new.Stat().Mode&proto.DMEXCL != 0 {
+			s.fs.excl.acquire(new, c.toConnFid(t.Fid))
+		}
+		if new.Stat().Mode&proto.DMTMP != 0 && s.fs.removeTmp {
+			c.tmpsMu.Lock()
+			c.tmps = append(c.tmps, new)
+			c.tmpsMu.Unlock()
 		}
 		info = info.deriveInfo(new)
 		info.openMode = proto.Mode(t.Mode)
@@ -305,25 +535,25 @@ func (s *server) Create(gc go9p.Conn, t *proto.TCreate) (proto.FCall, error) {
 		if f, ok := new.(File); ok {
 			err := f.Open(c.toConnFid(t.Fid), proto.Mode(t.Mode))
 			if err != nil {
-				return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
 			}
 		}
 		return &proto.RCreate{proto.Header{proto.Rcreate, t.Tag}, new.Stat().Qid, proto.IOUnit}, nil
 	} else if f, ok := info.n.(File); ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, f.Stat().Name + ": IS A FILE Not a directory"}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: f.Stat().Name + ": IS A FILE Not a directory"}, nil
 	} else {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, info.n.Stat().Name + ": Not a directory"}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: info.n.Stat().Name + ": Not a directory"}, nil
 	}
 }
 
-func (_ *server) Read(gc go9p.Conn, t *proto.TRead) (proto.FCall, error) {
+func (s *server) Read(gc go9p.Conn, t *proto.TRead) (proto.FCall, error) {
 	c := gc.(*conn)
 	if t.Count > c.msize-11 {
 		t.Count = c.msize - 11
 	}
 	i, ok := c.fids.Load(t.Fid)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Bad Fid."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
 	}
 	info := i.(*fidInfo)
 
@@ -332,115 +562,190 @@ func (_ *server) Read(gc go9p.Conn, t *proto.TRead) (proto.FCall, error) {
 	if openmode != proto.Oread &&
 		openmode != proto.Ordwr &&
 		openmode != proto.Oexec {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "1File not opened."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "1File not opened."}, nil
 	}
 
+	s.fs.excl.touch(info.n, c.toConnFid(t.Fid))
 	switch n := info.n.(type) {
 	case File:
-		data, err := n.Read(c.toConnFid(t.Fid), t.Offset, uint64(t.Count))
+		var data []byte
+		var err error
+		if cr, ok := n.(ContextReader); ok {
+			data, err = cr.ReadContext(c.requestContext(t.Tag), c.toConnFid(t.Fid), t.Offset, uint64(t.Count))
+		} else {
+			data, err = n.Read(c.toConnFid(t.Fid), t.Offset, uint64(t.Count))
+		}
 		if err != nil {
-			return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+		}
+		if tn, ok := n.(timedNode); ok && !s.fs.fixedTimes {
+			tn.accessed()
 		}
 		return &proto.RRead{proto.Header{proto.Rread, t.Tag}, uint32(len(data)), data}, nil
 	case Dir:
 		return readDir(t, info), nil
 	}
-	return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "2File not opened."}, nil
+	return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "2File not opened."}, nil
+}
+
+// dirListing holds the listing of a directory for a fid that has it open.
+// The entries' stats are marshaled on the first read and every read is
+// served from them, so entries stay at the same offsets for as long as the
+// fid is open, even if the directory or its children change.
+type dirListing struct {
+	children []FSNode
+	stats    []byte
+	ends     []int // ends[i] is the offset just past entry i in stats.
+	listed   bool
+	sync.Mutex
 }
 
 func readDir(t *proto.TRead, info *fidInfo) proto.FCall {
-	contents := make([]byte, 0)
-	children := info.extra.([]FSNode)
-
-	var length uint64
-
-	// determine which child to start with based on read offset.
-	startIndex := -1
-	for i, c := range children {
-		st := c.Stat()
-		nextLength := uint64(st.ComposeLength())
-		if length+nextLength > t.Offset {
-			startIndex = i
-			break
+	l := info.extra.(*dirListing)
+	l.Lock()
+	defer l.Unlock()
+	if !l.listed {
+		for _, c := range l.children {
+			st := c.Stat()
+			l.stats = append(l.stats, st.Compose()...)
+			l.ends = append(l.ends, len(l.stats))
 		}
-		length = length + nextLength
+		l.listed = true
 	}
 
+	// Start with the entry containing the offset.
+	first := sort.Search(len(l.ends), func(i int) bool {
+		return uint64(l.ends[i]) > t.Offset
+	})
 	// Offset is beyond the end of our list.
-	if startIndex < 0 {
+	if first == len(l.ends) {
 		return &proto.RRead{proto.Header{proto.Rread, t.Tag}, 0, nil}
 	}
+	start := 0
+	if first > 0 {
+		start = l.ends[first-1]
+	}
 
-	for _, f := range children[startIndex:] {
-		st := f.Stat()
-		nextLength := uint32(st.ComposeLength())
-		if uint32(len(contents))+nextLength > t.Count {
+	// Return as many whole entries as fit in count.
+	end := start
+	for _, e := range l.ends[first:] {
+		if e-start > int(t.Count) {
 			break
 		}
-		contents = append(contents, st.Compose()...)
+		end = e
 	}
+	contents := l.stats[start:end]
 	return &proto.RRead{proto.Header{proto.Rread, t.Tag}, uint32(len(contents)), contents}
 }
 
-func (_ *server) Write(gc go9p.Conn, t *proto.TWrite) (proto.FCall, error) {
+func (s *server) Write(gc go9p.Conn, t *proto.TWrite) (proto.FCall, error) {
 	c := gc.(*conn)
 	i, ok := c.fids.Load(t.Fid)
 	if !ok {
-		// TODO: Handle Auth
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Bad Fid."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
 	}
 	info := i.(*fidInfo)
 
-	if (info.openMode&0x0F) != proto.Owrite &&
-		(info.openMode&0x0F) != proto.Ordwr {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "File not opened for write."}, nil
+	if !writable(info.openMode) {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "File not opened for write."}, nil
 	} else if (info.n.Stat().Mode & proto.DMDIR) != 0 {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Cannot write to directory."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Cannot write to directory."}, nil
 	}
 
 	offset := t.Offset
+	if info.n.Stat().Mode&proto.DMAPPEND != 0 {
+		// Writes to append-only files always go to the end.
+		offset = info.n.Stat().Length
+	}
+	s.fs.excl.touch(info.n, c.toConnFid(t.Fid))
 	if f, ok := info.n.(File); ok {
+		tn, timed := f.(timedNode)
+		timed = timed && !s.fs.fixedTimes
+		// The write records the user as the file's Muid.
+		if timed && !s.fs.knownUser(info.uname) {
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Unknown user."}, nil
+		}
 		n, err := f.Write(c.toConnFid(t.Fid), offset, t.Data)
 		if err != nil {
-			return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+			return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+		}
+		if timed {
+			tn.modified(info.uname)
 		}
 		return &proto.RWrite{proto.Header{proto.Rwrite, t.Tag}, n}, nil
 	} else {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Cannot write to directory."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Cannot write to directory."}, nil
 	}
 }
 
-func (_ *server) Clunk(gc go9p.Conn, t *proto.TClunk) (proto.FCall, error) {
+func (s *server) Clunk(gc go9p.Conn, t *proto.TClunk) (proto.FCall, error) {
 	c := gc.(*conn)
 	i, ok := c.fids.Load(t.Fid)
 	c.fids.Delete(t.Fid)
 	if !ok {
 		return &proto.RClunk{proto.Header{proto.Rclunk, t.Tag}}, nil
 	}
-	info := i.(*fidInfo)
+	if err := s.clunk(c, t.Fid, i.(*fidInfo)); err != nil {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+	}
+	return &proto.RClunk{proto.Header{proto.Rclunk, t.Tag}}, nil
+}
+
+// clunk releases fid, which has already been deleted from c.fids, and
+// removes its file if it was opened with Orclose.
+func (s *server) clunk(c *conn, fid uint32, info *fidInfo) error {
+	err := s.release(c, fid, info)
+	if info.openMode == proto.None || info.openMode&proto.Orclose == 0 {
+		return err
+	}
+	if info.n.Parent() == nil {
+		// Already removed.
+		return err
+	}
+	if rmErr := s.fs.RemoveFile(s.fs, info.n); rmErr != nil {
+		return rmErr
+	}
+	return err
+}
 
+// release frees everything held for fid, which has already been deleted
+// from c.fids, closing its file if it was open.
+func (s *server) release(c *conn, fid uint32, info *fidInfo) error {
+	if ai, ok := info.extra.(*authInfo); ok {
+		// Clunking an afid abandons any authentication in progress.
+		// Closing the stream unblocks the auth function.
+		ai.stream.Close()
+	}
 	if info.openMode != proto.None {
+		s.fs.excl.release(info.n, c.toConnFid(fid))
+		var syncErr error
+		if sf, ok := info.n.(Syncer); ok && writable(info.openMode) {
+			syncErr = sf.Sync(c.toConnFid(fid))
+		}
 		if f, ok := info.n.(File); ok {
-			err := f.Close(c.toConnFid(t.Fid))
-			if err != nil {
-				return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+			if err := f.Close(c.toConnFid(fid)); err != nil {
+				return err
 			}
 		}
+		return syncErr
 	}
-	return &proto.RClunk{proto.Header{proto.Rclunk, t.Tag}}, nil
+	return nil
 }
 
+// Remove clunks the fid whether or not the file is removed, as remove(5)
+// requires.
 func (s *server) Remove(gc go9p.Conn, t *proto.TRemove) (proto.FCall, error) {
 	c := gc.(*conn)
 	i, ok := c.fids.Load(t.Fid)
 	c.fids.Delete(t.Fid)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Bad Fid."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
 	}
 	info := i.(*fidInfo)
+	closeErr := s.release(c, t.Fid, info)
 
-	if !s.fs.ignorePerms && !openPermission(info.n, info.uname, proto.Owrite) {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Permission denied."}, nil
+	if !s.fs.ignorePerms && !s.fs.mayRemove(info.n, info.uname) {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
 	}
 
 	var err error
@@ -449,8 +754,11 @@ func (s *server) Remove(gc go9p.Conn, t *proto.TRemove) (proto.FCall, error) {
 	} else {
 		err = fmt.Errorf("Cannot delete files.")
 	}
+	if err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
 	}
 	return &proto.RRemove{proto.Header{proto.Rremove, t.Tag}}, nil
 }
@@ -459,11 +767,105 @@ func (_ *server) Stat(gc go9p.Conn, t *proto.TStat) (proto.FCall, error) {
 	c := gc.(*conn)
 	i, ok := c.fids.Load(t.Fid)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Bad Fid."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
 	}
 	info := i.(*fidInfo)
+	stat, err := sizedStat(info.n)
+	if err != nil {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+	}
+	return &proto.RStat{proto.Header{proto.Rstat, t.Tag}, stat}, nil
+}
 
-	return &proto.RStat{proto.Header{proto.Rstat, t.Tag}, info.n.Stat()}, nil
+// sizedStat returns the stat of n, with its length from Size if n is a
+// Sizer.
+func sizedStat(n FSNode) (proto.Stat, error) {
+	stat := n.Stat()
+	if s, ok := n.(Sizer); ok {
+		size, err := s.Size()
+		if err != nil {
+			return stat, err
+		}
+		stat.Length = size
+	}
+	return stat, nil
+}
+
+// move is a move to another directory, see WithCrossDirRename.
+type move struct {
+	from, to ModDir
+	name     string // the node's name in to.
+}
+
+// prepareMove checks that the node of info may be moved to dest, a path
+// relative to its directory or to the root, and returns the move.
+func (s *server) prepareMove(info *fidInfo, dest string) (*move, error) {
+	parent := info.n.Parent()
+	if parent == nil {
+		return nil, errors.New("Cannot move the root.")
+	}
+	from, ok := parent.(ModDir)
+	if !ok {
+		return nil, fmt.Errorf("%s does not support modification.", FullPath(parent))
+	}
+	if !path.IsAbs(dest) {
+		dest = path.Join(FullPath(parent), dest)
+	}
+	// Resolved in the tree the node is in, which may not be Root.
+	n, err := FindFrom(rootOf(parent), path.Dir(dest))
+	if err != nil {
+		return nil, err
+	}
+	to, ok := n.(ModDir)
+	if !ok {
+		return nil, fmt.Errorf("%s does not support modification.", path.Dir(dest))
+	}
+	for p := FSNode(to); p != nil; p = p.Parent() {
+		if p == info.n {
+			return nil, fmt.Errorf("Cannot move %s into itself.", FullPath(info.n))
+		}
+	}
+	name := path.Base(dest)
+	if !validName(name) {
+		return nil, fmt.Errorf("Invalid name: %q", name)
+	}
+	if _, exists := to.Children()[name]; exists {
+		return nil, fmt.Errorf("%s already exists", name)
+	}
+	if !s.fs.ignorePerms && (!s.fs.openPermission(from, info.uname, proto.Owrite) ||
+		!s.fs.openPermission(to, info.uname, proto.Owrite)) {
+		return nil, errors.New("Permission denied.")
+	}
+	return &move{from, to, name}, nil
+}
+
+// do moves n, giving it stat, which has its new name. If the move fails,
+// n is left where and as it was.
+func (m *move) do(n FSNode, stat proto.Stat) error {
+	old := n.Stat()
+	if err := m.from.DeleteChild(old.Name); err != nil {
+		return err
+	}
+	if err := n.WriteStat(&stat); err != nil {
+		m.from.AddChild(n)
+		return err
+	}
+	if err := m.to.AddChild(n); err != nil {
+		n.WriteStat(&old)
+		m.from.AddChild(n)
+		return err
+	}
+	return nil
+}
+
+// writable reports whether a fid opened with mode may be written.
+func writable(mode proto.Mode) bool {
+	return mode&0x0F == proto.Owrite || mode&0x0F == proto.Ordwr
+}
+
+// validName reports whether name may be used as the name of a file.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
 }
 
 /* The name can be changed by anyone with write permission in
@@ -506,56 +908,82 @@ func (s *server) Wstat(gc go9p.Conn, t *proto.TWstat) (proto.FCall, error) {
 	c := gc.(*conn)
 	i, ok := c.fids.Load(t.Fid)
 	if !ok {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Bad Fid."}, nil
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Bad Fid."}, nil
 	}
 	info := i.(*fidInfo)
 
+	// Start from the node's own stat, so that a Sizer's length is only
+	// written back if the wstat sets it.
 	stat := info.n.Stat()
 	newstat := &t.Stat
-	relation := userRelation(info.uname, info.n)
+	relation := s.fs.userRelation(info.uname, info.n)
+	var mv *move
 
 	{
 		// Need to check all this stuff before we change *ANYTHING*
 		// The server needs to accept ALL the changes or none of them.
+		// In 9P an empty name is the "don't touch" value, so a file
+		// can never be renamed to the empty string.
 		if len(newstat.Name) != 0 {
 			if !s.fs.ignorePerms && relation != ugo_user {
 				log.Println("Can't change name. Not owner.")
-				return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Permission denied."}, nil
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
+			}
+			if s.fs.crossRename && strings.Contains(newstat.Name, "/") {
+				var err error
+				if mv, err = s.prepareMove(info, newstat.Name); err != nil {
+					return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+				}
+			} else if !validName(newstat.Name) {
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: fmt.Sprintf("Invalid name: %q", newstat.Name)}, nil
+			} else if parent := info.n.Parent(); parent != nil && newstat.Name != stat.Name {
+				if _, exists := parent.Children()[newstat.Name]; exists {
+					return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: fmt.Sprintf("%s already exists", newstat.Name)}, nil
+				}
 			}
 		}
 
-		if newstat.Length != math.MaxUint64 && newstat.Length != stat.Length {
-			if !s.fs.ignorePerms && !openPermission(info.n, info.uname, proto.Owrite) {
-				log.Printf("Can't alter length. Don't have write permission. OLD: %d, NEW: %d\n", stat.Length, newstat.Length)
-				return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Permission denied."}, nil
+		if newstat.Length != math.MaxUint64 {
+			sized, err := sizedStat(info.n)
+			if err != nil {
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
+			}
+			if newstat.Length != sized.Length && !s.fs.ignorePerms && !s.fs.openPermission(info.n, info.uname, proto.Owrite) {
+				log.Printf("Can't alter length. Don't have write permission. OLD: %d, NEW: %d\n", sized.Length, newstat.Length)
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
 			}
 		}
 
 		if newstat.Mode != math.MaxUint32 && newstat.Mode != stat.Mode {
 			if !s.fs.ignorePerms && relation != ugo_user {
 				log.Printf("Can't alter mode. Not owner. OLD: %#o, NEW: %#o\n", stat.Mode, newstat.Mode)
-				return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Permission denied."}, nil
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
 			}
 		}
 
 		if newstat.Mtime != math.MaxUint32 && newstat.Mtime != stat.Mtime {
 			if !s.fs.ignorePerms && relation != ugo_user {
 				log.Println("Can't alter mtime. Not owner.")
-				return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Permission denied."}, nil
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
 			}
 		}
 
 		if len(newstat.Gid) != 0 {
 			if !s.fs.ignorePerms && (info.n.Stat().Uid != info.uname ||
-				!userInGroup(info.uname, newstat.Gid)) {
+				!s.fs.userInGroup(info.uname, newstat.Gid)) {
 				log.Println("Can't changegroup. Not owner or not member of new group.")
-				return &proto.RError{proto.Header{proto.Rerror, t.Tag}, "Permission denied."}, nil
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Permission denied."}, nil
+			}
+			if !s.fs.knownGroup(newstat.Gid) {
+				return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: "Unknown group."}, nil
 			}
 		}
 	}
 
 	// Do the changes.
-	if len(newstat.Name) != 0 {
+	if mv != nil {
+		stat.Name = mv.name
+	} else if len(newstat.Name) != 0 {
 		stat.Name = newstat.Name
 	}
 
@@ -564,8 +992,13 @@ func (s *server) Wstat(gc go9p.Conn, t *proto.TWstat) (proto.FCall, error) {
 	}
 
 	if newstat.Mode != math.MaxUint32 {
-		newmode := newstat.Mode & 0x000001FF
-		stat.Mode = (stat.Mode & ^uint32(0x1FF)) | newmode
+		// The permissions, the setuid, setgid and sticky bits, and
+		// the append-only, exclusive-use and temporary bits may
+		// change. DMDIR may not.
+		mask := uint32(0x1FF) | proto.DMSETUID | proto.DMSETGID | proto.DMSETVTX |
+			proto.DMAPPEND | proto.DMEXCL | proto.DMTMP
+		stat.Mode = (stat.Mode &^ mask) | (newstat.Mode & mask)
+		stat.Qid.Qtype = uint8(stat.Mode >> 24)
 	}
 
 	if newstat.Mtime != math.MaxUint32 {
@@ -576,8 +1009,14 @@ func (s *server) Wstat(gc go9p.Conn, t *proto.TWstat) (proto.FCall, error) {
 		stat.Gid = newstat.Gid
 	}
 
-	if err := info.n.WriteStat(&stat); err != nil {
-		return &proto.RError{proto.Header{proto.Rerror, t.Tag}, err.Error()}, nil
+	var err error
+	if mv != nil {
+		err = mv.do(info.n, stat)
+	} else {
+		err = info.n.WriteStat(&stat)
+	}
+	if err != nil {
+		return &proto.RError{Header: proto.Header{proto.Rerror, t.Tag}, Ename: err.Error()}, nil
 	}
 	return &proto.RWstat{proto.Header{proto.Rwstat, t.Tag}}, nil
 
@@ -0,0 +1,1080 @@
+package fs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knusbaum/go9p"
+	"github.com/knusbaum/go9p/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConn speaks raw 9p to an FS being served over a pipe.
+type testConn struct {
+	t       testing.TB
+	r       *io.PipeReader
+	w       *io.PipeWriter
+	replies chan proto.FCall
+}
+
+func serveTest(t testing.TB, fs *FS) *testConn {
+	p1r, p1w := io.Pipe()
+	p2r, p2w := io.Pipe()
+	go go9p.ServeReadWriter(p1r, p2w, fs.Server())
+	c := &testConn{t: t, r: p2r, w: p1w, replies: make(chan proto.FCall, 100)}
+	go func() {
+		defer close(c.replies)
+		for {
+			call, err := proto.ParseCall(c.r)
+			if err != nil {
+				return
+			}
+			c.replies <- call
+		}
+	}()
+	return c
+}
+
+func (c *testConn) Close() {
+	c.w.Close()
+	c.r.Close()
+}
+
+func (c *testConn) send(call proto.FCall) {
+	_, err := c.w.Write(call.Compose())
+	require.NoError(c.t, err)
+}
+
+func (c *testConn) recv() proto.FCall {
+	select {
+	case call := <-c.replies:
+		return call
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for reply")
+		return nil
+	}
+}
+
+func (c *testConn) rpc(call proto.FCall) proto.FCall {
+	c.send(call)
+	return c.recv()
+}
+
+// attach performs the version exchange and attaches fid as uname.
+func (c *testConn) attach(fid uint32, uname string) {
+	r := c.rpc(&proto.TRVersion{Header: proto.Header{Type: proto.Tversion, Tag: proto.NOTAG}, Msize: 8192, Version: "9P2000"})
+	require.IsType(c.t, &proto.TRVersion{}, r)
+	r = c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: fid, Afid: ^uint32(0), Uname: uname})
+	require.IsType(c.t, &proto.RAttach{}, r)
+}
+
+func TestFlush(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	release := make(chan struct{})
+	root.AddChild(&WrappedFile{
+		File: NewStaticFile(testFS.NewStat("block", "glenda", "glenda", 0444), []byte("data")),
+		ReadF: func(fid uint64, offset uint64, count uint64) ([]byte, error) {
+			<-release
+			return []byte("data"), nil
+		},
+	})
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"block"}})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+
+	// The read blocks, so the flush is only answered once it returns, and
+	// without the read's reply.
+	c.send(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 5}, Fid: 2, Offset: 0, Count: 100})
+	c.send(&proto.TFlush{Header: proto.Header{Type: proto.Tflush, Tag: 6}, Oldtag: 5})
+	select {
+	case r = <-c.replies:
+		t.Fatalf("%v sent while the flushed read is running", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	r = c.recv()
+	assert.IsType(&proto.RFlush{}, r)
+	assert.Equal(uint16(6), r.GetTag())
+
+	// The flushed read must not be answered. The tag may be reused.
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 5}, Fid: 2, Offset: 0, Count: 100})
+	if assert.IsType(&proto.RRead{}, r) {
+		assert.Equal(uint16(5), r.GetTag())
+		assert.Equal("data", string(r.(*proto.RRead).Data))
+	}
+	r = c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 7}, Fid: 2})
+	assert.IsType(&proto.RClunk{}, r)
+	assert.Equal(uint16(7), r.GetTag())
+}
+
+func TestFlushCancels(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	stopped := make(chan error, 1)
+	root.AddChild(&WrappedFile{
+		File: NewStaticFile(testFS.NewStat("block", "glenda", "glenda", 0444), []byte("data")),
+		ReadContextF: func(ctx context.Context, fid uint64, offset uint64, count uint64) ([]byte, error) {
+			<-ctx.Done()
+			stopped <- ctx.Err()
+			return nil, ctx.Err()
+		},
+	})
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"block"}})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+
+	// Flushing the read stops it before the Rflush is sent, and its reply
+	// is never sent.
+	c.send(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 5}, Fid: 2, Offset: 0, Count: 100})
+	r = c.rpc(&proto.TFlush{Header: proto.Header{Type: proto.Tflush, Tag: 6}, Oldtag: 5})
+	assert.IsType(&proto.RFlush{}, r)
+	select {
+	case err := <-stopped:
+		assert.Equal(context.Canceled, err)
+	default:
+		t.Fatal("flushed read did not stop before the Rflush")
+	}
+	r = c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 7}, Fid: 2})
+	assert.IsType(&proto.RClunk{}, r)
+	assert.Equal(uint16(7), r.GetTag())
+
+	// Reads still blocked when the connection ends are stopped too.
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 3, Nwname: 1, Wname: []string{"block"}})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 3, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+	c.send(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 8}, Fid: 3, Offset: 0, Count: 100})
+	c.Close()
+	select {
+	case err := <-stopped:
+		assert.Equal(context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not stop when the connection ended")
+	}
+}
+
+func TestFlushCompleted(t *testing.T) {
+	assert := assert.New(t)
+	testFS, _ := NewFS("glenda", "glenda", 0777)
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	// Flushing a tag that is not outstanding is answered immediately.
+	r := c.rpc(&proto.TFlush{Header: proto.Header{Type: proto.Tflush, Tag: 2}, Oldtag: 100})
+	assert.IsType(&proto.RFlush{}, r)
+	assert.Equal(uint16(2), r.GetTag())
+}
+
+func TestAttachAfid(t *testing.T) {
+	version := &proto.TRVersion{Header: proto.Header{Type: proto.Tversion, Tag: proto.NOTAG}, Msize: 8192, Version: "9P2000"}
+	t.Run("NoAuth", func(t *testing.T) {
+		assert := assert.New(t)
+		testFS, _ := NewFS("glenda", "glenda", 0777)
+		c := serveTest(t, testFS)
+		defer c.Close()
+		require.IsType(t, &proto.TRVersion{}, c.rpc(version))
+
+		for _, afid := range []uint32{0, 1, 10, proto.NOFID - 1, rand.Uint32() &^ 1} {
+			r := c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 1, Afid: afid, Uname: "glenda"})
+			if assert.IsType(&proto.RError{}, r, "afid %d", afid) {
+				assert.Contains(r.(*proto.RError).Ename, "NOFID")
+			}
+		}
+		r := c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: proto.NOFID, Afid: proto.NOFID, Uname: "glenda"})
+		assert.IsType(&proto.RError{}, r)
+		r = c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 1, Afid: proto.NOFID, Uname: "glenda"})
+		assert.IsType(&proto.RAttach{}, r)
+	})
+	t.Run("Auth", func(t *testing.T) {
+		assert := assert.New(t)
+		testFS, _ := NewFS("glenda", "glenda", 0777, WithAuth(func(s io.ReadWriter) (string, error) {
+			return "glenda", nil
+		}))
+		c := serveTest(t, testFS)
+		defer c.Close()
+		require.IsType(t, &proto.TRVersion{}, c.rpc(version))
+
+		r := c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 1, Afid: proto.NOFID, Uname: "glenda"})
+		if assert.IsType(&proto.RError{}, r) {
+			assert.Contains(r.(*proto.RError).Ename, "authentication required")
+		}
+		for i := 0; i < 100; i++ {
+			r := c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 1, Afid: rand.Uint32() &^ 1, Uname: "glenda"})
+			assert.IsType(&proto.RError{}, r)
+		}
+	})
+}
+
+func TestAttachRoots(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	root.AddChild(NewStaticFile(testFS.NewStat("main", "glenda", "glenda", 0444), []byte{}))
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	r := c.rpc(&proto.TRVersion{Header: proto.Header{Type: proto.Tversion, Tag: proto.NOTAG}, Msize: 8192, Version: "9P2000"})
+	require.IsType(t, &proto.TRVersion{}, r)
+	attach := func(fid uint32, aname string) proto.FCall {
+		return c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: fid, Afid: proto.NOFID, Uname: "glenda", Aname: aname})
+	}
+	walk := func(fid uint32, name string) proto.FCall {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: fid, Newfid: 100, Nwname: 1, Wname: []string{name}})
+		c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 100})
+		return r
+	}
+
+	// Without other roots, every aname gets Root.
+	assert.IsType(&proto.RAttach{}, attach(1, "anything"))
+	assert.IsType(&proto.RWalk{}, walk(1, "main"))
+
+	foo := testFS.NewRoot("foo", "glenda", "glenda", 0755)
+	foo.AddChild(NewStaticFile(testFS.NewStat("foofile", "glenda", "glenda", 0444), []byte{}))
+	bar := testFS.NewRoot("bar", "glenda", "glenda", 0755)
+	bar.AddChild(NewStaticFile(testFS.NewStat("barfile", "glenda", "glenda", 0444), []byte{}))
+
+	r = attach(2, "foo")
+	require.IsType(t, &proto.RAttach{}, r)
+	assert.Equal(foo.Stat().Qid, r.(*proto.RAttach).Qid)
+	assert.IsType(&proto.RWalk{}, walk(2, "foofile"))
+	assert.IsType(&proto.RError{}, walk(2, "barfile"))
+	assert.IsType(&proto.RError{}, walk(2, "main"))
+	assert.IsType(&proto.RWalk{}, walk(2, ".."))
+
+	require.IsType(t, &proto.RAttach{}, attach(3, "bar"))
+	assert.IsType(&proto.RWalk{}, walk(3, "barfile"))
+	require.IsType(t, &proto.RAttach{}, attach(4, ""))
+	assert.IsType(&proto.RWalk{}, walk(4, "main"))
+
+	r = attach(5, "baz")
+	if assert.IsType(&proto.RError{}, r) {
+		assert.Contains(r.(*proto.RError).Ename, "baz")
+	}
+	// The failed attach did not take the fid.
+	assert.IsType(&proto.RAttach{}, attach(5, "foo"))
+}
+
+func TestWalkTooLong(t *testing.T) {
+	assert := assert.New(t)
+	testFS, _ := NewFS("glenda", "glenda", 0777)
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	names := make([]string, proto.MAXWELEM+1)
+	for i := range names {
+		names[i] = ".."
+	}
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: uint16(len(names)), Wname: names})
+	if assert.IsType(&proto.RError{}, r) {
+		assert.Contains(r.(*proto.RError).Ename, "Too many names")
+	}
+	names = names[:proto.MAXWELEM]
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: uint16(len(names)), Wname: names})
+	assert.IsType(&proto.RWalk{}, r)
+}
+
+func TestMaxDepth(t *testing.T) {
+	assert := assert.New(t)
+	// Every name walked to is made up, as a directory.
+	made := 0
+	testFS, _ := NewFS("glenda", "glenda", 0777, WithMaxDepth(3), WithMaxPathLen(12),
+		WithCreateFile(CreateStaticFile),
+		WithWalkFailHandler(func(fs *FS, parent Dir, name string) (FSNode, error) {
+			made++
+			return NewStaticDir(fs.NewStat(name, "glenda", "glenda", 0777)), nil
+		}))
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	walk := func(fid, newfid uint32, names ...string) proto.FCall {
+		return c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: fid, Newfid: newfid, Nwname: uint16(len(names)), Wname: names})
+	}
+
+	// The walk stops at the limit, without making up more nodes.
+	r := walk(1, 2, "a", "b", "c", "d", "e")
+	if assert.IsType(&proto.RWalk{}, r) {
+		assert.Equal(uint16(3), r.(*proto.RWalk).Nwqid)
+	}
+	assert.Equal(3, made)
+	r = walk(1, 2, "a", "b", "c")
+	assert.IsType(&proto.RWalk{}, r)
+	r = walk(2, 3, "d")
+	if assert.IsType(&proto.RError{}, r) {
+		assert.Contains(r.(*proto.RError).Ename, "Path too deep")
+	}
+	// Going up makes room again.
+	r = walk(2, 3, "..", "x")
+	if assert.IsType(&proto.RWalk{}, r) {
+		assert.Equal(uint16(2), r.(*proto.RWalk).Nwqid)
+	}
+	r = c.rpc(&proto.TCreate{Header: proto.Header{Type: proto.Tcreate, Tag: 1}, Fid: 2, Name: "f", Perm: 0666, Mode: uint8(proto.Ordwr)})
+	if assert.IsType(&proto.RError{}, r) {
+		assert.Contains(r.(*proto.RError).Ename, "Path too deep")
+	}
+
+	// "/a/b" is 4 bytes long, leaving room for a name of 7.
+	r = walk(2, 4, "..")
+	assert.IsType(&proto.RWalk{}, r)
+	r = walk(4, 5, "yyyyyyy")
+	assert.IsType(&proto.RWalk{}, r)
+	r = walk(4, 6, "zzzzzzzz")
+	if assert.IsType(&proto.RError{}, r) {
+		assert.Contains(r.(*proto.RError).Ename, "Path too long")
+	}
+}
+
+func TestAuthEarlyClunk(t *testing.T) {
+	assert := assert.New(t)
+	authDone := make(chan struct{})
+	testFS, _ := NewFS("glenda", "glenda", 0777, WithAuth(func(s io.ReadWriter) (string, error) {
+		defer close(authDone)
+		var bs [128]byte
+		for {
+			if _, err := s.Read(bs[:]); err != nil {
+				return "", err
+			}
+		}
+	}))
+	c := serveTest(t, testFS)
+	defer c.Close()
+	r := c.rpc(&proto.TRVersion{Header: proto.Header{Type: proto.Tversion, Tag: proto.NOTAG}, Msize: 8192, Version: "9P2000"})
+	require.IsType(t, &proto.TRVersion{}, r)
+
+	r = c.rpc(&proto.TAuth{Header: proto.Header{Type: proto.Tauth, Tag: 1}, Afid: 10, Uname: "glenda"})
+	require.IsType(t, &proto.RAuth{}, r)
+
+	// Attaching before authentication completes fails.
+	r = c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 1, Afid: 10, Uname: "glenda"})
+	assert.IsType(&proto.RError{}, r)
+
+	r = c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 10})
+	assert.IsType(&proto.RClunk{}, r)
+
+	// The auth conversation is abandoned once the afid is clunked.
+	select {
+	case <-authDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("auth function was not stopped by clunk")
+	}
+
+	r = c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 1, Afid: 10, Uname: "glenda"})
+	if assert.IsType(&proto.RError{}, r) {
+		assert.Contains(r.(*proto.RError).Ename, "clunked afid")
+	}
+
+	// The fid was not attached.
+	r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 1})
+	assert.IsType(&proto.RError{}, r)
+}
+
+func TestSecretAuthFid(t *testing.T) {
+	assert := assert.New(t)
+	testFS, _ := NewFS("glenda", "glenda", 0777, WithAuth(SecretAuth("sesame")), WithCreateFile(CreateStaticFile))
+	c := serveTest(t, testFS)
+	defer c.Close()
+	r := c.rpc(&proto.TRVersion{Header: proto.Header{Type: proto.Tversion, Tag: proto.NOTAG}, Msize: 8192, Version: "9P2000"})
+	require.IsType(t, &proto.TRVersion{}, r)
+
+	r = c.rpc(&proto.TAuth{Header: proto.Header{Type: proto.Tauth, Tag: 1}, Afid: 10, Uname: "rob"})
+	require.IsType(t, &proto.RAuth{}, r)
+	r = c.rpc(&proto.TAuth{Header: proto.Header{Type: proto.Tauth, Tag: 1}, Afid: 10, Uname: "rob"})
+	if assert.IsType(&proto.RError{}, r) {
+		assert.Contains(r.(*proto.RError).Ename, "in use")
+	}
+
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 10, Count: 8192})
+	require.IsType(t, &proto.RRead{}, r)
+	nonce := r.(*proto.RRead).Data
+	require.Len(t, nonce, secretNonceLen)
+	mac := hmac.New(sha256.New, []byte("sesame"))
+	mac.Write(nonce)
+	mac.Write([]byte("rob"))
+	reply := append(mac.Sum(nil), "rob"...)
+	r = c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: 10, Count: uint32(len(reply)), Data: reply})
+	require.IsType(t, &proto.RWrite{}, r)
+
+	// The stream ends once the server has accepted the reply.
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 10, Count: 8192})
+	require.IsType(t, &proto.RRead{}, r)
+	assert.Empty(r.(*proto.RRead).Data)
+
+	// The user is the one that authenticated, not the one attaching.
+	r = c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 1, Afid: 10, Uname: "glenda"})
+	require.IsType(t, &proto.RAttach{}, r)
+	r = c.rpc(&proto.TCreate{Header: proto.Header{Type: proto.Tcreate, Tag: 1}, Fid: 1, Name: "f", Perm: 0666, Mode: uint8(proto.Owrite)})
+	require.IsType(t, &proto.RCreate{}, r)
+	r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 1})
+	if assert.IsType(&proto.RStat{}, r) {
+		assert.Equal("rob", r.(*proto.RStat).Stat.Uid)
+	}
+
+	// Once clunked, the afid can be used for a new conversation.
+	r = c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 10})
+	assert.IsType(&proto.RClunk{}, r)
+	r = c.rpc(&proto.TAuth{Header: proto.Header{Type: proto.Tauth, Tag: 1}, Afid: 10, Uname: "rob"})
+	assert.IsType(&proto.RAuth{}, r)
+}
+
+func TestRemoveClunks(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	var closed int
+	root.AddChild(&WrappedFile{
+		File: NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), nil),
+		CloseF: func(fid uint64) error {
+			closed++
+			return nil
+		},
+	})
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"file"}})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+
+	// The FS has no RemoveFile hook, so the remove fails.
+	r = c.rpc(&proto.TRemove{Header: proto.Header{Type: proto.Tremove, Tag: 1}, Fid: 2})
+	assert.IsType(&proto.RError{}, r)
+	assert.Equal(1, closed)
+	r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2})
+	assert.IsType(&proto.RError{}, r, "fid survived a failed remove")
+
+	// The fid can be used again.
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"file"}})
+	assert.IsType(&proto.RWalk{}, r)
+}
+
+func TestRemoveTmpOnClose(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777, RemoveTmpOnClose(), WithCreateFile(CreateStaticFile))
+
+	c := serveTest(t, testFS)
+	c.attach(1, "glenda")
+	create := func(fid uint32, name string, perm uint32) {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: fid})
+		require.IsType(t, &proto.RWalk{}, r)
+		r = c.rpc(&proto.TCreate{Header: proto.Header{Type: proto.Tcreate, Tag: 1}, Fid: fid, Name: name, Perm: perm, Mode: uint8(proto.Owrite)})
+		require.IsType(t, &proto.RCreate{}, r)
+	}
+	create(2, "scratch", 0666|proto.DMTMP)
+	create(3, "keep", 0666)
+	create(4, "kept", 0666|proto.DMTMP)
+
+	// The DMTMP bit is reported by stat and can be cleared by wstat.
+	r := c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2})
+	if assert.IsType(&proto.RStat{}, r) {
+		st := r.(*proto.RStat).Stat
+		assert.Equal(proto.DMTMP, st.Mode&proto.DMTMP)
+		assert.Equal(uint8(proto.DMTMP>>24), st.Qid.Qtype)
+	}
+	st := proto.Stat{Type: 0xFFFF, Dev: 0xFFFFFFFF, Qid: proto.Qid{Qtype: 0xFF, Vers: 0xFFFFFFFF, Uid: 0xFFFFFFFFFFFFFFFF},
+		Mode: 0666, Atime: 0xFFFFFFFF, Mtime: 0xFFFFFFFF, Length: 0xFFFFFFFFFFFFFFFF}
+	r = c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 4, Stat: st})
+	require.IsType(t, &proto.RWstat{}, r)
+	assert.Len(root.Children(), 3)
+
+	c.Close()
+	assert.Eventually(func() bool { return len(root.Children()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.NotContains(root.Children(), "scratch")
+}
+
+func TestDirReadSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	var want []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		want = append(want, name)
+		root.AddChild(NewStaticFile(testFS.NewStat(name, "glenda", "glenda", 0666), nil))
+	}
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	r := c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 1, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+
+	var got []string
+	var offset uint64
+	for i := 0; ; i++ {
+		// Room for two and a half entries.
+		r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 1, Offset: offset, Count: 150})
+		require.IsType(t, &proto.RRead{}, r)
+		data := r.(*proto.RRead).Data
+		if len(data) == 0 {
+			break
+		}
+		stats, err := proto.ParseStats(data)
+		require.NoError(t, err, "entries were split")
+		assert.Len(stats, 2)
+		for _, st := range stats {
+			got = append(got, st.Name)
+		}
+		offset += uint64(len(data))
+
+		// Changes made while reading don't affect the listing.
+		root.DeleteChild(fmt.Sprintf("file%02d", 19-i))
+		root.AddChild(NewStaticFile(testFS.NewStat(fmt.Sprintf("new%02d", i), "glenda", "glenda", 0666), nil))
+		if f, ok := root.Children()["file10"]; ok {
+			st := f.Stat()
+			st.Name = "file10-renamed-to-something-much-longer"
+			f.WriteStat(&st)
+		}
+	}
+	assert.ElementsMatch(want, got)
+}
+
+func TestPartialWalk(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	a := NewStaticDir(testFS.NewStat("a", "glenda", "glenda", 0777))
+	b := NewStaticDir(testFS.NewStat("b", "glenda", "glenda", 0777))
+	root.AddChild(a)
+	a.AddChild(b)
+	b.AddChild(NewStaticFile(testFS.NewStat("f", "glenda", "glenda", 0666), nil))
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	walk := func(names ...string) proto.FCall {
+		return c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: uint16(len(names)), Wname: names})
+	}
+
+	r := walk("a", "b", "nonexistent")
+	if assert.IsType(&proto.RWalk{}, r) {
+		rw := r.(*proto.RWalk)
+		assert.Equal(uint16(2), rw.Nwqid)
+		assert.Equal([]proto.Qid{a.Stat().Qid, b.Stat().Qid}, rw.Wqid)
+	}
+	// newfid is only created by a complete walk.
+	assert.IsType(&proto.RError{}, c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2}))
+
+	assert.IsType(&proto.RError{}, walk("nonexistent", "a"))
+	assert.IsType(&proto.RError{}, c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2}))
+
+	// Walking through a file stops there.
+	if r := walk("a", "b", "f", "g"); assert.IsType(&proto.RWalk{}, r) {
+		assert.Equal(uint16(3), r.(*proto.RWalk).Nwqid)
+	}
+
+	// ".." may appear anywhere, and stays put at the root.
+	r = walk("a", "b", "..", "..", "..", "a")
+	if assert.IsType(&proto.RWalk{}, r) {
+		assert.Equal(uint16(6), r.(*proto.RWalk).Nwqid)
+		r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 2})
+		if assert.IsType(&proto.RStat{}, r) {
+			assert.Equal("a", r.(*proto.RStat).Stat.Name)
+		}
+	}
+}
+
+func TestQidConsistent(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	root.AddChild(NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("data")))
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	walkStat := func(newfid uint32) (proto.Qid, proto.Qid) {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: newfid, Nwname: 1, Wname: []string{"file"}})
+		require.IsType(t, &proto.RWalk{}, r)
+		walk := r.(*proto.RWalk)
+		require.Len(t, walk.Wqid, 1)
+		r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: newfid})
+		require.IsType(t, &proto.RStat{}, r)
+		return walk.Wqid[0], r.(*proto.RStat).Stat.Qid
+	}
+
+	walkQid, statQid := walkStat(2)
+	assert.Equal(walkQid, statQid)
+
+	r := c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Owrite})
+	require.IsType(t, &proto.ROpen{}, r)
+	assert.Equal(walkQid, r.(*proto.ROpen).Qid)
+	r = c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: 2, Offset: 4, Count: 4, Data: []byte("more")})
+	require.IsType(t, &proto.RWrite{}, r)
+
+	// After a write, Vers may change but the path and type must not.
+	walkQid2, statQid2 := walkStat(3)
+	assert.Equal(walkQid2, statQid2)
+	assert.Equal(walkQid.Uid, walkQid2.Uid)
+	assert.Equal(walkQid.Qtype, walkQid2.Qtype)
+}
+
+func TestPerFidUser(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	root.AddChild(NewStaticFile(testFS.NewStat("secret", "alice", "alice", 0600), []byte("alice's")))
+
+	// Two users attach over the same connection.
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "alice")
+	r := c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 2, Afid: ^uint32(0), Uname: "bob"})
+	require.IsType(t, &proto.RAttach{}, r)
+
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 3, Nwname: 1, Wname: []string{"secret"}})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 2, Newfid: 4, Nwname: 1, Wname: []string{"secret"}})
+	require.IsType(t, &proto.RWalk{}, r)
+
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 3, Mode: proto.Oread})
+	assert.IsType(&proto.ROpen{}, r, "alice's fid")
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 4, Mode: proto.Oread})
+	assert.IsType(&proto.RError{}, r, "bob's fid")
+
+	// Neither attach nor walk may take over a fid another user holds.
+	r = c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 3, Afid: ^uint32(0), Uname: "bob"})
+	assert.IsType(&proto.RError{}, r)
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 2, Newfid: 3, Nwname: 0})
+	assert.IsType(&proto.RError{}, r)
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 3, Offset: 0, Count: 100})
+	if assert.IsType(&proto.RRead{}, r) {
+		assert.Equal("alice's", string(r.(*proto.RRead).Data))
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	log := NewStaticFile(testFS.NewStat("log", "glenda", "glenda", 0666|proto.DMAPPEND), []byte("one\n"))
+	root.AddChild(log)
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"log"}})
+	require.IsType(t, &proto.RWalk{}, r)
+
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Owrite | proto.Otrunc})
+	assert.IsType(&proto.RError{}, r)
+
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Owrite})
+	require.IsType(t, &proto.ROpen{}, r)
+
+	// The offset is ignored; writes go to the end of the file.
+	r = c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: 2, Offset: 0, Count: 4, Data: []byte("two\n")})
+	assert.IsType(&proto.RWrite{}, r)
+	r = c.rpc(&proto.TWrite{Header: proto.Header{Type: proto.Twrite, Tag: 1}, Fid: 2, Offset: 1, Count: 6, Data: []byte("three\n")})
+	assert.IsType(&proto.RWrite{}, r)
+	assert.Equal("one\ntwo\nthree\n", string(log.Data))
+}
+
+func TestExclusive(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	root.AddChild(NewStaticFile(testFS.NewStat("lock", "glenda", "glenda", 0666|proto.DMEXCL), []byte{}))
+
+	c1 := serveTest(t, testFS)
+	defer c1.Close()
+	c1.attach(1, "glenda")
+	c2 := serveTest(t, testFS)
+	defer c2.Close()
+	c2.attach(1, "glenda")
+
+	open := func(c *testConn, fid uint32) proto.FCall {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: fid, Nwname: 1, Wname: []string{"lock"}})
+		require.IsType(t, &proto.RWalk{}, r)
+		return c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: fid, Mode: proto.Ordwr})
+	}
+
+	assert.IsType(&proto.ROpen{}, open(c1, 2))
+
+	// A second open, on either connection, fails while the first is open.
+	if r := open(c2, 2); assert.IsType(&proto.RError{}, r) {
+		assert.Equal("file in use", r.(*proto.RError).Ename)
+	}
+	assert.IsType(&proto.RError{}, open(c1, 3))
+
+	r := c1.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 2})
+	assert.IsType(&proto.RClunk{}, r)
+
+	// Once clunked, the file may be opened again.
+	assert.IsType(&proto.ROpen{}, open(c2, 3))
+}
+
+func TestFilterDir(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	sub := NewStaticDir(testFS.NewStat("sub", "glenda", "glenda", 0777|proto.DMDIR))
+	root.AddChild(sub)
+	root.AddChild(NewStaticFile(testFS.NewStat("visible", "glenda", "glenda", 0666), []byte{}))
+	root.AddChild(NewStaticFile(testFS.NewStat(".hidden", "glenda", "glenda", 0666), []byte{}))
+	sub.AddChild(NewStaticFile(testFS.NewStat(".git", "glenda", "glenda", 0666), []byte{}))
+	testFS.Root = FilterDir(root, func(name string) bool { return strings.HasPrefix(name, ".") })
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	walk := func(names ...string) proto.FCall {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: uint16(len(names)), Wname: names})
+		c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 2})
+		return r
+	}
+	assert.IsType(&proto.RWalk{}, walk("visible"))
+	assert.IsType(&proto.RError{}, walk(".hidden"))
+	// Only sub could be walked.
+	if r := walk("sub", ".git"); assert.IsType(&proto.RWalk{}, r) {
+		assert.Equal(uint16(1), r.(*proto.RWalk).Nwqid)
+	}
+
+	r := c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 1, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 1, Offset: 0, Count: 8000})
+	require.IsType(t, &proto.RRead{}, r)
+	stats, err := proto.ParseStats(r.(*proto.RRead).Data)
+	assert.NoError(err)
+	var names []string
+	for _, st := range stats {
+		names = append(names, st.Name)
+	}
+	assert.ElementsMatch([]string{"sub", "visible"}, names)
+
+	// The underlying dirs are unchanged.
+	assert.Contains(root.Children(), ".hidden")
+	assert.Contains(sub.Children(), ".git")
+}
+
+func TestWstatName(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	f := NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("data"))
+	root.AddChild(f)
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"file"}})
+	require.IsType(t, &proto.RWalk{}, r)
+
+	wstat := func(st proto.Stat) proto.FCall {
+		return c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 2, Stat: st})
+	}
+
+	// An empty name means "don't rename", both alone and with other changes.
+	assert.IsType(&proto.RWstat{}, wstat(dontTouch()))
+	assert.Equal("file", f.Stat().Name)
+	st := dontTouch()
+	st.Mode = 0600
+	assert.IsType(&proto.RWstat{}, wstat(st))
+	assert.Equal("file", f.Stat().Name)
+	assert.Equal(uint32(0600), f.Stat().Mode&0777)
+	assert.Equal([]byte("data"), f.Data)
+
+	// Names that can never be valid are rejected.
+	for _, name := range []string{".", "..", "a/b", "/"} {
+		st := dontTouch()
+		st.Name = name
+		assert.IsType(&proto.RError{}, wstat(st), name)
+		assert.Equal("file", f.Stat().Name)
+	}
+
+	st = dontTouch()
+	st.Name = "renamed"
+	assert.IsType(&proto.RWstat{}, wstat(st))
+	assert.Equal("renamed", f.Stat().Name)
+
+	// Renaming onto a sibling fails and changes nothing, while keeping
+	// the name is fine.
+	other := NewStaticFile(testFS.NewStat("other", "glenda", "glenda", 0666), []byte("other"))
+	root.AddChild(other)
+	st = dontTouch()
+	st.Name = "other"
+	st.Mode = 0644
+	assert.IsType(&proto.RError{}, wstat(st))
+	assert.Equal("renamed", f.Stat().Name)
+	assert.Equal(uint32(0600), f.Stat().Mode&0777)
+	assert.Equal(other, root.Children()["other"])
+	st.Name = "renamed"
+	assert.IsType(&proto.RWstat{}, wstat(st))
+	assert.Equal(uint32(0644), f.Stat().Mode&0777)
+}
+
+func TestCrossDirRename(t *testing.T) {
+	assert := assert.New(t)
+	for _, cross := range []bool{false, true} {
+		var opts []Option
+		if cross {
+			opts = append(opts, WithCrossDirRename())
+		}
+		testFS, root := NewFS("glenda", "glenda", 0777, opts...)
+		a := NewStaticDir(testFS.NewStat("a", "glenda", "glenda", 0777))
+		b := NewStaticDir(testFS.NewStat("b", "glenda", "glenda", 0777))
+		root.AddChild(a)
+		root.AddChild(b)
+		f := NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("data"))
+		a.AddChild(f)
+
+		c := serveTest(t, testFS)
+		c.attach(1, "glenda")
+		wstat := func(wname []string, name string) proto.FCall {
+			r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: uint16(len(wname)), Wname: wname})
+			require.IsType(t, &proto.RWalk{}, r)
+			defer c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 2})
+			st := dontTouch()
+			st.Name = name
+			return c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 2, Stat: st})
+		}
+
+		if !cross {
+			assert.IsType(&proto.RError{}, wstat([]string{"a", "file"}, "/b/file"))
+			assert.Contains(a.Children(), "file")
+			c.Close()
+			continue
+		}
+
+		// Absolute paths are from the root, others from the directory.
+		assert.IsType(&proto.RWstat{}, wstat([]string{"a", "file"}, "/b/moved"))
+		assert.NotContains(a.Children(), "file")
+		assert.Equal(f, b.Children()["moved"])
+		assert.Equal("moved", f.Stat().Name)
+		assert.Equal(b, f.Parent())
+		assert.IsType(&proto.RWstat{}, wstat([]string{"b", "moved"}, "../a/file"))
+		assert.Equal(f, a.Children()["file"])
+		assert.Empty(b.Children())
+
+		// A directory can't be moved into itself, and moves can't
+		// replace files or go to directories that don't exist.
+		assert.IsType(&proto.RError{}, wstat([]string{"a"}, "/a/sub"))
+		assert.IsType(&proto.RError{}, wstat([]string{"b"}, "/a/file"))
+		assert.IsType(&proto.RError{}, wstat([]string{"a", "file"}, "/c/file"))
+		assert.IsType(&proto.RError{}, wstat(nil, "/b/root"))
+		assert.Equal(a, root.Children()["a"])
+		assert.Equal(b, root.Children()["b"])
+		assert.Equal(f, a.Children()["file"])
+
+		// Moving a directory takes its contents along.
+		assert.IsType(&proto.RWstat{}, wstat([]string{"a"}, "/b/a"))
+		assert.Equal("/b/a/file", FullPath(f))
+		c.Close()
+	}
+}
+
+func TestCrossDirRenameRoots(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777, WithCrossDirRename())
+	root.AddChild(NewStaticDir(testFS.NewStat("b", "glenda", "glenda", 0777)))
+	foo := testFS.NewRoot("foo", "glenda", "glenda", 0777)
+	a := NewStaticDir(testFS.NewStat("a", "glenda", "glenda", 0777))
+	b := NewStaticDir(testFS.NewStat("b", "glenda", "glenda", 0777))
+	foo.AddChild(a)
+	foo.AddChild(b)
+	f := NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("data"))
+	a.AddChild(f)
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	r := c.rpc(&proto.TRVersion{Header: proto.Header{Type: proto.Tversion, Tag: proto.NOTAG}, Msize: 8192, Version: "9P2000"})
+	require.IsType(t, &proto.TRVersion{}, r)
+	r = c.rpc(&proto.TAttach{Header: proto.Header{Type: proto.Tattach, Tag: 1}, Fid: 1, Afid: proto.NOFID, Uname: "glenda", Aname: "foo"})
+	require.IsType(t, &proto.RAttach{}, r)
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 2, Wname: []string{"a", "file"}})
+	require.IsType(t, &proto.RWalk{}, r)
+
+	// The destination is in foo's tree, not Root's.
+	st := dontTouch()
+	st.Name = "/b/file"
+	r = c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 2, Stat: st})
+	assert.IsType(&proto.RWstat{}, r)
+	assert.Equal(f, b.Children()["file"])
+	assert.Empty(root.Children()["b"].(Dir).Children())
+}
+
+type syncFile struct {
+	*StaticFile
+	synced []uint64
+	err    error
+}
+
+func (f *syncFile) Sync(fid uint64) error {
+	f.synced = append(f.synced, fid)
+	return f.err
+}
+
+func TestSync(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	f := &syncFile{StaticFile: NewStaticFile(testFS.NewStat("file", "glenda", "glenda", 0666), []byte("data"))}
+	root.AddChild(f)
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	openClunk := func(mode proto.Mode) proto.FCall {
+		r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 1, Wname: []string{"file"}})
+		require.IsType(t, &proto.RWalk{}, r)
+		r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: mode})
+		require.IsType(t, &proto.ROpen{}, r)
+		return c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 2})
+	}
+
+	// Only fids that could have written are synced.
+	assert.IsType(&proto.RClunk{}, openClunk(proto.Oread))
+	assert.Empty(f.synced)
+	assert.IsType(&proto.RClunk{}, openClunk(proto.Owrite))
+	assert.IsType(&proto.RClunk{}, openClunk(proto.Ordwr|proto.Otrunc))
+	assert.Len(f.synced, 2)
+
+	// A failed sync is reported, but the fid is still clunked.
+	f.err = errors.New("Disk on fire.")
+	r := openClunk(proto.Owrite)
+	require.IsType(t, &proto.RError{}, r)
+	assert.Equal("Disk on fire.", r.(*proto.RError).Ename)
+	assert.Len(f.synced, 3)
+	f.err = nil
+	assert.IsType(&proto.RClunk{}, openClunk(proto.Owrite))
+}
+
+func TestMaxDirEntries(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777, WithMaxDirEntries(10))
+	for i := 0; i < 1000; i++ {
+		root.AddChild(NewStaticFile(testFS.NewStat(fmt.Sprintf("f%d", i), "glenda", "glenda", 0444), []byte{}))
+	}
+
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2, Nwname: 0})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+	var stats []proto.Stat
+	var offset uint64
+	for {
+		r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 2, Offset: offset, Count: 8000})
+		require.IsType(t, &proto.RRead{}, r)
+		data := r.(*proto.RRead).Data
+		if len(data) == 0 {
+			break
+		}
+		st, err := proto.ParseStats(data)
+		require.NoError(t, err)
+		stats = append(stats, st...)
+		offset += uint64(len(data))
+	}
+	// The listing is the first entries by name, the same every time.
+	var names []string
+	for _, st := range stats {
+		names = append(names, st.Name)
+	}
+	assert.Equal([]string{"f0", "f1", "f10", "f100", "f101", "f102", "f103", "f104", "f105", "f106"}, names)
+
+	// Entries left out of the listing can still be walked to.
+	for _, name := range []string{"f0", "f500", "f999"} {
+		r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 3, Nwname: 1, Wname: []string{name}})
+		assert.IsType(&proto.RWalk{}, r, name)
+		c.rpc(&proto.TClunk{Header: proto.Header{Type: proto.Tclunk, Tag: 1}, Fid: 3})
+	}
+}
+
+// BenchmarkStat measures a connection doing nothing but Tstat/Rstat
+// exchanges. Run it with -benchtime=100000x to see the garbage produced by
+// 100k exchanges.
+func BenchmarkStat(b *testing.B) {
+	testFS, _ := NewFS("glenda", "glenda", 0777)
+	c := serveTest(b, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 2}, Fid: 1})
+		if _, ok := r.(*proto.RStat); !ok {
+			b.Fatalf("unexpected reply %v", r)
+		}
+	}
+}
+
+// reportFile is a Sizer whose size is only known once it is rendered.
+type reportFile struct {
+	*BaseFile
+	renders int
+}
+
+func (f *reportFile) render() []byte {
+	f.renders++
+	return []byte("A long and costly report.\n")
+}
+
+func (f *reportFile) Size() (uint64, error) {
+	return uint64(len(f.render())), nil
+}
+
+func TestSizer(t *testing.T) {
+	assert := assert.New(t)
+	testFS, root := NewFS("glenda", "glenda", 0777)
+	report := &reportFile{BaseFile: NewBaseFile(testFS.NewStat("report", "glenda", "glenda", 0666))}
+	root.AddChild(report)
+	c := serveTest(t, testFS)
+	defer c.Close()
+	c.attach(1, "glenda")
+
+	// Listing the directory doesn't size the file.
+	r := c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 2})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TOpen{Header: proto.Header{Type: proto.Topen, Tag: 1}, Fid: 2, Mode: proto.Oread})
+	require.IsType(t, &proto.ROpen{}, r)
+	r = c.rpc(&proto.TRead{Header: proto.Header{Type: proto.Tread, Tag: 1}, Fid: 2, Count: 8192})
+	require.IsType(t, &proto.RRead{}, r)
+	stats, err := proto.ParseStats(r.(*proto.RRead).Data)
+	require.NoError(t, err)
+	if assert.Len(stats, 1) {
+		assert.Equal(uint64(0), stats[0].Length)
+	}
+	assert.Equal(0, report.renders)
+
+	// Statting it does.
+	r = c.rpc(&proto.TWalk{Header: proto.Header{Type: proto.Twalk, Tag: 1}, Fid: 1, Newfid: 3, Nwname: 1, Wname: []string{"report"}})
+	require.IsType(t, &proto.RWalk{}, r)
+	r = c.rpc(&proto.TStat{Header: proto.Header{Type: proto.Tstat, Tag: 1}, Fid: 3})
+	if assert.IsType(&proto.RStat{}, r) {
+		assert.Equal(uint64(26), r.(*proto.RStat).Stat.Length)
+	}
+	assert.Equal(1, report.renders)
+
+	// A wstat leaving the length alone doesn't store the sized one, or
+	// size the file.
+	st := dontTouch()
+	st.Mode = 0644
+	r = c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 3, Stat: st})
+	assert.IsType(&proto.RWstat{}, r)
+	assert.Equal(uint64(0), report.Stat().Length)
+	assert.Equal(uint32(0644), report.Stat().Mode)
+	assert.Equal(1, report.renders)
+
+	// One setting it does store it.
+	st = dontTouch()
+	st.Length = 10
+	r = c.rpc(&proto.TWstat{Header: proto.Header{Type: proto.Twstat, Tag: 1}, Fid: 3, Stat: st})
+	assert.IsType(&proto.RWstat{}, r)
+	assert.Equal(uint64(10), report.Stat().Length)
+}
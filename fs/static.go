@@ -1,8 +1,10 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/knusbaum/go9p/proto"
 )
@@ -11,11 +13,22 @@ import (
 // implementation that allows the reading and writing
 // of a byte slice that every client sees. Writes modify
 // the content and reads serve the content.
+//
+// Reads, writes and Stat are safe to use concurrently. Code accessing
+// Data directly while the file is being served must hold the file's lock.
+//
+// Clients can't make Data larger than MaxSize, or DefaultMaxStaticSize if
+// MaxSize is 0, with writes or by setting the length.
 type StaticFile struct {
 	BaseFile
-	Data []byte
+	Data    []byte
+	MaxSize uint64
 }
 
+// DefaultMaxStaticSize is the size clients may grow a StaticFile to if
+// its MaxSize is 0.
+const DefaultMaxStaticSize = 64 << 20
+
 // NewStaticFile returns a StaticFile that contains the
 // byte slice data.
 func NewStaticFile(s *proto.Stat, data []byte) *StaticFile {
@@ -26,6 +39,18 @@ func NewStaticFile(s *proto.Stat, data []byte) *StaticFile {
 	}
 }
 
+// checkSize fails if the file may not grow to size bytes.
+func (f *StaticFile) checkSize(size uint64) error {
+	max := f.MaxSize
+	if max == 0 {
+		max = DefaultMaxStaticSize
+	}
+	if size > max && size > uint64(len(f.Data)) {
+		return fmt.Errorf("File too large: at most %d bytes.", max)
+	}
+	return nil
+}
+
 func (f *StaticFile) Stat() proto.Stat {
 	f.Lock()
 	defer f.Unlock()
@@ -33,15 +58,51 @@ func (f *StaticFile) Stat() proto.Stat {
 	return f.fStat
 }
 
+// WriteStat sets the file's stat. A change of length truncates Data or
+// extends it with zeros.
+func (f *StaticFile) WriteStat(s *proto.Stat) error {
+	f.Lock()
+	defer f.Unlock()
+	flen := uint64(len(f.Data))
+	vers := f.fStat.Qid.Vers
+	if err := f.checkSize(s.Length); err != nil {
+		return err
+	}
+	if s.Length < flen {
+		f.Data = f.Data[:s.Length]
+	} else if s.Length > flen {
+		f.Data = append(f.Data, make([]byte, s.Length-flen)...)
+	}
+	f.fStat = *s
+	if s.Length != flen {
+		f.fStat.Qid.Vers = vers + 1
+	}
+	return nil
+}
+
 func (f *StaticFile) Open(fid uint64, omode proto.Mode) error {
 	if omode&proto.Otrunc > 0 {
 		f.Lock()
 		defer f.Unlock()
 		f.Data = make([]byte, 0)
+		f.fStat.Qid.Vers++
 	}
 	return nil
 }
 
+func (f *StaticFile) accessed() {
+	f.Lock()
+	defer f.Unlock()
+	f.fStat.Atime = uint32(time.Now().Unix())
+}
+
+func (f *StaticFile) modified(uname string) {
+	f.Lock()
+	defer f.Unlock()
+	f.fStat.Mtime = uint32(time.Now().Unix())
+	f.fStat.Muid = uname
+}
+
 func (f *StaticFile) Read(fid uint64, offset uint64, count uint64) ([]byte, error) {
 	f.RLock()
 	defer f.RUnlock()
@@ -52,22 +113,41 @@ func (f *StaticFile) Read(fid uint64, offset uint64, count uint64) ([]byte, erro
 	if offset+count > flen {
 		count = flen - offset
 	}
-	return f.Data[offset : offset+count], nil
+	// Return a copy, since Data may be changed by a write before the
+	// reply has been sent.
+	data := make([]byte, count)
+	copy(data, f.Data[offset:])
+	return data, nil
 }
 
 func (f *StaticFile) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
 	f.Lock()
 	defer f.Unlock()
 	flen := uint64(len(f.Data))
+	if f.fStat.Mode&proto.DMAPPEND != 0 {
+		// Another writer may have appended since the server
+		// computed offset.
+		offset = flen
+	}
 	count := uint64(len(data))
+	if offset > ^uint64(0)-count {
+		return 0, errors.New("Offset out of range.")
+	}
+	if err := f.checkSize(offset + count); err != nil {
+		return 0, err
+	}
 	if offset+count > flen {
+		// Grow the file, zero-filling any gap between the old end
+		// and offset.
 		newlen := offset + count
 		f.fStat.Length = newlen
-		// TODO: Maybe this can be optimized
 		f.Data = append(f.Data, make([]byte, newlen-flen)...)
 	}
 
 	copy(f.Data[offset:offset+count], data)
+	// Every change to the contents gets a new version, so that
+	// clients know to drop what they have cached.
+	f.fStat.Qid.Vers++
 	return uint32(len(data)), nil
 }
 
@@ -95,6 +175,8 @@ func NewStaticDir(stat *proto.Stat) *StaticDir {
 }
 
 func (d *StaticDir) Stat() proto.Stat {
+	d.RLock()
+	defer d.RUnlock()
 	return d.dStat
 }
 
@@ -127,45 +209,74 @@ func (d *StaticDir) Children() map[string]FSNode {
 	return ret
 }
 
+// AddChild adds n to d and makes d its parent. It fails if n's name is not
+// a valid file name, if d already has a child by that name, or if n is d or
+// one of d's ancestors.
 func (d *StaticDir) AddChild(n FSNode) error {
-	d.Lock()
-	defer d.Unlock()
+	return d.addChild(n, d)
+}
+
+// addChild adds n to d's children, with parent as its parent. Types
+// embedding a StaticDir use it to become the parent of their children.
+// The parent is set while d is locked, so no one sees n in d before its
+// parent is set.
+func (d *StaticDir) addChild(n FSNode, parent Dir) error {
+	if n == nil {
+		return errors.New("Cannot add nil child.")
+	}
 	stat := n.Stat()
+	if !validName(stat.Name) {
+		return fmt.Errorf("Invalid name: %q", stat.Name)
+	}
+	for p := parent; p != nil; p = p.Parent() {
+		if FSNode(p) == n {
+			return fmt.Errorf("Cannot add %s to itself or its descendants.", stat.Name)
+		}
+	}
+
+	d.Lock()
 	for _, n := range d.children {
 		if n.Stat().Name == stat.Name {
+			d.Unlock()
 			return fmt.Errorf("%s already exists", stat.Name)
 		}
 	}
 	d.children = append(d.children, n)
-	n.SetParent(d)
+	n.SetParent(parent)
+	d.Unlock()
 	return nil
 }
 
+// DeleteChild removes the child with the given name from d and clears its
+// parent. It fails if d has no such child.
 func (d *StaticDir) DeleteChild(name string) error {
 	d.Lock()
 	defer d.Unlock()
-	k := 0
-	for _, c := range d.children {
-		if c.Stat().Name != name {
-			d.children[k] = c
-			k++
-		} else {
+	for i, c := range d.children {
+		if c.Stat().Name == name {
 			c.SetParent(nil)
+			d.children = append(d.children[:i], d.children[i+1:]...)
+			return nil
 		}
 	}
-	d.children = d.children[:k]
-	return nil
+	return fmt.Errorf("%s does not exist", name)
 }
 
 // CreateStaticFile is a function meant to be passed to WithCreateFile.
 // It will add an empty StaticFile to the FS whenever a client attempts to
-// create a file.
+// create a file, or an empty StaticSymlink if the file is a DMSYMLINK.
 func CreateStaticFile(fs *FS, parent Dir, user, name string, perm uint32, mode uint8) (File, error) {
 	modParent, ok := parent.(ModDir)
 	if !ok {
 		return nil, fmt.Errorf("%s does not support modification.", FullPath(parent))
 	}
-	f := NewStaticFile(fs.NewStat(name, user, user, perm), []byte{})
+	var f File
+	st := fs.newStat(childPath(parent, name), name, user, user, perm)
+	if perm&proto.DMSYMLINK != 0 {
+		f = NewStaticSymlink(st, "")
+	} else {
+		f = NewStaticFile(st, []byte{})
+	}
 	err := modParent.AddChild(f)
 	return f, err
 }
@@ -178,7 +289,7 @@ func CreateStaticDir(fs *FS, parent Dir, user, name string, perm uint32, mode ui
 	if !ok {
 		return nil, fmt.Errorf("%s does not support modification.", FullPath(parent))
 	}
-	f := NewStaticDir(fs.NewStat(name, user, user, perm))
+	f := NewStaticDir(fs.newStat(childPath(parent, name), name, user, user, perm))
 	err := modParent.AddChild(f)
 	return f, err
 }
@@ -3,6 +3,8 @@ package fs
 import (
 	"errors"
 	"fmt"
+	"io"
+	"sync"
 
 	"github.com/knusbaum/go9p/proto"
 )
@@ -24,6 +26,15 @@ type BiDiStreamFile struct {
 	fidReader map[uint64]StreamReadWriter
 }
 
+// markStream sets the DMAPPEND bit of stat, the only hint 9P2000 offers
+// that a file's length and offsets mean nothing. mount9p reads and writes
+// such files directly, without caching or seeking.
+func markStream(stat *proto.Stat) *proto.Stat {
+	stat.Mode |= proto.DMAPPEND
+	stat.Qid.Qtype |= uint8(proto.DMAPPEND >> 24)
+	return stat
+}
+
 // NewStreamFile creates a file that serves a stream to clients.
 // If the Stream s implements the BiDiStream protocol, a
 // BiDiStreamFile is returned. Otherwise a StreamFile is
@@ -34,13 +45,13 @@ type BiDiStreamFile struct {
 func NewStreamFile(stat *proto.Stat, s Stream) File {
 	if bidi, ok := s.(BiDiStream); ok {
 		return &BiDiStreamFile{
-			BaseFile:  NewBaseFile(stat),
+			BaseFile:  NewBaseFile(markStream(stat)),
 			s:         bidi,
 			fidReader: make(map[uint64]StreamReadWriter),
 		}
 	}
 	return &StreamFile{
-		BaseFile:  NewBaseFile(stat),
+		BaseFile:  NewBaseFile(markStream(stat)),
 		s:         s,
 		fidReader: make(map[uint64]StreamReader),
 	}
@@ -155,7 +166,7 @@ type PipeFile struct {
 // be closed.
 func NewPipeFile(stat *proto.Stat, handler func(s BiDiStream)) *PipeFile {
 	return &PipeFile{
-		BaseFile:  NewBaseFile(stat),
+		BaseFile:  NewBaseFile(markStream(stat)),
 		fidReader: make(map[uint64]streamWithReader),
 		handler:   handler,
 	}
@@ -204,3 +215,128 @@ func (f *PipeFile) Close(fid uint64) error {
 	}
 	return nil
 }
+
+type rwPair struct {
+	r     io.Reader
+	w     io.Writer
+	rLock sync.Mutex
+	wLock sync.Mutex
+}
+
+// RWFile is a File backed by an io.Reader and an io.Writer. Reads by
+// clients pull from the reader and writes push to the writer. Offsets are
+// ignored, as with a pipe. The length is always reported as 0 and the file
+// is marked DMAPPEND, so clients treat it as an unseekable stream.
+type RWFile struct {
+	*BaseFile
+	shared  *rwPair
+	factory func() (io.Reader, io.Writer, error)
+	fidRW   map[uint64]*rwPair
+}
+
+// NewRWFile creates an RWFile whose fids all share r and w. Either may be
+// nil, in which case opening the file for reading or writing respectively
+// will fail.
+func NewRWFile(stat *proto.Stat, r io.Reader, w io.Writer) *RWFile {
+	return &RWFile{
+		BaseFile: NewBaseFile(markStream(stat)),
+		shared:   &rwPair{r: r, w: w},
+		fidRW:    make(map[uint64]*rwPair),
+	}
+}
+
+// NewRWFileFactory creates an RWFile that calls factory on every Open(),
+// giving each fid its own reader and writer. If the reader or writer
+// implements io.Closer, it is closed when the fid is clunked.
+func NewRWFileFactory(stat *proto.Stat, factory func() (io.Reader, io.Writer, error)) *RWFile {
+	return &RWFile{
+		BaseFile: NewBaseFile(markStream(stat)),
+		factory:  factory,
+		fidRW:    make(map[uint64]*rwPair),
+	}
+}
+
+func (f *RWFile) Stat() proto.Stat {
+	stat := f.BaseFile.Stat()
+	stat.Length = 0
+	return stat
+}
+
+func (f *RWFile) Open(fid uint64, omode proto.Mode) error {
+	rw := f.shared
+	if f.factory != nil {
+		r, w, err := f.factory()
+		if err != nil {
+			return err
+		}
+		rw = &rwPair{r: r, w: w}
+	}
+	mode := omode & 0x0F
+	if (mode == proto.Oread || mode == proto.Ordwr) && rw.r == nil {
+		return errors.New("Cannot open this file for reading.")
+	}
+	if (mode == proto.Owrite || mode == proto.Ordwr) && rw.w == nil {
+		return errors.New("Cannot open this file for writing.")
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.fidRW[fid] = rw
+	return nil
+}
+
+func (f *RWFile) getRW(fid uint64) (*rwPair, bool) {
+	f.RLock()
+	defer f.RUnlock()
+	rw, ok := f.fidRW[fid]
+	return rw, ok
+}
+
+func (f *RWFile) Read(fid uint64, offset uint64, count uint64) ([]byte, error) {
+	rw, ok := f.getRW(fid)
+	if !ok || rw.r == nil {
+		// This really shouldn't happen.
+		return nil, fmt.Errorf("Failed to read stream. Not opened for read.")
+	}
+	rw.rLock.Lock()
+	defer rw.rLock.Unlock()
+	bs := make([]byte, count)
+	n, err := rw.r.Read(bs)
+	if err == io.EOF {
+		// 9p EOF is a 0-length RRead, not an RError.
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bs[:n], nil
+}
+
+func (f *RWFile) Write(fid uint64, offset uint64, data []byte) (uint32, error) {
+	rw, ok := f.getRW(fid)
+	if !ok || rw.w == nil {
+		// This really shouldn't happen.
+		return 0, fmt.Errorf("Failed to write stream. Not opened for write.")
+	}
+	rw.wLock.Lock()
+	defer rw.wLock.Unlock()
+	n, err := rw.w.Write(data)
+	return uint32(n), err
+}
+
+func (f *RWFile) Close(fid uint64) error {
+	f.Lock()
+	rw, ok := f.fidRW[fid]
+	delete(f.fidRW, fid)
+	f.Unlock()
+	if !ok || f.factory == nil {
+		return nil
+	}
+	rc, rok := rw.r.(io.Closer)
+	if rok {
+		rc.Close()
+	}
+	if wc, ok := rw.w.(io.Closer); ok && (!rok || wc != rc) {
+		wc.Close()
+	}
+	return nil
+}
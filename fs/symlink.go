@@ -0,0 +1,29 @@
+package fs
+
+import (
+	"github.com/knusbaum/go9p/proto"
+)
+
+// StaticSymlink is a symbolic link held in memory. As 9P2000 has no
+// readlink, a DMSYMLINK file's target is served as its contents, which is
+// how mount9p and 9P2000.u clients read it. Writing the file changes the
+// target, so StaticSymlinks also serve as the links clients create.
+type StaticSymlink struct {
+	StaticFile
+}
+
+// NewStaticSymlink returns a StaticSymlink pointing to target. The
+// DMSYMLINK bit is set in the stat's mode and Qid.
+func NewStaticSymlink(s *proto.Stat, target string) *StaticSymlink {
+	s.Mode |= proto.DMSYMLINK
+	s.Qid.Qtype |= uint8(proto.DMSYMLINK >> 24)
+	s.Length = uint64(len(target))
+	return &StaticSymlink{StaticFile{BaseFile: BaseFile{fStat: *s}, Data: []byte(target)}}
+}
+
+// Target returns the path the link points to.
+func (l *StaticSymlink) Target() string {
+	l.RLock()
+	defer l.RUnlock()
+	return string(l.Data)
+}
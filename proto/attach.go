@@ -18,18 +18,30 @@ func (attach *TAttach) String() string {
 }
 
 func (attach *TAttach) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 8, "tattach"); err != nil {
+		return nil, err
+	}
 	attach.Fid, buff = fromLittleE32(buff)
 	attach.Afid, buff = fromLittleE32(buff)
-	attach.Uname, buff = fromString(buff)
-	attach.Aname, buff = fromString(buff)
+	var err error
+	if attach.Uname, buff, err = parseString(buff, "uname"); err != nil {
+		return nil, err
+	}
+	if attach.Aname, buff, err = parseString(buff, "aname"); err != nil {
+		return nil, err
+	}
 	return buff, nil
 }
 
 func (attach *TAttach) Compose() []byte {
+	return attach.encode(nil)
+}
+
+func (attach *TAttach) encode(b []byte) []byte {
 	// size[4] Tattach tag[2] fid[4] afid[4] uname[s] aname[s]
 	length := 4 + 1 + 2 + 4 + 4 +
 		(2 + len(attach.Uname)) + (2 + len(attach.Aname))
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -40,7 +52,7 @@ func (attach *TAttach) Compose() []byte {
 	buffer = toLittleE32(attach.Afid, buffer)
 	buffer = toString(attach.Uname, buffer)
 	buffer = toString(attach.Aname, buffer)
-	return buff
+	return b
 }
 
 type RAttach struct {
@@ -62,16 +74,19 @@ func (attach *RAttach) parse(buff []byte) ([]byte, error) {
 }
 
 func (attach *RAttach) Compose() []byte {
+	return attach.encode(nil)
+}
+
+func (attach *RAttach) encode(b []byte) []byte {
 	// size[4] Rattach tag[2] qid[13]
 	length := 4 + 1 + 2 + 13
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
 	buffer[0] = attach.Type
 	buffer = buffer[1:]
 	buffer = toLittleE16(attach.Tag, buffer)
-	qidbuff := attach.Qid.Compose()
-	copy(buffer, qidbuff)
-	return buff
+	attach.Qid.put(buffer)
+	return b
 }
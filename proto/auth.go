@@ -17,17 +17,29 @@ func (auth *TAuth) String() string {
 }
 
 func (auth *TAuth) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 4, "tauth"); err != nil {
+		return nil, err
+	}
 	auth.Afid, buff = fromLittleE32(buff)
-	auth.Uname, buff = fromString(buff)
-	auth.Aname, buff = fromString(buff)
+	var err error
+	if auth.Uname, buff, err = parseString(buff, "uname"); err != nil {
+		return nil, err
+	}
+	if auth.Aname, buff, err = parseString(buff, "aname"); err != nil {
+		return nil, err
+	}
 	return buff, nil
 }
 
 func (auth *TAuth) Compose() []byte {
+	return auth.encode(nil)
+}
+
+func (auth *TAuth) encode(b []byte) []byte {
 	// size[4] Tauth tag[2] afid[4] uname[s] aname[s]
 	var length uint32 = uint32(4 + 1 + 2 + 4 +
 		(2 + len(auth.Uname)) + (2 + len(auth.Aname)))
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(length, buffer)
@@ -38,7 +50,7 @@ func (auth *TAuth) Compose() []byte {
 	buffer = toString(auth.Uname, buffer)
 	buffer = toString(auth.Aname, buffer)
 
-	return buff
+	return b
 }
 
 type RAuth struct {
@@ -60,16 +72,19 @@ func (auth *RAuth) parse(buff []byte) ([]byte, error) {
 }
 
 func (auth *RAuth) Compose() []byte {
+	return auth.encode(nil)
+}
+
+func (auth *RAuth) encode(b []byte) []byte {
 	// size[4] Rauth tag[2] aqid[13]
 	length := 4 + 1 + 2 + 13
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
 	buffer[0] = auth.Type
 	buffer = buffer[1:]
 	buffer = toLittleE16(auth.Tag, buffer)
-	qidbuffer := auth.Aqid.Compose()
-	copy(buffer, qidbuffer)
-	return buff
+	auth.Aqid.put(buffer)
+	return b
 }
@@ -12,14 +12,21 @@ func (clunk *TClunk) String() string {
 }
 
 func (clunk *TClunk) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 4, "tclunk"); err != nil {
+		return nil, err
+	}
 	clunk.Fid, buff = fromLittleE32(buff)
 	return buff, nil
 }
 
 func (clunk *TClunk) Compose() []byte {
+	return clunk.encode(nil)
+}
+
+func (clunk *TClunk) encode(b []byte) []byte {
 	// size[4] Tclunk tag[2] fid[4]
 	length := 4 + 1 + 2 + 4
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -27,7 +34,7 @@ func (clunk *TClunk) Compose() []byte {
 	buffer = buffer[1:]
 	buffer = toLittleE16(clunk.Tag, buffer)
 	buffer = toLittleE32(clunk.Fid, buffer)
-	return buff
+	return b
 }
 
 type RClunk struct {
@@ -43,14 +50,18 @@ func (clunk *RClunk) parse(buff []byte) ([]byte, error) {
 }
 
 func (clunk *RClunk) Compose() []byte {
+	return clunk.encode(nil)
+}
+
+func (clunk *RClunk) encode(b []byte) []byte {
 	// size[4] Rclunk tag[2]
 	length := 4 + 1 + 2
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
 	buffer[0] = clunk.Type
 	buffer = buffer[1:]
 	buffer = toLittleE16(clunk.Tag, buffer)
-	return buff
+	return b
 }
@@ -16,8 +16,17 @@ func (create *TCreate) String() string {
 }
 
 func (create *TCreate) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 4, "tcreate"); err != nil {
+		return nil, err
+	}
 	create.Fid, buff = fromLittleE32(buff)
-	create.Name, buff = fromString(buff)
+	var err error
+	if create.Name, buff, err = parseString(buff, "name"); err != nil {
+		return nil, err
+	}
+	if err := need(buff, 5, "tcreate"); err != nil {
+		return nil, err
+	}
 	create.Perm, buff = fromLittleE32(buff)
 	create.Mode = buff[0]
 	buff = buff[1:]
@@ -25,9 +34,13 @@ func (create *TCreate) parse(buff []byte) ([]byte, error) {
 }
 
 func (create *TCreate) Compose() []byte {
+	return create.encode(nil)
+}
+
+func (create *TCreate) encode(b []byte) []byte {
 	// size[4] Tcreate tag[2] fid[4] name[s] perm[4] mode[1]
 	length := 4 + 1 + 2 + 4 + (2 + len(create.Name)) + 4 + 1
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -39,7 +52,7 @@ func (create *TCreate) Compose() []byte {
 	buffer = toLittleE32(create.Perm, buffer)
 	buffer[0] = create.Mode
 	buffer = buffer[1:]
-	return buff
+	return b
 }
 
 type RCreate struct {
@@ -58,24 +71,28 @@ func (create *RCreate) parse(buff []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-
+	if err := need(buff, 4, "iounit"); err != nil {
+		return nil, err
+	}
 	create.Iounit, buff = fromLittleE32(buff)
 	return buff, nil
 }
 
 func (create *RCreate) Compose() []byte {
+	return create.encode(nil)
+}
+
+func (create *RCreate) encode(b []byte) []byte {
 	// size[4] Rcreate tag[2] qid[13] iounit[4]
 	length := 4 + 1 + 2 + 13 + 4
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
 	buffer[0] = create.Type
 	buffer = buffer[1:]
 	buffer = toLittleE16(create.Tag, buffer)
-	qidbuff := create.Qid.Compose()
-	copy(buffer, qidbuff)
-	buffer = buffer[len(qidbuff):]
+	buffer = create.Qid.put(buffer)
 	buffer = toLittleE32(create.Iounit, buffer)
-	return buff
+	return b
 }
@@ -0,0 +1,67 @@
+package proto
+
+import "io"
+
+// An Encoder writes 9P messages to an io.Writer. It marshals every message
+// into the same buffer, so that once the buffer has grown to fit the largest
+// message sent, encoding does not allocate. Each message is written with a
+// single call to Write.
+//
+// An Encoder is not safe for concurrent use.
+type Encoder struct {
+	w    io.Writer
+	buf  []byte
+	dotu bool
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// SetVersion sets the protocol version negotiated on the Encoder's
+// writer. Messages are encoded as plain 9P2000 until it is set to
+// "9P2000.u".
+func (e *Encoder) SetVersion(version string) {
+	e.dotu = isDotu(version)
+}
+
+// Encode writes fc to the Encoder's writer.
+func (e *Encoder) Encode(fc FCall) error {
+	if dc, ok := fc.(dotuCall); ok && e.dotu {
+		e.buf = dc.encodeDotu(e.buf[:0])
+	} else {
+		e.buf = fc.encode(e.buf[:0])
+	}
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// A Decoder reads 9P messages from an io.Reader. Unlike ParseCall, it reads
+// each message into a buffer reused from one message to the next. The
+// FCalls it returns do not refer to that buffer, so they remain valid after
+// later calls to Decode.
+//
+// A Decoder is not safe for concurrent use.
+type Decoder struct {
+	r    io.Reader
+	buf  []byte
+	dotu bool
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// SetVersion is like Encoder's SetVersion, for the messages decoded.
+func (d *Decoder) SetVersion(version string) {
+	d.dotu = isDotu(version)
+}
+
+// Decode reads the next message from the Decoder's reader.
+func (d *Decoder) Decode() (FCall, error) {
+	fc, buf, err := parseCallBuffer(d.r, d.buf, d.dotu)
+	d.buf = buf
+	return fc, err
+}
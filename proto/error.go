@@ -7,22 +7,62 @@ import (
 type RError struct {
 	Header
 	Ename string
+	// Errno is the numeric error 9P2000.u adds to Rerror. It is only
+	// parsed and composed for connections that negotiated 9P2000.u, by
+	// ParseCallVersion and Encoders and Decoders set to that version.
+	// Compose and ParseCall speak plain 9P2000, which has no errno.
+	Errno uint32
 }
 
 func (error *RError) String() string {
+	if error.Errno != 0 {
+		return fmt.Sprintf("rerror: [%s, ename: %s, errno: %d]",
+			&error.Header, error.Ename, error.Errno)
+	}
 	return fmt.Sprintf("rerror: [%s, ename: %s]",
 		&error.Header, error.Ename)
 }
 
 func (error *RError) parse(buff []byte) ([]byte, error) {
-	error.Ename, buff = fromString(buff)
+	ename, buff, err := parseString(buff, "ename")
+	if err != nil {
+		return nil, err
+	}
+	error.Ename = ename
+	return buff, nil
+}
+
+func (error *RError) parseDotu(buff []byte) ([]byte, error) {
+	buff, err := error.parse(buff)
+	if err != nil {
+		return nil, err
+	}
+	if err := need(buff, 4, "errno"); err != nil {
+		return nil, err
+	}
+	error.Errno, buff = fromLittleE32(buff)
 	return buff, nil
 }
 
 func (error *RError) Compose() []byte {
-	// size[4] Rerror tag[2] ename[s]
+	return error.encode(nil)
+}
+
+func (error *RError) encode(b []byte) []byte {
+	return error.encodeVersion(b, false)
+}
+
+func (error *RError) encodeDotu(b []byte) []byte {
+	return error.encodeVersion(b, true)
+}
+
+func (error *RError) encodeVersion(b []byte, dotu bool) []byte {
+	// size[4] Rerror tag[2] ename[s], and for 9P2000.u errno[4]
 	length := 4 + 1 + 2 + (2 + len(error.Ename))
-	buff := make([]byte, length)
+	if dotu {
+		length += 4
+	}
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -30,6 +70,9 @@ func (error *RError) Compose() []byte {
 	buffer = buffer[1:]
 	buffer = toLittleE16(error.Tag, buffer)
 	buffer = toString(error.Ename, buffer)
+	if dotu {
+		toLittleE32(error.Errno, buffer)
+	}
 
-	return buff
+	return b
 }
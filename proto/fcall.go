@@ -53,6 +53,14 @@ const (
 	MaxMsgLen = 65535 // 65k should be enough for anyone.
 )
 
+// NOTAG is the tag used for messages that are not part of a
+// tagged exchange, such as Tversion.
+const NOTAG = ^uint16(0)
+
+// NOFID is the fid meaning "no fid", such as the afid of a Tattach made
+// without authenticating.
+const NOFID = ^uint32(0)
+
 // FCall - the interface that all FCall types imlement. The String
 // function returns a human readable string representation of the
 // message. The Compose function returns a slice containing the 9p
@@ -60,9 +68,12 @@ const (
 // written to a stream.
 type FCall interface {
 	GetTag() uint16
+	SetTag(tag uint16)
 	String() string
 	Compose() []byte
 	parse([]byte) ([]byte, error)
+	// encode appends the marshaled message to b and returns the result.
+	encode(b []byte) []byte
 }
 
 // Header - every 9p message begins with this header.
@@ -75,6 +86,11 @@ func (fc *Header) GetTag() uint16 {
 	return fc.Tag
 }
 
+// SetTag sets the message's tag, e.g. to resend it as a new request.
+func (fc *Header) SetTag(tag uint16) {
+	fc.Tag = tag
+}
+
 func (fc *Header) String() string {
 	return fmt.Sprintf("tag: %d", fc.Tag)
 }
@@ -97,6 +113,17 @@ type Qid struct {
 	Uid   uint64
 }
 
+// The bits of Qid.Qtype. Each is the top byte of the matching DM bit of
+// Stat.Mode.
+const (
+	QTDIR     = uint8(DMDIR >> 24)
+	QTAPPEND  = uint8(DMAPPEND >> 24)
+	QTEXCL    = uint8(DMEXCL >> 24)
+	QTTMP     = uint8(DMTMP >> 24)
+	QTSYMLINK = uint8(DMSYMLINK >> 24)
+	QTFILE    = uint8(0)
+)
+
 func (qid *Qid) String() string {
 	return fmt.Sprintf("qtype: 0x%X, version: %d, uid: %d",
 		qid.Qtype, qid.Vers, qid.Uid)
@@ -104,8 +131,8 @@ func (qid *Qid) String() string {
 
 // parse - parse a Qid from a slice of a 9P2000 stream
 func (qid *Qid) parse(buff []byte) ([]byte, error) {
-	if len(buff) == 0 {
-		return nil, &ParseError{"can't parse. Reached end of buffer."}
+	if err := need(buff, 13, "qid"); err != nil {
+		return nil, err
 	}
 	qid.Qtype = buff[0]
 	qid.Vers, buff = fromLittleE32(buff[1:])
@@ -115,45 +142,95 @@ func (qid *Qid) parse(buff []byte) ([]byte, error) {
 
 func (qid *Qid) Compose() []byte {
 	buff := make([]byte, 13)
-	buffer := buff
+	qid.put(buff)
+	return buff
+}
 
+// put writes the qid to the start of buffer and returns the rest of it.
+func (qid *Qid) put(buffer []byte) []byte {
 	buffer[0] = qid.Qtype
 	buffer = buffer[1:]
 	buffer = toLittleE32(qid.Vers, buffer)
 	buffer = toLittleE64(qid.Uid, buffer)
-
-	return buff
+	return buffer
 }
 
 // ParseCall - Reads from a 9P2000 stream and parses an FCall from it.
 // On error, the protocol on the stream is in an unknown state and
 // the stream should be closed.
 func ParseCall(r io.Reader) (FCall, error) {
+	fc, _, err := ParseCallBuffer(r, nil)
+	return fc, err
+}
+
+// ParseCallVersion is like ParseCall, for a stream on which version was
+// negotiated. The fields 9P2000.u adds, such as the errno of an Rerror,
+// are only parsed if version is "9P2000.u".
+func ParseCallVersion(r io.Reader, version string) (FCall, error) {
+	fc, _, err := parseCallBuffer(r, nil, isDotu(version))
+	return fc, err
+}
+
+// isDotu reports whether version is 9P2000.u.
+func isDotu(version string) bool {
+	return version == "9P2000.u"
+}
+
+// dotuCall is implemented by messages 9P2000.u adds fields to.
+type dotuCall interface {
+	parseDotu(buff []byte) ([]byte, error)
+	encodeDotu(b []byte) []byte
+}
+
+// ParseCallBuffer is like ParseCall, but reads the message into buf rather
+// than a newly allocated buffer, growing it if it is too small. It returns
+// the buffer used, so that the caller can keep it for the next message. The
+// returned FCall does not refer to the buffer.
+func ParseCallBuffer(r io.Reader, buf []byte) (FCall, []byte, error) {
+	return parseCallBuffer(r, buf, false)
+}
+
+func parseCallBuffer(r io.Reader, buf []byte, dotu bool) (FCall, []byte, error) {
 	if r == nil {
-		return nil, &ParseError{"nil reader."}
+		return nil, buf, &ParseError{"nil reader."}
+	}
+	if cap(buf) < 4 {
+		buf = make([]byte, 4)
 	}
 
-	sizebuff := make([]byte, 4)
-	err := readBytes(r, sizebuff)
+	err := readBytes(r, buf[:4])
 	if err != nil {
-		return nil, err
+		return nil, buf, err
 	}
 
 	// We now have the length of the call.
-	length, _ := fromLittleE32(sizebuff)
+	length, _ := fromLittleE32(buf[:4])
 	if length > MaxMsgLen {
-		return nil, fmt.Errorf("Can't allocate %d bytes for message.", length)
+		return nil, buf, fmt.Errorf("Can't allocate %d bytes for message.", length)
+	}
+	if length < 4 {
+		return nil, buf, &ParseError{fmt.Sprintf("Message length %d too short.", length)}
 	}
 
 	// Subtract 4 for uint32 length we read
-	buff := make([]byte, length-4)
+	if uint32(cap(buf)) < length-4 {
+		buf = make([]byte, length-4)
+	}
+	buff := buf[:length-4]
 	err = readBytes(r, buff)
 	if err != nil {
-		return nil, err
+		return nil, buf, err
 	}
+	fc, err := parseFrame(buff, dotu)
+	return fc, buf, err
+}
 
+// parseFrame parses a message from buff, which holds everything following
+// the message's size field, with the fields of 9P2000.u if dotu is set. The
+// returned FCall does not refer to buff.
+func parseFrame(buff []byte, dotu bool) (FCall, error) {
 	var h Header
-	buff, err = h.parse(buff)
+	buff, err := h.parse(buff)
 	if err != nil {
 		return nil, err
 	}
@@ -246,7 +323,11 @@ func ParseCall(r io.Reader) (FCall, error) {
 		return nil, &ParseError{fmt.Sprintf("Message type %d not implemented.", h.Type)}
 	}
 
-	_, err = fc.parse(buff)
+	if dc, ok := fc.(dotuCall); ok && dotu {
+		_, err = dc.parseDotu(buff)
+	} else {
+		_, err = fc.parse(buff)
+	}
 	if err != nil {
 		return nil, err
 	}
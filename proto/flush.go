@@ -13,14 +13,21 @@ func (flush *TFlush) String() string {
 }
 
 func (flush *TFlush) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 2, "tflush"); err != nil {
+		return nil, err
+	}
 	flush.Oldtag, buff = fromLittleE16(buff)
 	return buff, nil
 }
 
 func (flush *TFlush) Compose() []byte {
+	return flush.encode(nil)
+}
+
+func (flush *TFlush) encode(b []byte) []byte {
 	// size[4] Tflush tag[2] oldtag[2]
 	length := 4 + 1 + 2 + 2
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -28,7 +35,7 @@ func (flush *TFlush) Compose() []byte {
 	buffer = buffer[1:]
 	buffer = toLittleE16(flush.Tag, buffer)
 	buffer = toLittleE16(flush.Oldtag, buffer)
-	return buff
+	return b
 }
 
 type RFlush struct {
@@ -44,14 +51,18 @@ func (flush *RFlush) parse(buff []byte) ([]byte, error) {
 }
 
 func (flush *RFlush) Compose() []byte {
+	return flush.encode(nil)
+}
+
+func (flush *RFlush) encode(b []byte) []byte {
 	// size[4] Rflush tag[2]
 	length := 4 + 1 + 2
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
 	buffer[0] = flush.Type
 	buffer = buffer[1:]
 	buffer = toLittleE16(flush.Tag, buffer)
-	return buff
+	return b
 }
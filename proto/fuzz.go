@@ -0,0 +1,24 @@
+//go:build gofuzz
+// +build gofuzz
+
+package proto
+
+import "fmt"
+
+// Fuzz is the entry point for go-fuzz. Malformed messages must be rejected
+// with an error, and messages that parse must survive being composed and
+// parsed again.
+func Fuzz(data []byte) int {
+	fc, err := parseFrame(data, false)
+	if err != nil {
+		return 0
+	}
+	again, err := parseFrame(fc.Compose()[4:], false)
+	if err != nil {
+		panic(fmt.Sprintf("%v composes to a message that does not parse: %v", fc, err))
+	}
+	if again.String() != fc.String() {
+		panic(fmt.Sprintf("%v parses back as %v", fc, again))
+	}
+	return 1
+}
@@ -2,6 +2,7 @@ package proto
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -55,6 +56,41 @@ func fromString(buff []byte) (string, []byte) {
 	return ret, buff[leng:]
 }
 
+// need returns an error unless buff holds at least n more bytes, for the
+// field named what. A negative n is a count too large for an int.
+func need(buff []byte, n int, what string) error {
+	if n < 0 || len(buff) < n {
+		return &ParseError{fmt.Sprintf("message too short for %s: need %d bytes, have %d", what, n, len(buff))}
+	}
+	return nil
+}
+
+// parseString is like fromString, but fails if buff ends before the string
+// does.
+func parseString(buff []byte, what string) (string, []byte, error) {
+	if err := need(buff, 2, what); err != nil {
+		return "", nil, err
+	}
+	if err := need(buff[2:], int(binary.LittleEndian.Uint16(buff)), what); err != nil {
+		return "", nil, err
+	}
+	s, buff := fromString(buff)
+	return s, buff, nil
+}
+
+// grow extends b by n bytes, reusing its spare capacity if there is enough,
+// and returns the extended slice along with the n new bytes.
+func grow(b []byte, n int) ([]byte, []byte) {
+	l := len(b)
+	if cap(b)-l < n {
+		nb := make([]byte, l, l+n)
+		copy(nb, b)
+		b = nb
+	}
+	b = b[:l+n]
+	return b, b[l:]
+}
+
 func toLittleE16(i uint16, buff []byte) []byte {
 	binary.LittleEndian.PutUint16(buff, i)
 	return buff[2:]
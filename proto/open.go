@@ -31,18 +31,22 @@ func (open *TOpen) String() string {
 }
 
 func (open *TOpen) parse(buff []byte) ([]byte, error) {
-	open.Fid, buff = fromLittleE32(buff)
-	if len(buff) < 1 {
-		return buff, fmt.Errorf("short fcall")
+	if err := need(buff, 5, "topen"); err != nil {
+		return nil, err
 	}
+	open.Fid, buff = fromLittleE32(buff)
 	open.Mode = Mode(buff[0])
 	return buff[1:], nil
 }
 
 func (open *TOpen) Compose() []byte {
+	return open.encode(nil)
+}
+
+func (open *TOpen) encode(b []byte) []byte {
 	// size[4] Topen tag[2] fid[4] mode[1]
 	length := 4 + 1 + 2 + 4 + 1
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -52,7 +56,7 @@ func (open *TOpen) Compose() []byte {
 	buffer = toLittleE32(open.Fid, buffer)
 	buffer[0] = byte(open.Mode)
 	buffer = buffer[1:]
-	return buff
+	return b
 }
 
 type ROpen struct {
@@ -71,23 +75,28 @@ func (open *ROpen) parse(buff []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := need(buff, 4, "iounit"); err != nil {
+		return nil, err
+	}
 	open.Iounit, buff = fromLittleE32(buff)
 	return buff, nil
 }
 
 func (open *ROpen) Compose() []byte {
+	return open.encode(nil)
+}
+
+func (open *ROpen) encode(b []byte) []byte {
 	// size[4] Ropen tag[2] qid[13] iounit[4]
 	length := 4 + 1 + 2 + 13 + 4
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
 	buffer[0] = open.Type
 	buffer = buffer[1:]
 	buffer = toLittleE16(open.Tag, buffer)
-	qidbuff := open.Qid.Compose()
-	copy(buffer, qidbuff)
-	buffer = buffer[len(qidbuff):]
+	buffer = open.Qid.put(buffer)
 	buffer = toLittleE32(open.Iounit, buffer)
-	return buff
+	return b
 }
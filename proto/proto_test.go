@@ -3,6 +3,8 @@ package proto
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -18,15 +20,16 @@ func randQid() Qid {
 	return Qid{uint8(rand.Int31n(256)), rand.Uint32(), rand.Uint64()}
 }
 
-func TestMarshall(t *testing.T) {
-	for _, tt := range []FCall{
+// sampleCalls returns one message of every type.
+func sampleCalls() []FCall {
+	return []FCall{
 		&TRVersion{randHeader(Tversion), rand.Uint32(), "version"},
 		&TRVersion{randHeader(Rversion), rand.Uint32(), "version"},
 		&TAuth{randHeader(Tauth), rand.Uint32(), "UNAME", "ANAME"},
 		&RAuth{randHeader(Rauth), randQid()},
 		&TAttach{randHeader(Tattach), rand.Uint32(), rand.Uint32(), "UNAME", "ANAME"},
 		&RAttach{randHeader(Rattach), randQid()},
-		&RError{randHeader(Rerror), "ERROR"},
+		&RError{Header: randHeader(Rerror), Ename: "ERROR"},
 		&TFlush{randHeader(Tflush), uint16(rand.Uint32())},
 		&RFlush{randHeader(Rflush)},
 		&TWalk{randHeader(Twalk), rand.Uint32(), rand.Uint32(), 2, []string{"wname1", "wname2"}},
@@ -71,7 +74,11 @@ func TestMarshall(t *testing.T) {
 			"Muid",
 		}},
 		&RWstat{randHeader(Rwstat)},
-	} {
+	}
+}
+
+func TestMarshall(t *testing.T) {
+	for _, tt := range sampleCalls() {
 		t.Run(reflect.TypeOf(tt).Elem().Name(), func(t *testing.T) {
 			assert := assert.New(t)
 			comp := tt.Compose()
@@ -110,3 +117,145 @@ func TestBadMessage(t *testing.T) {
 		assert.Nil(fc)
 	})
 }
+
+// frame returns body as a message, with its size prepended.
+func frame(body []byte) []byte {
+	bs := make([]byte, 4, 4+len(body))
+	binary.LittleEndian.PutUint32(bs, uint32(4+len(body)))
+	return append(bs, body...)
+}
+
+func TestTruncatedMessage(t *testing.T) {
+	for _, tt := range sampleCalls() {
+		t.Run(reflect.TypeOf(tt).Elem().Name(), func(t *testing.T) {
+			assert := assert.New(t)
+			body := tt.Compose()[4:]
+			for n := 0; n < len(body); n++ {
+				fc, err := ParseCall(bytes.NewReader(frame(body[:n])))
+				assert.Error(err, "truncated to %d bytes", n)
+				assert.Nil(fc)
+			}
+		})
+	}
+}
+
+func TestGarbledMessage(t *testing.T) {
+	// Corrupt sample messages at random, which must not panic the parser.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		calls := sampleCalls()
+		body := calls[r.Intn(len(calls))].Compose()[4:]
+		for j := r.Intn(4); j >= 0; j-- {
+			body[r.Intn(len(body))] = byte(r.Intn(256))
+		}
+		ParseCall(bytes.NewReader(frame(body)))
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	assert := assert.New(t)
+	calls := sampleCalls()
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, fc := range calls {
+		assert.NoError(enc.Encode(fc))
+	}
+	var composed []byte
+	for _, fc := range calls {
+		composed = append(composed, fc.Compose()...)
+	}
+	assert.Equal(composed, buf.Bytes())
+
+	dec := NewDecoder(&buf)
+	var decoded []FCall
+	for range calls {
+		fc, err := dec.Decode()
+		if !assert.NoError(err) {
+			return
+		}
+		decoded = append(decoded, fc)
+	}
+	// Earlier messages must not be clobbered by later reads into the
+	// decoder's buffer.
+	assert.Equal(calls, decoded)
+	_, err := dec.Decode()
+	assert.Equal(io.EOF, err)
+}
+
+func TestRerrorVersion(t *testing.T) {
+	assert := assert.New(t)
+	rerror := &RError{Header: randHeader(Rerror), Ename: "ERROR", Errno: 2}
+	plain := &RError{Header: rerror.Header, Ename: "ERROR"}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetVersion("9P2000.u")
+	assert.NoError(enc.Encode(rerror))
+	dotu := append([]byte(nil), buf.Bytes()...)
+	assert.Equal(len(rerror.Compose())+4, len(dotu))
+
+	fc, err := ParseCallVersion(bytes.NewReader(dotu), "9P2000.u")
+	if assert.NoError(err) {
+		assert.Equal(rerror, fc)
+	}
+	dec := NewDecoder(bytes.NewReader(dotu))
+	dec.SetVersion("9P2000.u")
+	fc, err = dec.Decode()
+	if assert.NoError(err) {
+		assert.Equal(rerror, fc)
+	}
+
+	// Plain 9P2000 has no errno, whatever follows the ename.
+	fc, err = ParseCall(bytes.NewReader(dotu))
+	if assert.NoError(err) {
+		assert.Equal(plain, fc)
+	}
+	assert.Equal(plain.Compose(), rerror.Compose())
+
+	// A 9P2000.u Rerror must carry its errno.
+	_, err = ParseCallVersion(bytes.NewReader(plain.Compose()), "9P2000.u")
+	assert.Error(err)
+}
+
+func benchCall() FCall {
+	return &RStat{randHeader(Rstat), Stat{
+		Qid:  randQid(),
+		Name: "NAME",
+		Uid:  "Uid",
+		Gid:  "Gid",
+		Muid: "Muid",
+	}}
+}
+
+func BenchmarkCompose(b *testing.B) {
+	fc := benchCall()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ioutil.Discard.Write(fc.Compose())
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	fc := benchCall()
+	enc := NewEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		enc.Encode(fc)
+	}
+}
+
+func TestDeviceExtension(t *testing.T) {
+	assert := assert.New(t)
+	ext := DeviceExtension('c', 1, 3)
+	assert.Equal("c 1 3", ext)
+	kind, major, minor, err := ParseDeviceExtension(ext)
+	if assert.NoError(err) {
+		assert.Equal(byte('c'), kind)
+		assert.Equal(uint32(1), major)
+		assert.Equal(uint32(3), minor)
+	}
+	for _, bad := range []string{"", "p 1 3", "b 1", "b x 3"} {
+		_, _, _, err := ParseDeviceExtension(bad)
+		assert.Error(err, bad)
+	}
+}
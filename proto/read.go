@@ -15,6 +15,9 @@ func (read *TRead) String() string {
 }
 
 func (read *TRead) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 16, "tread"); err != nil {
+		return nil, err
+	}
 	read.Fid, buff = fromLittleE32(buff)
 	read.Offset, buff = fromLittleE64(buff)
 	read.Count, buff = fromLittleE32(buff)
@@ -22,9 +25,13 @@ func (read *TRead) parse(buff []byte) ([]byte, error) {
 }
 
 func (read *TRead) Compose() []byte {
+	return read.encode(nil)
+}
+
+func (read *TRead) encode(b []byte) []byte {
 	// size[4] Twrite tag[2] fid[4] offset[8] count[4]
 	length := 4 + 1 + 2 + 4 + 8 + 4
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -34,7 +41,7 @@ func (read *TRead) Compose() []byte {
 	buffer = toLittleE32(read.Fid, buffer)
 	buffer = toLittleE64(read.Offset, buffer)
 	buffer = toLittleE32(read.Count, buffer)
-	return buff
+	return b
 }
 
 type RRead struct {
@@ -48,16 +55,26 @@ func (read *RRead) String() string {
 }
 
 func (read *RRead) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 4, "rread"); err != nil {
+		return nil, err
+	}
 	read.Count, buff = fromLittleE32(buff)
+	if err := need(buff, int(read.Count), "rread data"); err != nil {
+		return nil, err
+	}
 	read.Data = make([]byte, read.Count)
 	copy(read.Data, buff[:read.Count])
 	return buff[read.Count:], nil
 }
 
 func (read *RRead) Compose() []byte {
+	return read.encode(nil)
+}
+
+func (read *RRead) encode(b []byte) []byte {
 	// size[4] Rread tag[2] count[4] data[count]
 	length := 4 + 1 + 2 + 4 + read.Count
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -66,5 +83,5 @@ func (read *RRead) Compose() []byte {
 	buffer = toLittleE16(read.Tag, buffer)
 	buffer = toLittleE32(read.Count, buffer)
 	copy(buffer, read.Data)
-	return buff
+	return b
 }
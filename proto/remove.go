@@ -12,14 +12,21 @@ func (remove *TRemove) String() string {
 }
 
 func (remove *TRemove) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 4, "tremove"); err != nil {
+		return nil, err
+	}
 	remove.Fid, buff = fromLittleE32(buff)
 	return buff, nil
 }
 
 func (remove *TRemove) Compose() []byte {
+	return remove.encode(nil)
+}
+
+func (remove *TRemove) encode(b []byte) []byte {
 	// size[4] Tremove tag[2] fid[4]
 	length := 4 + 1 + 2 + 4
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -27,7 +34,7 @@ func (remove *TRemove) Compose() []byte {
 	buffer = buffer[1:]
 	buffer = toLittleE16(remove.Tag, buffer)
 	buffer = toLittleE32(remove.Fid, buffer)
-	return buff
+	return b
 }
 
 type RRemove struct {
@@ -43,14 +50,18 @@ func (remove *RRemove) parse(buff []byte) ([]byte, error) {
 }
 
 func (remove *RRemove) Compose() []byte {
+	return remove.encode(nil)
+}
+
+func (remove *RRemove) encode(b []byte) []byte {
 	// size[4] Rwstat tag[2]
 	length := 4 + 1 + 2
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
 	buffer[0] = remove.Type
 	buffer = buffer[1:]
 	buffer = toLittleE16(remove.Tag, buffer)
-	return buff
+	return b
 }
@@ -7,8 +7,41 @@ const (
 	DMAPPEND = uint32(1 << 30)
 	DMEXCL   = uint32(1 << 29)
 	DMTMP    = uint32(1 << 26)
+
+	// DMSYMLINK is from 9P2000.u. The file is a symbolic link whose
+	// contents are the link's target.
+	DMSYMLINK = uint32(1 << 25)
+	// DMDEVICE, DMNAMEDPIPE and DMSOCKET are from 9P2000.u too. A
+	// device's kind and numbers are described by its extension, see
+	// DeviceExtension.
+	DMDEVICE    = uint32(1 << 23)
+	DMNAMEDPIPE = uint32(1 << 21)
+	DMSOCKET    = uint32(1 << 20)
+	// DMSETUID and DMSETGID are from 9P2000.u, and DMSETVTX, the sticky
+	// bit, is the value Linux's v9fs gives it. On a directory, DMSETVTX
+	// keeps users from removing the files of others in it.
+	DMSETUID = uint32(1 << 19)
+	DMSETGID = uint32(1 << 18)
+	DMSETVTX = uint32(1 << 16)
 )
 
+// DeviceExtension returns the 9P2000.u extension describing a device of
+// the given kind, 'b' for block devices or 'c' for character devices,
+// such as "c 1 3".
+func DeviceExtension(kind byte, major, minor uint32) string {
+	return fmt.Sprintf("%c %d %d", kind, major, minor)
+}
+
+// ParseDeviceExtension parses an extension made by DeviceExtension.
+func ParseDeviceExtension(ext string) (kind byte, major, minor uint32, err error) {
+	var k rune
+	n, err := fmt.Sscanf(ext, "%c %d %d", &k, &major, &minor)
+	if err != nil || n != 3 || (k != 'b' && k != 'c') {
+		return 0, 0, 0, fmt.Errorf("bad device %q", ext)
+	}
+	return byte(k), major, minor, nil
+}
+
 type TStat struct {
 	Header
 	Fid uint32
@@ -19,14 +52,21 @@ func (stat *TStat) String() string {
 }
 
 func (stat *TStat) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 4, "tstat"); err != nil {
+		return nil, err
+	}
 	stat.Fid, buff = fromLittleE32(buff)
 	return buff, nil
 }
 
 func (stat *TStat) Compose() []byte {
+	return stat.encode(nil)
+}
+
+func (stat *TStat) encode(b []byte) []byte {
 	// size[4] Twrite tag[2] fid[4]
 	length := 4 + 1 + 2 + 4
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -35,7 +75,7 @@ func (stat *TStat) Compose() []byte {
 	buffer = toLittleE16(stat.Tag, buffer)
 	buffer = toLittleE32(stat.Fid, buffer)
 
-	return buff
+	return b
 }
 
 type Stat struct {
@@ -74,7 +114,21 @@ func ParseStats(buff []byte) ([]Stat, error) {
 }
 
 func (stat *Stat) parse(buff []byte) ([]byte, error) {
-	_, buff = fromLittleE16(buff) // throw away length
+	if err := need(buff, 2, "stat"); err != nil {
+		return nil, err
+	}
+	var size uint16
+	size, buff = fromLittleE16(buff)
+	if err := need(buff, int(size), "stat"); err != nil {
+		return nil, err
+	}
+	// Parse only the stat itself, so a stat whose fields overrun its size
+	// fails rather than eating into what follows.
+	rest := buff[size:]
+	buff = buff[:size]
+	if err := need(buff, 2+4+13+4+4+4+8, "stat"); err != nil {
+		return nil, err
+	}
 	stat.Type, buff = fromLittleE16(buff)
 	stat.Dev, buff = fromLittleE32(buff)
 	buff, err := stat.Qid.parse(buff)
@@ -85,11 +139,19 @@ func (stat *Stat) parse(buff []byte) ([]byte, error) {
 	stat.Atime, buff = fromLittleE32(buff)
 	stat.Mtime, buff = fromLittleE32(buff)
 	stat.Length, buff = fromLittleE64(buff)
-	stat.Name, buff = fromString(buff)
-	stat.Uid, buff = fromString(buff)
-	stat.Gid, buff = fromString(buff)
-	stat.Muid, buff = fromString(buff)
-	return buff, nil
+	if stat.Name, buff, err = parseString(buff, "name"); err != nil {
+		return nil, err
+	}
+	if stat.Uid, buff, err = parseString(buff, "uid"); err != nil {
+		return nil, err
+	}
+	if stat.Gid, buff, err = parseString(buff, "gid"); err != nil {
+		return nil, err
+	}
+	if stat.Muid, buff, err = parseString(buff, "muid"); err != nil {
+		return nil, err
+	}
+	return rest, nil
 }
 
 func (stat *Stat) ComposeLength() uint16 {
@@ -103,16 +165,18 @@ func (stat *Stat) ComposeLength() uint16 {
 }
 
 func (stat *Stat) Compose() []byte {
-	length := stat.ComposeLength()
-	buff := make([]byte, length)
-	buffer := buff
+	buff := make([]byte, stat.ComposeLength())
+	stat.put(buff)
+	return buff
+}
 
-	buffer = toLittleE16(length-2, buffer)
+// put writes the stat to the start of buffer, which must have room for
+// ComposeLength bytes, and returns the rest of buffer.
+func (stat *Stat) put(buffer []byte) []byte {
+	buffer = toLittleE16(stat.ComposeLength()-2, buffer)
 	buffer = toLittleE16(stat.Type, buffer)
 	buffer = toLittleE32(stat.Dev, buffer)
-	qidbuff := stat.Qid.Compose()
-	copy(buffer, qidbuff)
-	buffer = buffer[len(qidbuff):]
+	buffer = stat.Qid.put(buffer)
 	buffer = toLittleE32(stat.Mode, buffer)
 	buffer = toLittleE32(stat.Atime, buffer)
 	buffer = toLittleE32(stat.Mtime, buffer)
@@ -121,7 +185,7 @@ func (stat *Stat) Compose() []byte {
 	buffer = toString(stat.Uid, buffer)
 	buffer = toString(stat.Gid, buffer)
 	buffer = toString(stat.Muid, buffer)
-	return buff
+	return buffer
 }
 
 type RStat struct {
@@ -135,6 +199,9 @@ func (stat *RStat) String() string {
 }
 
 func (stat *RStat) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 2, "rstat"); err != nil {
+		return nil, err
+	}
 	_, buff = fromLittleE16(buff) // stat length
 	buff, err := stat.Stat.parse(buff)
 	if err != nil {
@@ -144,10 +211,14 @@ func (stat *RStat) parse(buff []byte) ([]byte, error) {
 }
 
 func (stat *RStat) Compose() []byte {
+	return stat.encode(nil)
+}
+
+func (stat *RStat) encode(b []byte) []byte {
 	// size[4] Rstat tag[2] stat[n]
 	statLength := stat.Stat.ComposeLength()
 	length := 4 + 1 + 2 + 2 + statLength
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -155,7 +226,7 @@ func (stat *RStat) Compose() []byte {
 	buffer = buffer[1:]
 	buffer = toLittleE16(stat.Tag, buffer)
 	buffer = toLittleE16(statLength, buffer)
-	copy(buffer, stat.Stat.Compose())
+	stat.Stat.put(buffer)
 
-	return buff
+	return b
 }
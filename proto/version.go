@@ -22,15 +22,26 @@ func (version *TRVersion) String() string {
 }
 
 func (version *TRVersion) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 4, "version"); err != nil {
+		return nil, err
+	}
 	version.Msize, buff = fromLittleE32(buff)
-	version.Version, buff = fromString(buff)
+	v, buff, err := parseString(buff, "version")
+	if err != nil {
+		return nil, err
+	}
+	version.Version = v
 	return buff, nil
 }
 
 func (version *TRVersion) Compose() []byte {
+	return version.encode(nil)
+}
+
+func (version *TRVersion) encode(b []byte) []byte {
 	// size[4] Tversion tag[2] msize[4] version[s]
 	length := 4 + 1 + 2 + 4 + (2 + len(version.Version))
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -40,5 +51,5 @@ func (version *TRVersion) Compose() []byte {
 	buffer = toLittleE32(version.Msize, buffer)
 	buffer = toString(version.Version, buffer)
 
-	return buff
+	return b
 }
@@ -2,6 +2,10 @@ package proto
 
 import "fmt"
 
+// MAXWELEM is the most names a single Twalk may carry. Longer paths are
+// walked with several Twalks.
+const MAXWELEM = 16
+
 type TWalk struct {
 	Header
 	Fid    uint32
@@ -21,24 +25,38 @@ func (walk *TWalk) String() string {
 }
 
 func (walk *TWalk) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 10, "twalk"); err != nil {
+		return nil, err
+	}
 	walk.Fid, buff = fromLittleE32(buff)
 	walk.Newfid, buff = fromLittleE32(buff)
 	walk.Nwname, buff = fromLittleE16(buff)
+	// Each name takes at least its 2 byte length.
+	if err := need(buff, 2*int(walk.Nwname), "wname"); err != nil {
+		return nil, err
+	}
 	walk.Wname = make([]string, walk.Nwname)
 	var i uint16
+	var err error
 	for ; i < walk.Nwname; i++ {
-		walk.Wname[i], buff = fromString(buff)
+		if walk.Wname[i], buff, err = parseString(buff, "wname"); err != nil {
+			return nil, err
+		}
 	}
 	return buff, nil
 }
 
 func (walk *TWalk) Compose() []byte {
+	return walk.encode(nil)
+}
+
+func (walk *TWalk) encode(b []byte) []byte {
 	// size[4] Twalk  tag[2] fid[4] newfid[4] nwname[2] nwname*(wname[s])
 	length := 4 + 1 + 2 + 4 + 4 + 2
 	for _, name := range walk.Wname {
 		length += 2 + len(name)
 	}
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -52,7 +70,7 @@ func (walk *TWalk) Compose() []byte {
 		buffer = toString(name, buffer)
 	}
 
-	return buff
+	return b
 }
 
 type RWalk struct {
@@ -72,7 +90,16 @@ func (walk *RWalk) String() string {
 }
 
 func (walk *RWalk) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 2, "rwalk"); err != nil {
+		return nil, err
+	}
 	walk.Nwqid, buff = fromLittleE16(buff)
+	if walk.Nwqid > MAXWELEM {
+		return nil, &ParseError{fmt.Sprintf("rwalk has %d qids, more than %d", walk.Nwqid, MAXWELEM)}
+	}
+	if err := need(buff, 13*int(walk.Nwqid), "wqid"); err != nil {
+		return nil, err
+	}
 	walk.Wqid = make([]Qid, walk.Nwqid)
 	var i uint16
 	var err error
@@ -86,9 +113,13 @@ func (walk *RWalk) parse(buff []byte) ([]byte, error) {
 }
 
 func (walk *RWalk) Compose() []byte {
+	return walk.encode(nil)
+}
+
+func (walk *RWalk) encode(b []byte) []byte {
 	// size[4] Rwalk tag[2] nwqid[2] nwqid*(wqid[13])
 	length := 4 + 1 + 2 + 2 + (walk.Nwqid * 13)
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -97,10 +128,8 @@ func (walk *RWalk) Compose() []byte {
 	buffer = toLittleE16(walk.Tag, buffer)
 	buffer = toLittleE16(walk.Nwqid, buffer)
 	for _, qid := range walk.Wqid {
-		qidbuff := qid.Compose()
-		copy(buffer, qidbuff)
-		buffer = buffer[len(qidbuff):]
+		buffer = qid.put(buffer)
 	}
 
-	return buff
+	return b
 }
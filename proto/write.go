@@ -16,18 +16,28 @@ func (write *TWrite) String() string {
 }
 
 func (write *TWrite) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 16, "twrite"); err != nil {
+		return nil, err
+	}
 	write.Fid, buff = fromLittleE32(buff)
 	write.Offset, buff = fromLittleE64(buff)
 	write.Count, buff = fromLittleE32(buff)
+	if err := need(buff, int(write.Count), "twrite data"); err != nil {
+		return nil, err
+	}
 	write.Data = make([]byte, write.Count)
 	copy(write.Data, buff[:write.Count])
 	return buff[write.Count:], nil
 }
 
 func (write *TWrite) Compose() []byte {
+	return write.encode(nil)
+}
+
+func (write *TWrite) encode(b []byte) []byte {
 	// size[4] Twrite tag[2] fid[4] offset[8] count[4] data[count]
 	length := 4 + 1 + 2 + 4 + 8 + 4 + write.Count
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -38,7 +48,7 @@ func (write *TWrite) Compose() []byte {
 	buffer = toLittleE64(write.Offset, buffer)
 	buffer = toLittleE32(write.Count, buffer)
 	copy(buffer, write.Data)
-	return buff
+	return b
 }
 
 type RWrite struct {
@@ -51,14 +61,21 @@ func (write *RWrite) String() string {
 }
 
 func (write *RWrite) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 4, "rwrite"); err != nil {
+		return nil, err
+	}
 	write.Count, buff = fromLittleE32(buff)
 	return buff, nil
 }
 
 func (write *RWrite) Compose() []byte {
+	return write.encode(nil)
+}
+
+func (write *RWrite) encode(b []byte) []byte {
 	// size[4] Rwrite tag[2] count[4]
 	length := 4 + 1 + 2 + 4
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -66,5 +83,5 @@ func (write *RWrite) Compose() []byte {
 	buffer = buffer[1:]
 	buffer = toLittleE16(write.Tag, buffer)
 	buffer = toLittleE32(write.Count, buffer)
-	return buff
+	return b
 }
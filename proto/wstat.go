@@ -14,6 +14,9 @@ func (wstat *TWstat) String() string {
 }
 
 func (wstat *TWstat) parse(buff []byte) ([]byte, error) {
+	if err := need(buff, 6, "twstat"); err != nil {
+		return nil, err
+	}
 	wstat.Fid, buff = fromLittleE32(buff)
 	_, buff = fromLittleE16(buff) // Throw away stat length.
 	buff, err := wstat.Stat.parse(buff)
@@ -24,10 +27,14 @@ func (wstat *TWstat) parse(buff []byte) ([]byte, error) {
 }
 
 func (wstat *TWstat) Compose() []byte {
+	return wstat.encode(nil)
+}
+
+func (wstat *TWstat) encode(b []byte) []byte {
 	// size[4] Twstat tag[2] fid[4] stat[n]
 	statLength := wstat.Stat.ComposeLength()
 	length := 4 + 1 + 2 + 4 + 2 + statLength
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
@@ -36,9 +43,9 @@ func (wstat *TWstat) Compose() []byte {
 	buffer = toLittleE16(wstat.Tag, buffer)
 	buffer = toLittleE32(wstat.Fid, buffer)
 	buffer = toLittleE16(statLength, buffer)
-	copy(buffer, wstat.Stat.Compose())
+	wstat.Stat.put(buffer)
 
-	return buff
+	return b
 }
 
 type RWstat struct {
@@ -54,14 +61,18 @@ func (wstat *RWstat) parse(buff []byte) ([]byte, error) {
 }
 
 func (wstat *RWstat) Compose() []byte {
+	return wstat.encode(nil)
+}
+
+func (wstat *RWstat) encode(b []byte) []byte {
 	// size[4] Rwstat tag[2]
 	length := 4 + 1 + 2
-	buff := make([]byte, length)
+	b, buff := grow(b, int(length))
 	buffer := buff
 
 	buffer = toLittleE32(uint32(length), buffer)
 	buffer[0] = wstat.Type
 	buffer = buffer[1:]
 	buffer = toLittleE16(wstat.Tag, buffer)
-	return buff
+	return b
 }
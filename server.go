@@ -13,12 +13,16 @@ package go9p
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/knusbaum/go9p/proto"
 )
@@ -60,44 +64,123 @@ type Srv interface {
 // Conn represents an individual connection to a 9p server.
 // In the case of a server listening on a network, there
 // may be many clients connected to a given server at once.
+//
+// TagContext returns the context for the request with the given tag.
+// The context is cancelled when the request completes, when it is
+// flushed by the client with a Tflush, or when the connection ends.
+// Long-running handlers may use it to abandon work whose reply will never
+// be sent.
 type Conn interface {
 	TagContext(uint16) context.Context
 	DropContext(uint16)
 }
 
-func handleConnection(nc net.Conn, srv Srv) {
+// A ConnCloser is a Conn that is told when its connection ends. Close is
+// called once the connection has been closed and every request read from
+// it has been handled, so it may release whatever the connection held.
+type ConnCloser interface {
+	Conn
+	Close()
+}
+
+// FidInfo describes a fid in use on a connection.
+type FidInfo struct {
+	Fid  uint32
+	Path string     // The path of the file the fid refers to.
+	Mode proto.Mode // The mode the fid was opened with, or proto.None.
+	User string     // The user the fid acts as.
+}
+
+// ConnInfo describes one of a Server's connections.
+type ConnInfo struct {
+	RemoteAddr string
+	User       string // The user the connection first attached as.
+	Fids       []FidInfo
+}
+
+// An Inspector is a Conn that can describe itself, for
+// Server.Connections. Inspect fills in everything but RemoteAddr.
+type Inspector interface {
+	Conn
+	Inspect() ConnInfo
+}
+
+// closeConn calls conn's Close method, if it has one.
+func closeConn(conn Conn) {
+	if cc, ok := conn.(ConnCloser); ok {
+		cc.Close()
+	}
+}
+
+func handleConnection(nc net.Conn, srv Srv, conn Conn) {
 	defer nc.Close()
 	read := bufio.NewReader(nc)
-	err := handleIOAsync(read, nc, srv)
+	err := handleIOAsync(read, nc, srv, conn)
 	if err != nil {
 		log.Printf("%v\n", err)
 	}
 }
 
+// framePool holds the buffers incoming messages are read into. Parsed
+// messages copy everything they keep out of the buffer, so a buffer can be
+// returned to the pool as soon as its message has been parsed.
+var framePool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// readCall reads and parses the next message from r using a buffer from
+// framePool. msize is the connection's negotiated message size; buffers
+// smaller than it are replaced so that reads do not have to grow them.
+func readCall(r io.Reader, msize uint32) (proto.FCall, error) {
+	bp := framePool.Get().(*[]byte)
+	if uint32(cap(*bp)) < msize {
+		*bp = make([]byte, msize)
+	}
+	call, buf, err := proto.ParseCallBuffer(r, *bp)
+	*bp = buf
+	framePool.Put(bp)
+	return call, err
+}
+
+// negotiatedMsize returns the msize agreed on by resp if it is an Rversion,
+// or msize otherwise.
+func negotiatedMsize(resp proto.FCall, msize uint32) uint32 {
+	if v, ok := resp.(*proto.TRVersion); ok && v.Type == proto.Rversion {
+		return v.Msize
+	}
+	return msize
+}
+
 // handleIO seems to be about 10x faster than handleIOAsync
 // in my experiments. It would be nice to be able to keep some
 // performance without making the reading, handling, and
 // writing of calls synchronous.
 func handleIO(r io.Reader, w io.Writer, srv Srv) error {
 	conn := srv.NewConn()
+	defer closeConn(conn)
+	tracker := newTagTracker()
+	enc := proto.NewEncoder(w)
+	msize := uint32(proto.MaxMsgLen)
 	for {
-		call, err := proto.ParseCall(r)
+		call, err := readCall(r, msize)
 		if err != nil {
 			return err
 		}
 		verboseLog("=in=> %s\n", call)
-		resp, err := handleCall(call, srv, conn)
+		req := tracker.start(call, conn)
+		resp, err := handleCall(call, srv, conn, tracker)
 		if err != nil {
 			return err
 		}
+		msize = negotiatedMsize(resp, msize)
 
-		if resp == nil {
-			// This case happens when an active tag is
-			// flushed.
-			continue
-		}
-		verboseLog("<=out= %s\n", resp)
-		_, err = w.Write(resp.Compose())
+		tracker.finish(req, conn, func() {
+			if resp == nil {
+				return
+			}
+			verboseLog("<=out= %s\n", resp)
+			err = enc.Encode(resp)
+		})
 		if err != nil {
 			return err
 		}
@@ -105,11 +188,16 @@ func handleIO(r io.Reader, w io.Writer, srv Srv) error {
 	return nil
 }
 
-func handleIOAsync(r io.Reader, w io.Writer, srv Srv) error {
-	incoming := make(chan proto.FCall, 100)
+func handleIOAsync(r io.Reader, w io.Writer, srv Srv, conn Conn) error {
+	// Unbuffered, so that requests are only given to idle workers and
+	// never wait behind a handler that blocks.
+	incoming := make(chan *request)
 	outgoing := make(chan proto.FCall, 100)
 
-	conn := srv.NewConn()
+	// Deferred first, so that it runs once the workers have finished.
+	defer closeConn(conn)
+	tracker := newTagTracker()
+	msize := uint32(proto.MaxMsgLen)
 
 	// Write the outgoing
 	var outgoingWG sync.WaitGroup
@@ -117,9 +205,10 @@ func handleIOAsync(r io.Reader, w io.Writer, srv Srv) error {
 	outgoingWG.Add(1)
 	go func() {
 		outgoingWG.Done()
+		enc := proto.NewEncoder(w)
 		for call := range outgoing {
 			verboseLog("<=out= %s\n", call)
-			_, err := w.Write(call.Compose())
+			err := enc.Encode(call)
 			if err != nil {
 				log.Printf("Protocol error: %v\n", err)
 			}
@@ -128,23 +217,36 @@ func handleIOAsync(r io.Reader, w io.Writer, srv Srv) error {
 
 	var workerWG sync.WaitGroup
 	defer func() { workerWG.Wait(); close(outgoing) }()
+	// Slots for requests handled outside the workers while every worker
+	// is busy.
+	overflow := make(chan struct{}, maxOverflow)
+	handle := func(req *request) bool {
+		resp, err := handleCall(req.call, srv, conn, tracker)
+		if err != nil {
+			tracker.finish(req, conn, func() {})
+			log.Printf("Protocol error: %v\n", err)
+			return false
+		}
+		if m := negotiatedMsize(resp, 0); m != 0 {
+			atomic.StoreUint32(&msize, m)
+		}
+		tracker.finish(req, conn, func() {
+			if resp == nil {
+				return
+			}
+			outgoing <- resp
+		})
+		return true
+	}
 	for i := 0; i < 100; i++ {
 		workerWG.Add(1)
 		go func() {
 			defer workerWG.Done()
-			for call := range incoming {
-				resp, err := handleCall(call, srv, conn)
-				if err != nil {
-					log.Printf("Protocol error: %v\n", err)
+			for req := range incoming {
+				if !handle(req) {
 					//return err
 					return
 				}
-				if resp == nil {
-					// This case happens when an active tag is
-					// flushed.
-					continue
-				}
-				outgoing <- resp
 			}
 		}()
 	}
@@ -152,23 +254,132 @@ func handleIOAsync(r io.Reader, w io.Writer, srv Srv) error {
 	// Read incoming
 	defer close(incoming)
 	for {
-		call, err := proto.ParseCall(r)
+		call, err := readCall(r, atomic.LoadUint32(&msize))
 		verboseLog("=in=> %s\n", call)
 		if err != nil {
 			log.Printf("Protocol error: %v\n", err)
+			// Nobody is left to read the replies, so stop the
+			// handlers still working on them.
+			tracker.abandon(conn)
 			return err
 		}
+		// Requests must be registered in the order they are read, so
+		// that a Tflush always sees the request it refers to.
+		req := tracker.start(call, conn)
 		select {
-		case incoming <- call:
+		case incoming <- req:
+			continue
 		default:
-			panic("FAILED TO QUEUE INCOMING!")
+		}
+		// Every worker is busy, perhaps blocked in reads waiting for
+		// something to happen. Handle the request on its own rather
+		// than wait, which would keep a Tflush from reaching them.
+		// Tflushes are always handled at once. Other requests wait for
+		// a worker once maxOverflow of them are handled on their own.
+		if _, ok := call.(*proto.TFlush); ok {
+			workerWG.Add(1)
+			go func() {
+				defer workerWG.Done()
+				handle(req)
+			}()
+			continue
+		}
+		select {
+		case incoming <- req:
+		case overflow <- struct{}{}:
+			workerWG.Add(1)
+			go func() {
+				defer workerWG.Done()
+				defer func() { <-overflow }()
+				handle(req)
+			}()
 		}
 	}
 	return nil
 }
 
-func handleCall(call proto.FCall, srv Srv, conn Conn) (proto.FCall, error) {
-	ctx := conn.TagContext(call.GetTag())
+// maxOverflow is the number of requests a connection handles outside its
+// workers at once.
+const maxOverflow = 1000
+
+// request is a single outstanding call on a connection.
+type request struct {
+	call    proto.FCall
+	flushed bool
+	done    chan struct{} // closed once the call's handler has returned.
+}
+
+// tagTracker tracks the outstanding requests on a connection by tag.
+// It guarantees that once a request has been flushed, its reply is never
+// sent, and that a reply sent before the flush is always written before
+// the Rflush.
+type tagTracker struct {
+	pending map[uint16]*request
+	sync.Mutex
+}
+
+func newTagTracker() *tagTracker {
+	return &tagTracker{pending: make(map[uint16]*request)}
+}
+
+// start registers call as outstanding and creates its context in conn.
+func (t *tagTracker) start(call proto.FCall, conn Conn) *request {
+	req := &request{call: call, done: make(chan struct{})}
+	t.Lock()
+	defer t.Unlock()
+	t.pending[call.GetTag()] = req
+	conn.TagContext(call.GetTag())
+	return req
+}
+
+// finish retires req, once its handler has returned. If req has not been
+// flushed, send is called while the tracker is locked, so that a concurrent
+// flush happens either entirely before or entirely after the reply is
+// queued.
+func (t *tagTracker) finish(req *request, conn Conn, send func()) {
+	t.Lock()
+	defer t.Unlock()
+	close(req.done)
+	if req.flushed {
+		return
+	}
+	tag := req.call.GetTag()
+	if t.pending[tag] == req {
+		delete(t.pending, tag)
+	}
+	conn.DropContext(tag)
+	send()
+}
+
+// flush cancels the outstanding request with the given tag, if there is one.
+// Once flush returns, no reply will be sent for that request. The returned
+// channel is closed once the request's handler has returned, and is nil if
+// there was no such request.
+func (t *tagTracker) flush(tag uint16, conn Conn) <-chan struct{} {
+	t.Lock()
+	defer t.Unlock()
+	req, ok := t.pending[tag]
+	if !ok {
+		return nil
+	}
+	req.flushed = true
+	delete(t.pending, tag)
+	conn.DropContext(tag)
+	return req.done
+}
+
+// abandon flushes every outstanding request, once the connection has ended.
+func (t *tagTracker) abandon(conn Conn) {
+	t.Lock()
+	defer t.Unlock()
+	for tag, req := range t.pending {
+		req.flushed = true
+		delete(t.pending, tag)
+		conn.DropContext(tag)
+	}
+}
+
+func handleCall(call proto.FCall, srv Srv, conn Conn, tracker *tagTracker) (proto.FCall, error) {
 	var (
 		ret proto.FCall
 		err error
@@ -182,7 +393,14 @@ func handleCall(call proto.FCall, srv Srv, conn Conn) (proto.FCall, error) {
 		ret, err = srv.Attach(conn, call.(*proto.TAttach))
 	case *proto.TFlush:
 		flush := call.(*proto.TFlush)
-		//conn.DropContext(flush.Oldtag)
+		if flush.Oldtag != flush.Tag {
+			// The flushed handler has been cancelled through its
+			// context. The Rflush tells the client it is done with,
+			// so wait for it to return.
+			if done := tracker.flush(flush.Oldtag, conn); done != nil {
+				<-done
+			}
+		}
 		ret, err = &proto.RFlush{proto.Header{proto.Rflush, flush.Tag}}, nil
 	case *proto.TWalk:
 		ret, err = srv.Walk(conn, call.(*proto.TWalk))
@@ -205,11 +423,6 @@ func handleCall(call proto.FCall, srv Srv, conn Conn) (proto.FCall, error) {
 	default:
 		return nil, fmt.Errorf("Invalid call: %s", reflect.TypeOf(call))
 	}
-
-	if ctx.Err() != nil {
-		return nil, nil
-	}
-	conn.DropContext(call.GetTag())
 	return ret, err
 }
 
@@ -217,7 +430,7 @@ func handleCall(call proto.FCall, srv Srv, conn Conn) (proto.FCall, error) {
 // It reads 9p2000 messages from r, handles them with srv, and
 // writes the responses to w.
 func ServeReadWriter(r io.Reader, w io.Writer, srv Srv) error {
-	return handleIOAsync(r, w, srv)
+	return handleIOAsync(r, w, srv, srv.NewConn())
 }
 
 // Serve serves srv on the given address, addr.
@@ -226,19 +439,221 @@ func Serve(addr string, srv Srv) error {
 	if err != nil {
 		return err
 	}
+	return (&Server{Srv: srv}).Serve(l)
+}
+
+// ErrServerClosed is returned by Server.Serve once Shutdown has been
+// called.
+var ErrServerClosed = errors.New("go9p: Server closed")
+
+// An Authenticator runs the server side of an authentication protocol over
+// the stream of an auth fid, and returns the user the client proved to be.
+// fs.SecretAuth returns one.
+type Authenticator func(s io.ReadWriter) (string, error)
+
+// An AuthSrv is a Srv that can require clients to authenticate with an
+// Authenticator. The Srv of an fs.FS is one.
+type AuthSrv interface {
+	Srv
+	SetAuthenticator(a Authenticator)
+}
+
+// A Server serves Srv to the connections accepted from one or more
+// listeners, and keeps track of them so that it can be shut down. Srv must
+// be set before Serve is called. Servers made with NewServer may also be
+// configured with ServerOptions.
+type Server struct {
+	Srv Srv
+
+	tlsConfig *tls.Config
+	auth      Authenticator
+	err       error // set if the options can't be applied to Srv
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]Conn
+	closed    bool
+	active    sync.WaitGroup
+}
+
+// ServerOption configures a Server made with NewServer.
+type ServerOption func(*Server)
+
+// WithTLS makes the Server speak TLS on the connections it accepts, with
+// config. Setting config.ClientAuth to tls.RequireAndVerifyClientCert
+// requires clients to present a certificate as well.
+func WithTLS(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithAuthenticator makes the Server's Srv require clients to authenticate
+// with a, using Tauth, before they can attach. The Srv must be an AuthSrv.
+func WithAuthenticator(a Authenticator) ServerOption {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// NewServer returns a Server serving srv, configured with opts.
+func NewServer(srv Srv, opts ...ServerOption) *Server {
+	s := &Server{Srv: srv}
+	for _, o := range opts {
+		o(s)
+	}
+	if s.auth != nil {
+		if as, ok := srv.(AuthSrv); ok {
+			as.SetAuthenticator(s.auth)
+		} else {
+			s.err = errors.New("go9p: Srv does not support authentication")
+		}
+	}
+	return s
+}
+
+// Serve accepts connections from l and serves Srv on each of them until l
+// fails or is closed. After Shutdown, it returns ErrServerClosed. If the
+// Server was made WithTLS, the connections are wrapped in TLS.
+func (s *Server) Serve(l net.Listener) error {
+	if s.err != nil {
+		l.Close()
+		return s.err
+	}
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
 	for {
-		a, err := l.Accept()
+		nc, err := l.Accept()
 		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
 			return err
 		}
-		go func(nc net.Conn, srv Srv) {
-			defer nc.Close()
-			read := bufio.NewReader(nc)
-			err := ServeReadWriter(read, nc, srv)
-			if err != nil {
-				log.Printf("%v\n", err)
-			}
-		}(a, srv)
+		conn := s.Srv.NewConn()
+		if !s.track(nc, conn) {
+			nc.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(nc)
+			handleConnection(nc, s.Srv, conn)
+		}()
+	}
+}
+
+// ServeConn serves Srv on nc, a single connection, until it is closed or
+// fails, and is meant for connections that don't come from a listener,
+// such as the server end of a NewPipe. nc is tracked like the connections
+// Serve accepts, so it is listed by Connections and closed by Shutdown.
+func (s *Server) ServeConn(nc net.Conn) error {
+	if s.err != nil {
+		nc.Close()
+		return s.err
+	}
+	if s.tlsConfig != nil {
+		nc = tls.Server(nc, s.tlsConfig)
+	}
+	conn := s.Srv.NewConn()
+	if !s.track(nc, conn) {
+		nc.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(nc)
+	handleConnection(nc, s.Srv, conn)
+	return nil
+}
+
+// track adds nc, served as conn, to the server's connections, unless it
+// has been shut down.
+func (s *Server) track(nc net.Conn, conn Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]Conn)
+	}
+	s.conns[nc] = conn
+	s.active.Add(1)
+	return true
+}
+
+// untrack removes nc, whose handler has returned.
+func (s *Server) untrack(nc net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, nc)
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+// Connections returns a snapshot of the server's connections, ordered by
+// remote address. Users and fids are only listed for Conns that are
+// Inspectors, as those of an fs.FS are.
+func (s *Server) Connections() []ConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]ConnInfo, 0, len(s.conns))
+	for nc, conn := range s.conns {
+		var info ConnInfo
+		if in, ok := conn.(Inspector); ok {
+			info = in.Inspect()
+		}
+		info.RemoteAddr = nc.RemoteAddr().String()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].RemoteAddr < infos[j].RemoteAddr })
+	return infos
+}
+
+// Shutdown closes the server's listeners and connections, then waits until
+// every connection has been released, which for an fs.FS means its fids
+// have been clunked. Requests still being handled are waited for too. If
+// ctx ends first, Shutdown returns its error, and the remaining
+// connections are left to finish on their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for nc := range s.conns {
+		nc.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 